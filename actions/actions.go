@@ -0,0 +1,460 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package actions runs one-off actions requested by PMM server, like EXPLAIN of a query,
+// and sends their results back.
+package actions
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/rpc"
+)
+
+const (
+	prometheusNamespace = "pmm_agent"
+	prometheusSubsystem = "actions"
+
+	defaultTimeout = 10 * time.Second
+	maxTimeout     = time.Minute
+
+	maxRunning       = 10
+	maxOutputSize    = 1024 * 1024      // larger outputs are truncated
+	maxPendingSize   = 16 * 1024 * 1024 // total size of results not sent yet
+	maxResultPartLen = 64 * 1024        // size of a single ActionResult output
+
+	// delays between send retries
+	minRetryDelay = time.Second
+	maxRetryDelay = 30 * time.Second
+
+	// number of rejections in a row after which result is dropped
+	maxRejections = 3
+)
+
+// Action results.
+const (
+	resultOK       = "ok"
+	resultError    = "error"
+	resultTimeout  = "timeout"
+	resultCanceled = "canceled"
+	resultDropped  = "dropped"
+)
+
+// Params represent action parameters.
+type Params struct {
+	DSN      string // source DSN
+	Database string // database to use instead of DSN database; may be empty
+	Query    string // query text
+
+	// Redact redacts execution plan according to the source redaction policy before it leaves the host.
+	// It returns error if policy does not allow sending plans.
+	Redact func(plan []byte) ([]byte, error)
+}
+
+// Action is a one-off action.
+type Action interface {
+	// Run runs action until it is done or ctx is canceled, and writes its output to w as it is produced.
+	Run(ctx context.Context, w io.Writer) error
+}
+
+// NewActionFunc creates a new action of some type.
+type NewActionFunc func(params *Params) (Action, error)
+
+// DSNFunc returns DSN of query analytics source with a given ID.
+type DSNFunc func(sourceID string) (string, error)
+
+// RedactFunc redacts execution plan according to redaction policy of query analytics source with a given ID.
+type RedactFunc func(sourceID string, plan []byte) ([]byte, error)
+
+// Service handles actions requests from PMM server, runs actions, and sends their results.
+type Service struct {
+	ctx       context.Context
+	dsn       DSNFunc
+	redact    RedactFunc
+	factories map[string]NewActionFunc
+	l         *logrus.Entry
+	wg        sync.WaitGroup
+
+	m           sync.Mutex
+	running     map[string]context.CancelFunc // by action ID
+	pending     []*api.ActionResultRequest    // not sent results
+	pendingSize int
+	failed      map[string]string // by action ID, send error of running action with dropped results
+	notify      chan struct{}
+
+	actions *prometheus.CounterVec
+	dropped prometheus.Counter
+}
+
+// NewService creates a new service. Actions are canceled when ctx is canceled.
+// Plans in actions output are redacted with redact. factories maps action types to action constructors.
+func NewService(ctx context.Context, dsn DSNFunc, redact RedactFunc, factories map[string]NewActionFunc) *Service {
+	return &Service{
+		ctx:       ctx,
+		dsn:       dsn,
+		redact:    redact,
+		factories: factories,
+		l:         logrus.WithField("component", "actions"),
+		running:   make(map[string]context.CancelFunc),
+		failed:    make(map[string]string),
+		notify:    make(chan struct{}, 1),
+		actions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "total",
+			Help:      "A total number of finished actions by type and result (ok, error, timeout, canceled, dropped).",
+		}, []string{"type", "result"}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "result_parts_dropped_total",
+			Help:      "A total number of action result parts dropped after being rejected by PMM server.",
+		}),
+	}
+}
+
+// StartAction starts action. Its result is sent later.
+func (s *Service) StartAction(ctx context.Context, req *api.StartActionRequest) (*api.StartActionResponse, error) {
+	if req.ActionID == "" {
+		return nil, errors.New("action ID is empty")
+	}
+	newAction := s.factories[req.Type]
+	if newAction == nil {
+		return nil, errors.Errorf("unexpected action type %q", req.Type)
+	}
+	timeout := defaultTimeout
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds * float64(time.Second))
+	}
+	if timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+	dsn, err := s.dsn(req.SourceID)
+	if err != nil {
+		return nil, err
+	}
+	sourceID := req.SourceID
+	action, err := newAction(&Params{
+		DSN:      dsn,
+		Database: req.Database,
+		Query:    req.Query,
+		Redact: func(plan []byte) ([]byte, error) {
+			return s.redact(sourceID, plan)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.running[req.ActionID] != nil {
+		return nil, errors.Errorf("action %q is already running", req.ActionID)
+	}
+	if len(s.running) >= maxRunning {
+		return nil, errors.Errorf("too many running actions (%d)", len(s.running))
+	}
+
+	s.l.Infof("Starting %s action %s.", req.Type, req.ActionID)
+	actionCtx, cancel := context.WithTimeout(s.ctx, timeout)
+	s.running[req.ActionID] = cancel
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+
+		output := &output{
+			s:        s,
+			actionID: req.ActionID,
+		}
+		err := action.Run(actionCtx, output)
+		result := resultOK
+		switch {
+		case err == nil:
+		case actionCtx.Err() == context.DeadlineExceeded:
+			result = resultTimeout
+			err = errors.Errorf("action timed out after %s: %s", timeout, err)
+		case actionCtx.Err() == context.Canceled:
+			result = resultCanceled
+			err = errors.Errorf("action canceled: %s", err)
+		default:
+			result = resultError
+		}
+		if err != nil {
+			s.l.Warnf("%s action %s failed: %s.", req.Type, req.ActionID, err)
+		} else {
+			s.l.Infof("%s action %s done.", req.Type, req.ActionID)
+		}
+
+		if !s.finish(req.ActionID, output, err) {
+			result = resultDropped
+		}
+		s.actions.WithLabelValues(req.Type, result).Inc()
+	}()
+	return new(api.StartActionResponse), nil
+}
+
+// StopAction cancels running action.
+func (s *Service) StopAction(ctx context.Context, req *api.StopActionRequest) (*api.StopActionResponse, error) {
+	s.m.Lock()
+	cancel := s.running[req.ActionID]
+	s.m.Unlock()
+
+	if cancel == nil {
+		return nil, errors.Errorf("action %q is not running", req.ActionID)
+	}
+	cancel()
+	return new(api.StopActionResponse), nil
+}
+
+// output is action output writer. It splits output into result parts as it is written, and adds them
+// to pending results, so they are sent while action is still running.
+type output struct {
+	s         *Service
+	actionID  string
+	buf       []byte // not added part of output
+	offset    int64  // offset of buf in the whole output
+	truncated bool   // output is larger than maxOutputSize
+	dropped   bool   // output is dropped because there are too many pending results
+}
+
+// Write implements io.Writer. It never fails: output after truncation or drop is discarded.
+func (o *output) Write(p []byte) (int, error) {
+	n := len(p)
+	if o.truncated || o.dropped {
+		return n, nil
+	}
+	if rest := maxOutputSize - int(o.offset) - len(o.buf); len(p) > rest {
+		p = p[:rest]
+		o.truncated = true
+	}
+	o.buf = append(o.buf, p...)
+
+	o.s.m.Lock()
+	defer o.s.m.Unlock()
+
+	for len(o.buf) >= maxResultPartLen && !o.dropped {
+		o.add(maxResultPartLen, false, nil)
+	}
+	return n, nil
+}
+
+// add adds a part with a given length from the start of buf to pending results. If done is true,
+// it is the last part with a given action error. Caller should hold s.m.
+func (o *output) add(n int, done bool, err error) {
+	s := o.s
+	if !o.dropped && s.pendingSize+n > maxPendingSize {
+		s.l.Warnf("Too many results are not sent, dropping output of action %s.", o.actionID)
+		o.dropped = true
+	}
+	if o.dropped {
+		o.buf, n = nil, 0
+		err = errors.New("action output dropped: too many results are not sent")
+	}
+
+	// previous results of this action were rejected by PMM server, and dropped
+	if sendErr, ok := s.failed[o.actionID]; ok {
+		if !done {
+			o.buf = o.buf[n:]
+			o.offset += int64(n)
+			return
+		}
+		delete(s.failed, o.actionID)
+		o.buf, n = nil, 0
+		err = errors.New(sendErr)
+	}
+
+	if !done && n == 0 {
+		return
+	}
+	part := &api.ActionResultRequest{
+		ActionID: o.actionID,
+		Offset:   o.offset,
+	}
+	if n > 0 {
+		part.Output = o.buf[:n]
+		o.buf = o.buf[n:]
+		o.offset += int64(n)
+	}
+	if done {
+		part.Done = true
+		part.Truncated = o.truncated && !o.dropped
+		if err != nil {
+			part.Error = err.Error()
+		}
+	}
+	s.pending = append(s.pending, part)
+	s.pendingSize += len(part.Output)
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// finish removes action from running ones, and adds the last part of its output with a given error
+// to pending results. It returns false if output was dropped because there are too many pending results.
+func (s *Service) finish(actionID string, o *output, err error) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	delete(s.running, actionID)
+	o.add(len(o.buf), true, err)
+	return !o.dropped
+}
+
+// Send sends actions results to PMM server in order until done is closed.
+// Failed requests are retried with increasing delay; results are kept until they are sent,
+// so they are sent again after reconnection. Result rejected by PMM server several times in a row
+// is dropped with the rest of the same action output, and replaced with an error, so later results are not blocked.
+func (s *Service) Send(client rpc.ActionsGatewayClient, done <-chan struct{}) {
+	delay := minRetryDelay
+	var rejections int
+	for {
+		s.m.Lock()
+		var part *api.ActionResultRequest
+		if len(s.pending) > 0 {
+			part = s.pending[0]
+		}
+		s.m.Unlock()
+
+		if part == nil {
+			select {
+			case <-done:
+				return
+			case <-s.notify:
+			}
+			continue
+		}
+
+		if _, err := client.ActionResult(context.Background(), part); err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if rpc.IsRejected(err) {
+				rejections++
+				if rejections >= maxRejections {
+					rejections = 0
+					s.l.Errorf("Dropping result of action %s: rejected %d times: %s.", part.ActionID, maxRejections, err)
+					s.drop(part, err)
+					delay = minRetryDelay
+					continue
+				}
+			}
+
+			s.l.Warnf("Failed to send result of action %s, retrying in %s: %s.", part.ActionID, delay, err)
+			select {
+			case <-done:
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+			continue
+		}
+
+		delay = minRetryDelay
+		rejections = 0
+		s.m.Lock()
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+		s.pendingSize -= len(part.Output)
+		s.m.Unlock()
+	}
+}
+
+// drop removes a given rejected part, which should be the first pending one, and all pending parts
+// of the same action. Unless dropped part is the last one, the last part is replaced with a send error.
+func (s *Service) drop(part *api.ActionResultRequest, err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	pending := make([]*api.ActionResultRequest, 0, len(s.pending))
+	var last bool
+	for _, p := range s.pending {
+		if p.ActionID != part.ActionID {
+			pending = append(pending, p)
+			continue
+		}
+		last = last || p.Done
+		s.pendingSize -= len(p.Output)
+		s.dropped.Inc()
+	}
+	s.pending = pending
+	if part.Done {
+		return
+	}
+
+	sendErr := "failed to send action output: " + err.Error()
+	if !last {
+		// action is still running; its last part will contain send error
+		s.failed[part.ActionID] = sendErr
+		return
+	}
+	s.pending = append([]*api.ActionResultRequest{{
+		ActionID: part.ActionID,
+		Offset:   part.Offset,
+		Done:     true,
+		Error:    sendErr,
+	}}, s.pending...)
+}
+
+// Wait waits for all actions to finish after context passed to NewService is canceled.
+func (s *Service) Wait() {
+	s.wg.Wait()
+}
+
+// Describe implements prometheus.Collector.
+func (s *Service) Describe(ch chan<- *prometheus.Desc) {
+	s.actions.Describe(ch)
+	s.dropped.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (s *Service) Collect(ch chan<- prometheus.Metric) {
+	s.actions.Collect(ch)
+	s.dropped.Collect(ch)
+}
+
+// cleanQuery returns query without surrounding whitespace and trailing semicolons, or error if query is empty.
+func cleanQuery(query string) (string, error) {
+	query = strings.TrimRight(strings.TrimSpace(query), "; \t\r\n")
+	if query == "" {
+		return "", errors.New("query is empty")
+	}
+	return query, nil
+}
+
+// check interfaces
+var (
+	_ rpc.ActionsServer    = (*Service)(nil)
+	_ prometheus.Collector = (*Service)(nil)
+)
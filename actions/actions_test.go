@@ -0,0 +1,211 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package actions
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/rpc"
+)
+
+// testClient records sent results; parts rejected by reject function are not recorded.
+type testClient struct {
+	m       sync.Mutex
+	reject  func(part *api.ActionResultRequest) bool
+	results map[string][]*api.ActionResultRequest
+	sent    chan *api.ActionResultRequest
+}
+
+func newTestClient(reject func(part *api.ActionResultRequest) bool) *testClient {
+	return &testClient{
+		reject:  reject,
+		results: make(map[string][]*api.ActionResultRequest),
+		sent:    make(chan *api.ActionResultRequest, 100),
+	}
+}
+
+func (c *testClient) ActionResult(ctx context.Context, req *api.ActionResultRequest) (*api.ActionResultResponse, error) {
+	if c.reject != nil && c.reject(req) {
+		return nil, &rpc.Error{Path: "/ActionResult", Message: "rejected"}
+	}
+	c.m.Lock()
+	c.results[req.ActionID] = append(c.results[req.ActionID], req)
+	c.m.Unlock()
+	c.sent <- req
+	return new(api.ActionResultResponse), nil
+}
+
+// waitDone waits for the last part of a given action.
+func (c *testClient) waitDone(t *testing.T, actionID string) []*api.ActionResultRequest {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case part := <-c.sent:
+			if part.ActionID == actionID && part.Done {
+				c.m.Lock()
+				defer c.m.Unlock()
+				return c.results[actionID]
+			}
+		case <-timeout:
+			t.Fatalf("no result of action %s", actionID)
+		}
+	}
+}
+
+type testAction func(ctx context.Context, w io.Writer) error
+
+func (a testAction) Run(ctx context.Context, w io.Writer) error {
+	return a(ctx, w)
+}
+
+func newTestService(ctx context.Context, actions map[string]testAction) *Service {
+	factories := make(map[string]NewActionFunc, len(actions))
+	for typ, a := range actions {
+		a := a
+		factories[typ] = func(params *Params) (Action, error) {
+			return testAction(func(ctx context.Context, w io.Writer) error {
+				plan, err := params.Redact([]byte(params.Query))
+				if err != nil {
+					return err
+				}
+				if _, err = w.Write(plan); err != nil {
+					return err
+				}
+				return a(ctx, w)
+			}), nil
+		}
+	}
+	dsn := func(sourceID string) (string, error) { return "dsn", nil }
+	redact := func(sourceID string, plan []byte) ([]byte, error) {
+		return append([]byte(sourceID+":"), plan...), nil
+	}
+	return NewService(ctx, dsn, redact, factories)
+}
+
+func TestServiceStreamsOutput(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// action writes two full parts, and waits
+	release := make(chan struct{})
+	data := bytes.Repeat([]byte("x"), 2*maxResultPartLen)
+	s := newTestService(ctx, map[string]testAction{
+		"test": func(ctx context.Context, w io.Writer) error {
+			for i := 0; i < len(data); i += 1000 {
+				end := i + 1000
+				if end > len(data) {
+					end = len(data)
+				}
+				if _, err := w.Write(data[i:end]); err != nil {
+					return err
+				}
+			}
+			<-release
+			_, err := io.WriteString(w, "end")
+			return err
+		},
+	})
+	client := newTestClient(nil)
+	done := make(chan struct{})
+	defer close(done)
+	go s.Send(client, done)
+
+	_, err := s.StartAction(ctx, &api.StartActionRequest{ActionID: "a1", Type: "test", SourceID: "s1", Query: "plan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first parts are sent while action is running
+	for i := 0; i < 2; i++ {
+		select {
+		case part := <-client.sent:
+			if part.Done || len(part.Output) != maxResultPartLen {
+				t.Fatalf("unexpected part %d: done=%v, len=%d", i, part.Done, len(part.Output))
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("part %d is not sent while action is running", i)
+		}
+	}
+	close(release)
+	parts := client.waitDone(t, "a1")
+
+	var output []byte
+	for _, part := range parts {
+		if part.Offset != int64(len(output)) {
+			t.Errorf("expected offset %d, got %d", len(output), part.Offset)
+		}
+		output = append(output, part.Output...)
+	}
+	expected := "s1:plan" + string(data) + "end"
+	if string(output) != expected {
+		t.Errorf("unexpected output of length %d, expected %d", len(output), len(expected))
+	}
+	if last := parts[len(parts)-1]; last.Error != "" || last.Truncated {
+		t.Errorf("unexpected last part %+v", last)
+	}
+}
+
+func TestServiceDropsRejectedResults(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data := bytes.Repeat([]byte("x"), maxResultPartLen+10)
+	s := newTestService(ctx, map[string]testAction{
+		"test": func(ctx context.Context, w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		},
+	})
+
+	// output of a1 is always rejected, but error is accepted
+	client := newTestClient(func(part *api.ActionResultRequest) bool {
+		return part.ActionID == "a1" && part.Error == ""
+	})
+
+	// a2 is added to pending results after a1, and is not blocked by it
+	for _, id := range []string{"a1", "a2"} {
+		if _, err := s.StartAction(ctx, &api.StartActionRequest{ActionID: id, Type: "test", SourceID: "s1"}); err != nil {
+			t.Fatal(err)
+		}
+		s.Wait()
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go s.Send(client, done)
+
+	parts := client.waitDone(t, "a1")
+	if len(parts) != 1 || parts[0].Offset != 0 || len(parts[0].Output) != 0 ||
+		parts[0].Error != "failed to send action output: /ActionResult: rejected" {
+		t.Errorf("unexpected a1 parts %+v", parts)
+	}
+
+	parts = client.waitDone(t, "a2")
+	var output []byte
+	for _, part := range parts {
+		output = append(output, part.Output...)
+	}
+	if string(output) != "s1:"+string(data) {
+		t.Errorf("unexpected a2 output of length %d", len(output))
+	}
+}
@@ -0,0 +1,103 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package actions
+
+import (
+	"context"
+	"database/sql"
+	"io"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+
+	"github.com/Percona-Lab/pmm-agent/fingerprint"
+)
+
+// mysqlExplain is an action that runs EXPLAIN FORMAT=JSON for MySQL query.
+type mysqlExplain struct {
+	dsn    string
+	query  string
+	redact func(plan []byte) ([]byte, error)
+}
+
+// NewMySQLExplain creates a new MySQL EXPLAIN action.
+func NewMySQLExplain(params *Params) (Action, error) {
+	dsn, err := mysqlDSN(params)
+	if err != nil {
+		return nil, err
+	}
+	query, err := cleanQuery(params.Query)
+	if err != nil {
+		return nil, err
+	}
+	if fingerprint.Placeholders(query, fingerprint.MySQL) > 0 {
+		// like performance_schema digest texts
+		return nil, errors.New("query with ? placeholders can't be explained, query example with values is required")
+	}
+
+	return &mysqlExplain{
+		dsn:    dsn,
+		query:  query,
+		redact: params.Redact,
+	}, nil
+}
+
+// Run implements Action.
+func (e *mysqlExplain) Run(ctx context.Context, w io.Writer) error {
+	db, err := sql.Open("mysql", e.dsn)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// read-only transaction prevents data changes even if explained statement is executed somehow
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer tx.Rollback()
+
+	var plan []byte
+	if err = tx.QueryRowContext(ctx, "EXPLAIN FORMAT=JSON "+e.query).Scan(&plan); err != nil {
+		return errors.WithStack(err)
+	}
+	if plan, err = e.redact(plan); err != nil {
+		return err
+	}
+	_, err = w.Write(plan)
+	return errors.WithStack(err)
+}
+
+// mysqlDSN returns DSN for params with database replaced.
+func mysqlDSN(params *Params) (string, error) {
+	cfg, err := mysql.ParseDSN(params.DSN)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse DSN")
+	}
+	if params.Database != "" {
+		cfg.DBName = params.Database
+	}
+	cfg.MultiStatements = false // only a single statement is allowed
+	return cfg.FormatDSN(), nil
+}
+
+// check interfaces
+var (
+	_ NewActionFunc = NewMySQLExplain
+	_ Action        = (*mysqlExplain)(nil)
+)
@@ -0,0 +1,152 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package actions
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+
+	"github.com/Percona-Lab/pmm-agent/fingerprint"
+)
+
+// minimal server_version_num with EXPLAIN (GENERIC_PLAN) for queries with placeholders
+const genericPlanVersion = 160000
+
+// postgresqlExplain is an action that runs EXPLAIN (FORMAT JSON) for PostgreSQL query.
+// Queries with $1 placeholders, like normalized pg_stat_statements queries, are explained with GENERIC_PLAN option.
+type postgresqlExplain struct {
+	dsn          string
+	query        string
+	placeholders bool
+	redact       func(plan []byte) ([]byte, error)
+}
+
+// NewPostgreSQLExplain creates a new PostgreSQL EXPLAIN action.
+func NewPostgreSQLExplain(params *Params) (Action, error) {
+	dsn, err := postgresqlDSN(params)
+	if err != nil {
+		return nil, err
+	}
+	query, err := cleanQuery(params.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &postgresqlExplain{
+		dsn:          dsn,
+		query:        query,
+		placeholders: fingerprint.Placeholders(query, fingerprint.PostgreSQL) > 0,
+		redact:       params.Redact,
+	}, nil
+}
+
+// Run implements Action.
+func (e *postgresqlExplain) Run(ctx context.Context, w io.Writer) error {
+	db, err := sql.Open("postgres", e.dsn)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// read-only transaction prevents data changes even if explained statement is executed somehow
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer tx.Rollback()
+
+	// server-side timeout in addition to context cancelation
+	if ms := statementTimeout(ctx); ms > 0 {
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", ms)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	explain := "EXPLAIN (FORMAT JSON) "
+	if e.placeholders {
+		var version int
+		if err = tx.QueryRowContext(ctx, "SHOW server_version_num").Scan(&version); err != nil {
+			return errors.WithStack(err)
+		}
+		if version < genericPlanVersion {
+			return errors.Errorf("query with $1 placeholders can be explained only by PostgreSQL 16 or later "+
+				"(server_version_num is %d), query example with values is required", version)
+		}
+		explain = "EXPLAIN (GENERIC_PLAN, FORMAT JSON) "
+	}
+
+	// prepared statement can't contain several statements
+	stmt, err := tx.PrepareContext(ctx, explain+e.query)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer stmt.Close()
+
+	var plan []byte
+	if err = stmt.QueryRowContext(ctx).Scan(&plan); err != nil {
+		return errors.WithStack(err)
+	}
+	if plan, err = e.redact(plan); err != nil {
+		return err
+	}
+	_, err = w.Write(plan)
+	return errors.WithStack(err)
+}
+
+// postgresqlDSN returns key/value DSN for params with database replaced.
+func postgresqlDSN(params *Params) (string, error) {
+	dsn := params.DSN
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		if dsn, err = pq.ParseURL(dsn); err != nil {
+			return "", errors.Wrap(err, "failed to parse DSN")
+		}
+	}
+	if params.Database != "" {
+		// the last value wins
+		dsn += " dbname='" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(params.Database) + "'"
+	}
+	return dsn, nil
+}
+
+// statementTimeout returns statement_timeout value in milliseconds for context deadline,
+// or 0 if there is no deadline.
+func statementTimeout(ctx context.Context) int64 {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	ms := int64(time.Until(deadline) / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return ms
+}
+
+// check interfaces
+var (
+	_ NewActionFunc = NewPostgreSQLExplain
+	_ Action        = (*postgresqlExplain)(nil)
+)
@@ -0,0 +1,346 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package actions
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/fingerprint"
+)
+
+// maxTables is the maximal number of tables from the query for which catalog queries are run.
+const maxTables = 20
+
+// catalogQuery returns catalog query text and arguments for a given table.
+type catalogQuery func(t *fingerprint.Table) (string, []interface{})
+
+// namedQuery is a catalog query with a result name.
+type namedQuery struct {
+	name  string
+	query catalogQuery
+}
+
+// schemaAction is an action that runs catalog queries for each table referenced by the query,
+// and returns JSON array of api.TableInfo. Elements are written as soon as table queries are done.
+// Output contains only catalog data, not query text, so it is not redacted.
+type schemaAction struct {
+	driver  string
+	dsn     string
+	tables  []fingerprint.Table
+	init    func(ctx context.Context, conn *sql.Conn) error // may be nil
+	exists  catalogQuery                                    // returns true if table exists
+	queries []namedQuery
+}
+
+// newSchemaAction creates a new schema action for tables referenced by params query.
+func newSchemaAction(params *Params, d fingerprint.Dialect) (*schemaAction, error) {
+	query, err := cleanQuery(params.Query)
+	if err != nil {
+		return nil, err
+	}
+	tables := fingerprint.Tables(query, d)
+	if len(tables) == 0 {
+		return nil, errors.New("no tables found in query")
+	}
+	if len(tables) > maxTables {
+		tables = tables[:maxTables]
+	}
+	return &schemaAction{
+		tables: tables,
+	}, nil
+}
+
+// Run implements Action.
+func (a *schemaAction) Run(ctx context.Context, w io.Writer) error {
+	db, err := sql.Open(a.driver, a.dsn)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// use a single session for all queries
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+	if a.init != nil {
+		if err = a.init(ctx, conn); err != nil {
+			return err
+		}
+	}
+
+	if _, err = io.WriteString(w, "["); err != nil {
+		return errors.WithStack(err)
+	}
+	for i, t := range a.tables {
+		info := &api.TableInfo{
+			Schema: t.Schema,
+			Table:  t.Name,
+		}
+		if err = a.runTable(ctx, conn, &t, info); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			info.Error = err.Error()
+		}
+
+		b, err := json.Marshal(info)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if i > 0 {
+			b = append([]byte{','}, b...)
+		}
+		if _, err = w.Write(b); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	_, err = io.WriteString(w, "]")
+	return errors.WithStack(err)
+}
+
+// runTable runs catalog queries for a single table, and fills info results.
+func (a *schemaAction) runTable(ctx context.Context, conn *sql.Conn, t *fingerprint.Table, info *api.TableInfo) error {
+	var exists bool
+	q, args := a.exists(t)
+	if err := conn.QueryRowContext(ctx, q, args...).Scan(&exists); err != nil {
+		return errors.WithStack(err)
+	}
+	if !exists {
+		return errors.Errorf("table %s does not exist", t)
+	}
+
+	for _, nq := range a.queries {
+		q, args = nq.query(t)
+		rs, err := queryRowSet(ctx, conn, q, args...)
+		if err != nil {
+			return errors.Wrapf(err, "%s query failed", nq.name)
+		}
+		rs.Name = nq.name
+		info.Results = append(info.Results, rs)
+	}
+	return nil
+}
+
+// queryRowSet runs query and returns all its rows.
+func queryRowSet(ctx context.Context, conn *sql.Conn, query string, args ...interface{}) (*api.RowSet, error) {
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	rs := &api.RowSet{
+		Columns: columns,
+		Rows:    make([][]interface{}, 0),
+	}
+	for rows.Next() {
+		row := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		// both drivers return text values as bytes, JSON encoder would encode them as base64
+		for i, v := range row {
+			if b, ok := v.([]byte); ok {
+				row[i] = string(b)
+			}
+		}
+		rs.Rows = append(rs.Rows, row)
+	}
+	return rs, errors.WithStack(rows.Err())
+}
+
+// MySQL schema actions.
+
+// mysqlQuote returns quoted MySQL identifier.
+func mysqlQuote(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// mysqlTable returns quoted possibly qualified MySQL table name.
+func mysqlTable(t *fingerprint.Table) string {
+	if t.Schema == "" {
+		return mysqlQuote(t.Name)
+	}
+	return mysqlQuote(t.Schema) + "." + mysqlQuote(t.Name)
+}
+
+func newMySQLSchemaAction(params *Params, queries ...namedQuery) (Action, error) {
+	a, err := newSchemaAction(params, fingerprint.MySQL)
+	if err != nil {
+		return nil, err
+	}
+	if a.dsn, err = mysqlDSN(params); err != nil {
+		return nil, err
+	}
+	a.driver = "mysql"
+	a.exists = func(t *fingerprint.Table) (string, []interface{}) {
+		schema := sql.NullString{String: t.Schema, Valid: t.Schema != ""}
+		return "SELECT COUNT(*) > 0 FROM information_schema.tables WHERE table_schema = IFNULL(?, DATABASE()) AND table_name = ?",
+			[]interface{}{schema, t.Name}
+	}
+	a.queries = queries
+	return a, nil
+}
+
+// NewMySQLShowCreateTable creates a new action that returns SHOW CREATE TABLE for tables referenced by the query.
+func NewMySQLShowCreateTable(params *Params) (Action, error) {
+	return newMySQLSchemaAction(params, namedQuery{"create_table", func(t *fingerprint.Table) (string, []interface{}) {
+		return "SHOW CREATE TABLE " + mysqlTable(t), nil
+	}})
+}
+
+// NewMySQLShowIndex creates a new action that returns SHOW INDEX for tables referenced by the query.
+func NewMySQLShowIndex(params *Params) (Action, error) {
+	return newMySQLSchemaAction(params, namedQuery{"index", func(t *fingerprint.Table) (string, []interface{}) {
+		return "SHOW INDEX FROM " + mysqlTable(t), nil
+	}})
+}
+
+// NewMySQLShowTableStatus creates a new action that returns SHOW TABLE STATUS for tables referenced by the query.
+func NewMySQLShowTableStatus(params *Params) (Action, error) {
+	return newMySQLSchemaAction(params, namedQuery{"table_status", func(t *fingerprint.Table) (string, []interface{}) {
+		if t.Schema == "" {
+			return "SHOW TABLE STATUS WHERE Name = ?", []interface{}{t.Name}
+		}
+		return "SHOW TABLE STATUS FROM " + mysqlQuote(t.Schema) + " WHERE Name = ?", []interface{}{t.Name}
+	}})
+}
+
+// PostgreSQL schema actions. All catalog queries use to_regclass($1) to find a table like PostgreSQL does,
+// using search_path for unqualified names.
+
+const (
+	postgresqlColumnsQuery = `SELECT a.attname AS "column", pg_catalog.format_type(a.atttypid, a.atttypmod) AS "type",
+	co.collname AS "collation", a.attnotnull AS "not_null", pg_catalog.pg_get_expr(d.adbin, d.adrelid) AS "default"
+FROM pg_catalog.pg_attribute a
+	LEFT JOIN pg_catalog.pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+	LEFT JOIN pg_catalog.pg_type t ON t.oid = a.atttypid
+	LEFT JOIN pg_catalog.pg_collation co ON co.oid = a.attcollation AND a.attcollation <> t.typcollation
+WHERE a.attrelid = to_regclass($1) AND a.attnum > 0 AND NOT a.attisdropped
+ORDER BY a.attnum`
+
+	postgresqlConstraintsQuery = `SELECT conname AS "name", contype AS "type", pg_catalog.pg_get_constraintdef(oid, true) AS "definition"
+FROM pg_catalog.pg_constraint
+WHERE conrelid = to_regclass($1)
+ORDER BY conname`
+
+	postgresqlIndexesQuery = `SELECT i.indexname, i.tablespace, i.indexdef
+FROM pg_catalog.pg_indexes i
+	JOIN pg_catalog.pg_namespace n ON n.nspname = i.schemaname
+	JOIN pg_catalog.pg_class c ON c.relnamespace = n.oid AND c.relname = i.tablename
+WHERE c.oid = to_regclass($1)
+ORDER BY i.indexname`
+
+	postgresqlTableStatusQuery = `SELECT c.relkind AS "kind", c.reltuples::bigint AS "estimated_rows",
+	pg_catalog.pg_table_size(c.oid) AS "table_size", pg_catalog.pg_indexes_size(c.oid) AS "indexes_size",
+	pg_catalog.pg_total_relation_size(c.oid) AS "total_size",
+	s.seq_scan, s.idx_scan, s.n_live_tup, s.n_dead_tup,
+	s.last_vacuum, s.last_autovacuum, s.last_analyze, s.last_autoanalyze
+FROM pg_catalog.pg_class c
+	LEFT JOIN pg_catalog.pg_stat_all_tables s ON s.relid = c.oid
+WHERE c.oid = to_regclass($1)`
+)
+
+// postgresqlQuote returns quoted PostgreSQL identifier.
+func postgresqlQuote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// postgresqlQuery returns catalog query with quoted possibly qualified table name as a single argument.
+func postgresqlQuery(query string) catalogQuery {
+	return func(t *fingerprint.Table) (string, []interface{}) {
+		name := postgresqlQuote(t.Name)
+		if t.Schema != "" {
+			name = postgresqlQuote(t.Schema) + "." + name
+		}
+		return query, []interface{}{name}
+	}
+}
+
+func newPostgreSQLSchemaAction(params *Params, queries ...namedQuery) (Action, error) {
+	a, err := newSchemaAction(params, fingerprint.PostgreSQL)
+	if err != nil {
+		return nil, err
+	}
+	if a.dsn, err = postgresqlDSN(params); err != nil {
+		return nil, err
+	}
+	a.driver = "postgres"
+	a.init = func(ctx context.Context, conn *sql.Conn) error {
+		// server-side timeout in addition to context cancelation
+		if ms := statementTimeout(ctx); ms > 0 {
+			if _, err := conn.ExecContext(ctx, fmt.Sprintf("SET statement_timeout = %d", ms)); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	}
+	a.exists = postgresqlQuery("SELECT to_regclass($1) IS NOT NULL")
+	a.queries = queries
+	return a, nil
+}
+
+// NewPostgreSQLShowCreateTable creates a new action that returns columns and constraints
+// for tables referenced by the query, like psql's \d command.
+func NewPostgreSQLShowCreateTable(params *Params) (Action, error) {
+	return newPostgreSQLSchemaAction(params,
+		namedQuery{"columns", postgresqlQuery(postgresqlColumnsQuery)},
+		namedQuery{"constraints", postgresqlQuery(postgresqlConstraintsQuery)},
+	)
+}
+
+// NewPostgreSQLShowIndex creates a new action that returns pg_indexes rows for tables referenced by the query.
+func NewPostgreSQLShowIndex(params *Params) (Action, error) {
+	return newPostgreSQLSchemaAction(params, namedQuery{"indexes", postgresqlQuery(postgresqlIndexesQuery)})
+}
+
+// NewPostgreSQLShowTableStatus creates a new action that returns size and statistics
+// for tables referenced by the query.
+func NewPostgreSQLShowTableStatus(params *Params) (Action, error) {
+	return newPostgreSQLSchemaAction(params, namedQuery{"table_status", postgresqlQuery(postgresqlTableStatusQuery)})
+}
+
+// check interfaces
+var (
+	_ NewActionFunc = NewMySQLShowCreateTable
+	_ NewActionFunc = NewMySQLShowIndex
+	_ NewActionFunc = NewMySQLShowTableStatus
+	_ NewActionFunc = NewPostgreSQLShowCreateTable
+	_ NewActionFunc = NewPostgreSQLShowIndex
+	_ NewActionFunc = NewPostgreSQLShowTableStatus
+	_ Action        = (*schemaAction)(nil)
+)
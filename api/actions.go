@@ -0,0 +1,81 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+// Action types.
+const (
+	ActionMySQLExplain      = "mysql_explain"
+	ActionPostgreSQLExplain = "postgresql_explain"
+
+	// Schema actions return JSON array of TableInfo for tables referenced by the query.
+	ActionMySQLShowCreateTable      = "mysql_show_create_table"
+	ActionMySQLShowIndex            = "mysql_show_index"
+	ActionMySQLShowTableStatus      = "mysql_show_table_status"
+	ActionPostgreSQLShowCreateTable = "postgresql_show_create_table" // columns and constraints, like \d
+	ActionPostgreSQLShowIndex       = "postgresql_show_index"
+	ActionPostgreSQLShowTableStatus = "postgresql_show_table_status"
+)
+
+// TableInfo is a schema action output for a single table referenced by the query.
+type TableInfo struct {
+	Schema  string    `json:"schema,omitempty"` // database for MySQL, schema for PostgreSQL; empty if not specified in query
+	Table   string    `json:"table"`
+	Results []*RowSet `json:"results,omitempty"`
+	Error   string    `json:"error,omitempty"` // for example, if table does not exist
+}
+
+// RowSet is a result of a single catalog query.
+type RowSet struct {
+	Name    string          `json:"name"` // like "columns" or "constraints"
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// StartActionRequest starts an action on agent. Action output is sent back with ActionResult requests.
+type StartActionRequest struct {
+	ActionID       string  `json:"action_id"`                 // unique ID generated by PMM server
+	Type           string  `json:"type"`                      // one of Action* constants
+	SourceID       string  `json:"source_id"`                 // ID of query analytics source with DSN used for connection
+	Database       string  `json:"database,omitempty"`        // database to use instead of DSN database
+	Query          string  `json:"query"`                     // query text
+	TimeoutSeconds float64 `json:"timeout_seconds,omitempty"` // if zero, the default timeout is used
+}
+
+// StartActionResponse is an empty response.
+type StartActionResponse struct{}
+
+// StopActionRequest cancels a running action. Action result is sent with an error.
+type StopActionRequest struct {
+	ActionID string `json:"action_id"`
+}
+
+// StopActionResponse is an empty response.
+type StopActionResponse struct{}
+
+// ActionResultRequest sends a part of action output to PMM server. Parts are sent in order;
+// the last one has Done set, and contains an error for failed or canceled actions.
+type ActionResultRequest struct {
+	ActionID  string `json:"action_id"`
+	Offset    int64  `json:"offset"`           // offset of this part in the whole output
+	Output    []byte `json:"output,omitempty"` // base64-encoded in JSON
+	Done      bool   `json:"done,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"` // true if output was truncated to maximum size; set for the last part
+	Error     string `json:"error,omitempty"`     // set for the last part
+}
+
+// ActionResultResponse is an empty response.
+type ActionResultResponse struct{}
@@ -0,0 +1,56 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"time"
+)
+
+// Audit event types.
+const (
+	AuditSetState        = "set_state"
+	AuditSetScrapeConfig = "set_scrape_config"
+	AuditSetQANConfig    = "set_qan_config"
+	AuditStartAction     = "start_action"
+	AuditStopAction      = "stop_action"
+	AuditSetLogLevel     = "set_log_level"
+	AuditReloadConfig    = "reload_config"
+)
+
+// Audit event origins.
+const (
+	AuditOriginServer   = "server"    // request from PMM server
+	AuditOriginLocalAPI = "local_api" // request to local API
+	AuditOriginSignal   = "signal"    // signal like SIGHUP
+)
+
+// AuditEvent records a change of agent state requested by PMM server or local user.
+type AuditEvent struct {
+	Time    time.Time         `json:"time"`
+	Type    string            `json:"type"`              // one of Audit* type constants
+	Origin  string            `json:"origin"`            // one of AuditOrigin* constants
+	Details map[string]string `json:"details,omitempty"` // type-specific details; never contain credentials or query texts
+	Error   string            `json:"error,omitempty"`   // error message if change failed
+}
+
+// PushAuditRequest sends audit events to PMM server.
+type PushAuditRequest struct {
+	Events []AuditEvent `json:"events"`
+}
+
+// PushAuditResponse is an empty response.
+type PushAuditResponse struct{}
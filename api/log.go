@@ -0,0 +1,66 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"time"
+)
+
+// SetLogLevelRequest changes log level of a given component, or the default level if component is empty.
+type SetLogLevelRequest struct {
+	Component string `json:"component,omitempty"`
+	Level     string `json:"level"`
+}
+
+// SetLogLevelResponse contains log levels after change.
+type SetLogLevelResponse struct {
+	Default    string            `json:"default"`
+	Components map[string]string `json:"components,omitempty"`
+}
+
+// LogEntry represents a single agent log entry.
+type LogEntry struct {
+	Time      time.Time         `json:"time"`
+	Level     string            `json:"level"`
+	Component string            `json:"component,omitempty"`
+	Message   string            `json:"message"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+// GetLogsRequest requests the last agent log entries. All fields are optional.
+type GetLogsRequest struct {
+	// The least severe level to return: for example, "warning" returns warning, error, fatal and panic entries.
+	Level string `json:"level,omitempty"`
+
+	// Only entries of that component are returned.
+	Component string `json:"component,omitempty"`
+
+	// Only entries logged in [since, until) time range are returned.
+	Since time.Time `json:"since,omitempty"`
+	Until time.Time `json:"until,omitempty"`
+
+	// Only that number of the newest matching entries are returned.
+	Limit int `json:"limit,omitempty"`
+}
+
+// GetLogsResponse contains matching log entries from the oldest to the newest.
+type GetLogsResponse struct {
+	Entries []LogEntry `json:"entries"`
+
+	// Total number of entries dropped from agent log buffer since agent start.
+	Dropped uint64 `json:"dropped"`
+}
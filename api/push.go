@@ -0,0 +1,55 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"time"
+)
+
+// ScrapeTarget represents a local metrics endpoint scraped by agent.
+type ScrapeTarget struct {
+	ID              string            `json:"id"`               // unique ID; added to metrics as agent_id label
+	URL             string            `json:"url"`              // for example: http://127.0.0.1:42000/metrics
+	IntervalSeconds float64           `json:"interval_seconds"` // scrape interval
+	TimeoutSeconds  float64           `json:"timeout_seconds"`  // scrape timeout; if zero, interval is used
+	Labels          map[string]string `json:"labels,omitempty"` // extra labels added to all metrics
+}
+
+// SetScrapeConfigRequest contains a full list of targets PMM server wants agent to scrape.
+// Targets not in the list are not scraped anymore.
+type SetScrapeConfigRequest struct {
+	Targets []ScrapeTarget `json:"targets"`
+}
+
+// SetScrapeConfigResponse is an empty response.
+type SetScrapeConfigResponse struct{}
+
+// MetricsBatch contains metrics of a single scrape in Prometheus text exposition format,
+// with agent and node labels added.
+type MetricsBatch struct {
+	TargetID string    `json:"target_id"`
+	Time     time.Time `json:"time"` // scrape start time
+	Metrics  string    `json:"metrics"`
+}
+
+// PushMetricsRequest sends scraped metrics to PMM server.
+type PushMetricsRequest struct {
+	Batches []MetricsBatch `json:"batches"`
+}
+
+// PushMetricsResponse is an empty response.
+type PushMetricsResponse struct{}
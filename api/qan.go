@@ -0,0 +1,121 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"time"
+)
+
+// Query analytics source types.
+const (
+	TypeMySQLSlowLog           = "mysql_slowlog"
+	TypeMySQLPerfSchema        = "mysql_perfschema"
+	TypePostgreSQLPGStatements = "postgresql_pgstatstatements"
+	TypeMongoDBProfiler        = "mongodb_profiler"
+	TypePostgreSQLLog          = "postgresql_log"
+)
+
+// Query examples redaction modes.
+const (
+	RedactionNone        = "none"        // examples are sent as is
+	RedactionFingerprint = "fingerprint" // examples are not sent, only fingerprints
+	RedactionMask        = "mask"        // all literals in examples are replaced with "?"
+	RedactionRegex       = "regex"       // matches of regular expressions in examples are replaced
+)
+
+// RedactionRule is a regular expression in Go syntax and its replacement, which can refer to groups like $1.
+type RedactionRule struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// RedactionPolicy describes how query examples are redacted before they leave agent host.
+type RedactionPolicy struct {
+	Mode  string          `json:"mode"`            // one of Redaction* constants
+	Rules []RedactionRule `json:"rules,omitempty"` // for regex mode, applied in order
+}
+
+// QANSource represents a source of query analytics data collected by agent.
+type QANSource struct {
+	ID     string `json:"id"`               // unique ID; added to buckets as source_id
+	Type   string `json:"type"`             // one of Type* constants for sources
+	Path   string `json:"path,omitempty"`   // log file path for log-based sources
+	Format string `json:"format,omitempty"` // log format for PostgreSQL log: stderr (default), csvlog or jsonlog
+	DSN    string `json:"dsn,omitempty"`    // data source name for database-based sources and actions
+
+	// Redaction policy for this source; if nil, agent's default policy is used.
+	Redaction *RedactionPolicy `json:"redaction,omitempty"`
+}
+
+// SetQANConfigRequest contains a full list of query analytics sources. Sources not in the list
+// are not collected anymore.
+type SetQANConfigRequest struct {
+	Sources []QANSource `json:"sources"`
+}
+
+// SetQANConfigResponse is an empty response.
+type SetQANConfigResponse struct{}
+
+// MetricStats contains statistics of a single query metric in a bucket.
+type MetricStats struct {
+	Count uint64  `json:"count"` // number of queries with that metric
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+
+	// Percentiles and sketch are present for query_time only, and only if all queries were reported individually.
+	// They are absent for sources reporting aggregated statistics of several queries
+	// (pg_stat_statements, performance_schema), because distribution of query times is not known there.
+	P50    float64 `json:"p50,omitempty"`
+	P95    float64 `json:"p95,omitempty"`
+	P99    float64 `json:"p99,omitempty"`
+	Sketch *Sketch `json:"sketch,omitempty"`
+}
+
+// Sketch is a serialized DDSketch: a mergeable quantile sketch with relative accuracy guarantee.
+// Sketches with the same relative accuracy can be merged by adding counts of bins with the same index.
+//
+// Bin with index i contains values in range (gamma^(i-1), gamma^i], where gamma = (1+a)/(1-a)
+// and a is relative accuracy.
+type Sketch struct {
+	RelativeAccuracy float64  `json:"relative_accuracy"`
+	ZeroCount        uint64   `json:"zero_count,omitempty"` // number of values too small to be indexed
+	Offset           int32    `json:"offset"`               // index of the first bin
+	Counts           []uint64 `json:"counts"`               // counts of consecutive bins
+}
+
+// QueryBucket contains aggregated statistics of queries of a single class (fingerprint and schema) for a period.
+type QueryBucket struct {
+	SourceID            string                  `json:"source_id"`
+	QueryID             string                  `json:"query_id"` // fingerprint hash
+	Fingerprint         string                  `json:"fingerprint"`
+	Schema              string                  `json:"schema,omitempty"`
+	Example             string                  `json:"example,omitempty"` // the slowest query
+	Plan                string                  `json:"plan,omitempty"`    // execution plan of the slowest query with known plan
+	PeriodStart         time.Time               `json:"period_start"`
+	PeriodLengthSeconds uint32                  `json:"period_length_seconds"`
+	Count               uint64                  `json:"count"`             // number of queries
+	Metrics             map[string]*MetricStats `json:"metrics,omitempty"` // by name, for example: query_time
+}
+
+// PushQANRequest sends query analytics buckets to PMM server.
+type PushQANRequest struct {
+	Buckets []QueryBucket `json:"buckets"`
+}
+
+// PushQANResponse is an empty response.
+type PushQANResponse struct{}
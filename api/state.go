@@ -0,0 +1,50 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+// Agent process types.
+const (
+	TypeNodeExporter     = "node_exporter"
+	TypeMySQLdExporter   = "mysqld_exporter"
+	TypeMongoDBExporter  = "mongodb_exporter"
+	TypePostgresExporter = "postgres_exporter"
+)
+
+// AgentProcess represents desired state of a single process managed by agent on behalf of PMM server.
+//
+// Agent allocates a listen port for every process. Text files are rendered as text/template
+// and written to a private directory with 0600 permissions; it is removed when process is stopped.
+// Args and text files can use {{ .listen_port }} for allocated port and {{ .text_files.<name> }}
+// for a path of rendered text file, so secrets are not passed in arguments or environment.
+type AgentProcess struct {
+	ID        string            `json:"id"`                   // unique ID used as a process name
+	Type      string            `json:"type"`                 // one of Type constants
+	Args      []string          `json:"args,omitempty"`       // arguments without executable path; text/template, see below
+	Env       []string          `json:"env,omitempty"`        // environment variables in KEY=value form
+	TextFiles map[string]string `json:"text_files,omitempty"` // config file name -> text/template content
+}
+
+// SetStateRequest contains a full list of processes PMM server wants agent to run.
+// Processes not in the list and previously started by PMM server are stopped.
+type SetStateRequest struct {
+	AgentProcesses []AgentProcess `json:"agent_processes"`
+}
+
+// SetStateResponse contains statuses of all managed processes after reconciliation.
+type SetStateResponse struct {
+	Processes []ProcessStatus `json:"processes"`
+}
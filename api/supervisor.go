@@ -0,0 +1,50 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"time"
+)
+
+// Process states.
+const (
+	ProcessStateStarting = "starting" // process is being started
+	ProcessStateRunning  = "running"  // process is running
+	ProcessStateWaiting  = "waiting"  // process exited and will be restarted after delay
+	ProcessStateStopped  = "stopped"  // process was stopped and will not be restarted
+)
+
+// ProcessStatus represents status of a process managed by agent supervisor.
+type ProcessStatus struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	PID       int       `json:"pid,omitempty"`        // for running process
+	Since     time.Time `json:"since"`                // time of the last state change
+	Restarts  int       `json:"restarts"`             // number of restarts after the first start
+	LastError string    `json:"last_error,omitempty"` // the last start failure or exit reason
+
+	// Port allocated by agent for process to listen on; 0 if there is no allocated port.
+	ListenPort uint16 `json:"listen_port,omitempty"`
+}
+
+// ReportProcessesRequest reports statuses of all managed processes to PMM server.
+type ReportProcessesRequest struct {
+	Processes []ProcessStatus `json:"processes"`
+}
+
+// ReportProcessesResponse is an empty response.
+type ReportProcessesResponse struct{}
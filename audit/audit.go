@@ -0,0 +1,164 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package audit records changes of agent state requested by PMM server or local users,
+// and sends them to PMM server through spool, like metrics and query analytics data.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/rpc"
+	"github.com/Percona-Lab/pmm-agent/spool"
+)
+
+const (
+	prometheusNamespace = "pmm_agent"
+	prometheusSubsystem = "audit"
+
+	// maximum number of events in a single PushAudit request
+	maxEventsPerRequest = 500
+
+	// room for PushAuditRequest encoding in addition to encoded events
+	maxRequestOverhead = 64 * 1024
+)
+
+// Log writes audit events to spool, and sends them to PMM server in order.
+type Log struct {
+	spool   *spool.Spool
+	l       *logrus.Entry
+	maxSize int
+
+	written *prometheus.CounterVec
+	sent    prometheus.Counter
+	retries prometheus.Counter
+	dropped *prometheus.CounterVec
+}
+
+// NewLog creates a new audit log for a given spool. PushAudit requests are limited by a given maximum RPC message size.
+func NewLog(spool *spool.Spool, maxMessageSize int) *Log {
+	return &Log{
+		spool:   spool,
+		l:       logrus.WithField("component", "audit"),
+		maxSize: maxMessageSize - maxRequestOverhead,
+		written: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "events_written_total",
+			Help:      "A total number of audit events written to spool by type.",
+		}, []string{"type"}),
+		sent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "events_sent_total",
+			Help:      "A total number of audit events sent to PMM server.",
+		}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "send_retries_total",
+			Help:      "A total number of failed PushAudit requests which will be retried.",
+		}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "events_dropped_total",
+			Help:      "A total number of audit events dropped before sending by reason (spool_error, decode_error, too_large, rejected).",
+		}, []string{"reason"}),
+	}
+}
+
+// Record writes event to spool. Event time is set to the current time if it is zero.
+// Errors are logged, and never returned, so recording never blocks the audited change.
+func (a *Log) Record(e *api.AuditEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	a.l.Debugf("%s from %s: %v %s", e.Type, e.Origin, e.Details, e.Error)
+
+	data, err := json.Marshal(e)
+	if err == nil {
+		err = a.spool.Write(data)
+	}
+	if err != nil {
+		a.dropped.WithLabelValues("spool_error").Inc()
+		a.l.Errorf("Failed to write %s event: %s.", e.Type, err)
+		return
+	}
+	a.written.WithLabelValues(e.Type).Inc()
+}
+
+// Send sends events from spool to PMM server in order until done is closed.
+// See spool.Sender for retry and drop policy.
+func (a *Log) Send(client rpc.AuditGatewayClient, done <-chan struct{}) {
+	spool.NewSender(&spool.SenderParams{
+		Spool:      a.spool,
+		L:          a.l,
+		Name:       "audit events",
+		MaxRecords: maxEventsPerRequest,
+		MaxSize:    a.maxSize,
+		Send: func(records [][]byte) (int, error) {
+			req := &api.PushAuditRequest{
+				Events: make([]api.AuditEvent, 0, len(records)),
+			}
+			for _, r := range records {
+				var e api.AuditEvent
+				if err := json.Unmarshal(r, &e); err != nil {
+					a.dropped.WithLabelValues("decode_error").Inc()
+					a.l.Errorf("Failed to decode audit event from spool: %s.", err)
+					continue
+				}
+				req.Events = append(req.Events, e)
+			}
+			if len(req.Events) == 0 {
+				return 0, nil
+			}
+			_, err := client.PushAudit(context.Background(), req)
+			return len(req.Events), err
+		},
+		Rejected: rpc.IsRejected,
+		Sent:     a.sent,
+		Retries:  a.retries,
+		Dropped:  a.dropped,
+	}).Run(done)
+}
+
+// Describe implements prometheus.Collector.
+func (a *Log) Describe(ch chan<- *prometheus.Desc) {
+	a.written.Describe(ch)
+	a.sent.Describe(ch)
+	a.retries.Describe(ch)
+	a.dropped.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (a *Log) Collect(ch chan<- prometheus.Metric) {
+	a.written.Collect(ch)
+	a.sent.Collect(ch)
+	a.retries.Collect(ch)
+	a.dropped.Collect(ch)
+}
+
+// check interfaces
+var (
+	_ prometheus.Collector = (*Log)(nil)
+)
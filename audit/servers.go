@@ -0,0 +1,158 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/rpc"
+)
+
+// record records event for request from PMM server with a given handler error.
+func (a *Log) record(eventType string, details map[string]string, err error) {
+	e := &api.AuditEvent{
+		Type:    eventType,
+		Origin:  api.AuditOriginServer,
+		Details: details,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	a.Record(e)
+}
+
+// joinIDs returns sorted comma-separated IDs.
+func joinIDs(ids []string) string {
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+type supervisorServer struct {
+	rpc.SupervisorServer
+	a *Log
+}
+
+// SupervisorServer returns server which records SetState requests, and passes them to a given server.
+func (a *Log) SupervisorServer(server rpc.SupervisorServer) rpc.SupervisorServer {
+	return &supervisorServer{server, a}
+}
+
+func (s *supervisorServer) SetState(ctx context.Context, req *api.SetStateRequest) (*api.SetStateResponse, error) {
+	res, err := s.SupervisorServer.SetState(ctx, req)
+	ids := make([]string, len(req.AgentProcesses))
+	for i, p := range req.AgentProcesses {
+		ids[i] = p.ID
+	}
+	s.a.record(api.AuditSetState, map[string]string{"processes": joinIDs(ids)}, err)
+	return res, err
+}
+
+type pushServer struct {
+	rpc.PushServer
+	a *Log
+}
+
+// PushServer returns server which records SetScrapeConfig requests, and passes them to a given server.
+func (a *Log) PushServer(server rpc.PushServer) rpc.PushServer {
+	return &pushServer{server, a}
+}
+
+func (s *pushServer) SetScrapeConfig(ctx context.Context, req *api.SetScrapeConfigRequest) (*api.SetScrapeConfigResponse, error) {
+	res, err := s.PushServer.SetScrapeConfig(ctx, req)
+	ids := make([]string, len(req.Targets))
+	for i, t := range req.Targets {
+		ids[i] = t.ID
+	}
+	s.a.record(api.AuditSetScrapeConfig, map[string]string{"targets": joinIDs(ids)}, err)
+	return res, err
+}
+
+type qanServer struct {
+	rpc.QANServer
+	a *Log
+}
+
+// QANServer returns server which records SetQANConfig requests, and passes them to a given server.
+func (a *Log) QANServer(server rpc.QANServer) rpc.QANServer {
+	return &qanServer{server, a}
+}
+
+func (s *qanServer) SetQANConfig(ctx context.Context, req *api.SetQANConfigRequest) (*api.SetQANConfigResponse, error) {
+	res, err := s.QANServer.SetQANConfig(ctx, req)
+	ids := make([]string, len(req.Sources))
+	for i, source := range req.Sources {
+		ids[i] = source.ID
+	}
+	s.a.record(api.AuditSetQANConfig, map[string]string{"sources": joinIDs(ids)}, err)
+	return res, err
+}
+
+type actionsServer struct {
+	rpc.ActionsServer
+	a *Log
+}
+
+// ActionsServer returns server which records StartAction and StopAction requests, and passes them to a given server.
+// Query texts are not recorded.
+func (a *Log) ActionsServer(server rpc.ActionsServer) rpc.ActionsServer {
+	return &actionsServer{server, a}
+}
+
+func (s *actionsServer) StartAction(ctx context.Context, req *api.StartActionRequest) (*api.StartActionResponse, error) {
+	res, err := s.ActionsServer.StartAction(ctx, req)
+	s.a.record(api.AuditStartAction, map[string]string{
+		"action_id": req.ActionID,
+		"type":      req.Type,
+		"source_id": req.SourceID,
+		"database":  req.Database,
+	}, err)
+	return res, err
+}
+
+func (s *actionsServer) StopAction(ctx context.Context, req *api.StopActionRequest) (*api.StopActionResponse, error) {
+	res, err := s.ActionsServer.StopAction(ctx, req)
+	s.a.record(api.AuditStopAction, map[string]string{"action_id": req.ActionID}, err)
+	return res, err
+}
+
+type logServer struct {
+	rpc.LogServer
+	a *Log
+}
+
+// LogServer returns server which records SetLogLevel requests, and passes all requests to a given server.
+func (a *Log) LogServer(server rpc.LogServer) rpc.LogServer {
+	return &logServer{server, a}
+}
+
+func (s *logServer) SetLogLevel(ctx context.Context, req *api.SetLogLevelRequest) (*api.SetLogLevelResponse, error) {
+	res, err := s.LogServer.SetLogLevel(ctx, req)
+	s.a.record(api.AuditSetLogLevel, map[string]string{"component": req.Component, "level": req.Level}, err)
+	return res, err
+}
+
+// check interfaces
+var (
+	_ rpc.SupervisorServer = (*supervisorServer)(nil)
+	_ rpc.PushServer       = (*pushServer)(nil)
+	_ rpc.QANServer        = (*qanServer)(nil)
+	_ rpc.ActionsServer    = (*actionsServer)(nil)
+	_ rpc.LogServer        = (*logServer)(nil)
+)
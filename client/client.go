@@ -0,0 +1,365 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package client maintains connection to PMM server.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Percona-Lab/wsrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/actions"
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/audit"
+	"github.com/Percona-Lab/pmm-agent/push"
+	"github.com/Percona-Lab/pmm-agent/qan"
+	"github.com/Percona-Lab/pmm-agent/rpc"
+	"github.com/Percona-Lab/pmm-agent/supervisor"
+	"github.com/Percona-Lab/pmm-agent/tunnel"
+)
+
+const (
+	prometheusNamespace = "pmm_agent"
+	prometheusSubsystem = "connection"
+)
+
+// ServerVersionHeader is an HTTP header with PMM server version in connection response.
+const ServerVersionHeader = "Pmm-Server-Version"
+
+// Connection states.
+const (
+	StateConnecting   = "connecting"
+	StateConnected    = "connected"
+	StateDisconnected = "disconnected"
+)
+
+// Status represents connection status.
+type Status struct {
+	State         string    `json:"state"`
+	ServerAddress string    `json:"server_address"`
+	ServerVersion string    `json:"server_version,omitempty"` // for the current or last connection
+	Since         time.Time `json:"since"`                    // time of the last state change
+	LastError     string    `json:"last_error,omitempty"`
+	Tunnels       int       `json:"tunnels"`
+}
+
+// Params represent client parameters.
+type Params struct {
+	// PMM server address, for example: ws://127.0.0.1:8080/.
+	Address string
+
+	// TLS configuration for wss:// addresses. If nil, the default configuration with system CAs is used.
+	TLSConfig *tls.Config
+
+	// Maximum size of RPC request or response. If zero, rpc.DefaultMaxMessageSize is used.
+	MaxMessageSize int
+
+	// Maximum number of open tunnels, 0 for unlimited.
+	MaxTunnels int
+
+	// Handles logging control requests from PMM server.
+	LogServer rpc.LogServer
+
+	// Managed processes; their state is reported to PMM server.
+	Supervisor *supervisor.Supervisor
+
+	// Handles managed processes requests from PMM server.
+	SupervisorServer rpc.SupervisorServer
+
+	// Source of scraped metrics sent to PMM server.
+	Scraper *push.Scraper
+
+	// Handles push-mode metrics requests from PMM server.
+	PushServer rpc.PushServer
+
+	// Source of query analytics data sent to PMM server.
+	QANSender *qan.Sender
+
+	// Handles query analytics requests from PMM server.
+	QANServer rpc.QANServer
+
+	// Runs actions requested by PMM server and sends their results.
+	Actions *actions.Service
+
+	// Records state changes requested by PMM server, and sends them back.
+	Audit *audit.Log
+}
+
+// Client connects to PMM server, reconnects when connection is lost, and serves its requests.
+type Client struct {
+	addr             string
+	l                *logrus.Entry
+	logServer        rpc.LogServer
+	supervisor       *supervisor.Supervisor
+	supervisorServer rpc.SupervisorServer
+	scraper          *push.Scraper
+	pushServer       rpc.PushServer
+	qanSender        *qan.Sender
+	qanServer        rpc.QANServer
+	actions          *actions.Service
+	audit            *audit.Log
+
+	rpcMetrics    *rpc.Metrics
+	tunnelMetrics *tunnel.Metrics
+	up            prometheus.Gauge
+	reconnects    prometheus.Counter
+	dialErrors    prometheus.Counter
+
+	rw             sync.RWMutex
+	status         Status
+	tlsConfig      *tls.Config
+	maxMessageSize int
+	maxTunnels     int
+	tunnels        *tunnel.Service // nil if not connected
+}
+
+// New creates a new client.
+func New(params *Params) *Client {
+	return &Client{
+		addr:             params.Address,
+		l:                logrus.WithField("component", "connection"),
+		logServer:        params.LogServer,
+		supervisor:       params.Supervisor,
+		supervisorServer: params.SupervisorServer,
+		scraper:          params.Scraper,
+		pushServer:       params.PushServer,
+		qanSender:        params.QANSender,
+		qanServer:        params.QANServer,
+		actions:          params.Actions,
+		audit:            params.Audit,
+		rpcMetrics:       rpc.NewMetrics(),
+		tunnelMetrics:    tunnel.NewMetrics(),
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "up",
+			Help:      "1 if agent is connected to PMM server, 0 otherwise.",
+		}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "reconnects_total",
+			Help:      "A total number of connection attempts after the first one.",
+		}),
+		dialErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "dial_errors_total",
+			Help:      "A total number of failed connection attempts.",
+		}),
+		status: Status{
+			State:         StateDisconnected,
+			ServerAddress: params.Address,
+			Since:         time.Now(),
+		},
+		tlsConfig:      params.TLSConfig,
+		maxMessageSize: params.MaxMessageSize,
+		maxTunnels:     params.MaxTunnels,
+	}
+}
+
+// SetTLSConfig changes TLS configuration for new connections.
+func (c *Client) SetTLSConfig(tlsConfig *tls.Config) {
+	c.rw.Lock()
+	c.tlsConfig = tlsConfig
+	c.rw.Unlock()
+}
+
+// SetMaxMessageSize changes maximum size of RPC request or response for new connections.
+func (c *Client) SetMaxMessageSize(maxMessageSize int) {
+	c.rw.Lock()
+	c.maxMessageSize = maxMessageSize
+	c.rw.Unlock()
+}
+
+// SetMaxTunnels changes a limit of open tunnels for the current and new connections.
+func (c *Client) SetMaxTunnels(maxTunnels int) {
+	c.rw.Lock()
+	defer c.rw.Unlock()
+
+	c.maxTunnels = maxTunnels
+	if c.tunnels != nil {
+		c.tunnels.SetMaxTunnels(maxTunnels)
+	}
+}
+
+// Status returns current connection status.
+func (c *Client) Status() *Status {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+
+	s := c.status
+	if c.tunnels != nil {
+		s.Tunnels = c.tunnels.Count()
+	}
+	return &s
+}
+
+// setState changes connection state. If err is not nil, it is stored as the last error.
+func (c *Client) setState(state string, err error) {
+	c.rw.Lock()
+	defer c.rw.Unlock()
+
+	c.status.State = state
+	c.status.Since = time.Now()
+	if err != nil {
+		c.status.LastError = err.Error()
+	}
+}
+
+// Run connects to PMM server and serves its requests, reconnecting with random delay when connection is lost.
+// It returns when ctx is canceled.
+func (c *Client) Run(ctx context.Context) {
+	headers := make(http.Header)
+	rpc.AcceptCompression(headers)
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			delay := time.Duration(rand.Float64()*2.0*float64(time.Second)) + time.Second
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			c.reconnects.Inc()
+		}
+
+		c.l.Infof("Connecting to %s...", c.addr)
+		c.setState(StateConnecting, nil)
+		c.rw.RLock()
+		tlsConfig := c.tlsConfig
+		c.rw.RUnlock()
+		conn, respHeaders, err := wsrpc.DialTLS(c.addr, headers, tlsConfig)
+		if err != nil {
+			c.dialErrors.Inc()
+			c.setState(StateDisconnected, err)
+			c.l.Error(err)
+			continue
+		}
+
+		c.handleConn(ctx, conn, respHeaders)
+	}
+}
+
+// handleConn serves requests on established connection until it is closed or ctx is canceled.
+func (c *Client) handleConn(ctx context.Context, conn *wsrpc.Conn, headers http.Header) {
+	c.rw.Lock()
+	rpcConn := rpc.NewConn(conn, &rpc.Params{
+		Compression:    rpc.NegotiatedCompression(headers),
+		MaxMessageSize: c.maxMessageSize,
+		Metrics:        c.rpcMetrics,
+	})
+	server := tunnel.NewService(rpc.NewGatewayClient(rpcConn), c.tunnelMetrics, c.maxTunnels)
+	rpc.RegisterAgentServer(rpcConn, server)
+	rpc.RegisterLogServer(rpcConn, c.audit.LogServer(c.logServer))
+	rpc.RegisterSupervisorServer(rpcConn, c.audit.SupervisorServer(c.supervisorServer))
+	rpc.RegisterPushServer(rpcConn, c.audit.PushServer(c.pushServer))
+	rpc.RegisterQANServer(rpcConn, c.audit.QANServer(c.qanServer))
+	rpc.RegisterActionsServer(rpcConn, c.audit.ActionsServer(c.actions))
+
+	serverVersion := headers.Get(ServerVersionHeader)
+	c.status.ServerVersion = serverVersion
+	c.tunnels = server
+	c.rw.Unlock()
+
+	c.l.Infof("Connected to PMM server %s.", serverVersion)
+	c.setState(StateConnected, nil)
+	c.up.Set(1)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	go c.reportProcesses(rpc.NewSupervisorGatewayClient(rpcConn), done)
+	go c.scraper.Send(rpc.NewPushGatewayClient(rpcConn), done)
+	go c.qanSender.Send(rpc.NewQANGatewayClient(rpcConn), done)
+	go c.actions.Send(rpc.NewActionsGatewayClient(rpcConn), done)
+	go c.audit.Send(rpc.NewAuditGatewayClient(rpcConn), done)
+
+	err := rpcConn.Run()
+	close(done)
+	conn.Close()
+
+	c.up.Set(0)
+	c.rw.Lock()
+	c.tunnels = nil
+	c.rw.Unlock()
+	c.setState(StateDisconnected, err)
+
+	s := rpcConn.CompressionStats()
+	c.l.Infof("Compression %q: sent %d compressed and %d uncompressed messages, ratio %.2f, compression %s, decompression %s.",
+		s.Compression, s.SentCompressed, s.SentUncompressed, s.Ratio(), s.CompressionDuration, s.DecompressionDuration)
+	c.l.Infof("Server exited with %v", err)
+}
+
+// reportProcesses sends managed processes state to PMM server after connection and after every change,
+// until done is closed.
+func (c *Client) reportProcesses(client rpc.SupervisorGatewayClient, done <-chan struct{}) {
+	for {
+		req := &api.ReportProcessesRequest{
+			Processes: c.supervisor.Processes(),
+		}
+		if _, err := client.ReportProcesses(context.Background(), req); err != nil {
+			select {
+			case <-done:
+				return
+			default:
+				c.l.Errorf("Failed to report processes state: %s.", err)
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-c.supervisor.Changes():
+		}
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Client) Describe(ch chan<- *prometheus.Desc) {
+	c.rpcMetrics.Describe(ch)
+	c.tunnelMetrics.Describe(ch)
+	c.up.Describe(ch)
+	c.reconnects.Describe(ch)
+	c.dialErrors.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Client) Collect(ch chan<- prometheus.Metric) {
+	c.rpcMetrics.Collect(ch)
+	c.tunnelMetrics.Collect(ch)
+	c.up.Collect(ch)
+	c.reconnects.Collect(ch)
+	c.dialErrors.Collect(ch)
+}
+
+// check interfaces
+var (
+	_ prometheus.Collector = (*Client)(nil)
+)
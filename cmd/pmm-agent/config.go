@@ -0,0 +1,181 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/Percona-Lab/pmm-agent/client"
+	"github.com/Percona-Lab/pmm-agent/config"
+	"github.com/Percona-Lab/pmm-agent/logger"
+	"github.com/Percona-Lab/pmm-agent/supervisor"
+)
+
+// Flags and environment variables override configuration file values.
+// They have no defaults there; defaults are defined by config.Default.
+var (
+	configFileF     = kingpin.Flag("config-file", "Configuration file path [default: "+config.DefaultPath+"].").Envar("PMM_AGENT_CONFIG_FILE").String()
+	serverAddressF  = kingpin.Flag("server-address", "PMM server WebSocket URL.").Envar("PMM_AGENT_SERVER_ADDRESS").String()
+	caFileF         = kingpin.Flag("ca-file", "CA certificates file for PMM server certificate verification.").Envar("PMM_AGENT_CA_FILE").String()
+	maxMessageSizeF = kingpin.Flag("max-message-size", "Maximum size of RPC request or response.").Envar("PMM_AGENT_MAX_MESSAGE_SIZE").Bytes()
+	logLevelF       = kingpin.Flag("log-level", "Default log level: debug, info, warning, error.").Envar("PMM_AGENT_LOG_LEVEL").String()
+	logFormatF      = kingpin.Flag("log-format", "Log format: text or json.").Envar("PMM_AGENT_LOG_FORMAT").String()
+	listenAddressF  = kingpin.Flag("listen-address", "Local HTTP server address for /metrics and /status endpoints: loopback host:port or unix:/path.").Envar("PMM_AGENT_LISTEN_ADDRESS").String()
+)
+
+// loadConfig loads configuration file, applies flags and environment variables, and validates the result.
+// A missing file is an error only if its path was set explicitly.
+func loadConfig() (*config.Config, error) {
+	path, mustExist := *configFileF, true
+	if path == "" {
+		path, mustExist = config.DefaultPath, false
+	}
+	cfg, err := config.Load(path, mustExist)
+	if err != nil {
+		return nil, err
+	}
+
+	if *serverAddressF != "" {
+		cfg.Server.Address = *serverAddressF
+	}
+	if *caFileF != "" {
+		cfg.TLS.CAFile = *caFileF
+	}
+	if *maxMessageSizeF != 0 {
+		cfg.Server.MaxMessageSize = config.Bytes(*maxMessageSizeF)
+	}
+	if *logLevelF != "" {
+		cfg.Log.Level = *logLevelF
+	}
+	if *logFormatF != "" {
+		cfg.Log.Format = *logFormatF
+	}
+	if *listenAddressF != "" {
+		cfg.ListenAddress = *listenAddressF
+	}
+
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// setupLogger configures logger from validated configuration.
+func setupLogger(cfg *config.Config) {
+	if err := logger.Setup(cfg.Log.Format, cfg.Log.Levels()); err != nil {
+		logrus.Panic(err)
+	}
+}
+
+// reloadConfig re-reads configuration and applies changes that can be applied without restart.
+// It returns configuration in effect.
+func reloadConfig(cfg *config.Config, c *client.Client, sup *supervisor.Supervisor, logBuffer *logger.Buffer) *config.Config {
+	newCfg, err := loadConfig()
+	if err != nil {
+		logrus.Errorf("Failed to reload configuration, keeping the current one: %s", err)
+		return cfg
+	}
+
+	if newCfg.Log.Level != cfg.Log.Level || newCfg.Log.Format != cfg.Log.Format || !reflect.DeepEqual(newCfg.Log.Components, cfg.Log.Components) {
+		logrus.Infof("Changing logging configuration; runtime log level changes are discarded.")
+		setupLogger(newCfg)
+	}
+	if newCfg.Log.Buffer != cfg.Log.Buffer {
+		logrus.Infof("Changing log buffer limits to %d entries and %d bytes.", newCfg.Log.Buffer.Entries, newCfg.Log.Buffer.Size)
+		logBuffer.SetLimits(newCfg.Log.Buffer.Entries, int(newCfg.Log.Buffer.Size))
+	}
+	if newCfg.Tunnels.Max != cfg.Tunnels.Max {
+		logrus.Infof("Changing open tunnels limit from %d to %d.", cfg.Tunnels.Max, newCfg.Tunnels.Max)
+		c.SetMaxTunnels(newCfg.Tunnels.Max)
+	}
+	if newCfg.Server.MaxMessageSize != cfg.Server.MaxMessageSize {
+		logrus.Infof("Changing maximum message size from %d to %d; it will be used for the next connection.",
+			cfg.Server.MaxMessageSize, newCfg.Server.MaxMessageSize)
+		c.SetMaxMessageSize(int(newCfg.Server.MaxMessageSize))
+	}
+
+	if newCfg.TLS != cfg.TLS {
+		// validated by loadConfig, but CA file may be changed since then
+		if tlsConfig, err := newCfg.TLS.Config(); err != nil {
+			logrus.Errorf("Failed to load TLS configuration, keeping the current one: %s.", err)
+			newCfg.TLS = cfg.TLS
+		} else {
+			logrus.Infof("Changing TLS configuration; it will be used for the next connection.")
+			c.SetTLSConfig(tlsConfig)
+		}
+	}
+	if !reflect.DeepEqual(newCfg.Processes, cfg.Processes) {
+		logrus.Infof("Changing processes.")
+		if err = sup.SetLocalState(localProcesses(newCfg)); err != nil {
+			logrus.Errorf("Failed to change processes: %s.", err)
+		}
+	}
+
+	// those changes require restart; keep old values so they are reported again on the next reload
+	if newCfg.Server.Address != cfg.Server.Address {
+		logrus.Warnf("Server address change requires restart.")
+		newCfg.Server.Address = cfg.Server.Address
+	}
+	if newCfg.ListenAddress != cfg.ListenAddress {
+		logrus.Warnf("Listen address change requires restart.")
+		newCfg.ListenAddress = cfg.ListenAddress
+	}
+	if newCfg.Paths != cfg.Paths {
+		logrus.Warnf("Paths change requires restart.")
+		newCfg.Paths = cfg.Paths
+	}
+	if newCfg.Ports != cfg.Ports {
+		logrus.Warnf("Ports configuration change requires restart.")
+		newCfg.Ports = cfg.Ports
+	}
+	if newCfg.NodeName != cfg.NodeName {
+		logrus.Warnf("Node name change requires restart.")
+		newCfg.NodeName = cfg.NodeName
+	}
+	if newCfg.Spool != cfg.Spool {
+		logrus.Warnf("Spool configuration change requires restart.")
+		newCfg.Spool = cfg.Spool
+	}
+	if !reflect.DeepEqual(newCfg.QAN, cfg.QAN) {
+		logrus.Warnf("Query analytics configuration change requires restart.")
+		newCfg.QAN = cfg.QAN
+	}
+	if newCfg.Node != cfg.Node {
+		logrus.Warnf("Node collector configuration change requires restart.")
+		newCfg.Node = cfg.Node
+	}
+
+	logrus.Info("Configuration reloaded.")
+	return newCfg
+}
+
+// localProcesses returns parameters of processes from configuration.
+func localProcesses(cfg *config.Config) []*supervisor.ProcessParams {
+	res := make([]*supervisor.ProcessParams, len(cfg.Processes))
+	for i, p := range cfg.Processes {
+		res[i] = &supervisor.ProcessParams{
+			Name: p.Name,
+			Path: p.Path,
+			Args: p.Args,
+			Env:  p.Env,
+		}
+	}
+	return res
+}
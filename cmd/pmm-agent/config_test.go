@@ -0,0 +1,114 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmm-agent-main-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "pmm-agent.yaml")
+	b := []byte("server:\n  address: ws://file:8080/\n  max_message_size: 1MiB\nlog:\n  level: warning\n")
+	if err = ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name           string
+		env            map[string]string
+		args           []string
+		address        string
+		maxMessageSize int64
+		level          string
+		err            string
+	}{
+		{
+			name:           "File",
+			address:        "ws://file:8080/",
+			maxMessageSize: 1 << 20,
+			level:          "warning",
+		}, {
+			name: "Env",
+			env: map[string]string{
+				"PMM_AGENT_SERVER_ADDRESS":   "ws://env:8080/",
+				"PMM_AGENT_MAX_MESSAGE_SIZE": "2MiB",
+			},
+			address:        "ws://env:8080/",
+			maxMessageSize: 2 << 20,
+			level:          "warning",
+		}, {
+			name: "Flags",
+			env: map[string]string{
+				"PMM_AGENT_SERVER_ADDRESS":   "ws://env:8080/",
+				"PMM_AGENT_MAX_MESSAGE_SIZE": "2MiB",
+			},
+			args:           []string{"--server-address=ws://flag:8080/", "--log-level=debug"},
+			address:        "ws://flag:8080/",
+			maxMessageSize: 2 << 20,
+			level:          "debug",
+		}, {
+			name: "Invalid",
+			env: map[string]string{
+				"PMM_AGENT_LOG_LEVEL": "verbose",
+			},
+			args: []string{"--server-address=http://flag:8080/"},
+			err: `server.address: expected ws:// or wss:// URL, got "http://flag:8080/"` + "\n" +
+				`log.level: not a valid logrus Level: "verbose"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// flag variables keep values from the previous parsing
+			*serverAddressF, *caFileF, *logLevelF, *logFormatF, *listenAddressF = "", "", "", "", ""
+			*maxMessageSizeF = 0
+
+			for k, v := range tc.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+			args := append([]string{"run", "--config-file=" + path}, tc.args...)
+			if _, err := kingpin.CommandLine.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := loadConfig()
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Errorf("Expected error:\n%s\ngot:\n%v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Server.Address != tc.address || int64(cfg.Server.MaxMessageSize) != tc.maxMessageSize || cfg.Log.Level != tc.level {
+				t.Errorf("Unexpected configuration: address %q, max message size %d, log level %q.",
+					cfg.Server.Address, cfg.Server.MaxMessageSize, cfg.Log.Level)
+			}
+		})
+	}
+}
@@ -17,42 +17,227 @@
 package main
 
 import (
-	"math/rand"
-	"time"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
-	"github.com/Percona-Lab/wsrpc"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/alecthomas/kingpin.v2"
 
-	"github.com/Percona-Lab/pmm-agent/tunnel"
-	"github.com/Percona-Lab/pmm-api/agent"
-	"github.com/Percona-Lab/pmm-api/gateway"
+	"github.com/Percona-Lab/pmm-agent/actions"
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/audit"
+	"github.com/Percona-Lab/pmm-agent/client"
+	"github.com/Percona-Lab/pmm-agent/config"
+	"github.com/Percona-Lab/pmm-agent/localserver"
+	"github.com/Percona-Lab/pmm-agent/logger"
+	"github.com/Percona-Lab/pmm-agent/node"
+	"github.com/Percona-Lab/pmm-agent/ports"
+	"github.com/Percona-Lab/pmm-agent/push"
+	"github.com/Percona-Lab/pmm-agent/qan"
+	"github.com/Percona-Lab/pmm-agent/qan/mongoprofiler"
+	"github.com/Percona-Lab/pmm-agent/qan/perfschema"
+	"github.com/Percona-Lab/pmm-agent/qan/pglog"
+	"github.com/Percona-Lab/pmm-agent/qan/pgstatements"
+	"github.com/Percona-Lab/pmm-agent/qan/slowlog"
+	"github.com/Percona-Lab/pmm-agent/spool"
+	"github.com/Percona-Lab/pmm-agent/supervisor"
 )
 
-func handleConn(conn *wsrpc.Conn) {
-	logrus.Info("Connected!")
-	defer conn.Close()
+var (
+	runCmd         = kingpin.Command("run", "Run agent.").Default()
+	statusCmd      = kingpin.Command("status", "Show status of running agent.")
+	configCmd      = kingpin.Command("config", "Configuration commands.")
+	configCheckCmd = configCmd.Command("check", "Check configuration file, flags and environment variables.")
 
-	server := tunnel.NewService(gateway.NewServiceClient(conn))
-	err := agent.NewServiceDispatcher(conn, server).Run()
-	logrus.Infof("Server exited with %v", err)
+	logLevelCmd          = kingpin.Command("log-level", "Show or change log levels of running agent.")
+	logLevelLevelArg     = logLevelCmd.Arg("level", "New log level: debug, info, warning, error.").String()
+	logLevelComponentArg = logLevelCmd.Arg("component", "Component: connection, rpc, tunnel, supervisor; the default level is changed if empty.").String()
+)
+
+func run(cfg *config.Config) {
+	setupLogger(cfg)
+	logBuffer := logger.NewBuffer(cfg.Log.Buffer.Entries, int(cfg.Log.Buffer.Size))
+	logrus.AddHook(logBuffer)
+
+	tlsConfig, err := cfg.TLS.Config()
+	if err != nil {
+		logrus.Fatalf("Failed to load TLS configuration: %s.", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sup := supervisor.New(ctx)
+	if err = sup.SetLocalState(localProcesses(cfg)); err != nil {
+		logrus.Errorf("Failed to start processes: %s.", err)
+	}
+
+	allocator, err := ports.NewAllocator(cfg.Ports.Min, cfg.Ports.Max, cfg.Ports.StateFile)
+	if err != nil {
+		logrus.Fatalf("Failed to create ports allocator: %s.", err)
+	}
+
+	// private directory for text files; random name prevents other local users from creating it first
+	tempDir, err := ioutil.TempDir(cfg.Paths.TempDir, "pmm-agent-")
+	if err != nil {
+		logrus.Fatalf("Failed to create temporary directory: %s.", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	metricsSpool := openSpool(cfg, "metrics")
+	defer metricsSpool.Close()
+	scraper := push.NewScraper(ctx, cfg.NodeName, metricsSpool, int(cfg.Server.MaxMessageSize))
+	prometheus.MustRegister(scraper)
+
+	auditSpool := openSpool(cfg, "audit")
+	defer auditSpool.Close()
+	auditLog := audit.NewLog(auditSpool, int(cfg.Server.MaxMessageSize))
+	prometheus.MustRegister(auditLog)
+
+	qanSpool := openSpool(cfg, "qan")
+	defer qanSpool.Close()
+	qanSender := qan.NewSender(qanSpool, int(cfg.Server.MaxMessageSize))
+	prometheus.MustRegister(qanSender)
+	qanService := qan.NewService(ctx, qanSender, cfg.QAN.StateDir, cfg.QAN.Redaction.Policy(), map[string]qan.NewCollectorFunc{
+		api.TypeMySQLSlowLog:           slowlog.New,
+		api.TypeMySQLPerfSchema:        perfschema.New,
+		api.TypePostgreSQLPGStatements: pgstatements.New,
+		api.TypeMongoDBProfiler:        mongoprofiler.New,
+		api.TypePostgreSQLLog:          pglog.New,
+	})
+	actionsService := actions.NewService(ctx, qanService.SourceDSN, qanService.RedactPlan, map[string]actions.NewActionFunc{
+		api.ActionMySQLExplain:              actions.NewMySQLExplain,
+		api.ActionMySQLShowCreateTable:      actions.NewMySQLShowCreateTable,
+		api.ActionMySQLShowIndex:            actions.NewMySQLShowIndex,
+		api.ActionMySQLShowTableStatus:      actions.NewMySQLShowTableStatus,
+		api.ActionPostgreSQLExplain:         actions.NewPostgreSQLExplain,
+		api.ActionPostgreSQLShowCreateTable: actions.NewPostgreSQLShowCreateTable,
+		api.ActionPostgreSQLShowIndex:       actions.NewPostgreSQLShowIndex,
+		api.ActionPostgreSQLShowTableStatus: actions.NewPostgreSQLShowTableStatus,
+	})
+	prometheus.MustRegister(actionsService)
+
+	c := client.New(&client.Params{
+		Address:        cfg.Server.Address,
+		TLSConfig:      tlsConfig,
+		MaxMessageSize: int(cfg.Server.MaxMessageSize),
+		MaxTunnels:     cfg.Tunnels.Max,
+		LogServer:      logger.NewService(logBuffer),
+		Supervisor:     sup,
+		SupervisorServer: supervisor.NewService(sup, map[string]string{
+			api.TypeNodeExporter:     cfg.Paths.NodeExporter,
+			api.TypeMySQLdExporter:   cfg.Paths.MySQLdExporter,
+			api.TypeMongoDBExporter:  cfg.Paths.MongoDBExporter,
+			api.TypePostgresExporter: cfg.Paths.PostgresExporter,
+		}, allocator, tempDir),
+		Scraper:    scraper,
+		PushServer: push.NewService(scraper),
+		QANSender:  qanSender,
+		QANServer:  qanService,
+		Actions:    actionsService,
+		Audit:      auditLog,
+	})
+	prometheus.MustRegister(c)
+	if cfg.Node.Enabled {
+		prometheus.MustRegister(node.New(&node.Params{
+			ProcPath:   cfg.Node.ProcPath,
+			SysPath:    cfg.Node.SysPath,
+			RootFSPath: cfg.Node.RootFSPath,
+		}))
+	}
+
+	go func() {
+		server := localserver.New(&localserver.Params{
+			Address:    cfg.ListenAddress,
+			Gatherer:   prometheus.DefaultGatherer,
+			Client:     c,
+			Supervisor: sup,
+			Audit:      auditLog,
+		})
+		if err := server.Run(ctx); err != nil {
+			logrus.Errorf("Local server failed: %+v", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for s := range signals {
+			if s == syscall.SIGHUP {
+				logrus.Info("Got SIGHUP, reloading configuration...")
+				cfg = reloadConfig(cfg, c, sup, logBuffer)
+				auditLog.Record(&api.AuditEvent{Type: api.AuditReloadConfig, Origin: api.AuditOriginSignal})
+				continue
+			}
+
+			logrus.Warnf("Got %s, shutting down...", s)
+			cancel()
+			return
+		}
+	}()
+
+	c.Run(ctx)
+	qanService.Wait()
+	actionsService.Wait()
+	sup.Wait()
+}
+
+// openSpool opens spool with a given name in a subdirectory of configured spool directory, and registers its metrics.
+func openSpool(cfg *config.Config, name string) *spool.Spool {
+	s, err := spool.Open(&spool.Params{
+		Dir:         filepath.Join(cfg.Spool.Dir, name),
+		Name:        name,
+		MaxSize:     int64(cfg.Spool.MaxSize),
+		SegmentSize: int64(cfg.Spool.SegmentSize),
+	})
+	if err != nil {
+		logrus.Fatalf("Failed to open %s spool: %s.", name, err)
+	}
+	prometheus.MustRegister(s)
+	return s
 }
 
 func main() {
-	logrus.SetLevel(logrus.DebugLevel)
-	kingpin.Parse()
+	cmd := kingpin.Parse()
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration is invalid:\n%s\n", err)
+		os.Exit(1)
+	}
 
-	const addr = "ws://127.0.0.1:8080/"
-	logrus.Infof("Connecting to %s...", addr)
-	for {
-		conn, _, err := wsrpc.Dial(addr, nil)
+	switch cmd {
+	case runCmd.FullCommand():
+		run(cfg)
+
+	case statusCmd.FullCommand():
+		status, err := localserver.NewClient(cfg.ListenAddress).Status()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get status from pmm-agent at %s: %s.\n", cfg.ListenAddress, err)
+			os.Exit(1)
+		}
+		printStatus(os.Stdout, status)
+
+	case logLevelCmd.FullCommand():
+		c := localserver.NewClient(cfg.ListenAddress)
+		var levels *logger.Levels
+		if *logLevelLevelArg == "" {
+			levels, err = c.LogLevels()
+		} else {
+			levels, err = c.SetLogLevel(*logLevelComponentArg, *logLevelLevelArg)
+		}
 		if err != nil {
-			logrus.Error(err)
-			delay := time.Duration(rand.Float64()*2.0*float64(time.Second)) + time.Second
-			time.Sleep(delay)
-			continue
+			fmt.Fprintf(os.Stderr, "Failed to get or change log levels of pmm-agent at %s: %s.\n", cfg.ListenAddress, err)
+			os.Exit(1)
 		}
+		printLogLevels(os.Stdout, levels)
 
-		handleConn(conn)
+	case configCheckCmd.FullCommand():
+		fmt.Println("Configuration is valid.")
 	}
 }
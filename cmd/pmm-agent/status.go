@@ -0,0 +1,83 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Percona-Lab/pmm-agent/localserver"
+	"github.com/Percona-Lab/pmm-agent/logger"
+)
+
+// printStatus writes human-readable agent status summary.
+func printStatus(w io.Writer, status *localserver.Status) {
+	now := time.Now()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	defer tw.Flush()
+
+	fmt.Fprintf(tw, "Uptime:\t%s\n", roundDuration(now.Sub(status.StartTime)))
+
+	if conn := status.Connection; conn != nil {
+		fmt.Fprintf(tw, "Server:\t%s\n", conn.ServerAddress)
+		if conn.ServerVersion != "" {
+			fmt.Fprintf(tw, "Server version:\t%s\n", conn.ServerVersion)
+		}
+		fmt.Fprintf(tw, "Connection:\t%s for %s (since %s)\n",
+			conn.State, roundDuration(now.Sub(conn.Since)), conn.Since.Local().Format(time.RFC3339))
+		if conn.LastError != "" {
+			fmt.Fprintf(tw, "Last error:\t%s\n", conn.LastError)
+		}
+		fmt.Fprintf(tw, "Open tunnels:\t%d\n", conn.Tunnels)
+	}
+
+	for _, p := range status.Processes {
+		fmt.Fprintf(tw, "Process %s:\t%s for %s", p.Name, p.State, roundDuration(now.Sub(p.Since)))
+		if p.PID != 0 {
+			fmt.Fprintf(tw, ", PID %d", p.PID)
+		}
+		if p.ListenPort != 0 {
+			fmt.Fprintf(tw, ", port %d", p.ListenPort)
+		}
+		fmt.Fprintf(tw, ", %d restarts\n", p.Restarts)
+		if p.LastError != "" {
+			fmt.Fprintf(tw, "\tlast error: %s\n", p.LastError)
+		}
+	}
+}
+
+// printLogLevels writes log levels of all components.
+func printLogLevels(w io.Writer, levels *logger.Levels) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	defer tw.Flush()
+
+	fmt.Fprintf(tw, "default\t%s\n", levels.Default)
+	for _, c := range logger.Components() {
+		level, ok := levels.Components[c]
+		if !ok {
+			level = levels.Default + " (default)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", c, level)
+	}
+}
+
+// roundDuration rounds duration to seconds for display.
+func roundDuration(d time.Duration) time.Duration {
+	return d - d%time.Second
+}
@@ -0,0 +1,471 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package config implements pmm-agent YAML configuration file.
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/units"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/localserver"
+	"github.com/Percona-Lab/pmm-agent/logger"
+)
+
+// DefaultPath is a default configuration file path.
+const DefaultPath = "/usr/local/percona/pmm-agent.yaml"
+
+// Bytes is a size in bytes. In YAML, it can be an integer or a string with units, like "64MiB".
+type Bytes int64
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (b *Bytes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var i int64
+	if err := unmarshal(&i); err == nil {
+		*b = Bytes(i)
+		return nil
+	}
+
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := units.ParseBase2Bytes(s)
+	if err != nil {
+		return err
+	}
+	*b = Bytes(v)
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (b Bytes) MarshalYAML() (interface{}, error) {
+	return units.Base2Bytes(b).String(), nil
+}
+
+// Server represents PMM server connection configuration.
+type Server struct {
+	// WebSocket URL, for example: ws://127.0.0.1:8080/.
+	Address string `yaml:"address"`
+
+	// Maximum size of RPC request or response.
+	MaxMessageSize Bytes `yaml:"max_message_size"`
+}
+
+// TLS represents TLS configuration for PMM server connection.
+type TLS struct {
+	// PEM-encoded CA certificates file used to verify PMM server certificate instead of system ones.
+	CAFile string `yaml:"ca_file,omitempty"`
+}
+
+// Config returns TLS configuration for client package, or nil if defaults should be used.
+func (t *TLS) Config() (*tls.Config, error) {
+	if t.CAFile == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(t.CAFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.Errorf("no PEM-encoded certificates found in %s", t.CAFile)
+	}
+	return &tls.Config{
+		RootCAs: pool,
+	}, nil
+}
+
+// Log represents logging configuration.
+type Log struct {
+	// Default level name: debug, info, warning, error, fatal, panic.
+	Level string `yaml:"level"`
+
+	// Format: text or json.
+	Format string `yaml:"format"`
+
+	// Per-component levels overriding the default one; components are connection, rpc, tunnel, supervisor.
+	Components map[string]string `yaml:"components,omitempty"`
+
+	Buffer LogBuffer `yaml:"buffer"`
+}
+
+// LogBuffer represents in-memory buffer of the last log entries retrievable by PMM server.
+type LogBuffer struct {
+	// Maximum number of entries, 0 to disable buffer.
+	Entries int `yaml:"entries"`
+
+	// Maximum total size of entries.
+	Size Bytes `yaml:"size"`
+}
+
+// Levels returns log levels for logger package.
+func (l *Log) Levels() *logger.Levels {
+	return &logger.Levels{
+		Default:    l.Level,
+		Components: l.Components,
+	}
+}
+
+// Tunnels represents tunnels configuration.
+type Tunnels struct {
+	// Maximum number of open tunnels, 0 for unlimited.
+	Max int `yaml:"max"`
+}
+
+// Paths represents executable paths of processes started by PMM server.
+type Paths struct {
+	NodeExporter     string `yaml:"node_exporter"`
+	MySQLdExporter   string `yaml:"mysqld_exporter"`
+	MongoDBExporter  string `yaml:"mongodb_exporter"`
+	PostgresExporter string `yaml:"postgres_exporter"`
+
+	// Parent directory for private text files of processes, like credentials.
+	// Agent creates a directory with a random name and 0700 permissions there on start,
+	// and removes it on exit.
+	TempDir string `yaml:"tempdir"`
+}
+
+// Ports represents listen ports allocation for processes started by PMM server.
+type Ports struct {
+	// Ports range.
+	Min uint16 `yaml:"min"`
+	Max uint16 `yaml:"max"`
+
+	// File where assigned ports are stored between restarts.
+	StateFile string `yaml:"state_file"`
+}
+
+// Node represents built-in node metrics collector configuration.
+type Node struct {
+	// Expose node metrics on agent metrics endpoint; disable when node_exporter is used.
+	Enabled bool `yaml:"enabled"`
+
+	// procfs, sysfs and root filesystem mount points; can be changed to use host paths from container.
+	ProcPath   string `yaml:"proc_path"`
+	SysPath    string `yaml:"sys_path"`
+	RootFSPath string `yaml:"rootfs_path"`
+}
+
+// Spool represents on-disk queues of data waiting to be sent to PMM server, like pushed metrics.
+type Spool struct {
+	// Directory for queues; each queue uses own subdirectory.
+	Dir string `yaml:"dir"`
+
+	// Maximum size of a single queue; the oldest data is dropped when it is reached.
+	MaxSize Bytes `yaml:"max_size"`
+
+	// Size of queue segment file; the oldest data is dropped by whole segments.
+	SegmentSize Bytes `yaml:"segment_size"`
+}
+
+// QAN represents query analytics configuration.
+type QAN struct {
+	// Directory for collectors state, like slow log offsets.
+	StateDir string `yaml:"state_dir"`
+
+	// Default query examples redaction policy for sources without own policy set by PMM server.
+	Redaction Redaction `yaml:"redaction"`
+}
+
+// Redaction represents query examples redaction policy.
+type Redaction struct {
+	// Mode: none, fingerprint (examples are not sent), mask (literals are replaced with "?"),
+	// or regex (matches of rules are replaced).
+	Mode string `yaml:"mode"`
+
+	// Rules for regex mode, applied in order.
+	Rules []RedactionRule `yaml:"rules,omitempty"`
+}
+
+// RedactionRule represents a regular expression in Go syntax and its replacement, which can refer to groups like $1.
+type RedactionRule struct {
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+}
+
+// Policy returns redaction policy for qan package.
+func (r *Redaction) Policy() *api.RedactionPolicy {
+	res := &api.RedactionPolicy{
+		Mode: r.Mode,
+	}
+	for _, rule := range r.Rules {
+		res.Rules = append(res.Rules, api.RedactionRule{
+			Pattern:     rule.Pattern,
+			Replacement: rule.Replacement,
+		})
+	}
+	return res
+}
+
+// Process represents a process managed by agent supervisor.
+type Process struct {
+	// Unique name, for example: node_exporter.
+	Name string `yaml:"name"`
+
+	// Executable path.
+	Path string `yaml:"path"`
+
+	// Arguments without executable path.
+	Args []string `yaml:"args,omitempty"`
+
+	// Environment variables in KEY=value form; agent environment is not inherited.
+	Env []string `yaml:"env,omitempty"`
+}
+
+// Config represents pmm-agent configuration.
+type Config struct {
+	// Node name added to pushed metrics as node_name label; hostname by default.
+	NodeName string `yaml:"node_name"`
+
+	Server Server `yaml:"server"`
+	TLS    TLS    `yaml:"tls"`
+	Log    Log    `yaml:"log"`
+
+	// Local HTTP server address: loopback host:port or unix:/path.
+	ListenAddress string `yaml:"listen_address"`
+
+	Tunnels Tunnels `yaml:"tunnels"`
+
+	Paths Paths `yaml:"paths"`
+	Ports Ports `yaml:"ports"`
+	Node  Node  `yaml:"node"`
+	Spool Spool `yaml:"spool"`
+	QAN   QAN   `yaml:"qan"`
+
+	// Processes started by agent itself, in addition to processes started by PMM server.
+	Processes []Process `yaml:"processes,omitempty"`
+}
+
+// Default returns configuration with default values.
+func Default() *Config {
+	nodeName, _ := os.Hostname()
+	return &Config{
+		NodeName: nodeName,
+		Server: Server{
+			Address:        "ws://127.0.0.1:8080/",
+			MaxMessageSize: 64 * Bytes(units.MiB),
+		},
+		Log: Log{
+			Level:  "info",
+			Format: logger.FormatText,
+			Buffer: LogBuffer{
+				Entries: 10000,
+				Size:    Bytes(units.MiB),
+			},
+		},
+		ListenAddress: "127.0.0.1:7777",
+		Tunnels: Tunnels{
+			Max: 100,
+		},
+		Paths: Paths{
+			NodeExporter:     "/usr/local/percona/exporters/node_exporter",
+			MySQLdExporter:   "/usr/local/percona/exporters/mysqld_exporter",
+			MongoDBExporter:  "/usr/local/percona/exporters/mongodb_exporter",
+			PostgresExporter: "/usr/local/percona/exporters/postgres_exporter",
+			TempDir:          os.TempDir(),
+		},
+		Ports: Ports{
+			Min:       42000,
+			Max:       51999,
+			StateFile: "/usr/local/percona/pmm-agent-ports.json",
+		},
+		Node: Node{
+			ProcPath:   "/proc",
+			SysPath:    "/sys",
+			RootFSPath: "/",
+		},
+		Spool: Spool{
+			Dir:         "/usr/local/percona/pmm-agent-spool",
+			MaxSize:     256 * Bytes(units.MiB),
+			SegmentSize: 8 * Bytes(units.MiB),
+		},
+		QAN: QAN{
+			StateDir: "/usr/local/percona/pmm-agent-qan",
+			Redaction: Redaction{
+				Mode: api.RedactionNone,
+			},
+		},
+	}
+}
+
+// Load reads configuration from a given file on top of default values.
+// If file does not exist and mustExist is false, default configuration is returned.
+// It does not validate configuration.
+func Load(path string, mustExist bool) (*Config, error) {
+	cfg := Default()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !mustExist {
+			return cfg, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	if err = yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	return cfg, nil
+}
+
+// Validate returns error describing all found problems, or nil.
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.NodeName == "" {
+		add("node_name: should not be empty")
+	}
+
+	if u, err := url.Parse(c.Server.Address); err != nil {
+		add("server.address: %s", err)
+	} else if u.Scheme != "ws" && u.Scheme != "wss" {
+		add("server.address: expected ws:// or wss:// URL, got %q", c.Server.Address)
+	}
+	if c.Server.MaxMessageSize <= 0 {
+		add("server.max_message_size: should be positive, got %d", c.Server.MaxMessageSize)
+	}
+
+	if _, err := c.TLS.Config(); err != nil {
+		add("tls.ca_file: %s", err)
+	}
+
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		add("log.level: %s", err)
+	}
+	if c.Log.Format != logger.FormatText && c.Log.Format != logger.FormatJSON {
+		add("log.format: expected %s or %s, got %q", logger.FormatText, logger.FormatJSON, c.Log.Format)
+	}
+	components := make([]string, 0, len(c.Log.Components))
+	for component := range c.Log.Components {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	for _, component := range components {
+		if err := logger.CheckComponent(component); err != nil {
+			add("log.components: %s", err)
+			continue
+		}
+		if _, err := logrus.ParseLevel(c.Log.Components[component]); err != nil {
+			add("log.components.%s: %s", component, err)
+		}
+	}
+
+	if c.Log.Buffer.Entries < 0 {
+		add("log.buffer.entries: should be 0 (disabled) or positive, got %d", c.Log.Buffer.Entries)
+	}
+	if c.Log.Buffer.Size < 0 {
+		add("log.buffer.size: should not be negative, got %d", c.Log.Buffer.Size)
+	}
+
+	if err := localserver.CheckAddress(c.ListenAddress); err != nil {
+		add("listen_address: %s", err)
+	}
+
+	if c.Tunnels.Max < 0 {
+		add("tunnels.max: should be 0 (unlimited) or positive, got %d", c.Tunnels.Max)
+	}
+
+	if !filepath.IsAbs(c.Paths.TempDir) {
+		add("paths.tempdir: should be absolute path, got %q", c.Paths.TempDir)
+	}
+
+	if c.Ports.Min == 0 || c.Ports.Min > c.Ports.Max {
+		add("ports: invalid range [%d, %d]", c.Ports.Min, c.Ports.Max)
+	}
+
+	if !filepath.IsAbs(c.Spool.Dir) {
+		add("spool.dir: should be absolute path, got %q", c.Spool.Dir)
+	}
+	if c.Spool.SegmentSize <= 0 {
+		add("spool.segment_size: should be positive, got %d", c.Spool.SegmentSize)
+	}
+	if c.Spool.MaxSize < 2*c.Spool.SegmentSize {
+		add("spool.max_size: should be at least two segments, got %d", c.Spool.MaxSize)
+	}
+
+	if !filepath.IsAbs(c.QAN.StateDir) {
+		add("qan.state_dir: should be absolute path, got %q", c.QAN.StateDir)
+	}
+	switch c.QAN.Redaction.Mode {
+	case api.RedactionNone, api.RedactionFingerprint, api.RedactionMask:
+	case api.RedactionRegex:
+		if len(c.QAN.Redaction.Rules) == 0 {
+			add("qan.redaction.rules: should not be empty for %s mode", api.RedactionRegex)
+		}
+	default:
+		add("qan.redaction.mode: expected %s, %s, %s or %s, got %q",
+			api.RedactionNone, api.RedactionFingerprint, api.RedactionMask, api.RedactionRegex, c.QAN.Redaction.Mode)
+	}
+	for i, rule := range c.QAN.Redaction.Rules {
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			add("qan.redaction.rules[%d].pattern: %s", i, err)
+		}
+	}
+
+	if c.Node.Enabled {
+		for _, p := range []struct{ name, path string }{
+			{"proc_path", c.Node.ProcPath},
+			{"sys_path", c.Node.SysPath},
+			{"rootfs_path", c.Node.RootFSPath},
+		} {
+			if fi, err := os.Stat(p.path); err != nil {
+				add("node.%s: %s", p.name, err)
+			} else if !fi.IsDir() {
+				add("node.%s: %s is not a directory", p.name, p.path)
+			}
+		}
+	}
+
+	names := make(map[string]bool, len(c.Processes))
+	for i, p := range c.Processes {
+		if p.Name == "" {
+			add("processes[%d].name: should not be empty", i)
+		} else if names[p.Name] {
+			add("processes[%d].name: duplicate name %q", i, p.Name)
+		}
+		names[p.Name] = true
+		if p.Path == "" {
+			add("processes[%d].path: should not be empty", i)
+		}
+		for _, e := range p.Env {
+			if !strings.Contains(e, "=") {
+				add("processes[%d].env: expected KEY=value, got %q", i, e)
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "\n"))
+}
@@ -0,0 +1,189 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmm-agent-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("Missing", func(t *testing.T) {
+		path := filepath.Join(dir, "missing.yaml")
+		cfg, err := Load(path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cfg, Default()) {
+			t.Errorf("Expected default configuration, got %+v.", cfg)
+		}
+
+		if _, err = Load(path, true); !os.IsNotExist(errors.Cause(err)) {
+			t.Errorf("Expected not exist error, got %v.", err)
+		}
+	})
+
+	t.Run("Values", func(t *testing.T) {
+		path := filepath.Join(dir, "values.yaml")
+		b := []byte(strings.Join([]string{
+			"server:",
+			"  address: wss://pmm.example.com/agent",
+			"  max_message_size: 1MiB",
+			"log:",
+			"  level: debug",
+			"  components:",
+			"    rpc: warning",
+			"spool:",
+			"  max_size: 67108864",
+			"",
+		}, "\n"))
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := Load(path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// set values override defaults, others are kept
+		expected := Default()
+		expected.Server.Address = "wss://pmm.example.com/agent"
+		expected.Server.MaxMessageSize = 1024 * 1024
+		expected.Log.Level = "debug"
+		expected.Log.Components = map[string]string{"rpc": "warning"}
+		expected.Spool.MaxSize = 64 * 1024 * 1024
+		if !reflect.DeepEqual(cfg, expected) {
+			t.Errorf("Expected:\n%+v\ngot:\n%+v", expected, cfg)
+		}
+		if err = cfg.Validate(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	for name, content := range map[string]string{
+		"UnknownField": "server:\n  addres: ws://127.0.0.1/\n",
+		"InvalidSize":  "server:\n  max_message_size: 1 megabyte\n",
+		"InvalidYAML":  "server: [\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name+".yaml")
+			if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := Load(path, true)
+			if err == nil || !strings.HasPrefix(err.Error(), "failed to parse "+path) {
+				t.Errorf("Expected parse error, got %v.", err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("Default configuration is invalid: %s.", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		modify   func(*Config)
+		expected string
+	}{
+		{"NodeName", func(c *Config) { c.NodeName = "" }, "node_name: should not be empty"},
+		{"ServerAddress", func(c *Config) { c.Server.Address = "http://127.0.0.1/" }, `server.address: expected ws:// or wss:// URL, got "http://127.0.0.1/"`},
+		{"ServerAddressParse", func(c *Config) { c.Server.Address = "ws://[::1" }, "server.address: parse "},
+		{"MaxMessageSize", func(c *Config) { c.Server.MaxMessageSize = 0 }, "server.max_message_size: should be positive, got 0"},
+		{"CAFile", func(c *Config) { c.TLS.CAFile = "/nonexistent/ca.pem" }, "tls.ca_file: open /nonexistent/ca.pem: no such file or directory"},
+		{"LogLevel", func(c *Config) { c.Log.Level = "verbose" }, `log.level: not a valid logrus Level: "verbose"`},
+		{"LogFormat", func(c *Config) { c.Log.Format = "xml" }, `log.format: expected text or json, got "xml"`},
+		{"LogComponent", func(c *Config) { c.Log.Components = map[string]string{"foo": "debug"} }, `log.components: unexpected component "foo"`},
+		{"LogComponentLevel", func(c *Config) { c.Log.Components = map[string]string{"rpc": "verbose"} }, `log.components.rpc: not a valid logrus Level: "verbose"`},
+		{"LogBufferEntries", func(c *Config) { c.Log.Buffer.Entries = -1 }, "log.buffer.entries: should be 0 (disabled) or positive, got -1"},
+		{"LogBufferSize", func(c *Config) { c.Log.Buffer.Size = -1 }, "log.buffer.size: should not be negative, got -1"},
+		{"ListenAddress", func(c *Config) { c.ListenAddress = "0.0.0.0:7777" }, `listen_address: "0.0.0.0:7777": expected loopback address`},
+		{"TunnelsMax", func(c *Config) { c.Tunnels.Max = -1 }, "tunnels.max: should be 0 (unlimited) or positive, got -1"},
+		{"TempDir", func(c *Config) { c.Paths.TempDir = "tmp" }, `paths.tempdir: should be absolute path, got "tmp"`},
+		{"PortsZero", func(c *Config) { c.Ports.Min = 0 }, "ports: invalid range [0, 51999]"},
+		{"PortsRange", func(c *Config) { c.Ports.Min, c.Ports.Max = 2, 1 }, "ports: invalid range [2, 1]"},
+		{"SpoolDir", func(c *Config) { c.Spool.Dir = "spool" }, `spool.dir: should be absolute path, got "spool"`},
+		{"SpoolSegmentSize", func(c *Config) { c.Spool.SegmentSize = 0 }, "spool.segment_size: should be positive, got 0"},
+		{"SpoolMaxSize", func(c *Config) { c.Spool.MaxSize = c.Spool.SegmentSize }, "spool.max_size: should be at least two segments, got 8388608"},
+		{"QANStateDir", func(c *Config) { c.QAN.StateDir = "qan" }, `qan.state_dir: should be absolute path, got "qan"`},
+		{"RedactionMode", func(c *Config) { c.QAN.Redaction.Mode = "hide" }, `qan.redaction.mode: expected none, fingerprint, mask or regex, got "hide"`},
+		{"RedactionRules", func(c *Config) { c.QAN.Redaction.Mode = api.RedactionRegex }, "qan.redaction.rules: should not be empty for regex mode"},
+		{"RedactionPattern", func(c *Config) {
+			c.QAN.Redaction.Rules = []RedactionRule{{Pattern: "a"}, {Pattern: "("}}
+		}, "qan.redaction.rules[1].pattern: error parsing regexp: missing closing ): `(`"},
+		{"NodeProcPath", func(c *Config) {
+			c.Node.Enabled = true
+			c.Node.ProcPath = "/nonexistent"
+		}, "node.proc_path: stat /nonexistent: no such file or directory"},
+		{"NodeSysPath", func(c *Config) {
+			c.Node.Enabled = true
+			c.Node.ProcPath, c.Node.SysPath, c.Node.RootFSPath = "/", "/", "/dev/null"
+		}, "node.rootfs_path: /dev/null is not a directory"},
+		{"ProcessName", func(c *Config) { c.Processes = []Process{{Path: "/bin/true"}} }, "processes[0].name: should not be empty"},
+		{"ProcessDuplicate", func(c *Config) {
+			c.Processes = []Process{{Name: "a", Path: "/bin/true"}, {Name: "a", Path: "/bin/true"}}
+		}, `processes[1].name: duplicate name "a"`},
+		{"ProcessPath", func(c *Config) { c.Processes = []Process{{Name: "a"}} }, "processes[0].path: should not be empty"},
+		{"ProcessEnv", func(c *Config) {
+			c.Processes = []Process{{Name: "a", Path: "/bin/true", Env: []string{"A=1", "B"}}}
+		}, `processes[0].env: expected KEY=value, got "B"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Default()
+			tc.modify(cfg)
+			err := cfg.Validate()
+			if err == nil {
+				t.Fatal("Expected error.")
+			}
+			if problems := strings.Split(err.Error(), "\n"); len(problems) != 1 || !strings.HasPrefix(problems[0], tc.expected) {
+				t.Errorf("Expected single problem %q, got:\n%s", tc.expected, err)
+			}
+		})
+	}
+
+	t.Run("All", func(t *testing.T) {
+		cfg := Default()
+		cfg.NodeName = ""
+		cfg.Tunnels.Max = -1
+		cfg.Processes = []Process{{}}
+		expected := strings.Join([]string{
+			"node_name: should not be empty",
+			"tunnels.max: should be 0 (unlimited) or positive, got -1",
+			"processes[0].name: should not be empty",
+			"processes[0].path: should not be empty",
+		}, "\n")
+		if err := cfg.Validate(); err == nil || err.Error() != expected {
+			t.Errorf("Expected:\n%s\ngot:\n%v", expected, err)
+		}
+	})
+}
@@ -0,0 +1,180 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package fingerprint normalizes SQL queries for grouping, like pt-fingerprint does.
+//
+// Comments are removed, literals and placeholders are replaced with "?", IN lists and multi-row VALUES
+// are collapsed, LIMIT clauses with different values are made the same, whitespace is normalized,
+// and keywords and unquoted identifiers are lowercased. Tables referenced by queries can also be extracted.
+package fingerprint
+
+import (
+	"crypto/md5"
+	"fmt"
+	"strings"
+)
+
+// Dialect is SQL dialect which determines comments, quoting and placeholders syntax.
+type Dialect int
+
+// Supported dialects.
+const (
+	MySQL Dialect = iota
+	PostgreSQL
+)
+
+func (d Dialect) String() string {
+	switch d {
+	case MySQL:
+		return "MySQL"
+	case PostgreSQL:
+		return "PostgreSQL"
+	default:
+		return fmt.Sprintf("Dialect(%d)", int(d))
+	}
+}
+
+// Fingerprint returns normalized query text.
+func Fingerprint(query string, d Dialect) string {
+	tokens := tokenize(query, d, false)
+	tokens = collapseLists(tokens)
+	tokens = collapseLimit(tokens)
+	return format(tokens)
+}
+
+// Mask returns query text with all literals replaced with "?", and the number of replaced literals,
+// including placeholders. Like in Fingerprint, comments are removed, whitespace is normalized,
+// and unquoted words are lowercased, but lists are not collapsed.
+func Mask(query string, d Dialect) (string, int) {
+	tokens := tokenize(query, d, false)
+	var literals int
+	for _, t := range tokens {
+		if t.literal() {
+			literals++
+		}
+	}
+	return format(tokens), literals
+}
+
+// Placeholders returns the number of placeholders in query: "?" for MySQL, and "$1"-style for PostgreSQL.
+func Placeholders(query string, d Dialect) int {
+	var res int
+	for _, t := range tokenize(query, d, false) {
+		if t.kind == tokPlaceholder {
+			res++
+		}
+	}
+	return res
+}
+
+// QueryID returns a stable hash of fingerprint: the last 8 bytes of MD5 as upper-case hex,
+// the same as pt-query-digest checksum.
+func QueryID(fingerprint string) string {
+	sum := md5.Sum([]byte(fingerprint))
+	return fmt.Sprintf("%X", sum[8:])
+}
+
+// collapseLists replaces IN lists of literals with "(?+)", and several VALUES rows of literals with a single "(?+)".
+func collapseLists(tokens []token) []token {
+	res := make([]token, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		prev := last(res)
+		if t.is(tokPunct, "(") && (prev.is(tokWord, "in") || prev.is(tokWord, "values") || prev.is(tokWord, "value")) {
+			if end := literalList(tokens, i); end > 0 {
+				res = append(res, token{tokPunct, "("}, token{tokLiteral, "?+"}, token{tokPunct, ")"})
+				i = end
+
+				// skip the next rows of VALUES
+				for !prev.is(tokWord, "in") && i+2 < len(tokens) && tokens[i+1].is(tokPunct, ",") && tokens[i+2].is(tokPunct, "(") {
+					end = literalList(tokens, i+2)
+					if end < 0 {
+						break
+					}
+					i = end
+				}
+				continue
+			}
+		}
+		res = append(res, t)
+	}
+	return res
+}
+
+// literalList returns index of closing parenthesis if tokens[start] is an opening parenthesis
+// of a non-empty list of literals (including NULL), or -1.
+func literalList(tokens []token, start int) int {
+	for i := start + 1; i+1 < len(tokens); i += 2 {
+		if !tokens[i].literal() && !tokens[i].is(tokWord, "null") {
+			return -1
+		}
+		switch {
+		case tokens[i+1].is(tokPunct, ")"):
+			return i + 1
+		case !tokens[i+1].is(tokPunct, ","):
+			return -1
+		}
+	}
+	return -1
+}
+
+// collapseLimit replaces MySQL "LIMIT offset, count" with "LIMIT ?".
+func collapseLimit(tokens []token) []token {
+	res := make([]token, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		res = append(res, tokens[i])
+		if tokens[i].is(tokWord, "limit") && i+3 < len(tokens) &&
+			tokens[i+1].literal() && tokens[i+2].is(tokPunct, ",") && tokens[i+3].literal() {
+			res = append(res, token{tokLiteral, "?"})
+			i += 3
+		}
+	}
+	return res
+}
+
+// format joins tokens with normalized whitespace.
+func format(tokens []token) string {
+	var buf strings.Builder
+	for i, t := range tokens {
+		if i > 0 && needSpace(tokens[i-1], t) {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(t.text)
+	}
+	return buf.String()
+}
+
+// needSpace returns true if space should separate two adjacent tokens.
+func needSpace(prev, t token) bool {
+	switch {
+	case prev.is(tokPunct, "("), prev.is(tokPunct, "."), prev.is(tokPunct, "["), prev.is(tokOperator, "::"):
+		return false
+	case t.is(tokPunct, ")"), t.is(tokPunct, ","), t.is(tokPunct, "."), t.is(tokPunct, "]"), t.is(tokPunct, ";"),
+		t.is(tokOperator, "::"), t.is(tokOperator, ":"):
+		return false
+	case t.is(tokPunct, "("), t.is(tokPunct, "["):
+		return !(prev.kind == tokWord && !keywords[prev.text]) && prev.kind != tokQuoted
+	}
+	return true
+}
+
+// last returns the last token, or empty token.
+func last(tokens []token) token {
+	if len(tokens) == 0 {
+		return token{}
+	}
+	return tokens[len(tokens)-1]
+}
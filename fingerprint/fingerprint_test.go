@@ -0,0 +1,107 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fingerprint
+
+import (
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		d        Dialect
+		query    string
+		expected string
+	}{
+		// whitespace, case and literals
+		{"Simple", MySQL, "SELECT * FROM t WHERE id = 42", "select * from t where id = ?"},
+		{"Whitespace", MySQL, "SELECT  *\n\tFROM   t\r\nWHERE id=42  ", "select * from t where id = ?"},
+		{"StringLiterals", MySQL, `SELECT 'it''s', "dq", 'esc\'aped' FROM t`, "select ?, ?, ? from t"},
+		{"Numbers", MySQL, "SELECT 1, -2, 3.5, 1e10, 0x1F, b'101', X'AF' FROM t", "select ?, ?, ?, ?, ?, ?, ? from t"},
+		{"NumbersInNames", MySQL, "SELECT c1 FROM t2 WHERE t2.c3 = 4", "select c1 from t2 where t2.c3 = ?"},
+		{"NullTrueFalse", MySQL, "SELECT * FROM t WHERE a IS NULL AND b = TRUE", "select * from t where a is null and b = true"},
+
+		// comments
+		{"LineComments", MySQL, "SELECT 1 -- comment\nFROM t # another", "select ? from t"},
+		{"BlockComment", MySQL, "SELECT /* hint */ * FROM /* x */ t", "select * from t"},
+		{"LeadingComment", MySQL, "/* app:checkout */ SELECT 1", "select ?"},
+		{"PostgreSQLComments", PostgreSQL, "SELECT 1 -- c\nFROM t /* block */", "select ? from t"},
+		{"PostgreSQLHashIsOperator", PostgreSQL, "SELECT a # b FROM t", "select a # b from t"},
+
+		// quoted identifiers
+		{"MySQLBackticks", MySQL, "SELECT `Col` FROM `My Table`", "select col from `My Table`"},
+		{"MySQLDoubleQuotesAreStrings", MySQL, `SELECT * FROM t WHERE name = "Bob"`, "select * from t where name = ?"},
+		{"PostgreSQLDoubleQuotes", PostgreSQL, `SELECT "Col" FROM "My Table" WHERE name = 'Bob'`, `select "Col" from "My Table" where name = ?`},
+		{"PostgreSQLDollarQuoted", PostgreSQL, "SELECT $$it's$$, $tag$x$tag$ FROM t", "select ?, ? from t"},
+		{"PostgreSQLEscapeString", PostgreSQL, `SELECT E'a\'b' FROM t`, "select ? from t"},
+
+		// IN lists
+		{"InList", MySQL, "SELECT * FROM t WHERE id IN (1, 2, 3)", "select * from t where id in (?+)"},
+		{"InListSingle", MySQL, "SELECT * FROM t WHERE id IN (1)", "select * from t where id in (?+)"},
+		{"InListWithNull", MySQL, "SELECT * FROM t WHERE id IN (1, NULL, 'x')", "select * from t where id in (?+)"},
+		{"InListDifferentLength", PostgreSQL, "SELECT * FROM t WHERE id IN (7, 8)", "select * from t where id in (?+)"},
+		{"InSubquery", MySQL, "SELECT * FROM t WHERE id IN (SELECT id FROM u)", "select * from t where id in (select id from u)"},
+		{"NotIn", MySQL, "SELECT * FROM t WHERE id NOT IN (1,2)", "select * from t where id not in (?+)"},
+
+		// VALUES rows
+		{"ValuesSingleRow", MySQL, "INSERT INTO t (a, b) VALUES (1, 'x')", "insert into t(a, b) values (?+)"},
+		{"ValuesManyRows", MySQL, "INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y'), (3, NULL)", "insert into t(a, b) values (?+)"},
+		{"ValuesNotLiterals", MySQL, "INSERT INTO t VALUES (1, NOW()), (2, NOW())", "insert into t values (?, now()), (?, now())"},
+		{"ValueKeyword", MySQL, "INSERT INTO t VALUE (1)", "insert into t value (?+)"},
+		{"ValuesPostgreSQL", PostgreSQL, "INSERT INTO t VALUES ($1, $2), ($3, $4) RETURNING id", "insert into t values (?+) returning id"},
+
+		// placeholders
+		{"MySQLPlaceholders", MySQL, "SELECT * FROM t WHERE a = ? AND b = ?", "select * from t where a = ? and b = ?"},
+		{"PostgreSQLPlaceholders", PostgreSQL, "SELECT * FROM t WHERE a = $1 AND b = $2", "select * from t where a = ? and b = ?"},
+		{"PostgreSQLPlaceholdersInList", PostgreSQL, "SELECT * FROM t WHERE id IN ($1, $2, $3)", "select * from t where id in (?+)"},
+		{"PostgreSQLCast", PostgreSQL, "SELECT $1::int, '2018-01-01'::date", "select ?::int, ?::date"},
+
+		// LIMIT
+		{"Limit", MySQL, "SELECT * FROM t LIMIT 10", "select * from t limit ?"},
+		{"LimitOffset", MySQL, "SELECT * FROM t LIMIT 10, 20", "select * from t limit ?"},
+		{"LimitOffsetKeyword", PostgreSQL, "SELECT * FROM t LIMIT 10 OFFSET 20", "select * from t limit ? offset ?"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := Fingerprint(tc.query, tc.d)
+			if actual != tc.expected {
+				t.Errorf("%s:\n query:    %q\n expected: %q\n actual:   %q", tc.d, tc.query, tc.expected, actual)
+			}
+
+			// fingerprint is stable
+			if again := Fingerprint(actual, tc.d); again != actual {
+				t.Errorf("%s: fingerprint of fingerprint changed:\n first:  %q\n second: %q", tc.d, actual, again)
+			}
+		})
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	for _, tc := range []struct {
+		d        Dialect
+		query    string
+		expected int
+	}{
+		{MySQL, "SELECT * FROM t WHERE a = ? AND b IN (?, ?) AND c = '?'", 3},
+		{MySQL, "SELECT * FROM t WHERE a = 1", 0},
+		{PostgreSQL, "SELECT * FROM t WHERE a = $1 AND b = $12 AND c = '$3' AND d = $$ $4 $$", 2},
+		{PostgreSQL, "SELECT * FROM t WHERE j ? 'key'", 0},
+	} {
+		if actual := Placeholders(tc.query, tc.d); actual != tc.expected {
+			t.Errorf("%s: %q: expected %d placeholders, got %d", tc.d, tc.query, tc.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fingerprint
+
+import (
+	"flag"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+var (
+	randomSeed       = flag.Int64("random.seed", 0, "seed for randomized queries; 0 to use the current time")
+	randomIterations = flag.Int("random.iterations", 20000, "number of randomized queries")
+)
+
+// randomCorpus contains queries which are mutated by TestRandomQueries.
+var randomCorpus = []string{
+	"SELECT * FROM t WHERE id = 42",
+	"SELECT /* hint */ 'it''s', \"dq\", `My Table` FROM t -- comment\n# another",
+	"SELECT * FROM t WHERE id IN (1, NULL, 'x') LIMIT 10, 20",
+	"INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y'), (3, NULL)",
+	"SELECT $1::int, E'esc\\'aped', $$dollar$$, $tag$x$tag$ FROM \"Quoted\"\"Name\" WHERE j ?| $2",
+	"SELECT 1e10, 0x1F, b'101', X'AF', -2.5 FROM t2 WHERE t2.c3 = ?",
+	"UPDATE t SET a = 'unterminated",
+	"/* unterminated",
+
+	// table references, for Tables
+	"WITH RECURSIVE c (x) AS (SELECT * FROM t1), d AS NOT MATERIALIZED (SELECT 1 FROM DUAL) SELECT * FROM c, d JOIN db.t2 AS a USING (id)",
+	"SELECT EXTRACT(YEAR FROM ts), TRIM(LEADING 'x' FROM s) FROM (SELECT * FROM t) x WHERE id IN (SELECT id FROM u) FOR UPDATE",
+	"INSERT LOW_PRIORITY IGNORE INTO `my``db`.`t` (a) SELECT a FROM t2 ON DUPLICATE KEY UPDATE a = VALUES(a)",
+	"UPDATE ONLY \"My\"\"Schema\".T SET a = 1 FROM db.public.u, LATERAL generate_series(1, 2) g RETURNING *",
+	"SELECT * INTO OUTFILE '/tmp/x' FROM t1 STRAIGHT_JOIN t2 FORCE INDEX (i) INTO DUMPFILE",
+	"DELETE FROM t WHERE a = (SELECT MAX(a) FROM",
+}
+
+// randomAlphabet contains characters significant for tokenizer.
+const randomAlphabet = " \t\n'\"`$?:;,.()[]-+*/#\\=<>|!@eEx0123456789abcFROMselect"
+
+// mutate returns randomly changed query.
+func mutate(r *rand.Rand, query string) string {
+	b := []byte(query)
+	for n := r.Intn(4) + 1; n > 0; n-- {
+		var pos int
+		if len(b) > 0 {
+			pos = r.Intn(len(b))
+		}
+		switch r.Intn(6) {
+		case 0: // insert significant character
+			c := randomAlphabet[r.Intn(len(randomAlphabet))]
+			b = append(b[:pos], append([]byte{c}, b[pos:]...)...)
+		case 1: // insert arbitrary byte, including invalid UTF-8
+			b = append(b[:pos], append([]byte{byte(r.Intn(256))}, b[pos:]...)...)
+		case 2: // delete range
+			end := pos + r.Intn(8)
+			if end > len(b) {
+				end = len(b)
+			}
+			b = append(b[:pos], b[end:]...)
+		case 3: // truncate, like long queries in performance_schema
+			b = b[:pos]
+		case 4: // duplicate range
+			end := pos + r.Intn(16)
+			if end > len(b) {
+				end = len(b)
+			}
+			dup := append([]byte(nil), b[pos:end]...)
+			b = append(b[:end], append(dup, b[end:]...)...)
+		case 5: // splice with another query
+			other := randomCorpus[r.Intn(len(randomCorpus))]
+			b = append(b[:pos], other[r.Intn(len(other)):]...)
+		}
+	}
+	return string(b)
+}
+
+// checkQuery checks that all functions of the package handle query without panics, and return stable results.
+func checkQuery(t *testing.T, query string) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("panic for %q: %v", query, r)
+		}
+	}()
+
+	for _, d := range []Dialect{MySQL, PostgreSQL} {
+		fp := Fingerprint(query, d)
+		if again := Fingerprint(query, d); again != fp {
+			t.Fatalf("%s: unstable fingerprint of %q: %q != %q", d, query, fp, again)
+		}
+		if id := QueryID(fp); len(id) != 16 {
+			t.Fatalf("%s: unexpected query ID %q", d, id)
+		}
+
+		masked, _ := Mask(query, d)
+		if again, _ := Mask(query, d); again != masked {
+			t.Fatalf("%s: unstable masked query of %q: %q != %q", d, query, masked, again)
+		}
+
+		Placeholders(query, d)
+
+		seen := make(map[Table]bool)
+		for _, table := range Tables(query, d) {
+			if table.Name == "" || seen[table] {
+				t.Fatalf("%s: unexpected tables of %q: %v", d, query, Tables(query, d))
+			}
+			seen[table] = true
+		}
+	}
+}
+
+// TestRandomQueries checks randomly mutated queries. Failures can be reproduced with -random.seed flag.
+func TestRandomQueries(t *testing.T) {
+	seed := *randomSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	iterations := *randomIterations
+	if testing.Short() {
+		iterations /= 10
+	}
+	t.Logf("Using -random.seed=%d.", seed)
+
+	for _, query := range randomCorpus {
+		checkQuery(t, query)
+	}
+	r := rand.New(rand.NewSource(seed))
+	for i := 0; i < iterations; i++ {
+		query := randomCorpus[r.Intn(len(randomCorpus))]
+		for n := r.Intn(3) + 1; n > 0; n-- {
+			query = mutate(r, query)
+		}
+		checkQuery(t, query)
+	}
+}
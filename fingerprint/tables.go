@@ -0,0 +1,278 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fingerprint
+
+import (
+	"strings"
+)
+
+// Table is a table referenced by query.
+type Table struct {
+	Schema string // database for MySQL, schema for PostgreSQL; empty if not specified in query
+	Name   string
+}
+
+func (t Table) String() string {
+	if t.Schema == "" {
+		return t.Name
+	}
+	return t.Schema + "." + t.Name
+}
+
+// words after table name which are not aliases.
+var notAliases = map[string]bool{
+	"cross": true, "except": true, "fetch": true, "for": true, "force": true, "full": true, "group": true,
+	"having": true, "ignore": true, "inner": true, "intersect": true, "into": true, "join": true, "left": true,
+	"limit": true, "lock": true, "natural": true, "offset": true, "on": true, "order": true, "outer": true,
+	"partition": true, "returning": true, "right": true, "select": true, "set": true, "straight_join": true,
+	"tablesample": true, "union": true, "use": true, "using": true, "value": true, "values": true,
+	"where": true, "window": true, "with": true,
+}
+
+// Tables returns tables referenced by query in order of appearance, without duplicates.
+//
+// Quoted names are unquoted. Unquoted PostgreSQL names are lowercased like PostgreSQL does,
+// MySQL names are kept as is. CTEs, derived tables, table functions and MySQL DUAL are skipped.
+// Parsing is best-effort: query may be invalid, truncated, or contain unsupported syntax.
+func Tables(query string, d Dialect) []Table {
+	tokens := tokenize(query, d, true)
+	ctes := cteNames(tokens, d)
+
+	var res []Table
+	seen := make(map[Table]bool)
+	add := func(t Table) {
+		if t.Schema == "" && ctes[t.Name] {
+			return
+		}
+		if d == MySQL && t.Schema == "" && strings.EqualFold(t.Name, "dual") {
+			return
+		}
+		if !seen[t] {
+			seen[t] = true
+			res = append(res, t)
+		}
+	}
+
+	// for each open parenthesis, true if it is a function call, like EXTRACT(YEAR FROM ts)
+	var funcs []bool
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		switch {
+		case t.is(tokPunct, "("):
+			funcs = append(funcs, funcCall(tokens, i))
+			continue
+		case t.is(tokPunct, ")"):
+			if len(funcs) > 0 {
+				funcs = funcs[:len(funcs)-1]
+			}
+			continue
+		case t.kind != tokWord, len(funcs) > 0 && funcs[len(funcs)-1]:
+			continue
+		}
+
+		switch strings.ToLower(t.text) {
+		case "from", "join", "straight_join":
+			i = tableList(tokens, i+1, d, add) - 1
+
+		case "update":
+			// skip ON DUPLICATE KEY UPDATE, FOR UPDATE, DO UPDATE
+			if i == 0 || tokens[i-1].is(tokPunct, "(") || tokens[i-1].is(tokPunct, ")") {
+				i = tableList(tokens, skipWords(tokens, i+1, "low_priority", "ignore"), d, add) - 1
+			}
+
+		case "insert", "replace":
+			if i == 0 {
+				j := skipWords(tokens, i+1, "low_priority", "delayed", "high_priority", "ignore", "into")
+				if table, next := tableName(tokens, j, d, false); next > j {
+					add(table)
+					i = next - 1
+				}
+			}
+
+		case "into":
+			// skip SELECT ... INTO OUTFILE and INTO DUMPFILE
+			if word(tokens, i+1, "outfile") || word(tokens, i+1, "dumpfile") {
+				continue
+			}
+			if table, next := tableName(tokens, i+1, d, false); next > i+1 {
+				add(table)
+				i = next - 1
+			}
+		}
+	}
+	return res
+}
+
+// tableList parses comma-separated list of tables with optional aliases starting at i, calls add for each table,
+// and returns index of the first token after the list.
+func tableList(tokens []token, i int, d Dialect, add func(Table)) int {
+	for {
+		i = skipWords(tokens, i, "only", "lateral")
+		table, next := tableName(tokens, i, d, true)
+		if next == i {
+			return i
+		}
+		add(table)
+		i = next
+
+		// alias
+		switch {
+		case word(tokens, i, "as"):
+			i += 2
+		case i < len(tokens) && tokens[i].kind == tokQuoted,
+			i < len(tokens) && tokens[i].kind == tokWord && !notAliases[strings.ToLower(tokens[i].text)]:
+			i++
+		}
+
+		if i >= len(tokens) || !tokens[i].is(tokPunct, ",") {
+			return i
+		}
+		i++
+	}
+}
+
+// tableName parses possibly qualified table name starting at i, and returns it with index of the next token.
+// If there is no table name, returned index is i. Name followed by parenthesis is not a table name
+// (but a table function) if function is true.
+func tableName(tokens []token, i int, d Dialect, function bool) (Table, int) {
+	var parts []string
+	j := i
+	for {
+		if j >= len(tokens) || (tokens[j].kind != tokWord && tokens[j].kind != tokQuoted) {
+			return Table{}, i
+		}
+		name := identifier(tokens[j], d)
+		if name == "" || strings.HasPrefix(name, "@") && tokens[j].kind == tokWord {
+			return Table{}, i
+		}
+		parts = append(parts, name)
+		j++
+
+		if j+1 < len(tokens) && tokens[j].is(tokPunct, ".") {
+			j++
+			continue
+		}
+		break
+	}
+	if function && j < len(tokens) && tokens[j].is(tokPunct, "(") {
+		return Table{}, i
+	}
+
+	// PostgreSQL names may also include database
+	t := Table{Name: parts[len(parts)-1]}
+	if len(parts) > 1 {
+		t.Schema = parts[len(parts)-2]
+	}
+	return t, j
+}
+
+// cteNames returns names of common table expressions defined in query.
+func cteNames(tokens []token, d Dialect) map[string]bool {
+	res := make(map[string]bool)
+	for i := range tokens {
+		if !word(tokens, i, "with") {
+			continue
+		}
+
+		j := skipWords(tokens, i+1, "recursive")
+		for j < len(tokens) && (tokens[j].kind == tokWord || tokens[j].kind == tokQuoted) {
+			name := identifier(tokens[j], d)
+			j = skipParens(tokens, j+1) // column names
+			if !word(tokens, j, "as") {
+				break
+			}
+			res[name] = true
+			j = skipWords(tokens, j+1, "not", "materialized")
+			j = skipParens(tokens, j)
+			if j >= len(tokens) || !tokens[j].is(tokPunct, ",") {
+				break
+			}
+			j++
+		}
+	}
+	return res
+}
+
+// funcCall returns true if opening parenthesis at i starts function arguments.
+func funcCall(tokens []token, i int) bool {
+	if word(tokens, i+1, "select") || word(tokens, i+1, "with") || word(tokens, i+1, "values") {
+		return false
+	}
+	if i == 0 || tokens[i-1].kind != tokWord {
+		return false
+	}
+	prev := strings.ToLower(tokens[i-1].text)
+	return !keywords[prev] && !notAliases[prev]
+}
+
+// identifier returns unquoted identifier.
+func identifier(t token, d Dialect) string {
+	if t.kind == tokQuoted {
+		q := t.text[:1]
+		if len(t.text) < 2 || !strings.HasSuffix(t.text, q) {
+			return ""
+		}
+		return strings.Replace(t.text[1:len(t.text)-1], q+q, q, -1)
+	}
+	if d == PostgreSQL {
+		return strings.ToLower(t.text)
+	}
+	return t.text
+}
+
+// word returns true if token at i is a given unquoted word, in any case.
+func word(tokens []token, i int, w string) bool {
+	return i < len(tokens) && tokens[i].kind == tokWord && strings.EqualFold(tokens[i].text, w)
+}
+
+// skipWords returns index of the first token starting from i which is not one of given words.
+func skipWords(tokens []token, i int, words ...string) int {
+	for i < len(tokens) {
+		var found bool
+		for _, w := range words {
+			if word(tokens, i, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+		i++
+	}
+	return i
+}
+
+// skipParens returns index after balanced parentheses group starting at i, or i if there is no group.
+func skipParens(tokens []token, i int) int {
+	if i >= len(tokens) || !tokens[i].is(tokPunct, "(") {
+		return i
+	}
+	var depth int
+	for ; i < len(tokens); i++ {
+		switch {
+		case tokens[i].is(tokPunct, "("):
+			depth++
+		case tokens[i].is(tokPunct, ")"):
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return i
+}
@@ -0,0 +1,112 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fingerprint
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTables(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		d        Dialect
+		query    string
+		expected string // comma-separated tables
+	}{
+		// lists, joins and aliases
+		{"Simple", MySQL, "SELECT * FROM t WHERE id = 42", "t"},
+		{"Qualified", MySQL, "SELECT * FROM db1.t1 AS a JOIN t2 b ON a.id = b.id", "db1.t1, t2"},
+		{"CommaList", MySQL, "SELECT * FROM t1 a, t2, db.t3 AS c WHERE a.id = c.id", "t1, t2, db.t3"},
+		{"Joins", MySQL, "SELECT * FROM t1 LEFT OUTER JOIN t2 USING (id) STRAIGHT_JOIN t3 NATURAL JOIN t4", "t1, t2, t3, t4"},
+		{"IndexHints", MySQL, "SELECT * FROM t1 FORCE INDEX (i1) JOIN t2 USE INDEX (i2) ON t1.a = t2.a", "t1, t2"},
+		{"Duplicates", MySQL, "SELECT * FROM t JOIN t AS t2 ON t.id = t2.parent_id JOIN db.t", "t, db.t"},
+		{"MySQLCaseKept", MySQL, "SELECT * FROM MyTable JOIN mytable", "MyTable, mytable"},
+		{"Subquery", MySQL, "SELECT * FROM t1 WHERE id IN (SELECT id FROM t2 WHERE EXISTS (SELECT 1 FROM t3))", "t1, t2, t3"},
+		{"DerivedTable", MySQL, "SELECT * FROM (SELECT * FROM t1) AS x JOIN t2 ON x.id = t2.id", "t1, t2"},
+		{"Union", MySQL, "SELECT a FROM t1 UNION ALL SELECT a FROM t2", "t1, t2"},
+
+		// CTEs and DUAL
+		{"CTE", MySQL, "WITH c AS (SELECT * FROM t1), d (x) AS (SELECT x FROM t2) SELECT * FROM c JOIN d JOIN t3", "t1, t2, t3"},
+		{"RecursiveCTE", PostgreSQL, "WITH RECURSIVE r AS (SELECT 1 AS n UNION ALL SELECT n + 1 FROM r WHERE n < 10) SELECT * FROM r", ""},
+		{"MaterializedCTE", PostgreSQL, "WITH c AS NOT MATERIALIZED (SELECT * FROM t1) SELECT * FROM c, t2", "t1, t2"},
+		{"QualifiedCTEName", MySQL, "WITH c AS (SELECT 1) SELECT * FROM db.c", "db.c"},
+		{"Dual", MySQL, "SELECT 1 FROM DUAL", ""},
+		{"DualLowercase", MySQL, "SELECT NOW() FROM dual WHERE 1 = 1", ""},
+		{"PostgreSQLDual", PostgreSQL, "SELECT 1 FROM dual", "dual"},
+
+		// functions with FROM
+		{"Extract", MySQL, "SELECT EXTRACT(YEAR FROM created) FROM t WHERE EXTRACT(MONTH FROM created) = 1", "t"},
+		{"Trim", PostgreSQL, "SELECT TRIM(LEADING 'x' FROM name), SUBSTRING(s FROM 2 FOR 3) FROM t", "t"},
+		{"NestedFunctions", MySQL, "SELECT COALESCE(EXTRACT(DAY FROM (SELECT MAX(ts) FROM t1)), 0) FROM t2", "t1, t2"},
+
+		// INSERT, REPLACE, UPDATE, DELETE
+		{"Insert", MySQL, "INSERT LOW_PRIORITY IGNORE INTO db.t1 (a, b) VALUES (1, 2)", "db.t1"},
+		{"InsertWithoutInto", MySQL, "INSERT t1 SET a = 1", "t1"},
+		{"InsertSelect", MySQL, "INSERT INTO t1 (a) SELECT a FROM t2 JOIN t3 USING (id)", "t1, t2, t3"},
+		{"OnDuplicateKeyUpdate", MySQL, "INSERT INTO t1 (a) VALUES (1) ON DUPLICATE KEY UPDATE a = VALUES(a) + 1", "t1"},
+		{"Replace", MySQL, "REPLACE INTO t1 SELECT * FROM t2", "t1, t2"},
+		{"Update", MySQL, "UPDATE LOW_PRIORITY t1 JOIN t2 ON t1.id = t2.id SET t1.a = t2.a", "t1, t2"},
+		{"UpdateFrom", PostgreSQL, "UPDATE t1 SET a = t2.a FROM t2 WHERE t1.id = t2.id RETURNING t1.id", "t1, t2"},
+		{"OnConflictDoUpdate", PostgreSQL, "INSERT INTO t (a) VALUES ($1) ON CONFLICT (a) DO UPDATE SET a = EXCLUDED.a", "t"},
+		{"ForUpdate", MySQL, "SELECT * FROM t WHERE id = 1 FOR UPDATE", "t"},
+		{"Delete", MySQL, "DELETE FROM t1 WHERE id IN (SELECT id FROM t2)", "t1, t2"},
+		{"DeleteUsing", PostgreSQL, "DELETE FROM t1 USING t2 WHERE t1.id = t2.id", "t1"},
+
+		// SELECT ... INTO
+		{"IntoOutfile", MySQL, "SELECT * INTO OUTFILE '/tmp/t.csv' FROM t", "t"},
+		{"IntoDumpfile", MySQL, "SELECT a FROM t LIMIT 1 INTO DUMPFILE '/tmp/a'", "t"},
+		{"IntoVariable", MySQL, "SELECT a INTO @a FROM t", "t"},
+		{"PostgreSQLSelectInto", PostgreSQL, "SELECT * INTO new_t FROM t", "new_t, t"},
+
+		// quoted names
+		{"Backticks", MySQL, "SELECT * FROM `my db`.`My Table` JOIN `t``1`", "my db.My Table, t`1"},
+		{"MySQLDoubleQuotesAreStrings", MySQL, `SELECT * FROM t WHERE a = "b"`, "t"},
+		{"PostgreSQLDoubleQuotes", PostgreSQL, `SELECT * FROM "My Schema"."My""Table"`, `My Schema.My"Table`},
+		{"QuotedCTE", PostgreSQL, `WITH "C" AS (SELECT 1) SELECT * FROM "C", c`, "c"},
+		{"QuotedAlias", PostgreSQL, `SELECT * FROM t1 "T", t2`, "t1, t2"},
+
+		// PostgreSQL names
+		{"PostgreSQLLowercase", PostgreSQL, `SELECT * FROM Public.MyTable JOIN "MyTable" ON true`, "public.mytable, MyTable"},
+		{"DatabaseSchemaTable", PostgreSQL, "SELECT * FROM db.public.t JOIN db.s.\"T\" ON true", "public.t, s.T"},
+		{"Only", PostgreSQL, "SELECT * FROM ONLY t1, LATERAL (SELECT * FROM t2 WHERE t2.id = t1.id) x", "t1, t2"},
+		{"TableFunction", PostgreSQL, "SELECT * FROM generate_series(1, 10) g JOIN t ON t.id = g", "t"},
+		{"Cast", PostgreSQL, "SELECT CAST(a AS int) FROM t WHERE b = $1::text", "t"},
+
+		// invalid and truncated queries
+		{"Empty", MySQL, "", ""},
+		{"NoTables", MySQL, "SELECT 1 + 1", ""},
+		{"TruncatedAfterFrom", MySQL, "SELECT * FROM", ""},
+		{"TruncatedAfterJoin", MySQL, "SELECT * FROM t1 JOIN", "t1"},
+		{"TruncatedString", MySQL, "SELECT * FROM t1 WHERE a = 'unterminated", "t1"},
+		{"TruncatedQuotedName", PostgreSQL, `SELECT * FROM t1 JOIN "unterminated`, "t1"},
+		{"TruncatedInsert", MySQL, "INSERT INTO", ""},
+		{"TruncatedCTE", MySQL, "WITH c AS (SELECT * FROM t1", "t1"},
+		{"UnbalancedParentheses", MySQL, "SELECT * FROM t1) JOIN t2 WHERE (a = (1", "t1, t2"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var tables []string
+			for _, table := range Tables(tc.query, tc.d) {
+				tables = append(tables, table.String())
+			}
+			actual := strings.Join(tables, ", ")
+			if actual != tc.expected {
+				t.Errorf("%s:\n query:    %q\n expected: %q\n actual:   %q", tc.d, tc.query, tc.expected, actual)
+			}
+		})
+	}
+}
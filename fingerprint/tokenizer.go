@@ -0,0 +1,369 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fingerprint
+
+import (
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokNone        tokenKind = iota
+	tokWord                  // keyword or unquoted identifier, lowercased
+	tokQuoted                // quoted identifier, kept as is
+	tokLiteral               // literal, replaced with "?"
+	tokPlaceholder           // placeholder, like "?" in MySQL and "$1" in PostgreSQL, replaced with "?"
+	tokOperator              // operator, like "=" or "::"
+	tokPunct                 // parenthesis, bracket, comma, semicolon or dot
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func (t token) is(kind tokenKind, text string) bool {
+	return t.kind == kind && t.text == text
+}
+
+// literal returns true for literals and placeholders.
+func (t token) literal() bool {
+	return t.kind == tokLiteral || t.kind == tokPlaceholder
+}
+
+// keywords after which opening parenthesis is separated by space, and sign before number is unary.
+var keywords = map[string]bool{
+	"all": true, "and": true, "any": true, "as": true, "between": true, "by": true, "case": true, "distinct": true,
+	"else": true, "exists": true, "from": true, "having": true, "in": true, "interval": true, "into": true,
+	"is": true, "join": true, "lateral": true, "like": true, "limit": true, "not": true, "offset": true,
+	"on": true, "or": true, "over": true, "return": true, "returning": true, "returns": true, "select": true,
+	"set": true, "some": true, "table": true, "then": true, "union": true, "using": true, "value": true,
+	"values": true, "when": true, "where": true, "with": true,
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// isWordByte returns true for bytes of unquoted identifiers; all non-ASCII bytes are treated as letters.
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || isDigit(c) || c == '_' || c == '$' || c >= 0x80
+}
+
+// tokenize splits query into tokens, skipping whitespace and comments.
+// Unquoted words are lowercased unless keepCase is true.
+func tokenize(q string, d Dialect, keepCase bool) []token {
+	var res []token
+	lower := strings.ToLower
+	if keepCase {
+		lower = func(s string) string { return s }
+	}
+	operatorBytes := "<>=!|&~^:@"
+	if d == PostgreSQL {
+		operatorBytes += "#?"
+	}
+
+	for i := 0; i < len(q); {
+		c := q[i]
+		var next byte
+		if i+1 < len(q) {
+			next = q[i+1]
+		}
+
+		switch {
+		case isSpace(c):
+			i++
+
+		case c == '/' && next == '*':
+			i = skipBlockComment(q, i, d == PostgreSQL)
+
+		case c == '-' && next == '-' && (d == PostgreSQL || i+2 == len(q) || isSpace(q[i+2])),
+			c == '#' && d == MySQL:
+			if j := strings.IndexByte(q[i:], '\n'); j >= 0 {
+				i += j + 1
+			} else {
+				i = len(q)
+			}
+
+		case c == '\'':
+			i = skipString(q, i, d == MySQL)
+			res = append(res, token{tokLiteral, "?"})
+
+		case c == '"' && d == MySQL:
+			i = skipString(q, i, true)
+			res = append(res, token{tokLiteral, "?"})
+
+		case c == '"' || c == '`' && d == MySQL:
+			j := skipString(q, i, false)
+			if c == '`' && j-i >= 2 && q[j-1] == '`' && isPlainIdentifier(q[i+1:j-1]) {
+				// the same as unquoted, as normalized by MySQL in performance_schema digests
+				res = append(res, token{tokWord, lower(q[i+1 : j-1])})
+			} else {
+				res = append(res, token{tokQuoted, q[i:j]})
+			}
+			i = j
+
+		case c == '.' && strings.HasPrefix(q[i:], "..."):
+			// list of values collapsed by MySQL in performance_schema digests
+			i += 3
+			res = append(res, token{tokLiteral, "?"})
+
+		case c == '?' && strings.HasPrefix(q[i:], "?+)"):
+			// collapsed list in fingerprint, so fingerprint of fingerprint is the same
+			i += 2
+			res = append(res, token{tokLiteral, "?+"})
+
+		case c == '?' && d == MySQL:
+			i++
+			res = append(res, token{tokPlaceholder, "?"})
+
+		case c == '$' && d == PostgreSQL && isDigit(next):
+			i++
+			for i < len(q) && isDigit(q[i]) {
+				i++
+			}
+			res = append(res, token{tokPlaceholder, "?"})
+
+		case c == '$' && d == PostgreSQL && dollarTag(q, i) != "":
+			tag := dollarTag(q, i)
+			if j := strings.Index(q[i+len(tag):], tag); j >= 0 {
+				i += len(tag) + j + len(tag)
+			} else {
+				i = len(q)
+			}
+			res = append(res, token{tokLiteral, "?"})
+
+		case isDigit(c) || c == '.' && isDigit(next),
+			(c == '-' || c == '+') && (isDigit(next) || next == '.') && unaryContext(last(res)):
+			j := skipNumber(q, i)
+			if j < len(q) && isWordByte(q[j]) && c != '-' && c != '+' {
+				// MySQL identifier starting with digits
+				for j < len(q) && isWordByte(q[j]) {
+					j++
+				}
+				res = append(res, token{tokWord, lower(q[i:j])})
+			} else {
+				res = append(res, token{tokLiteral, "?"})
+			}
+			i = j
+
+		case c == '@' && d == MySQL && (next == '@' || isWordByte(next) || next == '`' || next == '\'' || next == '"'):
+			// user and system variables
+			j := i + 1
+			if next == '@' {
+				j++
+			}
+			for j < len(q) && (isWordByte(q[j]) || q[j] == '.') {
+				j++
+			}
+			if j < len(q) && j == i+1 && (q[j] == '`' || q[j] == '\'' || q[j] == '"') {
+				j = skipString(q, j, q[j] != '`')
+			}
+			res = append(res, token{tokWord, lower(q[i:j])})
+			i = j
+
+		case isWordByte(c):
+			j := i
+			for j < len(q) && isWordByte(q[j]) {
+				j++
+			}
+			word := lower(q[i:j])
+			if j < len(q) && q[j] == '\'' && stringPrefix(strings.ToLower(word), d) {
+				// prefixed string literal, like X'1F', E'\n' or _utf8mb4'text'
+				i = skipString(q, j, d == MySQL || word == "e")
+				res = append(res, token{tokLiteral, "?"})
+				continue
+			}
+			res = append(res, token{tokWord, word})
+			i = j
+
+		case c == '-' && next == '>':
+			// JSON operators -> and ->>
+			j := i + 2
+			if j < len(q) && q[j] == '>' {
+				j++
+			}
+			res = append(res, token{tokOperator, q[i:j]})
+			i = j
+
+		case c == ':' && next == ':':
+			i += 2
+			res = append(res, token{tokOperator, "::"})
+
+		case strings.IndexByte(operatorBytes, c) >= 0:
+			// type cast is never a part of other operator, like in ?::int
+			j := i + 1
+			for j < len(q) && strings.IndexByte(operatorBytes, q[j]) >= 0 && !strings.HasPrefix(q[j:], "::") {
+				j++
+			}
+			res = append(res, token{tokOperator, q[i:j]})
+			i = j
+
+		case strings.IndexByte("(),;.[]{}", c) >= 0:
+			res = append(res, token{tokPunct, q[i : i+1]})
+			i++
+
+		default:
+			res = append(res, token{tokOperator, q[i : i+1]})
+			i++
+		}
+	}
+
+	// remove trailing semicolons
+	for len(res) > 0 && res[len(res)-1].is(tokPunct, ";") {
+		res = res[:len(res)-1]
+	}
+	return res
+}
+
+// isPlainIdentifier returns true if s is a non-empty identifier which does not need quoting.
+func isPlainIdentifier(s string) bool {
+	if s == "" || isDigit(s[0]) {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isWordByte(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// unaryContext returns true if sign after a given token is unary.
+func unaryContext(prev token) bool {
+	switch prev.kind {
+	case tokNone, tokOperator:
+		return true
+	case tokPunct:
+		return prev.text != ")" && prev.text != "]"
+	case tokWord:
+		return keywords[prev.text]
+	default:
+		return false
+	}
+}
+
+// stringPrefix returns true if word followed by quote is a string literal prefix.
+func stringPrefix(word string, d Dialect) bool {
+	switch d {
+	case MySQL:
+		return word == "x" || word == "b" || word == "n" || strings.HasPrefix(word, "_")
+	case PostgreSQL:
+		return word == "e" || word == "x" || word == "b" || word == "n"
+	default:
+		return false
+	}
+}
+
+// skipBlockComment returns index after block comment starting at i. PostgreSQL comments can be nested.
+func skipBlockComment(q string, i int, nested bool) int {
+	depth := 0
+	for i < len(q) {
+		switch {
+		case q[i] == '/' && i+1 < len(q) && q[i+1] == '*':
+			depth++
+			i += 2
+		case q[i] == '*' && i+1 < len(q) && q[i+1] == '/':
+			depth--
+			i += 2
+			if depth == 0 || !nested {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+	return i
+}
+
+// skipString returns index after quoted string or identifier starting at i. Doubled quotes are handled,
+// and backslash escapes if backslash is true. Unterminated string continues to the end.
+func skipString(q string, i int, backslash bool) int {
+	quote := q[i]
+	for i++; i < len(q); i++ {
+		switch q[i] {
+		case '\\':
+			if backslash {
+				i++
+			}
+		case quote:
+			if i+1 < len(q) && q[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(q)
+}
+
+// skipNumber returns index after numeric literal (with optional sign) starting at i.
+func skipNumber(q string, i int) int {
+	if q[i] == '-' || q[i] == '+' {
+		i++
+	}
+	if i+1 < len(q) && q[i] == '0' && (q[i+1] == 'x' || q[i+1] == 'X') && i+2 < len(q) && isHexDigit(q[i+2]) {
+		i += 2
+		for i < len(q) && isHexDigit(q[i]) {
+			i++
+		}
+		return i
+	}
+
+	for i < len(q) && isDigit(q[i]) {
+		i++
+	}
+	if i < len(q) && q[i] == '.' {
+		i++
+		for i < len(q) && isDigit(q[i]) {
+			i++
+		}
+	}
+	if i+1 < len(q) && (q[i] == 'e' || q[i] == 'E') {
+		j := i + 1
+		if q[j] == '-' || q[j] == '+' {
+			j++
+		}
+		if j < len(q) && isDigit(q[j]) {
+			for i = j; i < len(q) && isDigit(q[i]); i++ {
+			}
+		}
+	}
+	return i
+}
+
+// dollarTag returns PostgreSQL dollar-quoting tag ($$ or $tag$) starting at i, or empty string.
+func dollarTag(q string, i int) string {
+	for j := i + 1; j < len(q); j++ {
+		switch {
+		case q[j] == '$':
+			return q[i : j+1]
+		case !isWordByte(q[j]) || q[j] == '$' || j == i+1 && isDigit(q[j]):
+			return ""
+		}
+	}
+	return ""
+}
@@ -0,0 +1,131 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package localserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/logger"
+)
+
+const clientTimeout = 5 * time.Second
+
+// Client is a client for local server API.
+type Client struct {
+	baseURL string
+	http    *http.Client
+}
+
+// NewClient creates a new client for server listening on a given address.
+func NewClient(addr string) *Client {
+	c := &Client{
+		baseURL: "http://" + addr,
+		http: &http.Client{
+			Timeout: clientTimeout,
+		},
+	}
+
+	if strings.HasPrefix(addr, unixPrefix) {
+		path := strings.TrimPrefix(addr, unixPrefix)
+		c.baseURL = "http://unix"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+	}
+	return c
+}
+
+// Status returns agent status.
+func (c *Client) Status() (*Status, error) {
+	status := new(Status)
+	if err := c.get("/status", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// LogLevels returns agent log levels.
+func (c *Client) LogLevels() (*logger.Levels, error) {
+	levels := new(logger.Levels)
+	if err := c.get("/log/levels", levels); err != nil {
+		return nil, err
+	}
+	return levels, nil
+}
+
+// SetLogLevel changes log level of a given component, or the default level if component is empty.
+// It returns log levels after change.
+func (c *Client) SetLogLevel(component, level string) (*logger.Levels, error) {
+	levels := new(logger.Levels)
+	req := &api.SetLogLevelRequest{
+		Component: component,
+		Level:     level,
+	}
+	if err := c.post("/log/levels", req, levels); err != nil {
+		return nil, err
+	}
+	return levels, nil
+}
+
+// get makes GET request and decodes JSON response into res.
+func (c *Client) get(path string, res interface{}) error {
+	resp, err := c.http.Get(c.baseURL + path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return decodeResponse(resp, res)
+}
+
+// post makes POST request with JSON-encoded req and decodes JSON response into res.
+func (c *Client) post(path string, req, res interface{}) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp, err := c.http.Post(c.baseURL+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return decodeResponse(resp, res)
+}
+
+// decodeResponse closes response body and decodes it into res, or returns error for non-200 response.
+func decodeResponse(resp *http.Response, res interface{}) error {
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return errors.WithStack(json.Unmarshal(b, res))
+}
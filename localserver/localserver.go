@@ -0,0 +1,239 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package localserver implements HTTP server for local clients: Prometheus, operators, etc.
+package localserver
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/audit"
+	"github.com/Percona-Lab/pmm-agent/client"
+	"github.com/Percona-Lab/pmm-agent/logger"
+	"github.com/Percona-Lab/pmm-agent/supervisor"
+)
+
+const shutdownTimeout = 3 * time.Second
+
+// unixPrefix is a listen address prefix for Unix domain sockets, for example: unix:/run/pmm-agent.sock.
+const unixPrefix = "unix:"
+
+// Status represents agent status returned by /status endpoint.
+type Status struct {
+	StartTime  time.Time           `json:"start_time"`
+	Connection *client.Status      `json:"connection"`
+	Processes  []api.ProcessStatus `json:"processes"`
+}
+
+// Params represent local server parameters.
+type Params struct {
+	// Listen address: host:port for TCP, or unix:/path for Unix domain socket.
+	// Only loopback addresses are allowed, see CheckAddress.
+	Address string
+
+	// Source of metrics for /metrics endpoint.
+	Gatherer prometheus.Gatherer
+
+	// Source of connection status for /status endpoint.
+	Client *client.Client
+
+	// Source of processes status for /status endpoint.
+	Supervisor *supervisor.Supervisor
+
+	// Records log level changes.
+	Audit *audit.Log
+}
+
+// Server is a local HTTP server.
+type Server struct {
+	params    *Params
+	startTime time.Time
+	l         *logrus.Entry
+}
+
+// New creates a new server.
+func New(params *Params) *Server {
+	return &Server{
+		params:    params,
+		startTime: time.Now(),
+		l:         logrus.WithField("component", "localserver"),
+	}
+}
+
+// Run runs server until ctx is canceled, or until listener fails.
+func (s *Server) Run(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer, promhttp.HandlerFor(s.params.Gatherer, promhttp.HandlerOpts{
+			ErrorLog:      s.l,
+			ErrorHandling: promhttp.ContinueOnError,
+		}),
+	))
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/log/levels", s.handleLogLevels)
+
+	l, err := listen(s.params.Address)
+	if err != nil {
+		return err
+	}
+	s.l.Infof("Listening on %s.", s.params.Address)
+
+	srv := &http.Server{
+		Handler: mux,
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			s.l.Errorf("Failed to shutdown gracefully: %s.", err)
+		}
+	}()
+
+	err = srv.Serve(l)
+	if err == http.ErrServerClosed {
+		<-done
+		return nil
+	}
+	return errors.WithStack(err)
+}
+
+func (s *Server) handleStatus(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := &Status{
+		StartTime:  s.startTime,
+		Connection: s.params.Client.Status(),
+		Processes:  s.params.Supervisor.Processes(),
+	}
+	s.writeJSON(rw, status)
+}
+
+// handleLogLevels returns log levels for GET, and changes one level for POST with api.SetLogLevelRequest body.
+func (s *Server) handleLogLevels(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		// nothing
+
+	case http.MethodPost:
+		var r api.SetLogLevelRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := logger.SetLevel(r.Component, r.Level)
+		e := &api.AuditEvent{
+			Type:    api.AuditSetLogLevel,
+			Origin:  api.AuditOriginLocalAPI,
+			Details: map[string]string{"component": r.Component, "level": r.Level},
+		}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		s.params.Audit.Record(e)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		component := r.Component
+		if component == "" {
+			component = "default"
+		}
+		s.l.Infof("Local client changed %s log level to %s.", component, r.Level)
+
+	default:
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.writeJSON(rw, logger.GetLevels())
+}
+
+// writeJSON writes indented JSON response.
+func (s *Server) writeJSON(rw http.ResponseWriter, res interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(rw)
+	e.SetIndent("", "  ")
+	if err := e.Encode(res); err != nil {
+		s.l.Errorf("Failed to encode response: %s.", err)
+	}
+}
+
+// listen creates TCP or Unix domain socket listener for a given address.
+func listen(addr string) (net.Listener, error) {
+	if err := CheckAddress(addr); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(addr, unixPrefix) {
+		l, err := net.Listen("tcp", addr)
+		return l, errors.WithStack(err)
+	}
+
+	// remove stale socket left after unclean shutdown
+	path := strings.TrimPrefix(addr, unixPrefix)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, errors.WithStack(err)
+	}
+	return l, nil
+}
+
+// CheckAddress returns error if addr is not a loopback TCP address or a Unix domain socket.
+// API is not authenticated and allows to change agent's settings, so it should not be exposed to the network.
+func CheckAddress(addr string) error {
+	if strings.HasPrefix(addr, unixPrefix) {
+		if strings.TrimPrefix(addr, unixPrefix) == "" {
+			return errors.Errorf("%q: empty socket path", addr)
+		}
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return errors.Errorf("%q: expected loopback address (like 127.0.0.1:7777) or unix:/path", addr)
+	}
+	return nil
+}
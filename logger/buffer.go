@@ -0,0 +1,186 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package logger
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+)
+
+// entryOverhead is an approximate size of log entry without message and fields.
+const entryOverhead = 64
+
+// Buffer is a logrus hook which keeps the last log entries in memory, bounded by both
+// a number of entries and their total size. Entries filtered out by component levels are not kept.
+type Buffer struct {
+	m       sync.Mutex
+	entries []api.LogEntry // ring buffer, len is a maximum number of entries
+	first   int            // index of the oldest entry
+	count   int            // number of stored entries
+	size    int            // total size of stored entries
+	maxSize int
+	dropped uint64 // number of entries dropped from buffer since start
+}
+
+// NewBuffer creates a new buffer. Buffer with maxEntries or maxSize equal to 0 keeps nothing.
+func NewBuffer(maxEntries, maxSize int) *Buffer {
+	return &Buffer{
+		entries: make([]api.LogEntry, maxEntries),
+		maxSize: maxSize,
+	}
+}
+
+// SetLimits changes buffer limits, dropping the oldest entries if needed.
+func (b *Buffer) SetLimits(maxEntries, maxSize int) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	entries := b.snapshot()
+	b.entries = make([]api.LogEntry, maxEntries)
+	b.first, b.count, b.size = 0, 0, 0
+	b.maxSize = maxSize
+	for _, e := range entries {
+		b.add(e)
+	}
+}
+
+// Levels implements logrus.Hook.
+func (b *Buffer) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook.
+func (b *Buffer) Fire(e *logrus.Entry) error {
+	// hooks are fired before formatter, so filter entries there too
+	if !Enabled(e) {
+		return nil
+	}
+
+	entry := api.LogEntry{
+		Time:      e.Time,
+		Level:     e.Level.String(),
+		Component: component(e),
+		Message:   e.Message,
+	}
+	if len(e.Data) > 0 {
+		entry.Fields = make(map[string]string, len(e.Data))
+		for k, v := range e.Data {
+			if k == "component" {
+				continue
+			}
+			if err, ok := v.(error); ok {
+				entry.Fields[k] = err.Error()
+			} else {
+				entry.Fields[k] = fmt.Sprint(v)
+			}
+		}
+	}
+
+	b.m.Lock()
+	b.add(entry)
+	b.m.Unlock()
+	return nil
+}
+
+// add adds entry to the buffer, dropping the oldest ones. Caller should hold b.m.
+func (b *Buffer) add(entry api.LogEntry) {
+	size := entrySize(&entry)
+	if len(b.entries) == 0 || size > b.maxSize {
+		b.dropped++
+		return
+	}
+
+	for b.count == len(b.entries) || b.size+size > b.maxSize {
+		b.size -= entrySize(&b.entries[b.first])
+		b.entries[b.first] = api.LogEntry{}
+		b.first = (b.first + 1) % len(b.entries)
+		b.count--
+		b.dropped++
+	}
+
+	b.entries[(b.first+b.count)%len(b.entries)] = entry
+	b.count++
+	b.size += size
+}
+
+// snapshot returns a copy of stored entries from the oldest to the newest. Caller should hold b.m.
+func (b *Buffer) snapshot() []api.LogEntry {
+	res := make([]api.LogEntry, b.count)
+	for i := range res {
+		res[i] = b.entries[(b.first+i)%len(b.entries)]
+	}
+	return res
+}
+
+// Filter selects entries from buffer.
+type Filter struct {
+	Level     logrus.Level // the least severe level to return
+	Component string       // if not empty, only entries of that component are returned
+	Since     time.Time    // if not zero, only entries logged at or after that time are returned
+	Until     time.Time    // if not zero, only entries logged before that time are returned
+	Limit     int          // if positive, only that number of the newest matching entries are returned
+}
+
+// Get returns entries matching filter, from the oldest to the newest, and a total number of
+// entries dropped from buffer since start.
+func (b *Buffer) Get(filter *Filter) ([]api.LogEntry, uint64) {
+	b.m.Lock()
+	entries := b.snapshot()
+	dropped := b.dropped
+	b.m.Unlock()
+
+	res := make([]api.LogEntry, 0, len(entries))
+	for _, e := range entries {
+		if level, err := logrus.ParseLevel(e.Level); err == nil && level > filter.Level {
+			continue
+		}
+		if filter.Component != "" && e.Component != filter.Component {
+			continue
+		}
+		if !filter.Since.IsZero() && e.Time.Before(filter.Since) {
+			continue
+		}
+		if !filter.Until.IsZero() && !e.Time.Before(filter.Until) {
+			continue
+		}
+		res = append(res, e)
+	}
+
+	if filter.Limit > 0 && len(res) > filter.Limit {
+		res = res[len(res)-filter.Limit:]
+	}
+	return res, dropped
+}
+
+// entrySize returns approximate size of entry in memory and on the wire.
+func entrySize(e *api.LogEntry) int {
+	size := entryOverhead + len(e.Level) + len(e.Component) + len(e.Message)
+	for k, v := range e.Fields {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// check interfaces
+var (
+	_ logrus.Hook = (*Buffer)(nil)
+)
@@ -0,0 +1,204 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package logger
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+)
+
+var bufferStart = time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// fire adds entries with given messages to buffer, one second apart.
+func fire(t *testing.T, b *Buffer, level logrus.Level, component string, messages ...string) {
+	t.Helper()
+	for _, m := range messages {
+		e := &logrus.Entry{
+			Time:    bufferStart,
+			Level:   level,
+			Message: m,
+			Data:    make(logrus.Fields),
+		}
+		if component != "" {
+			e.Data["component"] = component
+		}
+		bufferStart = bufferStart.Add(time.Second)
+		if err := b.Fire(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// getMessages returns messages of all buffered entries, and a number of dropped entries.
+func getMessages(b *Buffer) ([]string, uint64) {
+	entries, dropped := b.Get(&Filter{Level: logrus.DebugLevel})
+	var res []string
+	for _, e := range entries {
+		res = append(res, e.Message)
+	}
+	return res, dropped
+}
+
+func checkMessages(t *testing.T, b *Buffer, expected []string, expectedDropped uint64) {
+	t.Helper()
+	actual, dropped := getMessages(b)
+	if !reflect.DeepEqual(actual, expected) || dropped != expectedDropped {
+		t.Errorf("Expected %q (%d dropped), got %q (%d dropped).", expected, expectedDropped, actual, dropped)
+	}
+}
+
+func TestBufferEntries(t *testing.T) {
+	b := NewBuffer(3, 1024*1024)
+	fire(t, b, logrus.InfoLevel, "", "1", "2")
+	checkMessages(t, b, []string{"1", "2"}, 0)
+
+	// ring buffer wraps around several times
+	fire(t, b, logrus.InfoLevel, "", "3", "4", "5", "6", "7", "8")
+	checkMessages(t, b, []string{"6", "7", "8"}, 5)
+
+	// shrinking drops the oldest entries, growing keeps all
+	b.SetLimits(2, 1024*1024)
+	checkMessages(t, b, []string{"7", "8"}, 6)
+	b.SetLimits(4, 1024*1024)
+	fire(t, b, logrus.InfoLevel, "", "9")
+	checkMessages(t, b, []string{"7", "8", "9"}, 6)
+
+	// disabled buffer keeps nothing
+	b.SetLimits(0, 1024*1024)
+	fire(t, b, logrus.InfoLevel, "", "10")
+	checkMessages(t, b, nil, 10)
+}
+
+func TestBufferSize(t *testing.T) {
+	// each entry is entryOverhead + len("info") + 32 = 100 bytes
+	msg := func(s string) string {
+		return s + strings.Repeat(".", 32-len(s))
+	}
+	b := NewBuffer(100, 250)
+	fire(t, b, logrus.InfoLevel, "", msg("1"), msg("2"))
+	checkMessages(t, b, []string{msg("1"), msg("2")}, 0)
+
+	fire(t, b, logrus.InfoLevel, "", msg("3"))
+	checkMessages(t, b, []string{msg("2"), msg("3")}, 1)
+
+	// larger entry drops several entries
+	fire(t, b, logrus.InfoLevel, "", msg("4")+strings.Repeat(".", 100))
+	checkMessages(t, b, []string{msg("4") + strings.Repeat(".", 100)}, 3)
+
+	// entry larger than the whole buffer is dropped without dropping others
+	fire(t, b, logrus.InfoLevel, "", strings.Repeat(".", 250))
+	checkMessages(t, b, []string{msg("4") + strings.Repeat(".", 100)}, 4)
+
+	// fields and component are counted too
+	b.SetLimits(100, 250)
+	e := &logrus.Entry{
+		Time:    bufferStart,
+		Level:   logrus.InfoLevel,
+		Message: msg("5"),
+		Data:    logrus.Fields{"component": "rpc", "key": strings.Repeat(".", 47)},
+	}
+	if err := b.Fire(e); err != nil {
+		t.Fatal(err)
+	}
+	checkMessages(t, b, []string{msg("5")}, 5)
+
+	// shrinking size drops the oldest entries
+	b.SetLimits(100, 400)
+	fire(t, b, logrus.InfoLevel, "", msg("6"))
+	checkMessages(t, b, []string{msg("5"), msg("6")}, 5)
+	b.SetLimits(100, 200)
+	checkMessages(t, b, []string{msg("6")}, 6)
+}
+
+func TestBufferFire(t *testing.T) {
+	defer resetLogger(t)
+	if err := SetLevels(&Levels{Default: "info", Components: map[string]string{RPC: "warning"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewBuffer(10, 1024*1024)
+	e := &logrus.Entry{
+		Time:    bufferStart,
+		Level:   logrus.WarnLevel,
+		Message: "message",
+		Data: logrus.Fields{
+			"component": "wsrpc",
+			"error":     errors.New("failed"),
+			"n":         42,
+		},
+	}
+	if err := b.Fire(e); err != nil {
+		t.Fatal(err)
+	}
+
+	// filtered out by component level
+	fire(t, b, logrus.InfoLevel, RPC, "rpc info")
+	fire(t, b, logrus.DebugLevel, "", "debug")
+
+	entries, dropped := b.Get(&Filter{Level: logrus.DebugLevel})
+	expected := []api.LogEntry{{
+		Time:      e.Time,
+		Level:     "warning",
+		Component: Connection,
+		Message:   "message",
+		Fields:    map[string]string{"error": "failed", "n": "42"},
+	}}
+	if !reflect.DeepEqual(entries, expected) || dropped != 0 {
+		t.Errorf("Expected %+v, got %+v (%d dropped).", expected, entries, dropped)
+	}
+}
+
+func TestBufferGet(t *testing.T) {
+	b := NewBuffer(10, 1024*1024)
+	start := bufferStart
+	fire(t, b, logrus.InfoLevel, RPC, "rpc 1")
+	fire(t, b, logrus.WarnLevel, Tunnel, "tunnel 1")
+	fire(t, b, logrus.ErrorLevel, RPC, "rpc 2")
+	fire(t, b, logrus.InfoLevel, "", "default")
+	fire(t, b, logrus.WarnLevel, RPC, "rpc 3")
+
+	for _, tc := range []struct {
+		name     string
+		filter   Filter
+		expected []string
+	}{
+		{"All", Filter{Level: logrus.DebugLevel}, []string{"rpc 1", "tunnel 1", "rpc 2", "default", "rpc 3"}},
+		{"Level", Filter{Level: logrus.WarnLevel}, []string{"tunnel 1", "rpc 2", "rpc 3"}},
+		{"Component", Filter{Level: logrus.DebugLevel, Component: RPC}, []string{"rpc 1", "rpc 2", "rpc 3"}},
+		{"Since", Filter{Level: logrus.DebugLevel, Since: start.Add(3 * time.Second)}, []string{"default", "rpc 3"}},
+		{"Until", Filter{Level: logrus.DebugLevel, Until: start.Add(time.Second)}, []string{"rpc 1"}},
+		{"Limit", Filter{Level: logrus.WarnLevel, Limit: 2}, []string{"rpc 2", "rpc 3"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entries, _ := b.Get(&tc.filter)
+			var actual []string
+			for _, e := range entries {
+				actual = append(actual, e.Message)
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("Expected %q, got %q.", tc.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package logger configures global logrus logger with per-component log levels.
+//
+// Component is a value of "component" field of log entry. Entries without that field,
+// or with a component without own level, use the default level. Levels can be changed at runtime.
+package logger
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Components with own log levels.
+const (
+	Connection = "connection"
+	RPC        = "rpc"
+	Tunnel     = "tunnel"
+	Supervisor = "supervisor"
+)
+
+// Components returns all known components.
+func Components() []string {
+	return []string{Connection, RPC, Tunnel, Supervisor}
+}
+
+// aliases maps component field values used by vendored packages to our components.
+var aliases = map[string]string{
+	"wsrpc": Connection,
+}
+
+// Log formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Levels represent the default log level and per-component levels.
+type Levels struct {
+	Default    string            `json:"default"`
+	Components map[string]string `json:"components,omitempty"`
+}
+
+// filter is a logrus formatter which drops entries below their component level.
+// It is a formatter, not a hook, because hooks can't prevent entries from being written.
+type filter struct {
+	rw         sync.RWMutex
+	formatter  logrus.Formatter
+	def        logrus.Level
+	components map[string]logrus.Level
+}
+
+var f = &filter{
+	formatter:  new(logrus.TextFormatter),
+	def:        logrus.InfoLevel,
+	components: make(map[string]logrus.Level),
+}
+
+// Format implements logrus.Formatter.
+func (f *filter) Format(e *logrus.Entry) ([]byte, error) {
+	if !Enabled(e) {
+		return nil, nil
+	}
+
+	f.rw.RLock()
+	formatter := f.formatter
+	f.rw.RUnlock()
+	return formatter.Format(e)
+}
+
+// Enabled returns true if entry level is enabled for its component.
+func Enabled(e *logrus.Entry) bool {
+	return e.Level <= f.level(component(e))
+}
+
+// component returns entry component, with aliases resolved.
+func component(e *logrus.Entry) string {
+	c, _ := e.Data["component"].(string)
+	if a := aliases[c]; a != "" {
+		return a
+	}
+	return c
+}
+
+// level returns level for a given component.
+func (f *filter) level(component string) logrus.Level {
+	f.rw.RLock()
+	defer f.rw.RUnlock()
+
+	if l, ok := f.components[component]; ok {
+		return l
+	}
+	return f.def
+}
+
+// updateLoggerLevel sets global logger level to the most verbose one, so entries are not created
+// without a need. Caller should hold f.rw.
+func (f *filter) updateLoggerLevel() {
+	max := f.def
+	for _, l := range f.components {
+		if l > max {
+			max = l
+		}
+	}
+	logrus.SetLevel(max)
+}
+
+// Setup configures global logger with a given format and levels.
+func Setup(format string, levels *Levels) error {
+	var formatter logrus.Formatter
+	switch format {
+	case FormatText, "":
+		formatter = new(logrus.TextFormatter)
+	case FormatJSON:
+		formatter = new(logrus.JSONFormatter)
+	default:
+		return errors.Errorf("unexpected log format %q", format)
+	}
+
+	if err := SetLevels(levels); err != nil {
+		return err
+	}
+
+	f.rw.Lock()
+	f.formatter = formatter
+	f.rw.Unlock()
+	logrus.SetFormatter(f)
+	return nil
+}
+
+// SetLevels replaces the default level and all per-component levels.
+func SetLevels(levels *Levels) error {
+	def, err := logrus.ParseLevel(levels.Default)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	components := make(map[string]logrus.Level, len(levels.Components))
+	for c, l := range levels.Components {
+		if err = CheckComponent(c); err != nil {
+			return err
+		}
+		if components[c], err = logrus.ParseLevel(l); err != nil {
+			return errors.Wrapf(err, "component %s", c)
+		}
+	}
+
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	f.def = def
+	f.components = components
+	f.updateLoggerLevel()
+	return nil
+}
+
+// SetLevel changes level for a given component, or the default level if component is empty.
+func SetLevel(component, level string) error {
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if component != "" {
+		if err = CheckComponent(component); err != nil {
+			return err
+		}
+	}
+
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	if component == "" {
+		f.def = l
+	} else {
+		f.components[component] = l
+	}
+	f.updateLoggerLevel()
+	return nil
+}
+
+// GetLevels returns current levels.
+func GetLevels() *Levels {
+	f.rw.RLock()
+	defer f.rw.RUnlock()
+
+	res := &Levels{
+		Default:    f.def.String(),
+		Components: make(map[string]string, len(f.components)),
+	}
+	for c, l := range f.components {
+		res.Components[c] = l.String()
+	}
+	return res
+}
+
+// CheckComponent returns error if component is unknown.
+func CheckComponent(component string) error {
+	components := Components()
+	sort.Strings(components)
+	if i := sort.SearchStrings(components, component); i < len(components) && components[i] == component {
+		return nil
+	}
+	return errors.Errorf("unexpected component %q, expected one of: %v", component, components)
+}
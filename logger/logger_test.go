@@ -0,0 +1,149 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// resetLogger restores default logger configuration.
+func resetLogger(t *testing.T) {
+	t.Helper()
+	if err := Setup(FormatText, &Levels{Default: "info"}); err != nil {
+		t.Fatal(err)
+	}
+	logrus.SetOutput(os.Stderr)
+}
+
+func TestLevels(t *testing.T) {
+	defer resetLogger(t)
+
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	err := Setup(FormatJSON, &Levels{
+		Default:    "warning",
+		Components: map[string]string{RPC: "debug", Tunnel: "error"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// global level is the most verbose one, so debug entries of rpc are created
+	if l := logrus.GetLevel(); l != logrus.DebugLevel {
+		t.Errorf("Expected debug global level, got %s.", l)
+	}
+
+	logAll := func() {
+		logrus.Info("default info")
+		logrus.Warn("default warning")
+		logrus.WithField("component", "rpc").Debug("rpc debug")
+		logrus.WithField("component", "tunnel").Warn("tunnel warning")
+		logrus.WithField("component", "tunnel").Error("tunnel error")
+		logrus.WithField("component", "wsrpc").Info("wsrpc info")
+		logrus.WithField("component", "other").Info("other info")
+		logrus.WithField("component", "other").Warn("other warning")
+	}
+	messages := func() []string {
+		var res []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var m map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &m); err != nil {
+				t.Fatalf("%s: %s", line, err)
+			}
+			res = append(res, m["msg"].(string))
+		}
+		buf.Reset()
+		return res
+	}
+
+	logAll()
+	expected := []string{"default warning", "rpc debug", "tunnel error", "other warning"}
+	if actual := messages(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %q, got %q.", expected, actual)
+	}
+
+	// wsrpc entries use connection level
+	if err = SetLevel(Connection, "info"); err != nil {
+		t.Fatal(err)
+	}
+	if err = SetLevel("", "error"); err != nil {
+		t.Fatal(err)
+	}
+	logAll()
+	expected = []string{"rpc debug", "tunnel error", "wsrpc info"}
+	if actual := messages(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %q, got %q.", expected, actual)
+	}
+
+	expectedLevels := &Levels{
+		Default:    "error",
+		Components: map[string]string{Connection: "info", RPC: "debug", Tunnel: "error"},
+	}
+	if actual := GetLevels(); !reflect.DeepEqual(actual, expectedLevels) {
+		t.Errorf("Expected %+v, got %+v.", expectedLevels, actual)
+	}
+
+	// SetLevels replaces all component levels
+	if err = SetLevels(&Levels{Default: "info"}); err != nil {
+		t.Fatal(err)
+	}
+	if actual := GetLevels(); actual.Default != "info" || len(actual.Components) != 0 {
+		t.Errorf("Unexpected levels %+v.", actual)
+	}
+	if l := logrus.GetLevel(); l != logrus.InfoLevel {
+		t.Errorf("Expected info global level, got %s.", l)
+	}
+}
+
+func TestLevelsErrors(t *testing.T) {
+	defer resetLogger(t)
+
+	for _, tc := range []struct {
+		name string
+		f    func() error
+		err  string
+	}{
+		{"Format", func() error { return Setup("xml", &Levels{Default: "info"}) }, `unexpected log format "xml"`},
+		{"Default", func() error { return SetLevels(&Levels{Default: "verbose"}) }, `not a valid logrus Level: "verbose"`},
+		{"Component", func() error {
+			return SetLevels(&Levels{Default: "info", Components: map[string]string{"foo": "debug"}})
+		}, `unexpected component "foo", expected one of: [connection rpc supervisor tunnel]`},
+		{"ComponentLevel", func() error {
+			return SetLevels(&Levels{Default: "info", Components: map[string]string{RPC: "verbose"}})
+		}, `component rpc: not a valid logrus Level: "verbose"`},
+		{"SetLevelComponent", func() error { return SetLevel("wsrpc", "debug") }, `unexpected component "wsrpc", expected one of: [connection rpc supervisor tunnel]`},
+		{"SetLevel", func() error { return SetLevel(RPC, "verbose") }, `not a valid logrus Level: "verbose"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.f(); err == nil || err.Error() != tc.err {
+				t.Errorf("Expected %q, got %v.", tc.err, err)
+			}
+		})
+	}
+
+	// failed calls don't change levels
+	if actual := GetLevels(); actual.Default != "info" || len(actual.Components) != 0 {
+		t.Errorf("Unexpected levels %+v.", actual)
+	}
+}
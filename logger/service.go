@@ -0,0 +1,86 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package logger
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/rpc"
+)
+
+// Service handles logging control requests from PMM server.
+type Service struct {
+	buffer *Buffer
+}
+
+// NewService creates a new service returning log entries from a given buffer.
+func NewService(buffer *Buffer) *Service {
+	return &Service{
+		buffer: buffer,
+	}
+}
+
+// SetLogLevel changes log level of a given component, or the default level.
+func (s *Service) SetLogLevel(ctx context.Context, req *api.SetLogLevelRequest) (*api.SetLogLevelResponse, error) {
+	if err := SetLevel(req.Component, req.Level); err != nil {
+		return nil, err
+	}
+	component := req.Component
+	if component == "" {
+		component = "default"
+	}
+	logrus.Infof("PMM server changed %s log level to %s.", component, req.Level)
+
+	levels := GetLevels()
+	return &api.SetLogLevelResponse{
+		Default:    levels.Default,
+		Components: levels.Components,
+	}, nil
+}
+
+// GetLogs returns the last log entries matching request.
+func (s *Service) GetLogs(ctx context.Context, req *api.GetLogsRequest) (*api.GetLogsResponse, error) {
+	filter := &Filter{
+		Level:     logrus.DebugLevel,
+		Component: req.Component,
+		Since:     req.Since,
+		Until:     req.Until,
+		Limit:     req.Limit,
+	}
+	if req.Level != "" {
+		level, err := logrus.ParseLevel(req.Level)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		filter.Level = level
+	}
+
+	entries, dropped := s.buffer.Get(filter)
+	return &api.GetLogsResponse{
+		Entries: entries,
+		Dropped: dropped,
+	}, nil
+}
+
+// check interfaces
+var (
+	_ rpc.LogServer = (*Service)(nil)
+)
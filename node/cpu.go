@@ -0,0 +1,115 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package node
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/procfs"
+)
+
+// cpuCollector collects CPU and scheduler metrics from /proc/stat.
+type cpuCollector struct {
+	procPath string
+
+	cpu             *prometheus.Desc
+	bootTime        *prometheus.Desc
+	contextSwitches *prometheus.Desc
+	forks           *prometheus.Desc
+	procsRunning    *prometheus.Desc
+	procsBlocked    *prometheus.Desc
+}
+
+func newCPUCollector(params *Params) *cpuCollector {
+	return &cpuCollector{
+		procPath: params.ProcPath,
+		cpu: prometheus.NewDesc(
+			prometheus.BuildFQName(prometheusNamespace, "cpu", "seconds_total"),
+			"Seconds the CPUs spent in each mode.",
+			[]string{"cpu", "mode"}, nil,
+		),
+		bootTime: prometheus.NewDesc(
+			prometheus.BuildFQName(prometheusNamespace, "", "boot_time_seconds"),
+			"Node boot time, in unixtime.",
+			nil, nil,
+		),
+		contextSwitches: prometheus.NewDesc(
+			prometheus.BuildFQName(prometheusNamespace, "", "context_switches_total"),
+			"Total number of context switches.",
+			nil, nil,
+		),
+		forks: prometheus.NewDesc(
+			prometheus.BuildFQName(prometheusNamespace, "", "forks_total"),
+			"Total number of forks.",
+			nil, nil,
+		),
+		procsRunning: prometheus.NewDesc(
+			prometheus.BuildFQName(prometheusNamespace, "", "procs_running"),
+			"Number of processes in runnable state.",
+			nil, nil,
+		),
+		procsBlocked: prometheus.NewDesc(
+			prometheus.BuildFQName(prometheusNamespace, "", "procs_blocked"),
+			"Number of processes blocked waiting for I/O to complete.",
+			nil, nil,
+		),
+	}
+}
+
+func (c *cpuCollector) describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cpu
+	ch <- c.bootTime
+	ch <- c.contextSwitches
+	ch <- c.forks
+	ch <- c.procsRunning
+	ch <- c.procsBlocked
+}
+
+func (c *cpuCollector) update(ch chan<- prometheus.Metric) error {
+	fs, err := procfs.NewFS(c.procPath)
+	if err != nil {
+		return err
+	}
+	stat, err := fs.NewStat()
+	if err != nil {
+		return err
+	}
+
+	for i, s := range stat.CPU {
+		cpu := strconv.Itoa(i)
+		for mode, v := range map[string]float64{
+			"user":    s.User,
+			"nice":    s.Nice,
+			"system":  s.System,
+			"idle":    s.Idle,
+			"iowait":  s.Iowait,
+			"irq":     s.IRQ,
+			"softirq": s.SoftIRQ,
+			"steal":   s.Steal,
+		} {
+			ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.CounterValue, v, cpu, mode)
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.bootTime, prometheus.GaugeValue, float64(stat.BootTime))
+	ch <- prometheus.MustNewConstMetric(c.contextSwitches, prometheus.CounterValue, float64(stat.ContextSwitches))
+	ch <- prometheus.MustNewConstMetric(c.forks, prometheus.CounterValue, float64(stat.ProcessCreated))
+	ch <- prometheus.MustNewConstMetric(c.procsRunning, prometheus.GaugeValue, float64(stat.ProcessesRunning))
+	ch <- prometheus.MustNewConstMetric(c.procsBlocked, prometheus.GaugeValue, float64(stat.ProcessesBlocked))
+	return nil
+}
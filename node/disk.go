@@ -0,0 +1,98 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package node
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sectorSize is a size of sector used by /proc/diskstats regardless of actual device sector size.
+const sectorSize = 512
+
+// ignoredDisks matches virtual devices and partitions, like node_exporter does by default.
+var ignoredDisks = regexp.MustCompile(`^(ram|loop|fd|(h|s|v|xv)d[a-z]|nvme\d+n\d+p)\d+$`)
+
+// diskStat describes one /proc/diskstats column.
+type diskStat struct {
+	column    int // 0-based column index after major, minor and device name
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	factor    float64
+}
+
+// diskCollector collects disk IO metrics from /proc/diskstats.
+type diskCollector struct {
+	procPath string
+	stats    []diskStat
+}
+
+func newDiskCollector(params *Params) *diskCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "disk", name), help, []string{"device"}, nil)
+	}
+	return &diskCollector{
+		procPath: params.ProcPath,
+		stats: []diskStat{
+			{0, desc("reads_completed_total", "The total number of reads completed successfully."), prometheus.CounterValue, 1},
+			{1, desc("reads_merged_total", "The total number of reads merged."), prometheus.CounterValue, 1},
+			{2, desc("read_bytes_total", "The total number of bytes read successfully."), prometheus.CounterValue, sectorSize},
+			{3, desc("read_time_seconds_total", "The total number of seconds spent by all reads."), prometheus.CounterValue, 0.001},
+			{4, desc("writes_completed_total", "The total number of writes completed successfully."), prometheus.CounterValue, 1},
+			{5, desc("writes_merged_total", "The number of writes merged."), prometheus.CounterValue, 1},
+			{6, desc("written_bytes_total", "The total number of bytes written successfully."), prometheus.CounterValue, sectorSize},
+			{7, desc("write_time_seconds_total", "This is the total number of seconds spent by all writes."), prometheus.CounterValue, 0.001},
+			{8, desc("io_now", "The number of I/Os currently in progress."), prometheus.GaugeValue, 1},
+			{9, desc("io_time_seconds_total", "Total seconds spent doing I/Os."), prometheus.CounterValue, 0.001},
+			{10, desc("io_time_weighted_seconds_total", "The weighted number of seconds spent doing I/Os."), prometheus.CounterValue, 0.001},
+		},
+	}
+}
+
+func (c *diskCollector) describe(ch chan<- *prometheus.Desc) {
+	for _, s := range c.stats {
+		ch <- s.desc
+	}
+}
+
+func (c *diskCollector) update(ch chan<- prometheus.Metric) error {
+	return readLines(c.procPath+"/diskstats", func(line string) error {
+		//    8       0 sda 1234 0 5678 ...
+		fields := strings.Fields(line)
+		if len(fields) < 3+len(c.stats) {
+			return errors.Errorf("unexpected line %q", line)
+		}
+		device := fields[2]
+		if ignoredDisks.MatchString(device) {
+			return nil
+		}
+
+		values := fields[3:]
+		for _, s := range c.stats {
+			v, err := strconv.ParseFloat(values[s.column], 64)
+			if err != nil {
+				return errors.Wrapf(err, "failed to parse line %q", line)
+			}
+			ch <- prometheus.MustNewConstMetric(s.desc, s.valueType, v*s.factor, device)
+		}
+		return nil
+	})
+}
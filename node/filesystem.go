@@ -0,0 +1,183 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package node
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// statfsTimeout is a maximum duration of statfs call for a single mount point.
+// Mount points exceeding it (hung NFS or FUSE) are skipped until that call returns.
+const statfsTimeout = 5 * time.Second
+
+// ignoredFSTypes are pseudo and virtual filesystems.
+var ignoredFSTypes = map[string]bool{
+	"autofs": true, "binfmt_misc": true, "bpf": true, "cgroup": true, "cgroup2": true, "configfs": true,
+	"debugfs": true, "devpts": true, "devtmpfs": true, "fusectl": true, "hugetlbfs": true, "mqueue": true,
+	"nsfs": true, "overlay": true, "proc": true, "procfs": true, "pstore": true, "rpc_pipefs": true,
+	"securityfs": true, "squashfs": true, "sysfs": true, "tracefs": true,
+}
+
+// filesystemCollector collects filesystem usage metrics for mount points from /proc/mounts.
+type filesystemCollector struct {
+	l          *logrus.Entry
+	procPath   string
+	rootFSPath string
+	statfs     func(path string, buf *syscall.Statfs_t) error
+	timeout    time.Duration
+
+	stuckM sync.Mutex
+	stuck  map[string]bool // mount points with statfs call in progress after timeout
+
+	size      *prometheus.Desc
+	free      *prometheus.Desc
+	avail     *prometheus.Desc
+	files     *prometheus.Desc
+	filesFree *prometheus.Desc
+	readonly  *prometheus.Desc
+}
+
+func newFilesystemCollector(params *Params) *filesystemCollector {
+	labels := []string{"device", "mountpoint", "fstype"}
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "filesystem", name), help, labels, nil)
+	}
+	return &filesystemCollector{
+		l:          logrus.WithField("component", "node"),
+		procPath:   params.ProcPath,
+		rootFSPath: params.RootFSPath,
+		statfs:     syscall.Statfs,
+		timeout:    statfsTimeout,
+		stuck:      make(map[string]bool),
+		size:       desc("size_bytes", "Filesystem size in bytes."),
+		free:       desc("free_bytes", "Filesystem free space in bytes."),
+		avail:      desc("avail_bytes", "Filesystem space available to non-root users in bytes."),
+		files:      desc("files", "Filesystem total file nodes."),
+		filesFree:  desc("files_free", "Filesystem total free file nodes."),
+		readonly:   desc("readonly", "Filesystem read-only status."),
+	}
+}
+
+func (c *filesystemCollector) describe(ch chan<- *prometheus.Desc) {
+	ch <- c.size
+	ch <- c.free
+	ch <- c.avail
+	ch <- c.files
+	ch <- c.filesFree
+	ch <- c.readonly
+}
+
+func (c *filesystemCollector) update(ch chan<- prometheus.Metric) error {
+	seen := make(map[string]bool)
+	return readLines(c.procPath+"/mounts", func(line string) error {
+		// /dev/sda1 / ext4 rw,relatime 0 0
+		fields := strings.Fields(line)
+		if len(fields) < 4 || ignoredFSTypes[fields[2]] {
+			return nil
+		}
+		device, mountPoint, fsType := fields[0], unescapeMountPoint(fields[1]), fields[2]
+		if seen[mountPoint] {
+			return nil
+		}
+		seen[mountPoint] = true
+
+		s, err := c.statfsWithTimeout(mountPoint)
+		if err != nil {
+			// inaccessible and stuck mount points should not fail the whole collector
+			c.l.Debugf("Failed to get filesystem statistics for %q: %s.", mountPoint, err)
+			return nil
+		}
+		var ro float64
+		for _, o := range strings.Split(fields[3], ",") {
+			if o == "ro" {
+				ro = 1
+			}
+		}
+
+		bsize := float64(s.Bsize)
+		ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(s.Blocks)*bsize, device, mountPoint, fsType)
+		ch <- prometheus.MustNewConstMetric(c.free, prometheus.GaugeValue, float64(s.Bfree)*bsize, device, mountPoint, fsType)
+		ch <- prometheus.MustNewConstMetric(c.avail, prometheus.GaugeValue, float64(s.Bavail)*bsize, device, mountPoint, fsType)
+		ch <- prometheus.MustNewConstMetric(c.files, prometheus.GaugeValue, float64(s.Files), device, mountPoint, fsType)
+		ch <- prometheus.MustNewConstMetric(c.filesFree, prometheus.GaugeValue, float64(s.Ffree), device, mountPoint, fsType)
+		ch <- prometheus.MustNewConstMetric(c.readonly, prometheus.GaugeValue, ro, device, mountPoint, fsType)
+		return nil
+	})
+}
+
+// statfsWithTimeout returns filesystem statistics for a given mount point.
+// It does not wait for statfs call longer than c.timeout, and does not make new calls
+// for the mount point while the previous one is still in progress.
+func (c *filesystemCollector) statfsWithTimeout(mountPoint string) (*syscall.Statfs_t, error) {
+	c.stuckM.Lock()
+	stuck := c.stuck[mountPoint]
+	c.stuckM.Unlock()
+	if stuck {
+		return nil, errors.New("mount point is stuck")
+	}
+
+	type result struct {
+		s   *syscall.Statfs_t
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var s syscall.Statfs_t
+		err := c.statfs(filepath.Join(c.rootFSPath, mountPoint), &s)
+
+		c.stuckM.Lock()
+		done <- result{&s, err}
+		if c.stuck[mountPoint] {
+			c.l.Infof("Mount point %q is responsive again.", mountPoint)
+			delete(c.stuck, mountPoint)
+		}
+		c.stuckM.Unlock()
+	}()
+
+	t := time.NewTimer(c.timeout)
+	defer t.Stop()
+	select {
+	case r := <-done:
+		return r.s, r.err
+	case <-t.C:
+	}
+
+	// result may be sent between timer firing and taking a lock
+	c.stuckM.Lock()
+	defer c.stuckM.Unlock()
+	select {
+	case r := <-done:
+		return r.s, r.err
+	default:
+		c.l.Warnf("Mount point %q did not respond in %s, skipping it until it does.", mountPoint, c.timeout)
+		c.stuck[mountPoint] = true
+		return nil, errors.New("mount point is stuck")
+	}
+}
+
+// unescapeMountPoint replaces octal escapes used in /proc/mounts for spaces and tabs.
+func unescapeMountPoint(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
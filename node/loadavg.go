@@ -0,0 +1,71 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package node
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// loadavgCollector collects load average from /proc/loadavg.
+type loadavgCollector struct {
+	procPath string
+	descs    [3]*prometheus.Desc
+}
+
+func newLoadavgCollector(params *Params) *loadavgCollector {
+	c := &loadavgCollector{
+		procPath: params.ProcPath,
+	}
+	for i, name := range []string{"load1", "load5", "load15"} {
+		c.descs[i] = prometheus.NewDesc(
+			prometheus.BuildFQName(prometheusNamespace, "", name),
+			strings.TrimPrefix(name, "load")+"m load average.",
+			nil, nil,
+		)
+	}
+	return c
+}
+
+func (c *loadavgCollector) describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs {
+		ch <- d
+	}
+}
+
+func (c *loadavgCollector) update(ch chan<- prometheus.Metric) error {
+	// 0.35 0.21 0.18 1/345 12345
+	s, err := readFile(c.procPath + "/loadavg")
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(s)
+	if len(fields) < len(c.descs) {
+		return errors.Errorf("unexpected content %q", s)
+	}
+	for i, d := range c.descs {
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %q", s)
+		}
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package node
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// memoryFields are /proc/meminfo fields exposed as node_memory_<field>_bytes gauges;
+// HugePages_ fields are page counts, and are exposed without _bytes suffix.
+var memoryFields = []string{
+	"MemTotal", "MemFree", "MemAvailable", "Buffers", "Cached", "Active", "Inactive",
+	"SwapTotal", "SwapFree", "Dirty", "Writeback", "Shmem", "Slab", "SReclaimable",
+	"Committed_AS", "HugePages_Total", "HugePages_Free", "Hugepagesize",
+}
+
+// memoryCollector collects memory metrics from /proc/meminfo.
+type memoryCollector struct {
+	procPath string
+	descs    map[string]*prometheus.Desc
+}
+
+func newMemoryCollector(params *Params) *memoryCollector {
+	c := &memoryCollector{
+		procPath: params.ProcPath,
+		descs:    make(map[string]*prometheus.Desc, len(memoryFields)),
+	}
+	for _, f := range memoryFields {
+		name := f + "_bytes"
+		if strings.HasPrefix(f, "HugePages_") {
+			name = f
+		}
+		c.descs[f] = prometheus.NewDesc(
+			prometheus.BuildFQName(prometheusNamespace, "memory", name),
+			"Memory information field "+f+".",
+			nil, nil,
+		)
+	}
+	return c
+}
+
+func (c *memoryCollector) describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs {
+		ch <- d
+	}
+}
+
+func (c *memoryCollector) update(ch chan<- prometheus.Metric) error {
+	return readLines(c.procPath+"/meminfo", func(line string) error {
+		// MemTotal:        6158152 kB
+		// HugePages_Total:       0
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return errors.Errorf("unexpected line %q", line)
+		}
+		name := strings.TrimSuffix(fields[0], ":")
+		desc := c.descs[name]
+		if desc == nil {
+			return nil
+		}
+
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse line %q", line)
+		}
+		if len(fields) == 3 && fields[2] == "kB" {
+			v *= 1024
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v)
+		return nil
+	})
+}
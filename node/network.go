@@ -0,0 +1,103 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package node
+
+import (
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/procfs"
+)
+
+// networkCollector collects network interface metrics from /proc/net/dev and /sys/class/net.
+type networkCollector struct {
+	procPath string
+	sysPath  string
+
+	receiveBytes    *prometheus.Desc
+	receivePackets  *prometheus.Desc
+	receiveErrors   *prometheus.Desc
+	receiveDrop     *prometheus.Desc
+	transmitBytes   *prometheus.Desc
+	transmitPackets *prometheus.Desc
+	transmitErrors  *prometheus.Desc
+	transmitDrop    *prometheus.Desc
+	up              *prometheus.Desc
+}
+
+func newNetworkCollector(params *Params) *networkCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "network", name), help, []string{"device"}, nil)
+	}
+	return &networkCollector{
+		procPath:        params.ProcPath,
+		sysPath:         params.SysPath,
+		receiveBytes:    desc("receive_bytes_total", "Network device statistic receive_bytes."),
+		receivePackets:  desc("receive_packets_total", "Network device statistic receive_packets."),
+		receiveErrors:   desc("receive_errs_total", "Network device statistic receive_errs."),
+		receiveDrop:     desc("receive_drop_total", "Network device statistic receive_drop."),
+		transmitBytes:   desc("transmit_bytes_total", "Network device statistic transmit_bytes."),
+		transmitPackets: desc("transmit_packets_total", "Network device statistic transmit_packets."),
+		transmitErrors:  desc("transmit_errs_total", "Network device statistic transmit_errs."),
+		transmitDrop:    desc("transmit_drop_total", "Network device statistic transmit_drop."),
+		up:              desc("up", "1 if network interface operational state is up, 0 otherwise."),
+	}
+}
+
+func (c *networkCollector) describe(ch chan<- *prometheus.Desc) {
+	ch <- c.receiveBytes
+	ch <- c.receivePackets
+	ch <- c.receiveErrors
+	ch <- c.receiveDrop
+	ch <- c.transmitBytes
+	ch <- c.transmitPackets
+	ch <- c.transmitErrors
+	ch <- c.transmitDrop
+	ch <- c.up
+}
+
+func (c *networkCollector) update(ch chan<- prometheus.Metric) error {
+	fs, err := procfs.NewFS(c.procPath)
+	if err != nil {
+		return err
+	}
+	netDev, err := fs.NewNetDev()
+	if err != nil {
+		return err
+	}
+
+	for device, s := range netDev {
+		ch <- prometheus.MustNewConstMetric(c.receiveBytes, prometheus.CounterValue, float64(s.RxBytes), device)
+		ch <- prometheus.MustNewConstMetric(c.receivePackets, prometheus.CounterValue, float64(s.RxPackets), device)
+		ch <- prometheus.MustNewConstMetric(c.receiveErrors, prometheus.CounterValue, float64(s.RxErrors), device)
+		ch <- prometheus.MustNewConstMetric(c.receiveDrop, prometheus.CounterValue, float64(s.RxDropped), device)
+		ch <- prometheus.MustNewConstMetric(c.transmitBytes, prometheus.CounterValue, float64(s.TxBytes), device)
+		ch <- prometheus.MustNewConstMetric(c.transmitPackets, prometheus.CounterValue, float64(s.TxPackets), device)
+		ch <- prometheus.MustNewConstMetric(c.transmitErrors, prometheus.CounterValue, float64(s.TxErrors), device)
+		ch <- prometheus.MustNewConstMetric(c.transmitDrop, prometheus.CounterValue, float64(s.TxDropped), device)
+
+		// operstate may be missing in containers or fixture trees
+		if state, err := readFile(filepath.Join(c.sysPath, "class", "net", device, "operstate")); err == nil {
+			var up float64
+			if state == "up" {
+				up = 1
+			}
+			ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, up, device)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package node implements built-in node metrics collector reading /proc and /sys.
+// Metric names match node_exporter ones, so existing dashboards can be used.
+package node
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const prometheusNamespace = "node"
+
+// Params represent collector parameters. Paths can be changed to use fixture trees or host paths from container.
+type Params struct {
+	ProcPath   string // procfs mount point, usually /proc
+	SysPath    string // sysfs mount point, usually /sys
+	RootFSPath string // root filesystem mount point, usually /
+}
+
+// subcollector collects metrics of one kind.
+type subcollector interface {
+	describe(ch chan<- *prometheus.Desc)
+	update(ch chan<- prometheus.Metric) error
+}
+
+// Collector is a prometheus.Collector for node metrics.
+type Collector struct {
+	l             *logrus.Entry
+	subcollectors map[string]subcollector
+
+	scrapeDuration *prometheus.Desc
+	scrapeSuccess  *prometheus.Desc
+}
+
+// New creates a new collector.
+func New(params *Params) *Collector {
+	return &Collector{
+		l: logrus.WithField("component", "node"),
+		subcollectors: map[string]subcollector{
+			"cpu":        newCPUCollector(params),
+			"meminfo":    newMemoryCollector(params),
+			"loadavg":    newLoadavgCollector(params),
+			"diskstats":  newDiskCollector(params),
+			"filesystem": newFilesystemCollector(params),
+			"netdev":     newNetworkCollector(params),
+			"pressure":   newPressureCollector(params),
+		},
+		scrapeDuration: prometheus.NewDesc(
+			prometheus.BuildFQName(prometheusNamespace, "scrape", "collector_duration_seconds"),
+			"Duration of a collector scrape.",
+			[]string{"collector"}, nil,
+		),
+		scrapeSuccess: prometheus.NewDesc(
+			prometheus.BuildFQName(prometheusNamespace, "scrape", "collector_success"),
+			"1 if a collector succeeded, 0 otherwise.",
+			[]string{"collector"}, nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.scrapeDuration
+	ch <- c.scrapeSuccess
+	for _, s := range c.subcollectors {
+		s.describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+	wg.Add(len(c.subcollectors))
+	for name, s := range c.subcollectors {
+		go func(name string, s subcollector) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := s.update(ch)
+			ch <- prometheus.MustNewConstMetric(c.scrapeDuration, prometheus.GaugeValue, time.Since(start).Seconds(), name)
+			var success float64
+			if err == nil {
+				success = 1
+			} else {
+				c.l.Debugf("Collector %s failed: %s.", name, err)
+			}
+			ch <- prometheus.MustNewConstMetric(c.scrapeSuccess, prometheus.GaugeValue, success, name)
+		}(name, s)
+	}
+	wg.Wait()
+}
+
+// readLines calls f for every line of a given file.
+func readLines(path string, f func(line string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		if err = f(s.Text()); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// readFile returns trimmed file content.
+func readFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	return strings.TrimSpace(string(b)), err
+}
+
+// check interfaces
+var (
+	_ prometheus.Collector = (*Collector)(nil)
+)
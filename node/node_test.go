@@ -0,0 +1,189 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package node
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+// fixtureStatfs returns fake statistics for fixture mount points; /mnt/nfs is inaccessible.
+func fixtureStatfs(path string, buf *syscall.Statfs_t) error {
+	switch path {
+	case "/", "/run", "/var/lib/my data":
+		buf.Bsize = 4096
+		buf.Blocks = 1000
+		buf.Bfree = 300
+		buf.Bavail = 200
+		buf.Files = 5000
+		buf.Ffree = 4000
+		return nil
+	default:
+		return syscall.EACCES
+	}
+}
+
+// gather returns metrics in text format without collector durations.
+func gather(t *testing.T, c prometheus.Collector) string {
+	t.Helper()
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	for _, mf := range families {
+		if mf.GetName() == "node_scrape_collector_duration_seconds" {
+			continue
+		}
+		if _, err = expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.String()
+}
+
+func TestCollectorFixture(t *testing.T) {
+	c := New(&Params{
+		ProcPath:   filepath.Join("testdata", "proc"),
+		SysPath:    filepath.Join("testdata", "sys"),
+		RootFSPath: "/",
+	})
+	c.subcollectors["filesystem"].(*filesystemCollector).statfs = fixtureStatfs
+	actual := gather(t, c)
+
+	golden := filepath.Join("testdata", "metrics.txt")
+	if *updateGolden {
+		if err := ioutil.WriteFile(golden, []byte(actual), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != string(expected) {
+		t.Errorf("metrics do not match %s (run with -update to see the difference with git diff):\n%s", golden, actual)
+	}
+	for _, line := range strings.Split(actual, "\n") {
+		if strings.HasPrefix(line, "node_scrape_collector_success{") && strings.HasSuffix(line, " 0") {
+			t.Errorf("collector failed: %s", line)
+		}
+	}
+}
+
+func TestFilesystemStuckMount(t *testing.T) {
+	unblock := make(chan struct{})
+	calls := make(chan string, 10)
+	c := newFilesystemCollector(&Params{
+		ProcPath:   filepath.Join("testdata", "proc"),
+		RootFSPath: "/",
+	})
+	c.timeout = 100 * time.Millisecond
+	c.statfs = func(path string, buf *syscall.Statfs_t) error {
+		calls <- path
+		if path == "/mnt/nfs" {
+			<-unblock
+			buf.Bsize = 4096
+			return nil
+		}
+		return fixtureStatfs(path, buf)
+	}
+
+	mountPoints := func() map[string]bool {
+		ch := make(chan prometheus.Metric, 100)
+		start := time.Now()
+		if err := c.update(ch); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("update took %s", d)
+		}
+		close(ch)
+		res := make(map[string]bool)
+		for m := range ch {
+			if m.Desc() != c.size {
+				continue
+			}
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range pb.Label {
+				if l.GetName() == "mountpoint" {
+					res[l.GetValue()] = true
+				}
+			}
+		}
+		return res
+	}
+	called := func() map[string]bool {
+		res := make(map[string]bool)
+		for {
+			select {
+			case p := <-calls:
+				res[p] = true
+			default:
+				return res
+			}
+		}
+	}
+
+	// first update waits for timeout, and marks mount point as stuck
+	if mp := mountPoints(); mp["/mnt/nfs"] || !mp["/"] {
+		t.Errorf("unexpected mount points %v", mp)
+	}
+	if !called()["/mnt/nfs"] {
+		t.Error("statfs was not called for /mnt/nfs")
+	}
+
+	// second update skips stuck mount point without calling statfs
+	if mp := mountPoints(); mp["/mnt/nfs"] || !mp["/"] {
+		t.Errorf("unexpected mount points %v", mp)
+	}
+	if called()["/mnt/nfs"] {
+		t.Error("statfs was called for stuck /mnt/nfs")
+	}
+
+	// after the hung call returns, mount point is used again
+	close(unblock)
+	for i := 0; i < 100; i++ {
+		c.stuckM.Lock()
+		stuck := c.stuck["/mnt/nfs"]
+		c.stuckM.Unlock()
+		if !stuck {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mp := mountPoints(); !mp["/mnt/nfs"] {
+		t.Errorf("unexpected mount points %v", mp)
+	}
+}
@@ -0,0 +1,112 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pressureCollector collects pressure stall information from /proc/pressure (Linux 4.20+).
+type pressureCollector struct {
+	procPath string
+
+	cpuWaiting    *prometheus.Desc
+	memoryWaiting *prometheus.Desc
+	memoryStalled *prometheus.Desc
+	ioWaiting     *prometheus.Desc
+	ioStalled     *prometheus.Desc
+}
+
+func newPressureCollector(params *Params) *pressureCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "pressure", name), help, nil, nil)
+	}
+	return &pressureCollector{
+		procPath:      params.ProcPath,
+		cpuWaiting:    desc("cpu_waiting_seconds_total", "Total time in seconds that processes have waited for CPU time."),
+		memoryWaiting: desc("memory_waiting_seconds_total", "Total time in seconds that processes have waited for memory."),
+		memoryStalled: desc("memory_stalled_seconds_total", "Total time in seconds no process could make progress due to memory congestion."),
+		ioWaiting:     desc("io_waiting_seconds_total", "Total time in seconds that processes have waited due to IO congestion."),
+		ioStalled:     desc("io_stalled_seconds_total", "Total time in seconds no process could make progress due to IO congestion."),
+	}
+}
+
+func (c *pressureCollector) describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cpuWaiting
+	ch <- c.memoryWaiting
+	ch <- c.memoryStalled
+	ch <- c.ioWaiting
+	ch <- c.ioStalled
+}
+
+func (c *pressureCollector) update(ch chan<- prometheus.Metric) error {
+	for _, r := range []struct {
+		resource string
+		some     *prometheus.Desc
+		full     *prometheus.Desc
+	}{
+		{"cpu", c.cpuWaiting, nil},
+		{"memory", c.memoryWaiting, c.memoryStalled},
+		{"io", c.ioWaiting, c.ioStalled},
+	} {
+		totals, err := readPressure(filepath.Join(c.procPath, "pressure", r.resource))
+		if err != nil {
+			// older kernels do not have PSI at all
+			if os.IsNotExist(errors.Cause(err)) {
+				return nil
+			}
+			return err
+		}
+		if v, ok := totals["some"]; ok && r.some != nil {
+			ch <- prometheus.MustNewConstMetric(r.some, prometheus.CounterValue, v)
+		}
+		if v, ok := totals["full"]; ok && r.full != nil {
+			ch <- prometheus.MustNewConstMetric(r.full, prometheus.CounterValue, v)
+		}
+	}
+	return nil
+}
+
+// readPressure returns total stall times in seconds for "some" and "full" lines of PSI file.
+func readPressure(path string) (map[string]float64, error) {
+	res := make(map[string]float64, 2)
+	err := readLines(path, func(line string) error {
+		// some avg10=0.44 avg60=1.47 avg300=1.57 total=25027199
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return nil
+		}
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "total=") {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimPrefix(f, "total="), 64)
+			if err != nil {
+				return errors.Wrapf(err, "failed to parse line %q", line)
+			}
+			res[fields[0]] = v / 1e6 // microseconds
+		}
+		return nil
+	})
+	return res, err
+}
@@ -0,0 +1,202 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package ports allocates listen ports for managed processes, and remembers assignments in a state file.
+package ports
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Allocator assigns ports from a range to names.
+type Allocator struct {
+	min, max  uint16
+	stateFile string
+	l         *logrus.Entry
+
+	m        sync.Mutex
+	assigned map[string]uint16
+	last     uint16 // the last allocated port; search for the next one starts after it
+}
+
+// state is a state file content.
+type state struct {
+	Ports map[string]uint16 `json:"ports"`
+}
+
+// NewAllocator creates a new allocator for ports in [min, max] range.
+// If stateFile is not empty, assignments are loaded from it and saved to it after every change.
+func NewAllocator(min, max uint16, stateFile string) (*Allocator, error) {
+	if min == 0 || min > max {
+		return nil, errors.Errorf("invalid port range [%d, %d]", min, max)
+	}
+
+	a := &Allocator{
+		min:       min,
+		max:       max,
+		stateFile: stateFile,
+		l:         logrus.WithField("component", "supervisor"),
+		assigned:  make(map[string]uint16),
+		last:      min - 1,
+	}
+	if stateFile == "" {
+		return a, nil
+	}
+
+	b, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return a, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	var s state
+	if err = json.Unmarshal(b, &s); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", stateFile)
+	}
+	for name, port := range s.Ports {
+		// range may be changed since the last run
+		if port < min || port > max {
+			a.l.Infof("Dropping port %d assigned to %q: it is outside of [%d, %d] range.", port, name, min, max)
+			continue
+		}
+		a.assigned[name] = port
+	}
+	return a, nil
+}
+
+// Allocate returns port assigned to a given name. If there is no assignment, a new free port is allocated.
+// Existing assignment is returned without availability check, as port may be used by the same process.
+func (a *Allocator) Allocate(name string) (uint16, error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if port := a.assigned[name]; port != 0 {
+		return port, nil
+	}
+
+	used := make(map[uint16]bool, len(a.assigned))
+	for _, port := range a.assigned {
+		used[port] = true
+	}
+
+	size := int(a.max) - int(a.min) + 1
+	port := a.last
+	for i := 0; i < size; i++ {
+		if port >= a.max || port < a.min {
+			port = a.min
+		} else {
+			port++
+		}
+		if used[port] || !available(port) {
+			continue
+		}
+
+		a.assigned[name] = port
+		a.last = port
+		if err := a.save(); err != nil {
+			delete(a.assigned, name)
+			return 0, err
+		}
+		a.l.Infof("Port %d assigned to %q.", port, name)
+		return port, nil
+	}
+	return 0, errors.Errorf("no free ports in [%d, %d] range", a.min, a.max)
+}
+
+// Retain releases ports assigned to names not in a given list.
+func (a *Allocator) Retain(names []string) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+	var changed bool
+	for name, port := range a.assigned {
+		if !keep[name] {
+			a.l.Infof("Port %d released by %q.", port, name)
+			delete(a.assigned, name)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return a.save()
+}
+
+// Assigned returns a copy of all assignments.
+func (a *Allocator) Assigned() map[string]uint16 {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	res := make(map[string]uint16, len(a.assigned))
+	for name, port := range a.assigned {
+		res[name] = port
+	}
+	return res
+}
+
+// save writes state file atomically. Caller should hold a.m.
+func (a *Allocator) save() error {
+	if a.stateFile == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(&state{Ports: a.assigned}, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(a.stateFile), filepath.Base(a.stateFile)+".tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.WithStack(err)
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.WithStack(err)
+	}
+	if err = os.Rename(f.Name(), a.stateFile); err != nil {
+		os.Remove(f.Name())
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// available returns true if port can be listened on all interfaces.
+func available(port uint16) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(port))))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
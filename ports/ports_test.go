@@ -0,0 +1,180 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package ports
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// freeRange returns a range of n ports available at the moment.
+func freeRange(t *testing.T, n int) (uint16, uint16) {
+	t.Helper()
+	for min := 43000; min < 60000; min += n {
+		ok := true
+		for port := min; port < min+n; port++ {
+			if !available(uint16(port)) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return uint16(min), uint16(min + n - 1)
+		}
+	}
+	t.Fatalf("Failed to find %d free ports.", n)
+	return 0, 0
+}
+
+func TestAllocator(t *testing.T) {
+	if _, err := NewAllocator(0, 10, ""); err == nil || err.Error() != "invalid port range [0, 10]" {
+		t.Errorf("Unexpected error %v.", err)
+	}
+	if _, err := NewAllocator(11, 10, ""); err == nil || err.Error() != "invalid port range [11, 10]" {
+		t.Errorf("Unexpected error %v.", err)
+	}
+
+	min, max := freeRange(t, 4)
+	a, err := NewAllocator(min, max, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// port used by somebody else is skipped
+	l, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(min+1))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err = a.Allocate(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := map[string]uint16{"a": min, "b": min + 2, "c": min + 3}
+	if actual := a.Assigned(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, got %v.", expected, actual)
+	}
+
+	// existing assignment is returned even if port is used by the process itself
+	l2, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(min))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+	if port, err := a.Allocate("a"); err != nil || port != min {
+		t.Errorf("Expected %d, got %d (%v).", min, port, err)
+	}
+
+	// range is exhausted
+	if port, err := a.Allocate("d"); err == nil {
+		t.Errorf("Expected error, got %d.", port)
+	} else if expected := "no free ports in [" + strconv.Itoa(int(min)) + ", " + strconv.Itoa(int(max)) + "] range"; err.Error() != expected {
+		t.Errorf("Expected %q, got %q.", expected, err)
+	}
+	if _, ok := a.Assigned()["d"]; ok {
+		t.Error("Failed allocation is assigned.")
+	}
+
+	// released port is reused, retained are kept
+	if err = a.Retain([]string{"a", "c", "unknown"}); err != nil {
+		t.Fatal(err)
+	}
+	if port, err := a.Allocate("d"); err != nil || port != min+2 {
+		t.Errorf("Expected %d, got %d (%v).", min+2, port, err)
+	}
+	expected = map[string]uint16{"a": min, "c": min + 3, "d": min + 2}
+	if actual := a.Assigned(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, got %v.", expected, actual)
+	}
+
+	// Assigned returns a copy
+	a.Assigned()["a"] = 1
+	if port, _ := a.Allocate("a"); port != min {
+		t.Errorf("Expected %d, got %d.", min, port)
+	}
+}
+
+func TestAllocatorStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmm-agent-ports-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "ports.json")
+
+	min, max := freeRange(t, 3)
+	a, err := NewAllocator(min, max, stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Assigned()) != 0 {
+		t.Errorf("Unexpected assignments %v.", a.Assigned())
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err = a.Allocate(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = a.Retain([]string{"a", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]uint16{"a": min, "c": min + 2}
+
+	// state file is replaced atomically, temporary files are not left
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "ports.json" || files[0].Mode() != 0600 {
+		t.Errorf("Unexpected files in %s: %v.", dir, files)
+	}
+
+	a, err = NewAllocator(min, max, stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := a.Assigned(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, got %v.", expected, actual)
+	}
+	if port, err := a.Allocate("b"); err != nil || port != min+1 {
+		t.Errorf("Expected %d, got %d (%v).", min+1, port, err)
+	}
+
+	// assignments outside of a changed range are dropped
+	a, err = NewAllocator(min, min+1, stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]uint16{"a": min, "b": min + 1}
+	if actual := a.Assigned(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, got %v.", expected, actual)
+	}
+
+	if err = ioutil.WriteFile(stateFile, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewAllocator(min, max, stateFile); err == nil || err.Error() != "failed to parse "+stateFile+": unexpected end of JSON input" {
+		t.Errorf("Unexpected error %v.", err)
+	}
+}
@@ -0,0 +1,381 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package push scrapes local metrics endpoints and sends metrics to PMM server over agent connection.
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/rpc"
+	"github.com/Percona-Lab/pmm-agent/spool"
+)
+
+const (
+	prometheusNamespace = "pmm_agent"
+	prometheusSubsystem = "push"
+
+	// the same Accept header as Prometheus uses
+	acceptHeader = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3,*/*;q=0.1`
+
+	// maximum number of batches in a single PushMetrics request
+	maxBatchesPerRequest = 100
+
+	// room for PushMetricsRequest encoding in addition to encoded batches
+	maxRequestOverhead = 64 * 1024
+)
+
+// target is a scrape target with its scraping goroutine.
+type target struct {
+	params *api.ScrapeTarget
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Scraper scrapes targets on schedule and writes scraped metrics to spool.
+// Batches are sent from spool in order while agent is connected to PMM server.
+type Scraper struct {
+	ctx      context.Context
+	nodeName string
+	l        *logrus.Entry
+	http     *http.Client
+	spool    *spool.Spool
+	maxSize  int
+
+	scrapes  *prometheus.CounterVec
+	sent     prometheus.Counter
+	retries  prometheus.Counter
+	dropped  *prometheus.CounterVec
+	duration *prometheus.SummaryVec
+
+	m       sync.Mutex
+	targets map[string]*target
+}
+
+// NewScraper creates a new scraper. Targets are scraped until ctx is canceled.
+// nodeName is added to all metrics as node_name label. Batches waiting to be sent are stored in a given spool.
+// PushMetrics requests are limited by a given maximum RPC message size.
+func NewScraper(ctx context.Context, nodeName string, spool *spool.Spool, maxMessageSize int) *Scraper {
+	return &Scraper{
+		ctx:      ctx,
+		nodeName: nodeName,
+		l:        logrus.WithField("component", "push"),
+		http:     new(http.Client),
+		spool:    spool,
+		maxSize:  maxMessageSize - maxRequestOverhead,
+		scrapes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "scrapes_total",
+			Help:      "A total number of scrapes by target and result (ok, error).",
+		}, []string{"target", "result"}),
+		sent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "batches_sent_total",
+			Help:      "A total number of metrics batches sent to PMM server.",
+		}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "send_retries_total",
+			Help:      "A total number of failed PushMetrics requests which will be retried.",
+		}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "batches_dropped_total",
+			Help:      "A total number of metrics batches dropped before sending by reason (spool_error, decode_error, too_large, rejected).",
+		}, []string{"reason"}),
+		duration: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "scrape_duration_seconds",
+			Help:      "Scrape durations by target.",
+		}, []string{"target"}),
+		targets: make(map[string]*target),
+	}
+}
+
+// SetTargets replaces scrape targets: new targets are started, removed ones are stopped,
+// and changed ones are restarted.
+func (s *Scraper) SetTargets(targets []api.ScrapeTarget) error {
+	byID := make(map[string]*api.ScrapeTarget, len(targets))
+	for i := range targets {
+		t := &targets[i]
+		if err := checkTarget(t); err != nil {
+			return err
+		}
+		if byID[t.ID] != nil {
+			return errors.Errorf("duplicate target ID %q", t.ID)
+		}
+		byID[t.ID] = t
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for id, t := range s.targets {
+		if p := byID[id]; p == nil || !reflect.DeepEqual(p, t.params) {
+			s.l.Infof("Stopping scraping %s (%s).", id, t.params.URL)
+			t.cancel()
+			<-t.done
+			delete(s.targets, id)
+		}
+	}
+	for id, p := range byID {
+		if s.targets[id] != nil {
+			continue
+		}
+		s.l.Infof("Starting scraping %s (%s) every %gs.", id, p.URL, p.IntervalSeconds)
+		ctx, cancel := context.WithCancel(s.ctx)
+		t := &target{
+			params: p,
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		s.targets[id] = t
+		go s.run(ctx, t)
+	}
+	return nil
+}
+
+// checkTarget returns error if target parameters are invalid.
+func checkTarget(t *api.ScrapeTarget) error {
+	if t.ID == "" {
+		return errors.New("target ID is empty")
+	}
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return errors.Wrapf(err, "target %q", t.ID)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.Errorf("target %q: expected http:// or https:// URL, got %q", t.ID, t.URL)
+	}
+	if t.IntervalSeconds <= 0 {
+		return errors.Errorf("target %q: interval should be positive, got %g", t.ID, t.IntervalSeconds)
+	}
+	if t.TimeoutSeconds < 0 {
+		return errors.Errorf("target %q: timeout should not be negative, got %g", t.ID, t.TimeoutSeconds)
+	}
+	return nil
+}
+
+// run scrapes target until ctx is canceled.
+func (s *Scraper) run(ctx context.Context, t *target) {
+	defer close(t.done)
+
+	interval := time.Duration(t.params.IntervalSeconds * float64(time.Second))
+	timeout := time.Duration(t.params.TimeoutSeconds * float64(time.Second))
+	if timeout == 0 || timeout > interval {
+		timeout = interval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.scrape(ctx, t.params, timeout)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scrape scrapes target once and writes the result to spool. Failed scrape produces up metric with 0 value.
+func (s *Scraper) scrape(ctx context.Context, t *api.ScrapeTarget, timeout time.Duration) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	families, err := s.get(ctx, t.URL)
+	s.duration.WithLabelValues(t.ID).Observe(time.Since(start).Seconds())
+	if ctx.Err() == context.Canceled {
+		return
+	}
+
+	up := 1.0
+	result := "ok"
+	if err != nil {
+		s.l.Warnf("Failed to scrape %s (%s): %s.", t.ID, t.URL, err)
+		up = 0
+		result = "error"
+		families = nil
+	}
+	s.scrapes.WithLabelValues(t.ID, result).Inc()
+	families = append(families, &dto.MetricFamily{
+		Name: proto.String("up"),
+		Help: proto.String("1 if scrape was successful, 0 otherwise."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{
+			Gauge: &dto.Gauge{Value: proto.Float64(up)},
+		}},
+	})
+
+	labels := map[string]string{
+		"node_name": s.nodeName,
+		"agent_id":  t.ID,
+	}
+	for k, v := range t.Labels {
+		labels[k] = v
+	}
+	var buf bytes.Buffer
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			setLabels(m, labels)
+		}
+		if _, err = expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			s.l.Errorf("Failed to encode metrics of %s: %s.", t.ID, err)
+			return
+		}
+	}
+
+	b, err := json.Marshal(&api.MetricsBatch{
+		TargetID: t.ID,
+		Time:     start,
+		Metrics:  buf.String(),
+	})
+	if err == nil {
+		err = s.spool.Write(b)
+	}
+	if err != nil {
+		s.dropped.WithLabelValues("spool_error").Inc()
+		s.l.Errorf("Failed to write metrics of %s to spool: %s.", t.ID, err)
+	}
+}
+
+// get scrapes metrics from a given URL.
+func (s *Scraper) get(ctx context.Context, u string) ([]*dto.MetricFamily, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Accept", acceptHeader)
+	resp, err := s.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var res []*dto.MetricFamily
+	d := expfmt.NewDecoder(resp.Body, expfmt.ResponseFormat(resp.Header))
+	for {
+		mf := new(dto.MetricFamily)
+		if err = d.Decode(mf); err != nil {
+			if err == io.EOF {
+				return res, nil
+			}
+			return nil, errors.WithStack(err)
+		}
+		res = append(res, mf)
+	}
+}
+
+// setLabels sets labels of metric, replacing existing ones with the same names.
+func setLabels(m *dto.Metric, labels map[string]string) {
+	pairs := make([]*dto.LabelPair, 0, len(m.Label)+len(labels))
+	for _, p := range m.Label {
+		if _, ok := labels[p.GetName()]; !ok {
+			pairs = append(pairs, p)
+		}
+	}
+	for k, v := range labels {
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(k), Value: proto.String(v)})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+	m.Label = pairs
+}
+
+// Send sends batches from spool to PMM server in order until done is closed.
+// See spool.Sender for retry and drop policy.
+func (s *Scraper) Send(client rpc.PushGatewayClient, done <-chan struct{}) {
+	spool.NewSender(&spool.SenderParams{
+		Spool:      s.spool,
+		L:          s.l,
+		Name:       "metrics batches",
+		MaxRecords: maxBatchesPerRequest,
+		MaxSize:    s.maxSize,
+		Send: func(records [][]byte) (int, error) {
+			req := &api.PushMetricsRequest{
+				Batches: make([]api.MetricsBatch, 0, len(records)),
+			}
+			for _, r := range records {
+				var b api.MetricsBatch
+				if err := json.Unmarshal(r, &b); err != nil {
+					s.dropped.WithLabelValues("decode_error").Inc()
+					s.l.Errorf("Failed to decode metrics batch from spool: %s.", err)
+					continue
+				}
+				req.Batches = append(req.Batches, b)
+			}
+			if len(req.Batches) == 0 {
+				return 0, nil
+			}
+			_, err := client.PushMetrics(context.Background(), req)
+			return len(req.Batches), err
+		},
+		Rejected: rpc.IsRejected,
+		Sent:     s.sent,
+		Retries:  s.retries,
+		Dropped:  s.dropped,
+	}).Run(done)
+}
+
+// Describe implements prometheus.Collector.
+func (s *Scraper) Describe(ch chan<- *prometheus.Desc) {
+	s.scrapes.Describe(ch)
+	s.sent.Describe(ch)
+	s.retries.Describe(ch)
+	s.dropped.Describe(ch)
+	s.duration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (s *Scraper) Collect(ch chan<- prometheus.Metric) {
+	s.scrapes.Collect(ch)
+	s.sent.Collect(ch)
+	s.retries.Collect(ch)
+	s.dropped.Collect(ch)
+	s.duration.Collect(ch)
+}
+
+// check interfaces
+var (
+	_ prometheus.Collector = (*Scraper)(nil)
+)
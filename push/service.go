@@ -0,0 +1,49 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package push
+
+import (
+	"context"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/rpc"
+)
+
+// Service handles push-mode metrics requests from PMM server.
+type Service struct {
+	s *Scraper
+}
+
+// NewService creates a new service.
+func NewService(s *Scraper) *Service {
+	return &Service{
+		s: s,
+	}
+}
+
+// SetScrapeConfig replaces scrape targets.
+func (svc *Service) SetScrapeConfig(ctx context.Context, req *api.SetScrapeConfigRequest) (*api.SetScrapeConfigResponse, error) {
+	if err := svc.s.SetTargets(req.Targets); err != nil {
+		return nil, err
+	}
+	return new(api.SetScrapeConfigResponse), nil
+}
+
+// check interfaces
+var (
+	_ rpc.PushServer = (*Service)(nil)
+)
@@ -0,0 +1,200 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package qan
+
+import (
+	"math"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/fingerprint"
+	"github.com/Percona-Lab/pmm-agent/sketch"
+)
+
+// Maximum lengths of query example and plan in bytes; longer ones are truncated.
+const (
+	maxExampleLength = 4096
+	maxPlanLength    = 64 * 1024
+)
+
+type bucketKey struct {
+	start   int64 // Unix time
+	queryID string
+	schema  string
+}
+
+type bucket struct {
+	*api.QueryBucket
+	exampleTime float64        // query time of example
+	planTime    float64        // query time of plan
+	queryTime   *sketch.Sketch // query time distribution
+	aggregated  bool           // true if bucket contains events of several executions with unknown distribution
+}
+
+// Aggregator groups query events into buckets.
+type Aggregator struct {
+	sourceID string
+	dialect  fingerprint.Dialect
+	buckets  map[bucketKey]*bucket
+}
+
+// NewAggregator creates a new aggregator for a given source. Queries are fingerprinted using a given dialect.
+func NewAggregator(sourceID string, dialect fingerprint.Dialect) *Aggregator {
+	return &Aggregator{
+		sourceID: sourceID,
+		dialect:  dialect,
+		buckets:  make(map[bucketKey]*bucket),
+	}
+}
+
+// Add adds event to its bucket.
+func (a *Aggregator) Add(e *Event) {
+	fp := e.Fingerprint
+	if fp == "" {
+		fp = fingerprint.Fingerprint(e.Query, a.dialect)
+	}
+	key := bucketKey{
+		start:   e.Time.Truncate(BucketPeriod).Unix(),
+		queryID: fingerprint.QueryID(fp),
+		schema:  e.Schema,
+	}
+	b := a.buckets[key]
+	if b == nil {
+		b = &bucket{
+			QueryBucket: &api.QueryBucket{
+				SourceID:            a.sourceID,
+				QueryID:             key.queryID,
+				Fingerprint:         fp,
+				Schema:              e.Schema,
+				PeriodStart:         time.Unix(key.start, 0).UTC(),
+				PeriodLengthSeconds: uint32(BucketPeriod / time.Second),
+				Metrics:             make(map[string]*api.MetricStats),
+			},
+			exampleTime: -1,
+			planTime:    -1,
+			queryTime:   sketch.New(),
+		}
+		a.buckets[key] = b
+	}
+
+	count := e.Count
+	if count == 0 {
+		count = 1
+	}
+	b.Count += count
+	if count > 1 {
+		b.aggregated = true
+	}
+	for name, v := range e.Metrics {
+		min, max := v, v
+		if x, ok := e.Min[name]; ok && x < min {
+			min = x
+		}
+		if x, ok := e.Max[name]; ok && x > max {
+			max = x
+		}
+
+		m := b.Metrics[name]
+		if m == nil {
+			m = &api.MetricStats{
+				Min: min,
+				Max: max,
+			}
+			b.Metrics[name] = m
+		}
+		m.Count += count
+		m.Sum += v * float64(count)
+		if min < m.Min {
+			m.Min = min
+		}
+		if max > m.Max {
+			m.Max = max
+		}
+		if name == MetricQueryTime && !b.aggregated {
+			b.queryTime.Add(v, count)
+		}
+	}
+
+	example := e.Example
+	if example == "" {
+		example = e.Query
+	}
+	t := e.Metrics[MetricQueryTime]
+	if t > b.exampleTime {
+		b.exampleTime = t
+		b.Example = truncate(example, maxExampleLength)
+	}
+	if e.Plan != "" && t > b.planTime {
+		b.planTime = t
+		b.Plan = truncate(e.Plan, maxPlanLength)
+	}
+}
+
+// Flush removes and returns buckets with periods ended before a given time, ordered by period start.
+// Zero time flushes all buckets.
+func (a *Aggregator) Flush(before time.Time) []*api.QueryBucket {
+	var res []*api.QueryBucket
+	for key, b := range a.buckets {
+		if !before.IsZero() && b.PeriodStart.Add(BucketPeriod).After(before) {
+			continue
+		}
+		b.setPercentiles()
+		res = append(res, b.QueryBucket)
+		delete(a.buckets, key)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].PeriodStart.Equal(res[j].PeriodStart) {
+			return res[i].PeriodStart.Before(res[j].PeriodStart)
+		}
+		if res[i].QueryID != res[j].QueryID {
+			return res[i].QueryID < res[j].QueryID
+		}
+		return res[i].Schema < res[j].Schema
+	})
+	return res
+}
+
+// setPercentiles sets query time percentiles and sketch. They are not set for buckets with aggregated events:
+// distribution of several executions is not known, and estimations would be just an average.
+func (b *bucket) setPercentiles() {
+	m := b.Metrics[MetricQueryTime]
+	if m == nil || b.aggregated {
+		return
+	}
+
+	// estimations may be slightly outside of the exact range
+	quantile := func(q float64) float64 {
+		return math.Min(math.Max(b.queryTime.Quantile(q), m.Min), m.Max)
+	}
+	m.P50 = quantile(0.5)
+	m.P95 = quantile(0.95)
+	m.P99 = quantile(0.99)
+	m.Sketch = b.queryTime.Encode()
+}
+
+// truncate returns s truncated to at most max bytes without breaking UTF-8 characters.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
@@ -0,0 +1,78 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package qan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/pmm-agent/fingerprint"
+)
+
+func TestAggregatorPercentiles(t *testing.T) {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name        string
+		counts      []uint64
+		percentiles bool
+	}{
+		{"Individual", []uint64{0, 1, 0, 1}, true},
+		{"Aggregated", []uint64{4}, false},
+		{"Mixed", []uint64{1, 3}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := NewAggregator("test", fingerprint.MySQL)
+			for i, c := range tc.counts {
+				a.Add(&Event{
+					Time:    start,
+					Query:   "SELECT 1",
+					Count:   c,
+					Metrics: map[string]float64{MetricQueryTime: float64(i + 1)},
+				})
+			}
+
+			buckets := a.Flush(time.Time{})
+			if len(buckets) != 1 {
+				t.Fatalf("expected 1 bucket, got %d", len(buckets))
+			}
+			m := buckets[0].Metrics[MetricQueryTime]
+			if !tc.percentiles {
+				if m.P50 != 0 || m.P95 != 0 || m.P99 != 0 || m.Sketch != nil {
+					t.Errorf("unexpected percentiles: %+v", m)
+				}
+				return
+			}
+
+			if m.Sketch == nil {
+				t.Fatal("expected sketch")
+			}
+			var count uint64
+			for _, c := range m.Sketch.Counts {
+				count += c
+			}
+			if count != m.Count {
+				t.Errorf("expected %d values in sketch, got %d", m.Count, count)
+			}
+			for _, p := range []float64{m.P50, m.P95, m.P99} {
+				if p < m.Min || p > m.Max {
+					t.Errorf("expected percentiles in range [%v, %v], got %+v", m.Min, m.Max, m)
+				}
+			}
+		})
+	}
+}
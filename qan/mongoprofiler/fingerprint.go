@@ -0,0 +1,156 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package mongoprofiler
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// ignoredKeys are command document keys added by drivers and servers which are not a part of query shape.
+var ignoredKeys = map[string]bool{
+	"$clusterTime":    true,
+	"$client":         true,
+	"$db":             true,
+	"$readPreference": true,
+	"autocommit":      true,
+	"comment":         true,
+	"lsid":            true,
+	"shardVersion":    true,
+	"txnNumber":       true,
+}
+
+// command returns a document describing profiled operation.
+func command(e *profileEntry) bson.D {
+	cmd := e.Command
+	if e.Op == "getmore" && len(e.OriginatingCommand) != 0 {
+		cmd = e.OriginatingCommand
+	}
+	if len(cmd) == 0 {
+		// MongoDB before 3.6
+		cmd = e.Query
+	}
+
+	res := make(bson.D, 0, len(cmd))
+	for _, elem := range cmd {
+		if !ignoredKeys[elem.Name] {
+			res = append(res, elem)
+		}
+	}
+	return res
+}
+
+// queryFingerprint returns operation fingerprint: operation type, namespace, and query shape with all values stripped.
+func queryFingerprint(e *profileEntry, cmd bson.D) string {
+	var b strings.Builder
+	b.WriteString(e.Op)
+	b.WriteString(" ")
+	b.WriteString(e.Ns)
+	b.WriteString(" ")
+	render(&b, cmd, true)
+	return b.String()
+}
+
+// queryExample returns operation document with values in mongo shell-like syntax.
+func queryExample(cmd bson.D) string {
+	var b strings.Builder
+	render(&b, cmd, false)
+	return b.String()
+}
+
+// render writes BSON value to b. If strip is true, scalar values are replaced with "?",
+// and arrays of scalars are collapsed to "[?]".
+func render(b *strings.Builder, v interface{}, strip bool) {
+	switch v := v.(type) {
+	case bson.D:
+		b.WriteString("{")
+		for i, elem := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(elem.Name)
+			b.WriteString(": ")
+			render(b, elem.Value, strip)
+		}
+		b.WriteString("}")
+
+	case []interface{}:
+		if strip && scalars(v) {
+			b.WriteString("[?]")
+			return
+		}
+		b.WriteString("[")
+		for i, elem := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			render(b, elem, strip)
+		}
+		b.WriteString("]")
+
+	default:
+		if strip {
+			b.WriteString("?")
+			return
+		}
+		b.WriteString(scalar(v))
+	}
+}
+
+// scalars returns true if array contains only scalar values.
+func scalars(a []interface{}) bool {
+	for _, v := range a {
+		switch v.(type) {
+		case bson.D, []interface{}:
+			return false
+		}
+	}
+	return true
+}
+
+// scalar returns scalar value in mongo shell-like syntax.
+func scalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	case bson.ObjectId:
+		return fmt.Sprintf("ObjectId(%q)", v.Hex())
+	case time.Time:
+		return fmt.Sprintf("ISODate(%q)", v.UTC().Format(time.RFC3339Nano))
+	case bson.MongoTimestamp:
+		return fmt.Sprintf("Timestamp(%d, %d)", uint64(v)>>32, uint32(v))
+	case bson.RegEx:
+		return fmt.Sprintf("RegExp(%q, %q)", v.Pattern, v.Options)
+	case bson.Binary:
+		return fmt.Sprintf("BinData(%d, %q)", v.Kind, hex.EncodeToString(v.Data))
+	case []byte:
+		return fmt.Sprintf("BinData(0, %q)", hex.EncodeToString(v))
+	case bson.Decimal128:
+		return fmt.Sprintf("NumberDecimal(%q)", v.String())
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,396 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package mongoprofiler collects query analytics data from MongoDB profiler system.profile collections.
+package mongoprofiler
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/fingerprint"
+	"github.com/Percona-Lab/pmm-agent/qan"
+)
+
+const (
+	// interval of reading new profiler entries, writing complete buckets and saving positions
+	pollInterval = 10 * time.Second
+
+	// buckets are complete this time after their period end, so late entries are not split into several buckets
+	flushDelay = 10 * time.Second
+
+	queryTimeout = 10 * time.Second
+
+	// maximum number of entries read from a single database at once
+	batchSize = 1000
+
+	// application name of our connections; their operations are not collected
+	appName = "pmm-agent"
+
+	stateFile = "profiler.json"
+)
+
+// profileEntry is system.profile document.
+type profileEntry struct {
+	Op                 string    `bson:"op"`
+	Ns                 string    `bson:"ns"`
+	Command            bson.D    `bson:"command"`
+	Query              bson.D    `bson:"query"`
+	OriginatingCommand bson.D    `bson:"originatingCommand"`
+	DocsExamined       int64     `bson:"docsExamined"`
+	KeysExamined       int64     `bson:"keysExamined"`
+	NReturned          int64     `bson:"nreturned"`
+	Millis             int64     `bson:"millis"`
+	Ts                 time.Time `bson:"ts"`
+}
+
+// seenEntries counts read profiler entries by raw document. Entries have no _id, and BSON dates have
+// millisecond precision, so entries with the same timestamp as the last read one are read again and skipped.
+// nil means that all entries with position timestamp were read, like after restart.
+type seenEntries map[string]int
+
+// Profiler is MongoDB profiler collector.
+type Profiler struct {
+	params *qan.CollectorParams
+	l      *logrus.Entry
+	info   *mgo.DialInfo
+
+	session   *mgo.Session // nil if not connected
+	agg       *qan.Aggregator
+	started   bool                   // true after the first successful read
+	positions map[string]time.Time   // database -> timestamp of the last read entry
+	seen      map[string]seenEntries // database -> read entries with position timestamp
+	saved     map[string]time.Time   // database -> saved timestamp of the last written entry
+	lastErr   string
+}
+
+// New creates a new MongoDB profiler collector. Source DSN is MongoDB connection string.
+func New(params *qan.CollectorParams) (qan.Collector, error) {
+	info, err := mgo.ParseURL(params.Source.DSN)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse DSN")
+	}
+	info.AppName = appName
+	info.Timeout = queryTimeout
+
+	return &Profiler{
+		params: params,
+		l:      logrus.WithField("component", "qan").WithField("source", params.Source.ID),
+		info:   info,
+		// fingerprints are built by collector, dialect is not used
+		agg:       qan.NewAggregator(params.Source.ID, fingerprint.MySQL),
+		positions: make(map[string]time.Time),
+		seen:      make(map[string]seenEntries),
+		saved:     make(map[string]time.Time),
+	}, nil
+}
+
+// Run implements qan.Collector.
+func (p *Profiler) Run(ctx context.Context) {
+	p.loadPositions()
+	defer func() {
+		if p.session != nil {
+			p.session.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		p.read()
+
+		select {
+		case <-ctx.Done():
+			p.flush(time.Time{})
+			return
+		case <-ticker.C:
+			p.flush(time.Now().Add(-flushDelay))
+		}
+	}
+}
+
+// error logs only new errors, like missing permissions, to avoid flooding.
+func (p *Profiler) error(err error) {
+	if err.Error() != p.lastErr {
+		p.l.Error(err)
+		p.lastErr = err.Error()
+	}
+}
+
+// read reads new profiler entries from all databases with enabled profiling.
+func (p *Profiler) read() {
+	if p.session == nil {
+		session, err := mgo.DialWithInfo(p.info)
+		if err != nil {
+			p.error(errors.Wrap(err, "failed to connect"))
+			return
+		}
+		session.SetMode(mgo.Eventual, true)
+		session.SetSocketTimeout(queryTimeout)
+		p.session = session
+	}
+
+	names, err := p.session.DatabaseNames()
+	if err != nil {
+		p.error(errors.Wrap(err, "failed to list databases"))
+		p.session.Close()
+		p.session = nil
+		return
+	}
+
+	present := make(map[string]bool, len(names))
+	var failed bool
+	for _, db := range names {
+		present[db] = true
+		if db == "local" {
+			continue
+		}
+		if err = p.readDatabase(db); err != nil {
+			p.error(errors.Wrapf(err, "database %s", db))
+			failed = true
+		}
+	}
+	for db := range p.positions {
+		if !present[db] {
+			delete(p.positions, db)
+			delete(p.seen, db)
+		}
+	}
+	p.started = true
+	if !failed {
+		p.lastErr = ""
+	}
+}
+
+// readDatabase reads new entries of a single database profiler.
+func (p *Profiler) readDatabase(db string) error {
+	d := p.session.DB(db)
+	var status struct {
+		Was int `bson:"was"`
+	}
+	if err := d.Run(bson.D{{Name: "profile", Value: -1}}, &status); err != nil {
+		return errors.WithStack(err)
+	}
+	if status.Was == 0 {
+		return nil
+	}
+
+	c := d.C("system.profile")
+	pos, ok := p.positions[db]
+	if !ok && !p.started {
+		// skip entries written before the first start, like slowlog collector skips old log
+		var last profileEntry
+		err := c.Find(nil).Sort("-ts").One(&last)
+		if err != nil && err != mgo.ErrNotFound {
+			return errors.WithStack(err)
+		}
+		pos = last.Ts
+		p.positions[db] = pos
+		p.saved[db] = pos
+		p.l.Infof("Reading %s profiler entries after %s.", db, pos)
+	}
+
+	return p.readEntries(db, pos, func(filter bson.M, limit int) iter {
+		return c.Find(filter).Sort("ts").Limit(limit).Iter()
+	})
+}
+
+// iter is a subset of *mgo.Iter methods used by readEntries.
+type iter interface {
+	Next(result interface{}) bool
+	Close() error
+}
+
+// readEntries reads new entries of a single database profiler after a given position.
+// find should return entries matching filter sorted by timestamp, up to limit.
+func (p *Profiler) readEntries(db string, pos time.Time, find func(filter bson.M, limit int) iter) error {
+	seen := p.seen[db]
+	for {
+		op := "$gt"
+		skip := make(seenEntries, len(seen))
+		var limit int
+		if seen != nil {
+			op = "$gte"
+			for doc, n := range seen {
+				skip[doc] = n
+				limit += n
+			}
+		}
+		limit += batchSize
+
+		var n, read int
+		iter := find(bson.M{
+			"ts":      bson.M{op: pos},
+			"appName": bson.M{"$ne": appName},
+		}, limit)
+		var raw bson.Raw
+		for iter.Next(&raw) {
+			n++
+			doc := string(raw.Data)
+			ts, err := entryTime(raw)
+			if err != nil {
+				p.l.Warnf("Failed to decode %s profiler entry timestamp: %s.", db, err)
+				continue
+			}
+			if ts.Equal(pos) && skip[doc] > 0 {
+				skip[doc]--
+				continue
+			}
+
+			// position is advanced even if entry can't be decoded, so it is not read again
+			if seen == nil || ts.After(pos) {
+				pos = ts
+				seen = make(seenEntries)
+			}
+			seen[doc]++
+			read++
+
+			var e profileEntry
+			if err = raw.Unmarshal(&e); err != nil {
+				p.l.Warnf("Failed to decode %s profiler entry: %s.", db, err)
+				continue
+			}
+			p.add(db, &e)
+		}
+		p.positions[db] = pos
+		p.seen[db] = seen
+		if err := iter.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+		if n < limit {
+			return nil
+		}
+		if read == 0 {
+			// full batch without usable timestamps; reading it again would not advance position
+			return errors.Errorf("failed to decode timestamps of %d entries after %s", n, pos)
+		}
+	}
+}
+
+// entryTime returns timestamp of raw profiler entry without decoding other fields.
+func entryTime(raw bson.Raw) (time.Time, error) {
+	var doc bson.RawD
+	if err := raw.Unmarshal(&doc); err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+	for _, e := range doc {
+		if e.Name == "ts" {
+			var ts time.Time
+			err := e.Value.Unmarshal(&ts)
+			return ts, errors.WithStack(err)
+		}
+	}
+	return time.Time{}, errors.New("no ts field")
+}
+
+// add adds profiler entry to its bucket.
+func (p *Profiler) add(db string, e *profileEntry) {
+	cmd := command(e)
+	p.agg.Add(&qan.Event{
+		Time:        e.Ts,
+		Query:       queryExample(cmd),
+		Fingerprint: queryFingerprint(e, cmd),
+		Schema:      db,
+		Metrics: map[string]float64{
+			qan.MetricQueryTime: float64(e.Millis) / 1000,
+			"docs_examined":     float64(e.DocsExamined),
+			"keys_examined":     float64(e.KeysExamined),
+			"nreturned":         float64(e.NReturned),
+		},
+	})
+}
+
+// flush writes buckets with periods ended before a given time (all buckets for zero time) to spool,
+// and saves positions of the last written entries.
+func (p *Profiler) flush(before time.Time) {
+	if err := p.params.Sender.Write(p.agg.Flush(before)); err != nil {
+		p.l.Error(err)
+	}
+
+	// entries of not written buckets are read again after restart;
+	// BSON dates have millisecond precision
+	cutoff := before.Truncate(qan.BucketPeriod).Add(-time.Millisecond)
+	positions := make(map[string]time.Time, len(p.positions))
+	var changed bool
+	for db, pos := range p.positions {
+		if !before.IsZero() && pos.After(cutoff) {
+			pos = cutoff
+		}
+		if saved, ok := p.saved[db]; ok && pos.Before(saved) {
+			pos = saved
+		}
+		positions[db] = pos
+		if saved, ok := p.saved[db]; !ok || !saved.Equal(pos) {
+			changed = true
+		}
+	}
+	if !changed && len(positions) == len(p.saved) {
+		return
+	}
+
+	if err := p.savePositions(positions); err != nil {
+		p.l.Errorf("Failed to save positions: %s.", err)
+		return
+	}
+	p.saved = positions
+}
+
+// loadPositions loads saved positions from state file.
+func (p *Profiler) loadPositions() {
+	b, err := ioutil.ReadFile(filepath.Join(p.params.StateDir, stateFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			p.l.Warnf("Failed to read saved positions: %s.", err)
+		}
+		return
+	}
+	positions := make(map[string]time.Time)
+	if err = json.Unmarshal(b, &positions); err != nil {
+		p.l.Warnf("Failed to parse saved positions: %s.", err)
+		return
+	}
+	for db, pos := range positions {
+		p.positions[db] = pos
+		p.saved[db] = pos
+	}
+}
+
+// savePositions writes positions to state file atomically.
+func (p *Profiler) savePositions(positions map[string]time.Time) error {
+	b, err := json.Marshal(positions)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	path := filepath.Join(p.params.StateDir, stateFile)
+	if err = ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(path+".tmp", path))
+}
+
+// check interfaces
+var (
+	_ qan.Collector = (*Profiler)(nil)
+)
@@ -0,0 +1,191 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package mongoprofiler
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/fingerprint"
+	"github.com/Percona-Lab/pmm-agent/qan"
+)
+
+// testCollection is in-memory system.profile collection with entries sorted by timestamp.
+type testCollection struct {
+	entries []bson.Raw
+	reads   int
+}
+
+func (c *testCollection) find(filter bson.M, limit int) iter {
+	c.reads++
+	ts := filter["ts"].(bson.M)
+	res := &testIter{}
+	for _, raw := range c.entries {
+		t, err := entryTime(raw)
+		if err != nil {
+			panic(err)
+		}
+		if pos, ok := ts["$gt"]; ok && !t.After(pos.(time.Time)) {
+			continue
+		}
+		if pos, ok := ts["$gte"]; ok && t.Before(pos.(time.Time)) {
+			continue
+		}
+		if len(res.entries) == limit {
+			break
+		}
+		res.entries = append(res.entries, raw)
+	}
+	return res
+}
+
+type testIter struct {
+	entries []bson.Raw
+}
+
+func (i *testIter) Next(result interface{}) bool {
+	if len(i.entries) == 0 {
+		return false
+	}
+	*result.(*bson.Raw) = i.entries[0]
+	i.entries = i.entries[1:]
+	return true
+}
+
+func (i *testIter) Close() error { return nil }
+
+// testEntry returns raw profiler entry; entries with different n are different documents.
+func testEntry(t *testing.T, ts time.Time, n int) bson.Raw {
+	b, err := bson.Marshal(bson.D{
+		{Name: "op", Value: "query"},
+		{Name: "ns", Value: "test.c"},
+		{Name: "command", Value: bson.D{{Name: "find", Value: "c"}, {Name: "filter", Value: bson.D{{Name: "n", Value: n}}}}},
+		{Name: "millis", Value: 1},
+		{Name: "ts", Value: ts},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bson.Raw{Kind: 3, Data: b}
+}
+
+// corruptEntry returns raw profiler entry with valid timestamp that can't be fully decoded.
+func corruptEntry(t *testing.T, ts time.Time, n int) bson.Raw {
+	raw := testEntry(t, ts, n)
+	i := bytes.Index(raw.Data, []byte("find"))
+	raw.Data[i-1] = 0xEE // unknown element kind in command
+	var e profileEntry
+	if err := raw.Unmarshal(&e); err == nil {
+		t.Fatal("expected decoding error")
+	}
+	return raw
+}
+
+func newTestProfiler(t *testing.T) *Profiler {
+	return &Profiler{
+		l:         logrus.WithField("test", t.Name()),
+		agg:       qan.NewAggregator("test", fingerprint.MySQL),
+		positions: make(map[string]time.Time),
+		seen:      make(map[string]seenEntries),
+		saved:     make(map[string]time.Time),
+	}
+}
+
+// readTest reads new entries and returns the number of added ones.
+func (p *Profiler) readTest(t *testing.T, c *testCollection) uint64 {
+	if err := p.readEntries("test", p.positions["test"], c.find); err != nil {
+		t.Fatal(err)
+	}
+	var n uint64
+	for _, b := range p.agg.Flush(time.Time{}) {
+		n += b.Count
+	}
+	return n
+}
+
+func TestReadEntries(t *testing.T) {
+	t1 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Millisecond)
+
+	t.Run("SameTimestamp", func(t *testing.T) {
+		p := newTestProfiler(t)
+		p.positions["test"] = t1.Add(-time.Second)
+		c := &testCollection{entries: []bson.Raw{testEntry(t, t1, 1), testEntry(t, t1, 2)}}
+		if n := p.readTest(t, c); n != 2 {
+			t.Errorf("expected 2 entries, got %d", n)
+		}
+		if !p.positions["test"].Equal(t1) {
+			t.Errorf("expected position %s, got %s", t1, p.positions["test"])
+		}
+
+		// new entries with the same timestamp, including one identical to already read entry
+		c.entries = append(c.entries, testEntry(t, t1, 3), testEntry(t, t1, 1), testEntry(t, t2, 4))
+		if n := p.readTest(t, c); n != 3 {
+			t.Errorf("expected 3 entries, got %d", n)
+		}
+		if !p.positions["test"].Equal(t2) {
+			t.Errorf("expected position %s, got %s", t2, p.positions["test"])
+		}
+
+		if n := p.readTest(t, c); n != 0 {
+			t.Errorf("expected 0 entries, got %d", n)
+		}
+	})
+
+	t.Run("ManySameTimestamp", func(t *testing.T) {
+		p := newTestProfiler(t)
+		p.positions["test"] = t1.Add(-time.Second)
+		c := new(testCollection)
+		for i := 0; i < batchSize*5/2; i++ {
+			c.entries = append(c.entries, testEntry(t, t1, i))
+		}
+		if n := p.readTest(t, c); n != batchSize*5/2 {
+			t.Errorf("expected %d entries, got %d", batchSize*5/2, n)
+		}
+		if c.reads != 3 {
+			t.Errorf("expected 3 reads, got %d", c.reads)
+		}
+		if n := p.readTest(t, c); n != 0 {
+			t.Errorf("expected 0 entries, got %d", n)
+		}
+	})
+
+	t.Run("Undecodable", func(t *testing.T) {
+		p := newTestProfiler(t)
+		p.positions["test"] = t1.Add(-time.Second)
+		c := new(testCollection)
+		var last time.Time
+		for i := 0; i < batchSize*3/2; i++ {
+			last = t1.Add(time.Duration(i/2) * time.Millisecond)
+			c.entries = append(c.entries, corruptEntry(t, last, i))
+		}
+		c.entries = append(c.entries, testEntry(t, last, -1))
+		if n := p.readTest(t, c); n != 1 {
+			t.Errorf("expected 1 entry, got %d", n)
+		}
+		if !p.positions["test"].Equal(last) {
+			t.Errorf("expected position %s, got %s", last, p.positions["test"])
+		}
+		if n := p.readTest(t, c); n != 0 {
+			t.Errorf("expected 0 entries, got %d", n)
+		}
+	})
+}
@@ -0,0 +1,315 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package perfschema collects query analytics data from MySQL performance_schema statement digests.
+package perfschema
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql" // register SQL driver
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/fingerprint"
+	"github.com/Percona-Lab/pmm-agent/qan"
+)
+
+const (
+	// interval of reading examples from events_statements_history_long which keeps only the last statements
+	historyInterval = 10 * time.Second
+
+	queryTimeout = 10 * time.Second
+
+	// performance_schema timers are in picoseconds
+	picosecond = 1e-12
+)
+
+// column is events_statements_summary_by_digest column with a sum of metric values.
+type column struct {
+	name   string
+	metric string
+	scale  float64
+}
+
+var columns = []column{
+	{"SUM_TIMER_WAIT", qan.MetricQueryTime, picosecond},
+	{"SUM_LOCK_TIME", "lock_time", picosecond},
+	{"SUM_ERRORS", "errors", 1},
+	{"SUM_WARNINGS", "warnings", 1},
+	{"SUM_ROWS_AFFECTED", "rows_affected", 1},
+	{"SUM_ROWS_SENT", "rows_sent", 1},
+	{"SUM_ROWS_EXAMINED", "rows_examined", 1},
+	{"SUM_CREATED_TMP_DISK_TABLES", "tmp_disk_tables", 1},
+	{"SUM_CREATED_TMP_TABLES", "tmp_tables", 1},
+	{"SUM_SELECT_FULL_JOIN", "full_join", 1},
+	{"SUM_SELECT_FULL_RANGE_JOIN", "select_full_range_join", 1},
+	{"SUM_SELECT_RANGE", "select_range", 1},
+	{"SUM_SELECT_RANGE_CHECK", "select_range_check", 1},
+	{"SUM_SELECT_SCAN", "full_scan", 1},
+	{"SUM_SORT_MERGE_PASSES", "merge_passes", 1},
+	{"SUM_SORT_RANGE", "sort_range", 1},
+	{"SUM_SORT_ROWS", "sort_rows", 1},
+	{"SUM_SORT_SCAN", "sort_scan", 1},
+	{"SUM_NO_INDEX_USED", "no_index_used", 1},
+	{"SUM_NO_GOOD_INDEX_USED", "no_good_index_used", 1},
+}
+
+type digestKey struct {
+	schema string
+	digest string
+}
+
+// digestRow is events_statements_summary_by_digest row.
+type digestRow struct {
+	digestText string
+	count      uint64
+	firstSeen  float64 // Unix time
+	sums       []float64
+	minWait    float64 // MIN_TIMER_WAIT since digest was first seen
+	maxWait    float64 // MAX_TIMER_WAIT since digest was first seen
+}
+
+// snapshot is events_statements_summary_by_digest content.
+type snapshot struct {
+	time       time.Time // agent time
+	serverTime float64   // server Unix time before reading
+	rows       map[digestKey]*digestRow
+}
+
+// example is the slowest query of digest.
+type example struct {
+	query     string
+	timerWait uint64
+}
+
+// PerfSchema is performance_schema collector.
+type PerfSchema struct {
+	params   *qan.CollectorParams
+	l        *logrus.Entry
+	db       *sql.DB
+	prev     *snapshot
+	examples map[digestKey]*example
+}
+
+// New creates a new performance_schema collector.
+func New(params *qan.CollectorParams) (qan.Collector, error) {
+	db, err := sql.Open("mysql", params.Source.DSN)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+
+	return &PerfSchema{
+		params:   params,
+		l:        logrus.WithField("component", "qan").WithField("source", params.Source.ID),
+		db:       db,
+		examples: make(map[digestKey]*example),
+	}, nil
+}
+
+// Run implements qan.Collector.
+func (p *PerfSchema) Run(ctx context.Context) {
+	defer p.db.Close()
+
+	p.collect(ctx, false)
+	historyTicker := time.NewTicker(historyInterval)
+	defer historyTicker.Stop()
+	next := time.Now().Truncate(qan.BucketPeriod).Add(qan.BucketPeriod)
+	for {
+		select {
+		case <-ctx.Done():
+			// the last partial period
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+			p.collect(shutdownCtx, true)
+			cancel()
+			return
+
+		case <-historyTicker.C:
+			p.readExamples(ctx)
+
+		case <-time.After(time.Until(next)):
+			p.collect(ctx, true)
+			for !next.After(time.Now()) {
+				next = next.Add(qan.BucketPeriod)
+			}
+		}
+	}
+}
+
+// collect reads examples and a new snapshot. If write is true, deltas since the previous snapshot
+// are written as buckets.
+func (p *PerfSchema) collect(ctx context.Context, write bool) {
+	p.readExamples(ctx)
+	s, err := p.readSnapshot(ctx)
+	if err != nil {
+		p.l.Errorf("Failed to read statement digests: %s.", err)
+		return
+	}
+
+	if write && p.prev != nil {
+		agg := qan.NewAggregator(p.params.Source.ID, fingerprint.MySQL)
+		for _, e := range p.deltas(s) {
+			agg.Add(e)
+		}
+		if err = p.params.Sender.Write(agg.Flush(time.Time{})); err != nil {
+			p.l.Error(err)
+		}
+	}
+	p.prev = s
+	p.examples = make(map[digestKey]*example)
+}
+
+// deltas returns events for changes between the previous and a given snapshots.
+func (p *PerfSchema) deltas(s *snapshot) []*qan.Event {
+	var res []*qan.Event
+	for key, row := range s.rows {
+		count := row.count
+		sums := row.sums
+		minWait, maxWait := row.minWait, row.maxWait
+
+		// use the whole row if digest is new, was evicted and added again, or table was truncated
+		prev := p.prev.rows[key]
+		if prev != nil && row.count >= prev.count && row.firstSeen < p.prev.serverTime {
+			count -= prev.count
+			sums = make([]float64, len(columns))
+			for i := range sums {
+				if d := row.sums[i] - prev.sums[i]; d > 0 {
+					sums[i] = d
+				}
+			}
+
+			// MIN_TIMER_WAIT and MAX_TIMER_WAIT are not reset between snapshots;
+			// they are known for this period only if they were changed during it
+			if row.minWait >= prev.minWait {
+				minWait = -1
+			}
+			if row.maxWait <= prev.maxWait {
+				maxWait = -1
+			}
+		}
+		if count == 0 {
+			continue
+		}
+
+		e := &qan.Event{
+			Time:    p.prev.time,
+			Query:   row.digestText,
+			Schema:  key.schema,
+			Count:   count,
+			Metrics: make(map[string]float64, len(columns)),
+		}
+		for i, c := range columns {
+			e.Metrics[c.metric] = sums[i] * c.scale / float64(count)
+		}
+		if minWait >= 0 {
+			e.Min = map[string]float64{qan.MetricQueryTime: minWait * picosecond}
+		}
+		if maxWait >= 0 {
+			e.Max = map[string]float64{qan.MetricQueryTime: maxWait * picosecond}
+		}
+		if ex := p.examples[key]; ex != nil {
+			e.Example = ex.query
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+// readSnapshot reads events_statements_summary_by_digest.
+func (p *PerfSchema) readSnapshot(ctx context.Context) (*snapshot, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	s := &snapshot{
+		time: time.Now(),
+		rows: make(map[digestKey]*digestRow),
+	}
+	if err := p.db.QueryRowContext(ctx, "SELECT UNIX_TIMESTAMP(NOW(6))").Scan(&s.serverTime); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.name
+	}
+	q := "SELECT IFNULL(SCHEMA_NAME, ''), DIGEST, IFNULL(DIGEST_TEXT, ''), COUNT_STAR, UNIX_TIMESTAMP(FIRST_SEEN), " +
+		"MIN_TIMER_WAIT, MAX_TIMER_WAIT, " +
+		strings.Join(names, ", ") + " FROM performance_schema.events_statements_summary_by_digest WHERE DIGEST IS NOT NULL"
+	rows, err := p.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key digestKey
+		row := &digestRow{
+			sums: make([]float64, len(columns)),
+		}
+		dest := []interface{}{&key.schema, &key.digest, &row.digestText, &row.count, &row.firstSeen, &row.minWait, &row.maxWait}
+		for i := range row.sums {
+			dest = append(dest, &row.sums[i])
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		s.rows[key] = row
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return s, nil
+}
+
+// readExamples reads the slowest query examples from events_statements_history_long.
+// Errors are logged, and are not fatal: examples are optional.
+func (p *PerfSchema) readExamples(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	rows, err := p.db.QueryContext(ctx, "SELECT IFNULL(CURRENT_SCHEMA, ''), DIGEST, SQL_TEXT, IFNULL(TIMER_WAIT, 0) "+
+		"FROM performance_schema.events_statements_history_long WHERE DIGEST IS NOT NULL AND SQL_TEXT IS NOT NULL")
+	if err != nil {
+		p.l.Debugf("Failed to read statements history: %s.", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key digestKey
+		var ex example
+		if err = rows.Scan(&key.schema, &key.digest, &ex.query, &ex.timerWait); err != nil {
+			p.l.Debugf("Failed to read statements history: %s.", err)
+			return
+		}
+		if prev := p.examples[key]; prev == nil || ex.timerWait > prev.timerWait {
+			p.examples[key] = &ex
+		}
+	}
+	if err = rows.Err(); err != nil {
+		p.l.Debugf("Failed to read statements history: %s.", err)
+	}
+}
+
+// check interfaces
+var (
+	_ qan.Collector = (*PerfSchema)(nil)
+)
@@ -0,0 +1,202 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package perfschema
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/qan"
+	"github.com/Percona-Lab/pmm-agent/spool"
+)
+
+// testDigest is events_statements_summary_by_digest row; times are in seconds.
+type testDigest struct {
+	digest    string
+	count     int64
+	firstSeen int64
+	min       float64
+	max       float64
+	sum       float64
+}
+
+// expectCollect sets expectations for a single collect call.
+func expectCollect(mock sqlmock.Sqlmock, serverTime int64, digests ...testDigest) {
+	mock.ExpectQuery("FROM performance_schema.events_statements_history_long").
+		WillReturnRows(sqlmock.NewRows([]string{"CURRENT_SCHEMA", "DIGEST", "SQL_TEXT", "TIMER_WAIT"}))
+	mock.ExpectQuery(`^SELECT UNIX_TIMESTAMP\(NOW\(6\)\)$`).
+		WillReturnRows(sqlmock.NewRows([]string{"time"}).AddRow(serverTime))
+
+	names := []string{"SCHEMA_NAME", "DIGEST", "DIGEST_TEXT", "COUNT_STAR", "FIRST_SEEN", "MIN_TIMER_WAIT", "MAX_TIMER_WAIT"}
+	for _, c := range columns {
+		names = append(names, c.name)
+	}
+	rows := sqlmock.NewRows(names)
+	for _, d := range digests {
+		values := []driver.Value{"db", d.digest, "SELECT * FROM `t` WHERE `id` = ?", d.count, d.firstSeen,
+			int64(d.min / picosecond), int64(d.max / picosecond)}
+		for _, c := range columns {
+			switch c.metric {
+			case qan.MetricQueryTime:
+				values = append(values, int64(d.sum/picosecond))
+			case "rows_sent":
+				values = append(values, d.count)
+			default:
+				values = append(values, int64(0))
+			}
+		}
+		rows.AddRow(values...)
+	}
+	mock.ExpectQuery("FROM performance_schema.events_statements_summary_by_digest WHERE DIGEST IS NOT NULL").
+		WillReturnRows(rows)
+}
+
+func TestPerfSchemaDeltas(t *testing.T) {
+	prev := testDigest{digest: "d1", count: 10, firstSeen: 900, min: 0.5, max: 2, sum: 10}
+
+	for _, tc := range []struct {
+		name     string
+		next     testDigest
+		count    uint64
+		expected api.MetricStats // of query_time
+	}{
+		{
+			name:     "Delta",
+			next:     testDigest{digest: "d1", count: 15, firstSeen: 900, min: 0.5, max: 5, sum: 20},
+			count:    5,
+			expected: api.MetricStats{Count: 5, Sum: 10, Min: 2, Max: 5}, // minimum is not known, average is used
+		},
+		{
+			name:     "DeltaWithoutNewExtremes",
+			next:     testDigest{digest: "d1", count: 12, firstSeen: 900, min: 0.5, max: 2, sum: 13},
+			count:    2,
+			expected: api.MetricStats{Count: 2, Sum: 3, Min: 1.5, Max: 1.5},
+		},
+		{
+			name:     "Truncated",
+			next:     testDigest{digest: "d1", count: 3, firstSeen: 1010, min: 0.1, max: 0.7, sum: 1.2},
+			count:    3,
+			expected: api.MetricStats{Count: 3, Sum: 1.2, Min: 0.1, Max: 0.7},
+		},
+		{
+			name:     "EvictedAndAddedAgain",
+			next:     testDigest{digest: "d1", count: 12, firstSeen: 1030, min: 0.25, max: 3, sum: 12},
+			count:    12,
+			expected: api.MetricStats{Count: 12, Sum: 12, Min: 0.25, Max: 3},
+		},
+		{
+			name:     "New",
+			next:     testDigest{digest: "d2", count: 2, firstSeen: 1030, min: 0.2, max: 0.8, sum: 1},
+			count:    2,
+			expected: api.MetricStats{Count: 2, Sum: 1, Min: 0.2, Max: 0.8},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "pmm-agent-perfschema-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			s, err := spool.Open(&spool.Params{
+				Dir:         filepath.Join(dir, "spool"),
+				Name:        "qan",
+				MaxSize:     1024 * 1024,
+				SegmentSize: 64 * 1024,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			p := &PerfSchema{
+				params: &qan.CollectorParams{
+					Source: &api.QANSource{ID: "mysql1"},
+					Sender: qan.NewSender(s, 1024*1024),
+				},
+				l:        logrus.WithField("test", t.Name()),
+				db:       db,
+				examples: make(map[digestKey]*example),
+			}
+
+			// unchanged digest produces no bucket
+			unchanged := testDigest{digest: "d3", count: 7, firstSeen: 900, min: 1, max: 1, sum: 7}
+			expectCollect(mock, 1000, prev, unchanged)
+			expectCollect(mock, 1060, tc.next, unchanged)
+			p.collect(context.Background(), false)
+			p.collect(context.Background(), true)
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+
+			records, _, err := s.Peek(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 1 {
+				t.Fatalf("expected 1 bucket, got %d", len(records))
+			}
+			var b api.QueryBucket
+			if err = json.Unmarshal(records[0], &b); err != nil {
+				t.Fatal(err)
+			}
+			if b.Count != tc.count {
+				t.Errorf("expected count %d, got %d", tc.count, b.Count)
+			}
+			if m := b.Metrics["rows_sent"]; m == nil || m.Sum != float64(tc.count) {
+				t.Errorf("unexpected rows_sent: %+v", m)
+			}
+
+			m := b.Metrics[qan.MetricQueryTime]
+			if m == nil {
+				t.Fatal("no query_time")
+			}
+			const eps = 1e-9
+			for _, f := range []struct {
+				name             string
+				actual, expected float64
+			}{
+				{"count", float64(m.Count), float64(tc.expected.Count)},
+				{"sum", m.Sum, tc.expected.Sum},
+				{"min", m.Min, tc.expected.Min},
+				{"max", m.Max, tc.expected.Max},
+			} {
+				if d := f.actual - f.expected; d > eps || d < -eps {
+					t.Errorf("query_time %s: expected %v, got %v", f.name, f.expected, f.actual)
+				}
+			}
+			if m.P50 != 0 || m.P95 != 0 || m.P99 != 0 || m.Sketch != nil {
+				t.Errorf("unexpected query_time percentiles of aggregated events: %+v", m)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pglog
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Percona-Lab/pmm-agent/qan/tail"
+)
+
+// Log formats.
+const (
+	FormatStderr  = "stderr"
+	FormatCSVLog  = "csvlog"
+	FormatJSONLog = "jsonlog"
+)
+
+// entry is a single log entry.
+type entry struct {
+	time     time.Time // may be zero
+	pid      string    // may be empty
+	database string    // may be empty
+	severity string
+	message  string
+	pos      tail.Position // position of the first line
+}
+
+// decoder splits log lines into entries.
+type decoder interface {
+	// line decodes a single line without newline. pos is line position in the file.
+	// It returns entry if it is complete.
+	line(line string, pos tail.Position) *entry
+
+	// flush returns entry in progress, if any, when the end of file is reached.
+	flush() *entry
+
+	// pending returns position of entry in progress, if any.
+	pending() (tail.Position, bool)
+
+	// reset discards entry in progress after rotation or truncation.
+	reset()
+}
+
+func newDecoder(format string) decoder {
+	switch format {
+	case FormatCSVLog:
+		return new(csvDecoder)
+	case FormatJSONLog:
+		return new(jsonDecoder)
+	default:
+		return new(stderrDecoder)
+	}
+}
+
+var (
+	// severity separates log_line_prefix and message
+	severityRe = regexp.MustCompile(`^(.*?)\b(DEBUG[1-5]|INFO|NOTICE|WARNING|ERROR|LOG|FATAL|PANIC|DETAIL|HINT|QUERY|CONTEXT|LOCATION|STATEMENT):  (.*)$`)
+
+	// %t, %m and %n prefix escapes, and zone name or offset
+	prefixTimeRe = regexp.MustCompile(`(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?)(?: ([A-Za-z]+|[+-]\d+))?|^(\d{10}\.\d+)`)
+
+	// %p escape in common prefixes like "[%p]", "[%p-%l]" and "pid=%p"
+	prefixPIDRe = regexp.MustCompile(`\[(\d+)(?:-\d+)?\]|\bpid=(\d+)`)
+
+	// %d escape in common prefixes like "db=%d"
+	prefixDatabaseRe = regexp.MustCompile(`\bdb=([^\s,@]+)`)
+)
+
+// stderrDecoder decodes stderr format with any log_line_prefix. Messages continue on lines starting with tab.
+// Time and database are found in prefix only if it contains %m, %t or %n, and "db=%d".
+// Backend PID is found only if prefix contains "[%p]" (as the default "%m [%p] "), "[%p-%l]" or "pid=%p";
+// without it, auto_explain plans can't be merged with duration statements, and are counted separately.
+type stderrDecoder struct {
+	e *entry
+}
+
+func (d *stderrDecoder) line(line string, pos tail.Position) *entry {
+	if strings.HasPrefix(line, "\t") {
+		if d.e != nil {
+			d.e.message += "\n" + line[1:]
+		}
+		return nil
+	}
+
+	res := d.flush()
+	m := severityRe.FindStringSubmatch(line)
+	if m == nil {
+		// not a server log line
+		return res
+	}
+
+	prefix := m[1]
+	d.e = &entry{
+		severity: m[2],
+		message:  m[3],
+		pos:      pos,
+	}
+	if tm := prefixTimeRe.FindStringSubmatch(prefix); tm != nil {
+		if tm[3] != "" {
+			// seconds and fraction are parsed separately to avoid float rounding
+			parts := strings.SplitN(tm[3], ".", 2)
+			sec, err1 := strconv.ParseInt(parts[0], 10, 64)
+			frac, err2 := strconv.ParseInt((parts[1] + "000000000")[:9], 10, 64)
+			if err1 == nil && err2 == nil {
+				d.e.time = time.Unix(sec, frac)
+			}
+		} else {
+			d.e.time = parseTime(tm[1], tm[2])
+		}
+	}
+	if pm := prefixPIDRe.FindStringSubmatch(prefix); pm != nil {
+		d.e.pid = pm[1] + pm[2]
+	}
+	if dm := prefixDatabaseRe.FindStringSubmatch(prefix); dm != nil && dm[1] != "[unknown]" {
+		d.e.database = dm[1]
+	}
+	return res
+}
+
+func (d *stderrDecoder) flush() *entry {
+	res := d.e
+	d.e = nil
+	return res
+}
+
+func (d *stderrDecoder) pending() (tail.Position, bool) {
+	if d.e == nil {
+		return tail.Position{}, false
+	}
+	return d.e.pos, true
+}
+
+func (d *stderrDecoder) reset() {
+	d.e = nil
+}
+
+// csvlog columns
+const (
+	csvLogTime       = 0
+	csvDatabase      = 2
+	csvPID           = 3
+	csvSeverity      = 11
+	csvMessage       = 13
+	csvMinFields     = 14
+	csvMaxRecordSize = 16 * 1024 * 1024
+)
+
+// csvDecoder decodes csvlog format. Quoted fields may contain newlines.
+type csvDecoder struct {
+	record string
+	quotes int
+	pos    tail.Position
+}
+
+func (d *csvDecoder) line(line string, pos tail.Position) *entry {
+	if d.record == "" {
+		d.pos = pos
+	} else {
+		d.record += "\n"
+	}
+	d.record += line
+	d.quotes += strings.Count(line, `"`)
+	if d.quotes%2 != 0 {
+		if len(d.record) > csvMaxRecordSize {
+			// not a csvlog file, or broken record
+			d.reset()
+		}
+		return nil
+	}
+
+	record, pos := d.record, d.pos
+	d.reset()
+	fields, err := csv.NewReader(strings.NewReader(record)).Read()
+	if err != nil || len(fields) < csvMinFields {
+		return nil
+	}
+	return &entry{
+		time:     parseTimeWithZone(fields[csvLogTime]),
+		pid:      fields[csvPID],
+		database: fields[csvDatabase],
+		severity: fields[csvSeverity],
+		message:  fields[csvMessage],
+		pos:      pos,
+	}
+}
+
+func (d *csvDecoder) flush() *entry {
+	// records are complete when quotes are balanced
+	return nil
+}
+
+func (d *csvDecoder) pending() (tail.Position, bool) {
+	if d.record == "" {
+		return tail.Position{}, false
+	}
+	return d.pos, true
+}
+
+func (d *csvDecoder) reset() {
+	d.record = ""
+	d.quotes = 0
+}
+
+// jsonDecoder decodes jsonlog format (PostgreSQL 15+): one JSON object per line.
+type jsonDecoder struct{}
+
+func (d *jsonDecoder) line(line string, pos tail.Position) *entry {
+	var e struct {
+		Timestamp string `json:"timestamp"`
+		PID       int64  `json:"pid"`
+		Database  string `json:"dbname"`
+		Severity  string `json:"error_severity"`
+		Message   string `json:"message"`
+	}
+	if err := json.Unmarshal([]byte(line), &e); err != nil {
+		return nil
+	}
+	res := &entry{
+		time:     parseTimeWithZone(e.Timestamp),
+		database: e.Database,
+		severity: e.Severity,
+		message:  e.Message,
+		pos:      pos,
+	}
+	if e.PID != 0 {
+		res.pid = strconv.FormatInt(e.PID, 10)
+	}
+	return res
+}
+
+func (d *jsonDecoder) flush() *entry {
+	return nil
+}
+
+func (d *jsonDecoder) pending() (tail.Position, bool) {
+	return tail.Position{}, false
+}
+
+func (d *jsonDecoder) reset() {}
+
+// parseTimeWithZone parses time like "2018-10-15 13:59:52.123 UTC" from csvlog and jsonlog.
+func parseTimeWithZone(s string) time.Time {
+	var zone string
+	if i := strings.LastIndexByte(s, ' '); i > 0 && strings.IndexByte(s[i:], ':') < 0 {
+		s, zone = s[:i], s[i+1:]
+	}
+	return parseTime(s, zone)
+}
+
+// parseTime parses time like "2018-10-15 13:59:52.123" in zone like "UTC", "CEST" or "+03",
+// or returns zero time. Unknown zone names are treated as local time zone.
+func parseTime(s, zone string) time.Time {
+	const layout = "2006-01-02 15:04:05.999999999"
+	if zone == "" {
+		t, _ := time.ParseInLocation(layout, s, time.Local)
+		return t
+	}
+
+	if zone[0] == '+' || zone[0] == '-' {
+		for _, l := range []string{" -07", " -0700"} {
+			if t, err := time.Parse(layout+l, s+" "+zone); err == nil {
+				return t
+			}
+		}
+		return time.Time{}
+	}
+
+	if zone == "UTC" || zone == "GMT" {
+		t, _ := time.ParseInLocation(layout, s, time.UTC)
+		return t
+	}
+
+	// offset is used if zone name is known for local time zone
+	t, err := time.ParseInLocation(layout+" MST", s+" "+zone, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	if _, offset := t.Zone(); offset == 0 {
+		t, _ = time.ParseInLocation(layout, s, time.Local)
+	}
+	return t
+}
@@ -0,0 +1,204 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pglog
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Percona-Lab/pmm-agent/qan/tail"
+)
+
+// Event represents a single statement execution.
+type Event struct {
+	Time     time.Time // statement end time; may be zero
+	Database string    // may be empty
+	Query    string
+	Plan     string  // auto_explain plan without query text; may be empty
+	Duration float64 // in seconds
+
+	pos tail.Position // position of the first entry
+}
+
+var (
+	// log_min_duration_statement and auto_explain messages; parse and bind steps are skipped
+	durationRe = regexp.MustCompile(`(?s)^duration: (\d+(?:\.\d+)?) ms  (statement|execute [^:]*|plan):\s*(.*)$`)
+
+	// the first line of text plan after query text
+	planNodeRe = regexp.MustCompile(`^\S.*\((?:cost|actual)[ =]`)
+)
+
+// planExpireTicks is a number of expire calls after which auto_explain plan without matching
+// duration statement is returned as event.
+const planExpireTicks = 2
+
+type pendingPlan struct {
+	*Event
+	ticks int
+}
+
+// parser converts log entries into events. auto_explain plans are merged with duration statements
+// of the same backend and query, so statements logged by both are counted once.
+// Entries without backend PID (stderr log_line_prefix without %p) are never merged.
+type parser struct {
+	plans map[string]*pendingPlan // by backend PID
+}
+
+func newParser() *parser {
+	return &parser{
+		plans: make(map[string]*pendingPlan),
+	}
+}
+
+// entry parses a single log entry, and returns complete events.
+func (p *parser) entry(e *entry) []*Event {
+	if e.severity != "LOG" {
+		return nil
+	}
+	m := durationRe.FindStringSubmatch(e.message)
+	if m == nil {
+		return nil
+	}
+	ms, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return nil
+	}
+	event := &Event{
+		Time:     e.time,
+		Database: e.database,
+		Duration: ms / 1000,
+		pos:      e.pos,
+	}
+
+	if e.pid == "" {
+		if m[2] != "plan" {
+			event.Query = m[3]
+		} else if event.Query, event.Plan = splitPlan(m[3]); event.Query == "" {
+			return nil
+		}
+		return []*Event{event}
+	}
+
+	var res []*Event
+	pending := p.plans[e.pid]
+	delete(p.plans, e.pid)
+
+	if m[2] == "plan" {
+		if event.Query, event.Plan = splitPlan(m[3]); event.Query == "" {
+			return nil
+		}
+		if pending != nil {
+			res = append(res, pending.Event)
+		}
+		p.plans[e.pid] = &pendingPlan{Event: event}
+		return res
+	}
+
+	event.Query = m[3]
+	if pending != nil {
+		if normalize(pending.Query) == normalize(event.Query) {
+			event.Plan = pending.Plan
+			if pending.pos.Before(event.pos) {
+				event.pos = pending.pos
+			}
+		} else {
+			// plan of a nested statement, or statement faster than log_min_duration_statement
+			res = append(res, pending.Event)
+		}
+	}
+	return append(res, event)
+}
+
+// expire should be called periodically. It returns plans without matching duration statements.
+func (p *parser) expire() []*Event {
+	var res []*Event
+	for pid, plan := range p.plans {
+		plan.ticks++
+		if plan.ticks >= planExpireTicks {
+			res = append(res, plan.Event)
+			delete(p.plans, pid)
+		}
+	}
+	return res
+}
+
+// flush returns all pending plans.
+func (p *parser) flush() []*Event {
+	var res []*Event
+	for pid, plan := range p.plans {
+		res = append(res, plan.Event)
+		delete(p.plans, pid)
+	}
+	return res
+}
+
+// pending returns position of the earliest pending plan, if any.
+func (p *parser) pending() (tail.Position, bool) {
+	var res tail.Position
+	var ok bool
+	for _, plan := range p.plans {
+		if !ok || plan.pos.Before(res) {
+			res = plan.pos
+			ok = true
+		}
+	}
+	return res, ok
+}
+
+// normalize returns query text for comparison of auto_explain and statement queries.
+func normalize(query string) string {
+	return strings.TrimRight(strings.TrimSpace(query), "; \t\n")
+}
+
+// splitPlan splits auto_explain output in text or JSON format into query text and plan.
+// It returns empty query if format is not supported.
+func splitPlan(s string) (string, string) {
+	s = strings.TrimSpace(s)
+
+	if strings.HasPrefix(s, "{") {
+		var plan map[string]interface{}
+		if err := json.Unmarshal([]byte(s), &plan); err != nil {
+			return "", ""
+		}
+		query, _ := plan["Query Text"].(string)
+		delete(plan, "Query Text")
+		b, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			return "", ""
+		}
+		return query, string(b)
+	}
+
+	const prefix = "Query Text: "
+	if !strings.HasPrefix(s, prefix) {
+		return "", ""
+	}
+	lines := strings.Split(s[len(prefix):], "\n")
+
+	// query may span several lines; if the first plan node is not found, query is assumed to be a single line
+	n := 1
+	for i := 1; i < len(lines); i++ {
+		if planNodeRe.MatchString(lines[i]) {
+			n = i
+			break
+		}
+	}
+	return strings.Join(lines[:n], "\n"), strings.Join(lines[n:], "\n")
+}
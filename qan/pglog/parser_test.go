@@ -0,0 +1,140 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pglog
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Percona-Lab/pmm-agent/qan/tail"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+// parseFile returns all events of a given file in a given format.
+func parseFile(t *testing.T, path, format string) []*Event {
+	t.Helper()
+	tailer := tail.New(path)
+	if err := tailer.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer tailer.Close()
+
+	d := newDecoder(format)
+	p := newParser()
+	var res []*Event
+	for {
+		line, pos, err := tailer.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e := d.line(line, pos); e != nil {
+			res = append(res, p.entry(e)...)
+		}
+	}
+	if e := d.flush(); e != nil {
+		res = append(res, p.entry(e)...)
+	}
+
+	// pending plans are returned in random order
+	pending := p.flush()
+	sort.Slice(pending, func(i, j int) bool { return pending[i].pos.Before(pending[j].pos) })
+	return append(res, pending...)
+}
+
+func TestParserGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no samples")
+	}
+	for _, file := range files {
+		file := file
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			// format is the first part of file name, like stderr-nopid.log
+			format := strings.TrimSuffix(filepath.Base(file), ".log")
+			if i := strings.IndexByte(format, '-'); i > 0 {
+				format = format[:i]
+			}
+
+			events := parseFile(t, file, format)
+			for _, e := range events {
+				e.Time = e.Time.UTC()
+			}
+			actual, err := json.MarshalIndent(events, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual = append(actual, '\n')
+
+			golden := strings.TrimSuffix(file, ".log") + ".json"
+			if *updateGolden {
+				if err = ioutil.WriteFile(golden, actual, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(actual) != string(expected) {
+				t.Errorf("events do not match %s (run with -update to see the difference with git diff):\n%s", golden, actual)
+			}
+		})
+	}
+}
+
+func TestStderrPrefixes(t *testing.T) {
+	for _, tc := range []struct {
+		prefix   string
+		time     string // UTC
+		pid      string
+		database string
+	}{
+		{"2018-10-15 13:59:52.123 UTC [101] ", "2018-10-15T13:59:52.123Z", "101", ""},
+		{"2018-10-15 13:59:52 UTC [101-1] db=shop,user=app ", "2018-10-15T13:59:52Z", "101", "shop"},
+		{"2018-10-15 16:59:52.5 +03 pid=101 db=shop ", "2018-10-15T13:59:52.5Z", "101", "shop"},
+		{"1539611992.123 [101] ", "2018-10-15T13:59:52.123Z", "101", ""},
+		{"db=[unknown] ", "0001-01-01T00:00:00Z", "", ""},
+		{"", "0001-01-01T00:00:00Z", "", ""},
+	} {
+		d := new(stderrDecoder)
+		d.line(tc.prefix+"LOG:  duration: 1.000 ms  statement: SELECT 1", tail.Position{})
+		e := d.flush()
+		if e == nil {
+			t.Errorf("%q: no entry", tc.prefix)
+			continue
+		}
+		if tm := e.time.UTC().Format("2006-01-02T15:04:05.999999999Z07:00"); tm != tc.time || e.pid != tc.pid || e.database != tc.database {
+			t.Errorf("%q: unexpected time %s, PID %q, database %q", tc.prefix, tm, e.pid, e.database)
+		}
+		if e.severity != "LOG" || e.message != "duration: 1.000 ms  statement: SELECT 1" {
+			t.Errorf("%q: unexpected entry %+v", tc.prefix, e)
+		}
+	}
+}
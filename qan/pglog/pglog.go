@@ -0,0 +1,267 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package pglog collects query analytics data from PostgreSQL server log: statement durations
+// logged by log_min_duration_statement, and execution plans logged by auto_explain extension.
+package pglog
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/fingerprint"
+	"github.com/Percona-Lab/pmm-agent/qan"
+	"github.com/Percona-Lab/pmm-agent/qan/tail"
+)
+
+const (
+	// interval of checking for new data, rotation and truncation after the end of file is reached
+	pollInterval = time.Second
+
+	// interval of writing complete buckets and saving position
+	flushInterval = 10 * time.Second
+
+	// buckets are complete this time after their period end, so late events are not split into several buckets
+	flushDelay = 10 * time.Second
+
+	stateFile = "pglog.json"
+)
+
+// PGLog is PostgreSQL log collector.
+type PGLog struct {
+	params *qan.CollectorParams
+	l      *logrus.Entry
+
+	t       *tail.Tailer
+	d       decoder
+	p       *parser
+	agg     *qan.Aggregator
+	pending map[int64]tail.Position // period start (Unix time) -> position of the first event of that period
+	saved   tail.Position
+}
+
+// New creates a new PostgreSQL log collector. Source path should be a fixed path of the log file,
+// or a symlink to the current log file; source format is one of Format* constants (stderr by default).
+// For stderr format, log_line_prefix should contain "[%p]" (like the default "%m [%p] ") so auto_explain plans
+// are merged with duration statements of the same backend, and "db=%d" for schema.
+func New(params *qan.CollectorParams) (qan.Collector, error) {
+	if !filepath.IsAbs(params.Source.Path) {
+		return nil, errors.Errorf("log path should be absolute, got %q", params.Source.Path)
+	}
+	switch params.Source.Format {
+	case "", FormatStderr, FormatCSVLog, FormatJSONLog:
+	default:
+		return nil, errors.Errorf("unexpected log format %q, expected %s, %s or %s",
+			params.Source.Format, FormatStderr, FormatCSVLog, FormatJSONLog)
+	}
+
+	return &PGLog{
+		params:  params,
+		l:       logrus.WithField("component", "qan").WithField("source", params.Source.ID),
+		t:       tail.New(params.Source.Path),
+		d:       newDecoder(params.Source.Format),
+		p:       newParser(),
+		agg:     qan.NewAggregator(params.Source.ID, fingerprint.PostgreSQL),
+		pending: make(map[int64]tail.Position),
+	}, nil
+}
+
+// Run implements qan.Collector.
+func (c *PGLog) Run(ctx context.Context) {
+	c.open()
+	defer c.t.Close()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	lastFlush := time.Now()
+	var lastErr string
+	for {
+		if time.Since(lastFlush) >= flushInterval {
+			c.flush(time.Now().Add(-flushDelay))
+			lastFlush = time.Now()
+		}
+
+		line, pos, err := c.t.ReadLine()
+		if err == nil {
+			if e := c.d.line(line, pos); e != nil {
+				c.add(c.p.entry(e))
+			}
+
+			select {
+			case <-ctx.Done():
+				c.stop()
+				return
+			default:
+				continue
+			}
+		}
+
+		if err != io.EOF {
+			c.l.Errorf("Failed to read %s: %s.", c.t.Path(), err)
+			c.t.Close()
+		}
+		if e := c.d.flush(); e != nil {
+			c.add(c.p.entry(e))
+		}
+
+		select {
+		case <-ctx.Done():
+			c.stop()
+			return
+		case <-ticker.C:
+		}
+		c.add(c.p.expire())
+
+		switched, err := c.t.Check()
+		if err != nil {
+			// log only new errors, like missing permissions, to avoid flooding
+			if err.Error() != lastErr {
+				c.l.Errorf("Failed to open %s: %s.", c.t.Path(), err)
+				lastErr = err.Error()
+			}
+			continue
+		}
+		lastErr = ""
+		if switched {
+			c.l.Infof("%s was rotated or truncated, reading from the start.", c.t.Path())
+			c.d.reset()
+		}
+	}
+}
+
+// stop writes all pending events and buckets.
+func (c *PGLog) stop() {
+	c.add(c.p.flush())
+	c.flush(time.Time{})
+}
+
+// open opens log at the saved position. If there is no saved position, it starts from the end of file.
+// If file was rotated since position was saved, it starts from the start of the new file.
+func (c *PGLog) open() {
+	var saved *tail.Position
+	if b, err := ioutil.ReadFile(filepath.Join(c.params.StateDir, stateFile)); err == nil {
+		saved = new(tail.Position)
+		if err = json.Unmarshal(b, saved); err != nil {
+			c.l.Warnf("Failed to parse saved position: %s.", err)
+			saved = nil
+		}
+	}
+
+	fi, err := os.Stat(c.t.Path())
+	if err != nil {
+		// tailer will open file when it is created
+		c.l.Warnf("Failed to open %s: %s.", c.t.Path(), err)
+		return
+	}
+
+	var offset int64
+	switch {
+	case saved == nil:
+		offset = fi.Size()
+	case saved.Inode == tail.Inode(fi):
+		offset = saved.Offset
+	}
+	if err = c.t.Open(offset); err != nil {
+		c.l.Errorf("Failed to open %s: %s.", c.t.Path(), err)
+		return
+	}
+	c.l.Infof("Reading %s from offset %d.", c.t.Path(), c.t.Offset())
+}
+
+// add adds events to their buckets.
+func (c *PGLog) add(events []*Event) {
+	for _, e := range events {
+		t := e.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+
+		period := t.Truncate(qan.BucketPeriod).Unix()
+		if p, ok := c.pending[period]; !ok || e.pos.Before(p) {
+			c.pending[period] = e.pos
+		}
+
+		c.agg.Add(&qan.Event{
+			Time:   t,
+			Query:  e.Query,
+			Plan:   e.Plan,
+			Schema: e.Database,
+			Metrics: map[string]float64{
+				qan.MetricQueryTime: e.Duration,
+			},
+		})
+	}
+}
+
+// flush writes buckets with periods ended before a given time (all buckets for zero time) to spool,
+// and saves position of the first event which is not written yet.
+func (c *PGLog) flush(before time.Time) {
+	if err := c.params.Sender.Write(c.agg.Flush(before)); err != nil {
+		c.l.Error(err)
+	}
+
+	pos := c.t.Pos()
+	if p, ok := c.d.pending(); ok && p.Before(pos) {
+		pos = p
+	}
+	if p, ok := c.p.pending(); ok && p.Before(pos) {
+		pos = p
+	}
+	for period, p := range c.pending {
+		if before.IsZero() || !time.Unix(period, 0).Add(qan.BucketPeriod).After(before) {
+			delete(c.pending, period)
+			continue
+		}
+		if p.Before(pos) {
+			pos = p
+		}
+	}
+
+	if pos == c.saved || c.t.Inode() == 0 {
+		return
+	}
+	if err := c.savePosition(pos); err != nil {
+		c.l.Errorf("Failed to save position: %s.", err)
+		return
+	}
+	c.saved = pos
+}
+
+// savePosition writes position to state file atomically.
+func (c *PGLog) savePosition(pos tail.Position) error {
+	b, err := json.Marshal(pos)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	path := filepath.Join(c.params.StateDir, stateFile)
+	if err = ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(path+".tmp", path))
+}
+
+// check interfaces
+var (
+	_ qan.Collector = (*PGLog)(nil)
+)
@@ -0,0 +1,315 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package pgstatements collects query analytics data from PostgreSQL pg_stat_statements extension.
+package pgstatements
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/fingerprint"
+	"github.com/Percona-Lab/pmm-agent/qan"
+)
+
+const (
+	queryTimeout = 10 * time.Second
+
+	// pg_stat_statements times are in milliseconds
+	millisecond = 1e-3
+
+	// total_time was renamed in PostgreSQL 13
+	version13 = 130000
+
+	// pg_stat_statements_info view was added in PostgreSQL 14
+	version14 = 140000
+)
+
+// column is pg_stat_statements column with a sum of metric values.
+type column struct {
+	name   string
+	metric string
+	scale  float64
+}
+
+var columns = []column{
+	{"total_time", qan.MetricQueryTime, millisecond},
+	{"rows", "rows", 1},
+	{"shared_blks_hit", "shared_blks_hit", 1},
+	{"shared_blks_read", "shared_blks_read", 1},
+	{"shared_blks_dirtied", "shared_blks_dirtied", 1},
+	{"shared_blks_written", "shared_blks_written", 1},
+	{"local_blks_hit", "local_blks_hit", 1},
+	{"local_blks_read", "local_blks_read", 1},
+	{"local_blks_dirtied", "local_blks_dirtied", 1},
+	{"local_blks_written", "local_blks_written", 1},
+	{"temp_blks_read", "temp_blks_read", 1},
+	{"temp_blks_written", "temp_blks_written", 1},
+	{"blk_read_time", "blk_read_time", millisecond},
+	{"blk_write_time", "blk_write_time", millisecond},
+}
+
+// statementKey is pg_stat_statements entry key.
+type statementKey struct {
+	userID   int64
+	database string
+	queryID  int64
+}
+
+// statementRow is pg_stat_statements row without query text.
+type statementRow struct {
+	calls int64
+	sums  []float64
+}
+
+// snapshot is pg_stat_statements content.
+type snapshot struct {
+	time  time.Time
+	reset time.Time // stats reset time for PostgreSQL 14+, zero otherwise
+	rows  map[statementKey]*statementRow
+}
+
+// PGStatements is pg_stat_statements collector.
+type PGStatements struct {
+	params  *qan.CollectorParams
+	l       *logrus.Entry
+	db      *sql.DB
+	version int
+	prev    *snapshot
+	queries map[int64]string // normalized query texts by queryid
+}
+
+// New creates a new pg_stat_statements collector.
+func New(params *qan.CollectorParams) (qan.Collector, error) {
+	db, err := sql.Open("postgres", params.Source.DSN)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+
+	return &PGStatements{
+		params:  params,
+		l:       logrus.WithField("component", "qan").WithField("source", params.Source.ID),
+		db:      db,
+		queries: make(map[int64]string),
+	}, nil
+}
+
+// Run implements qan.Collector.
+func (p *PGStatements) Run(ctx context.Context) {
+	defer p.db.Close()
+
+	p.collect(ctx, false)
+	next := time.Now().Truncate(qan.BucketPeriod).Add(qan.BucketPeriod)
+	for {
+		select {
+		case <-ctx.Done():
+			// the last partial period
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+			p.collect(shutdownCtx, true)
+			cancel()
+			return
+
+		case <-time.After(time.Until(next)):
+			p.collect(ctx, true)
+			for !next.After(time.Now()) {
+				next = next.Add(qan.BucketPeriod)
+			}
+		}
+	}
+}
+
+// collect reads a new snapshot. If write is true, deltas since the previous snapshot are written as buckets.
+func (p *PGStatements) collect(ctx context.Context, write bool) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	s, err := p.readSnapshot(ctx)
+	if err == nil {
+		err = p.readQueries(ctx, s)
+	}
+	if err != nil {
+		p.l.Errorf("Failed to read pg_stat_statements: %s.", err)
+		return
+	}
+
+	if write && p.prev != nil {
+		agg := qan.NewAggregator(p.params.Source.ID, fingerprint.PostgreSQL)
+		for _, e := range p.deltas(s) {
+			agg.Add(e)
+		}
+		if err = p.params.Sender.Write(agg.Flush(time.Time{})); err != nil {
+			p.l.Error(err)
+		}
+	}
+	p.prev = s
+}
+
+// deltas returns events for changes between the previous and a given snapshots.
+func (p *PGStatements) deltas(s *snapshot) []*qan.Event {
+	reset := s.reset.After(p.prev.reset)
+	if reset {
+		p.l.Infof("pg_stat_statements was reset at %s.", s.reset)
+	}
+
+	var res []*qan.Event
+	for key, row := range s.rows {
+		calls := row.calls
+		sums := row.sums
+
+		// use the whole row if entry is new, or was deallocated and added again, or all stats were reset;
+		// any decreased counter means that entry was reset
+		if prev := p.prev.rows[key]; prev != nil && !reset && row.calls >= prev.calls {
+			deltaSums := make([]float64, len(columns))
+			for i := range deltaSums {
+				if deltaSums[i] = row.sums[i] - prev.sums[i]; deltaSums[i] < 0 {
+					deltaSums = nil
+					break
+				}
+			}
+			if deltaSums != nil {
+				calls -= prev.calls
+				sums = deltaSums
+			}
+		}
+		if calls == 0 {
+			continue
+		}
+
+		e := &qan.Event{
+			Time:    p.prev.time,
+			Query:   p.queries[key.queryID],
+			Schema:  key.database,
+			Count:   uint64(calls),
+			Metrics: make(map[string]float64, len(columns)),
+		}
+		for i, c := range columns {
+			e.Metrics[c.metric] = sums[i] * c.scale / float64(calls)
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+// readSnapshot reads pg_stat_statements counters without query texts.
+func (p *PGStatements) readSnapshot(ctx context.Context) (*snapshot, error) {
+	if p.version == 0 {
+		var v string
+		if err := p.db.QueryRowContext(ctx, "SHOW server_version_num").Scan(&v); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unexpected server_version_num %q", v)
+		}
+		p.version = version
+	}
+
+	s := &snapshot{
+		time: time.Now(),
+		rows: make(map[statementKey]*statementRow),
+	}
+	if p.version >= version14 {
+		if err := p.db.QueryRowContext(ctx, "SELECT stats_reset FROM pg_stat_statements_info").Scan(&s.reset); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = "s." + c.name
+		if c.name == "total_time" && p.version >= version13 {
+			names[i] = "s.total_exec_time"
+		}
+	}
+	q := "SELECT s.userid, d.datname, s.queryid, s.calls, " + strings.Join(names, ", ") +
+		" FROM pg_stat_statements(false) s JOIN pg_database d ON d.oid = s.dbid WHERE s.queryid IS NOT NULL"
+	rows, err := p.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key statementKey
+		row := &statementRow{
+			sums: make([]float64, len(columns)),
+		}
+		dest := []interface{}{&key.userID, &key.database, &key.queryID, &row.calls}
+		for i := range row.sums {
+			dest = append(dest, &row.sums[i])
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		s.rows[key] = row
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return s, nil
+}
+
+// readQueries reads normalized texts of new queries of snapshot, and forgets texts of removed ones.
+func (p *PGStatements) readQueries(ctx context.Context, s *snapshot) error {
+	present := make(map[int64]bool, len(s.rows))
+	var missing []int64
+	for key := range s.rows {
+		if !present[key.queryID] && p.queries[key.queryID] == "" {
+			missing = append(missing, key.queryID)
+		}
+		present[key.queryID] = true
+	}
+	for id := range p.queries {
+		if !present[id] {
+			delete(p.queries, id)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	rows, err := p.db.QueryContext(ctx, "SELECT queryid, query FROM pg_stat_statements WHERE queryid = ANY($1)", pq.Array(missing))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var query sql.NullString
+		if err = rows.Scan(&id, &query); err != nil {
+			return errors.WithStack(err)
+		}
+		if query.Valid {
+			p.queries[id] = query.String
+		}
+	}
+	return errors.WithStack(rows.Err())
+}
+
+// check interfaces
+var (
+	_ qan.Collector = (*PGStatements)(nil)
+)
@@ -0,0 +1,238 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pgstatements
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/qan"
+	"github.com/Percona-Lab/pmm-agent/spool"
+)
+
+// testStatement is pg_stat_statements row; time is in milliseconds.
+type testStatement struct {
+	queryID int64
+	calls   int64
+	time    float64
+}
+
+// expectCollect sets expectations for a single collect call. Version is queried only once, stats reset time
+// only for PostgreSQL 14+, query texts only for new query IDs.
+func expectCollect(mock sqlmock.Sqlmock, version int, first bool, reset time.Time, newQueries []int64, statements ...testStatement) {
+	if first {
+		mock.ExpectQuery(`^SHOW server_version_num$`).
+			WillReturnRows(sqlmock.NewRows([]string{"server_version_num"}).AddRow(fmt.Sprint(version)))
+	}
+	if version >= version14 {
+		mock.ExpectQuery(`^SELECT stats_reset FROM pg_stat_statements_info$`).
+			WillReturnRows(sqlmock.NewRows([]string{"stats_reset"}).AddRow(reset))
+	}
+
+	timeColumn := `s\.total_time`
+	if version >= version13 {
+		timeColumn = `s\.total_exec_time`
+	}
+	names := []string{"userid", "datname", "queryid", "calls"}
+	for _, c := range columns {
+		names = append(names, c.name)
+	}
+	rows := sqlmock.NewRows(names)
+	for _, s := range statements {
+		values := []driver.Value{int64(10), "db", s.queryID, s.calls}
+		for _, c := range columns {
+			switch c.metric {
+			case qan.MetricQueryTime:
+				values = append(values, s.time)
+			case "rows":
+				values = append(values, float64(s.calls))
+			default:
+				values = append(values, float64(0))
+			}
+		}
+		rows.AddRow(values...)
+	}
+	mock.ExpectQuery(`^SELECT s\.userid, d\.datname, s\.queryid, s\.calls, ` + timeColumn + `, s\.rows, .+ FROM pg_stat_statements\(false\) s`).
+		WillReturnRows(rows)
+
+	if len(newQueries) != 0 {
+		texts := sqlmock.NewRows([]string{"queryid", "query"})
+		for _, id := range newQueries {
+			texts.AddRow(id, fmt.Sprintf("SELECT * FROM t%d WHERE id = $1", id))
+		}
+		mock.ExpectQuery(`^SELECT queryid, query FROM pg_stat_statements WHERE queryid = ANY\(\$1\)$`).
+			WillReturnRows(texts)
+	}
+}
+
+func TestPGStatementsDeltas(t *testing.T) {
+	reset := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	prev := testStatement{queryID: 1, calls: 10, time: 100}
+
+	for _, tc := range []struct {
+		name       string
+		version    int
+		reset      time.Time
+		next       testStatement
+		newQueries []int64
+		count      uint64
+		sum        float64 // of query_time in seconds
+		buckets    int     // in addition to the checked one
+	}{
+		{
+			name:    "Delta",
+			version: 140000,
+			reset:   reset,
+			next:    testStatement{queryID: 1, calls: 15, time: 160},
+			count:   5,
+			sum:     0.06,
+		},
+		{
+			name:    "DeltaPG12",
+			version: 120000,
+			next:    testStatement{queryID: 1, calls: 15, time: 160},
+			count:   5,
+			sum:     0.06,
+		},
+		{
+			name:    "StatsReset",
+			version: 140000,
+			reset:   reset.Add(time.Minute),
+			next:    testStatement{queryID: 1, calls: 12, time: 120}, // counters are larger, but were reset
+			count:   12,
+			sum:     0.12,
+			buckets: 1, // unchanged entry is counted after reset too
+		},
+		{
+			name:    "DecreasedCalls",
+			version: 130000,
+			next:    testStatement{queryID: 1, calls: 3, time: 30}, // reset with pg_stat_statements_reset(userid, dbid, queryid)
+			count:   3,
+			sum:     0.03,
+		},
+		{
+			name:    "DecreasedSum",
+			version: 130000,
+			next:    testStatement{queryID: 1, calls: 12, time: 50}, // deallocated and added again
+			count:   12,
+			sum:     0.05,
+		},
+		{
+			name:       "NewQueryID",
+			version:    140000,
+			reset:      reset,
+			next:       testStatement{queryID: 2, calls: 2, time: 30},
+			newQueries: []int64{2},
+			count:      2,
+			sum:        0.03,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "pmm-agent-pgstatements-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			s, err := spool.Open(&spool.Params{
+				Dir:         filepath.Join(dir, "spool"),
+				Name:        "qan",
+				MaxSize:     1024 * 1024,
+				SegmentSize: 64 * 1024,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			p := &PGStatements{
+				params: &qan.CollectorParams{
+					Source: &api.QANSource{ID: "postgresql1"},
+					Sender: qan.NewSender(s, 1024*1024),
+				},
+				l:       logrus.WithField("test", t.Name()),
+				db:      db,
+				queries: make(map[int64]string),
+			}
+
+			// unchanged entry, and entry without calls (for example, after reset) produce no buckets
+			unchanged := testStatement{queryID: 3, calls: 7, time: 7}
+			noCalls := testStatement{queryID: 4}
+			next := []testStatement{tc.next, unchanged, noCalls}
+			if tc.next.queryID != prev.queryID {
+				next = append(next, prev)
+			}
+			expectCollect(mock, tc.version, true, reset, []int64{1, 3, 4}, prev, unchanged, noCalls)
+			expectCollect(mock, tc.version, false, tc.reset, tc.newQueries, next...)
+			p.collect(context.Background(), false)
+			p.collect(context.Background(), true)
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+
+			records, _, err := s.Peek(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != tc.buckets+1 {
+				t.Fatalf("expected %d buckets, got %d", tc.buckets+1, len(records))
+			}
+			buckets := make(map[string]*api.QueryBucket)
+			for _, r := range records {
+				var b api.QueryBucket
+				if err = json.Unmarshal(r, &b); err != nil {
+					t.Fatal(err)
+				}
+				buckets[b.Fingerprint] = &b
+			}
+			b := buckets[fmt.Sprintf("select * from t%d where id = ?", tc.next.queryID)]
+			if b == nil || b.Schema != "db" {
+				t.Fatalf("unexpected buckets %+v", buckets)
+			}
+			if b.Count != tc.count {
+				t.Errorf("expected count %d, got %d", tc.count, b.Count)
+			}
+			if m := b.Metrics["rows"]; m == nil || m.Sum != float64(tc.count) {
+				t.Errorf("unexpected rows: %+v", m)
+			}
+			m := b.Metrics[qan.MetricQueryTime]
+			if m == nil {
+				t.Fatal("no query_time")
+			}
+			if d := m.Sum - tc.sum; d > 1e-9 || d < -1e-9 {
+				t.Errorf("expected query_time sum %v, got %v", tc.sum, m.Sum)
+			}
+		})
+	}
+}
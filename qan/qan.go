@@ -0,0 +1,63 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package qan collects query analytics data: queries are grouped by fingerprint and schema
+// into one-minute buckets which are sent to PMM server.
+package qan
+
+import (
+	"context"
+	"time"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+)
+
+// BucketPeriod is a length of bucket period.
+const BucketPeriod = time.Minute
+
+// MetricQueryTime is a name of query execution time metric (in seconds) used by all collectors.
+// The slowest query by that metric is used as bucket example.
+const MetricQueryTime = "query_time"
+
+// Event represents a single query execution, or several executions of the same query.
+type Event struct {
+	Time        time.Time          // execution time used to select bucket
+	Query       string             // query text used for fingerprint
+	Fingerprint string             // if not empty, used instead of Query fingerprint
+	Example     string             // query example; if empty, Query is used
+	Plan        string             // execution plan of query example, if known
+	Schema      string             // default database, may be empty
+	Count       uint64             // number of executions; if zero, 1 is used
+	Metrics     map[string]float64 // by name, for example: query_time; averages for several executions
+	Min         map[string]float64 // by name, known minimums for several executions; if absent, Metrics value is used
+	Max         map[string]float64 // by name, known maximums for several executions; if absent, Metrics value is used
+}
+
+// Collector collects query analytics data from a single source.
+type Collector interface {
+	// Run collects data until ctx is canceled. Before return, it writes all pending buckets.
+	Run(ctx context.Context)
+}
+
+// CollectorParams represent collector parameters.
+type CollectorParams struct {
+	Source   *api.QANSource
+	StateDir string  // private directory for collector state, like log offset; exists
+	Sender   *Sender // writes buckets to spool
+}
+
+// NewCollectorFunc creates a new collector for a given source type.
+type NewCollectorFunc func(params *CollectorParams) (Collector, error)
@@ -0,0 +1,201 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package qan
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/fingerprint"
+)
+
+// planExpressionKeys are PostgreSQL and MySQL EXPLAIN properties which may contain literals.
+var planExpressionKeys = map[string]bool{
+	// MySQL
+	"attached_condition": true,
+	"index_condition":    true,
+
+	// PostgreSQL
+	"Cache Key":           true,
+	"Conflict Filter":     true,
+	"Filter":              true,
+	"Function Call":       true,
+	"Group Key":           true,
+	"Hash Cond":           true,
+	"Hash Key":            true,
+	"Index Cond":          true,
+	"Join Filter":         true,
+	"Merge Cond":          true,
+	"One-Time Filter":     true,
+	"Order By":            true,
+	"Output":              true,
+	"Presorted Key":       true,
+	"Recheck Cond":        true,
+	"Repeatable":          true,
+	"Run Condition":       true,
+	"Sampling":            true,
+	"Sort Key":            true,
+	"Table Function Call": true,
+	"TID Cond":            true,
+}
+
+type redactionRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// redactor redacts query examples of a single source according to its policy.
+type redactor struct {
+	mode    string
+	dialect fingerprint.Dialect
+	rules   []redactionRule
+}
+
+// newRedactor creates a new redactor for a given policy and source type.
+func newRedactor(policy *api.RedactionPolicy, sourceType string) (*redactor, error) {
+	r := &redactor{
+		mode:    policy.Mode,
+		dialect: fingerprint.MySQL,
+	}
+	switch sourceType {
+	case api.TypePostgreSQLPGStatements, api.TypePostgreSQLLog:
+		r.dialect = fingerprint.PostgreSQL
+	}
+
+	switch policy.Mode {
+	case api.RedactionNone, api.RedactionFingerprint, api.RedactionMask:
+	case api.RedactionRegex:
+		if len(policy.Rules) == 0 {
+			return nil, errors.Errorf("no rules for %s redaction mode", policy.Mode)
+		}
+	default:
+		return nil, errors.Errorf("unexpected redaction mode %q", policy.Mode)
+	}
+
+	for i, rule := range policy.Rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "redaction rule %d", i)
+		}
+		r.rules = append(r.rules, redactionRule{
+			re:          re,
+			replacement: rule.Replacement,
+		})
+	}
+	return r, nil
+}
+
+// redact returns redacted example, and true if it was changed by redaction.
+func (r *redactor) redact(example string) (string, bool) {
+	if example == "" {
+		return "", false
+	}
+
+	switch r.mode {
+	case api.RedactionFingerprint:
+		return "", true
+
+	case api.RedactionMask:
+		masked, literals := fingerprint.Mask(example, r.dialect)
+		return masked, literals > 0
+
+	case api.RedactionRegex:
+		var redacted bool
+		for _, rule := range r.rules {
+			if rule.re.MatchString(example) {
+				example = rule.re.ReplaceAllString(example, rule.replacement)
+				redacted = true
+			}
+		}
+		return example, redacted
+
+	default:
+		return example, false
+	}
+}
+
+// redactPlan returns redacted execution plan, and true if it was changed by redaction.
+func (r *redactor) redactPlan(plan string) (string, bool) {
+	if plan == "" {
+		return "", false
+	}
+
+	switch r.mode {
+	case api.RedactionMask:
+		masked := r.maskPlan(plan)
+		return masked, masked != plan
+
+	case api.RedactionNone, api.RedactionRegex:
+		return r.redact(plan)
+
+	default:
+		return "", true
+	}
+}
+
+// maskPlan replaces literals in expression properties of plan in text or JSON format.
+// Plans in other formats are removed.
+func (r *redactor) maskPlan(plan string) string {
+	if strings.HasPrefix(strings.TrimSpace(plan), "{") || strings.HasPrefix(strings.TrimSpace(plan), "[") {
+		var v interface{}
+		if err := json.Unmarshal([]byte(plan), &v); err != nil {
+			return ""
+		}
+		b, err := json.MarshalIndent(r.maskPlanValue(v, false), "", "  ")
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+
+	lines := strings.Split(plan, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, " ")
+		j := strings.Index(trimmed, ": ")
+		if j < 0 || !planExpressionKeys[trimmed[:j]] {
+			continue
+		}
+		masked, _ := fingerprint.Mask(trimmed[j+2:], r.dialect)
+		lines[i] = line[:len(line)-len(trimmed)] + trimmed[:j+2] + masked
+	}
+	return strings.Join(lines, "\n")
+}
+
+// maskPlanValue replaces literals in expression properties of plan in JSON format.
+// mask is true for values of expression properties.
+func (r *redactor) maskPlanValue(v interface{}, mask bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, elem := range v {
+			v[k] = r.maskPlanValue(elem, planExpressionKeys[k])
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = r.maskPlanValue(elem, mask)
+		}
+	case string:
+		if mask {
+			masked, _ := fingerprint.Mask(v, r.dialect)
+			return masked
+		}
+	}
+	return v
+}
@@ -0,0 +1,382 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package qan
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/fingerprint"
+	"github.com/Percona-Lab/pmm-agent/spool"
+)
+
+func TestNewRedactor(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		policy     *api.RedactionPolicy
+		sourceType string
+		dialect    fingerprint.Dialect
+		err        bool
+	}{
+		{"None", &api.RedactionPolicy{Mode: api.RedactionNone}, api.TypeMySQLSlowLog, fingerprint.MySQL, false},
+		{"Fingerprint", &api.RedactionPolicy{Mode: api.RedactionFingerprint}, api.TypeMySQLPerfSchema, fingerprint.MySQL, false},
+		{"MaskPGStatements", &api.RedactionPolicy{Mode: api.RedactionMask}, api.TypePostgreSQLPGStatements, fingerprint.PostgreSQL, false},
+		{"MaskPGLog", &api.RedactionPolicy{Mode: api.RedactionMask}, api.TypePostgreSQLLog, fingerprint.PostgreSQL, false},
+		{"Regex", &api.RedactionPolicy{Mode: api.RedactionRegex, Rules: []api.RedactionRule{{Pattern: `\d+`}}}, api.TypeMySQLSlowLog, fingerprint.MySQL, false},
+		{"RegexWithoutRules", &api.RedactionPolicy{Mode: api.RedactionRegex}, api.TypeMySQLSlowLog, 0, true},
+		{"InvalidPattern", &api.RedactionPolicy{Mode: api.RedactionRegex, Rules: []api.RedactionRule{{Pattern: `(`}}}, api.TypeMySQLSlowLog, 0, true},
+		{"UnknownMode", &api.RedactionPolicy{Mode: "hash"}, api.TypeMySQLSlowLog, 0, true},
+		{"EmptyMode", &api.RedactionPolicy{}, api.TypeMySQLSlowLog, 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := newRedactor(tc.policy, tc.sourceType)
+			if tc.err {
+				if err == nil {
+					t.Errorf("expected error, got %+v", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.dialect != tc.dialect {
+				t.Errorf("expected dialect %v, got %v", tc.dialect, r.dialect)
+			}
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	rules := []api.RedactionRule{
+		{Pattern: `'[^']*'`, Replacement: "'***'"},
+		{Pattern: `(card_number\s*=\s*)\d+`, Replacement: "${1}0"},
+	}
+
+	for _, tc := range []struct {
+		name       string
+		policy     *api.RedactionPolicy
+		sourceType string
+		example    string
+		expected   string
+		redacted   bool
+	}{
+		{
+			name:     "None",
+			policy:   &api.RedactionPolicy{Mode: api.RedactionNone},
+			example:  "SELECT * FROM users WHERE name = 'alice'",
+			expected: "SELECT * FROM users WHERE name = 'alice'",
+		},
+		{
+			name:     "Fingerprint",
+			policy:   &api.RedactionPolicy{Mode: api.RedactionFingerprint},
+			example:  "SELECT * FROM users WHERE name = 'alice'",
+			expected: "",
+			redacted: true,
+		},
+		{
+			name:     "Mask",
+			policy:   &api.RedactionPolicy{Mode: api.RedactionMask},
+			example:  "SELECT * FROM users WHERE name = 'alice' AND age > 30",
+			expected: "select * from users where name = ? and age > ?",
+			redacted: true,
+		},
+		{
+			name:     "MaskPlaceholders",
+			policy:   &api.RedactionPolicy{Mode: api.RedactionMask},
+			example:  "SELECT * FROM users WHERE name = ?",
+			expected: "select * from users where name = ?",
+			redacted: true,
+		},
+		{
+			name:     "MaskWithoutLiterals",
+			policy:   &api.RedactionPolicy{Mode: api.RedactionMask},
+			example:  "SELECT *  FROM users",
+			expected: "select * from users",
+		},
+		{
+			name:       "MaskPostgreSQL",
+			policy:     &api.RedactionPolicy{Mode: api.RedactionMask},
+			sourceType: api.TypePostgreSQLLog,
+			example:    `SELECT "it's" FROM users WHERE name = $$alice$$`,
+			expected:   `select "it's" from users where name = ?`,
+			redacted:   true,
+		},
+		{
+			name:     "Regex",
+			policy:   &api.RedactionPolicy{Mode: api.RedactionRegex, Rules: rules},
+			example:  "SELECT * FROM cards WHERE owner = 'alice' AND card_number = 4111111111111111",
+			expected: "SELECT * FROM cards WHERE owner = '***' AND card_number = 0",
+			redacted: true,
+		},
+		{
+			name:     "RegexNoMatch",
+			policy:   &api.RedactionPolicy{Mode: api.RedactionRegex, Rules: rules},
+			example:  "SELECT 1",
+			expected: "SELECT 1",
+		},
+		{
+			name:     "Empty",
+			policy:   &api.RedactionPolicy{Mode: api.RedactionFingerprint},
+			example:  "",
+			expected: "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sourceType := tc.sourceType
+			if sourceType == "" {
+				sourceType = api.TypeMySQLSlowLog
+			}
+			r, err := newRedactor(tc.policy, sourceType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, redacted := r.redact(tc.example)
+			if actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+			if redacted != tc.redacted {
+				t.Errorf("expected redacted %v, got %v", tc.redacted, redacted)
+			}
+		})
+	}
+}
+
+// equalJSON returns true if both strings are equal JSON values.
+func equalJSON(t *testing.T, expected, actual string) bool {
+	var e, a interface{}
+	if err := json.Unmarshal([]byte(expected), &e); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(actual), &a); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(e, a)
+}
+
+func TestRedactPlan(t *testing.T) {
+	const textPlan = `Nested Loop  (cost=0.29..16.34 rows=1 width=72)
+  Output: u.name, 'secret'::text
+  Join Filter: (u.id = o.user_id)
+  ->  Index Scan using users_pkey on public.users u  (cost=0.29..8.30 rows=1 width=36)
+        Index Cond: (u.id = 42)
+        Filter: (u.name = 'alice'::text)
+  ->  Seq Scan on public.orders o  (cost=0.00..8.00 rows=1 width=36)
+        Filter: (o.note ~~ '%: 13%'::text)`
+	const maskedTextPlan = `Nested Loop  (cost=0.29..16.34 rows=1 width=72)
+  Output: u.name, ?::text
+  Join Filter: (u.id = o.user_id)
+  ->  Index Scan using users_pkey on public.users u  (cost=0.29..8.30 rows=1 width=36)
+        Index Cond: (u.id = ?)
+        Filter: (u.name = ?::text)
+  ->  Seq Scan on public.orders o  (cost=0.00..8.00 rows=1 width=36)
+        Filter: (o.note ~~ ?::text)`
+
+	const pgJSONPlan = `[{"Plan": {
+		"Node Type": "Index Scan",
+		"Relation Name": "users 42",
+		"Index Cond": "(id = 42)",
+		"Filter": "(name = 'alice'::text)",
+		"Output": ["name", "'secret'::text"],
+		"Plans": [{"Node Type": "Seq Scan", "Alias": "o 'x'", "Filter": "(total > 100.5)"}]
+	}}]`
+	const maskedPGJSONPlan = `[{"Plan": {
+		"Node Type": "Index Scan",
+		"Relation Name": "users 42",
+		"Index Cond": "(id = ?)",
+		"Filter": "(name = ?::text)",
+		"Output": ["name", "?::text"],
+		"Plans": [{"Node Type": "Seq Scan", "Alias": "o 'x'", "Filter": "(total > ?)"}]
+	}}]`
+
+	const mysqlJSONPlan = `{"query_block": {"select_id": 1, "table": {
+		"table_name": "users",
+		"rows_examined_per_scan": 42,
+		"attached_condition": "(` + "`test`.`users`.`name`" + ` = 'alice')",
+		"index_condition": "(` + "`test`.`users`.`id`" + ` > 10)"
+	}}}`
+	const maskedMySQLJSONPlan = `{"query_block": {"select_id": 1, "table": {
+		"table_name": "users",
+		"rows_examined_per_scan": 42,
+		"attached_condition": "(test.users.name = ?)",
+		"index_condition": "(test.users.id > ?)"
+	}}}`
+
+	for _, tc := range []struct {
+		name       string
+		policy     *api.RedactionPolicy
+		sourceType string
+		plan       string
+		expected   string
+		json       bool // compare expected and actual plans as JSON values
+		redacted   bool
+	}{
+		{
+			name:     "None",
+			policy:   &api.RedactionPolicy{Mode: api.RedactionNone},
+			plan:     textPlan,
+			expected: textPlan,
+		},
+		{
+			name:     "Fingerprint",
+			policy:   &api.RedactionPolicy{Mode: api.RedactionFingerprint},
+			plan:     textPlan,
+			expected: "",
+			redacted: true,
+		},
+		{
+			name: "Regex",
+			policy: &api.RedactionPolicy{Mode: api.RedactionRegex, Rules: []api.RedactionRule{
+				{Pattern: `'[^']*'`, Replacement: "'***'"},
+			}},
+			plan:     "Filter: (u.name = 'alice'::text)",
+			expected: "Filter: (u.name = '***'::text)",
+			redacted: true,
+		},
+		{
+			name:       "MaskText",
+			policy:     &api.RedactionPolicy{Mode: api.RedactionMask},
+			sourceType: api.TypePostgreSQLPGStatements,
+			plan:       textPlan,
+			expected:   maskedTextPlan,
+			redacted:   true,
+		},
+		{
+			name:       "MaskTextWithoutLiterals",
+			policy:     &api.RedactionPolicy{Mode: api.RedactionMask},
+			sourceType: api.TypePostgreSQLPGStatements,
+			plan:       "Seq Scan on t 42  (cost=0.00..35.50 rows=2550 width=4)\n  Filter: (a = b)",
+			expected:   "Seq Scan on t 42  (cost=0.00..35.50 rows=2550 width=4)\n  Filter: (a = b)",
+		},
+		{
+			name:       "MaskPostgreSQLJSON",
+			policy:     &api.RedactionPolicy{Mode: api.RedactionMask},
+			sourceType: api.TypePostgreSQLPGStatements,
+			plan:       pgJSONPlan,
+			expected:   maskedPGJSONPlan,
+			json:       true,
+			redacted:   true,
+		},
+		{
+			name:     "MaskMySQLJSON",
+			policy:   &api.RedactionPolicy{Mode: api.RedactionMask},
+			plan:     mysqlJSONPlan,
+			expected: maskedMySQLJSONPlan,
+			json:     true,
+			redacted: true,
+		},
+		{
+			name:     "MaskInvalidJSON",
+			policy:   &api.RedactionPolicy{Mode: api.RedactionMask},
+			plan:     `{"query_block": {"attached_condition": "(a = 'alice')"`,
+			expected: "",
+			redacted: true,
+		},
+		{
+			name:     "Empty",
+			policy:   &api.RedactionPolicy{Mode: api.RedactionFingerprint},
+			plan:     "",
+			expected: "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sourceType := tc.sourceType
+			if sourceType == "" {
+				sourceType = api.TypeMySQLSlowLog
+			}
+			r, err := newRedactor(tc.policy, sourceType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, redacted := r.redactPlan(tc.plan)
+			if tc.json {
+				if !equalJSON(t, tc.expected, actual) {
+					t.Errorf("expected %s, got %s", tc.expected, actual)
+				}
+			} else if actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+			if redacted != tc.redacted {
+				t.Errorf("expected redacted %v, got %v", tc.redacted, redacted)
+			}
+		})
+	}
+}
+
+func TestSenderRedaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmm-agent-qan-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := spool.Open(&spool.Params{
+		Dir:         filepath.Join(dir, "spool"),
+		Name:        "qan",
+		MaxSize:     1024 * 1024,
+		SegmentSize: 64 * 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	sender := NewSender(s, 1024*1024)
+	r, err := newRedactor(&api.RedactionPolicy{Mode: api.RedactionNone}, api.TypeMySQLSlowLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.setRedactor("with", r)
+	sender.setRedactor("removed", r)
+	sender.setRedactor("removed", nil)
+
+	const example = "SELECT * FROM users WHERE name = 'alice'"
+	const plan = "Filter: (name = 'alice'::text)"
+	var buckets []*api.QueryBucket
+	for _, id := range []string{"with", "without", "removed"} {
+		buckets = append(buckets, &api.QueryBucket{SourceID: id, Example: example, Plan: plan})
+	}
+	if err = sender.Write(buckets); err != nil {
+		t.Fatal(err)
+	}
+
+	records, _, err := s.Peek(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 buckets, got %d", len(records))
+	}
+	for _, record := range records {
+		var b api.QueryBucket
+		if err = json.Unmarshal(record, &b); err != nil {
+			t.Fatal(err)
+		}
+		expectedExample, expectedPlan := "", ""
+		if b.SourceID == "with" {
+			expectedExample, expectedPlan = example, plan
+		}
+		if b.Example != expectedExample || b.Plan != expectedPlan {
+			t.Errorf("%s: expected example %q and plan %q, got %q and %q",
+				b.SourceID, expectedExample, expectedPlan, b.Example, b.Plan)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package qan
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/rpc"
+	"github.com/Percona-Lab/pmm-agent/spool"
+)
+
+const (
+	prometheusNamespace = "pmm_agent"
+	prometheusSubsystem = "qan"
+
+	// maximum number of buckets in a single PushQAN request
+	maxBucketsPerRequest = 500
+
+	// room for PushQANRequest encoding in addition to encoded buckets
+	maxRequestOverhead = 64 * 1024
+)
+
+// dropExamples is used for sources without redactor, so examples never leave host unredacted.
+var dropExamples = &redactor{mode: api.RedactionFingerprint}
+
+// Sender redacts query examples, writes buckets to spool, and sends them to PMM server in order.
+type Sender struct {
+	spool   *spool.Spool
+	l       *logrus.Entry
+	maxSize int
+
+	rw        sync.RWMutex
+	redactors map[string]*redactor // by source ID
+
+	written  *prometheus.CounterVec
+	redacted *prometheus.CounterVec
+	sent     prometheus.Counter
+	retries  prometheus.Counter
+	dropped  *prometheus.CounterVec
+}
+
+// NewSender creates a new sender for a given spool. PushQAN requests are limited by a given maximum RPC message size.
+func NewSender(spool *spool.Spool, maxMessageSize int) *Sender {
+	return &Sender{
+		spool:     spool,
+		l:         logrus.WithField("component", "qan"),
+		maxSize:   maxMessageSize - maxRequestOverhead,
+		redactors: make(map[string]*redactor),
+		written: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "buckets_written_total",
+			Help:      "A total number of buckets written to spool by source.",
+		}, []string{"source"}),
+		redacted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "examples_redacted_total",
+			Help:      "A total number of buckets with query example or plan changed or removed by redaction by source and mode.",
+		}, []string{"source", "mode"}),
+		sent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "buckets_sent_total",
+			Help:      "A total number of buckets sent to PMM server.",
+		}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "send_retries_total",
+			Help:      "A total number of failed PushQAN requests which will be retried.",
+		}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "buckets_dropped_total",
+			Help:      "A total number of buckets dropped before sending by reason (spool_error, decode_error, too_large, rejected).",
+		}, []string{"reason"}),
+	}
+}
+
+// setRedactor sets redactor for a given source, or removes it if r is nil.
+func (s *Sender) setRedactor(sourceID string, r *redactor) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+
+	if r == nil {
+		delete(s.redactors, sourceID)
+		return
+	}
+	s.redactors[sourceID] = r
+}
+
+// Write redacts examples and plans of buckets and writes buckets to spool.
+func (s *Sender) Write(buckets []*api.QueryBucket) error {
+	for _, b := range buckets {
+		s.rw.RLock()
+		r := s.redactors[b.SourceID]
+		s.rw.RUnlock()
+		if r == nil {
+			r = dropExamples
+		}
+		var exampleRedacted, planRedacted bool
+		b.Example, exampleRedacted = r.redact(b.Example)
+		b.Plan, planRedacted = r.redactPlan(b.Plan)
+		if exampleRedacted || planRedacted {
+			s.redacted.WithLabelValues(b.SourceID, r.mode).Inc()
+		}
+
+		data, err := json.Marshal(b)
+		if err == nil {
+			err = s.spool.Write(data)
+		}
+		if err != nil {
+			s.dropped.WithLabelValues("spool_error").Inc()
+			return errors.Wrapf(err, "failed to write bucket of %s", b.SourceID)
+		}
+		s.written.WithLabelValues(b.SourceID).Inc()
+	}
+	return nil
+}
+
+// Send sends buckets from spool to PMM server in order until done is closed.
+// See spool.Sender for retry and drop policy.
+func (s *Sender) Send(client rpc.QANGatewayClient, done <-chan struct{}) {
+	spool.NewSender(&spool.SenderParams{
+		Spool:      s.spool,
+		L:          s.l,
+		Name:       "buckets",
+		MaxRecords: maxBucketsPerRequest,
+		MaxSize:    s.maxSize,
+		Send: func(records [][]byte) (int, error) {
+			req := &api.PushQANRequest{
+				Buckets: make([]api.QueryBucket, 0, len(records)),
+			}
+			for _, r := range records {
+				var b api.QueryBucket
+				if err := json.Unmarshal(r, &b); err != nil {
+					s.dropped.WithLabelValues("decode_error").Inc()
+					s.l.Errorf("Failed to decode bucket from spool: %s.", err)
+					continue
+				}
+				req.Buckets = append(req.Buckets, b)
+			}
+			if len(req.Buckets) == 0 {
+				return 0, nil
+			}
+			_, err := client.PushQAN(context.Background(), req)
+			return len(req.Buckets), err
+		},
+		Rejected: rpc.IsRejected,
+		Sent:     s.sent,
+		Retries:  s.retries,
+		Dropped:  s.dropped,
+	}).Run(done)
+}
+
+// Describe implements prometheus.Collector.
+func (s *Sender) Describe(ch chan<- *prometheus.Desc) {
+	s.written.Describe(ch)
+	s.redacted.Describe(ch)
+	s.sent.Describe(ch)
+	s.retries.Describe(ch)
+	s.dropped.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (s *Sender) Collect(ch chan<- prometheus.Metric) {
+	s.written.Collect(ch)
+	s.redacted.Collect(ch)
+	s.sent.Collect(ch)
+	s.retries.Collect(ch)
+	s.dropped.Collect(ch)
+}
+
+// check interfaces
+var (
+	_ prometheus.Collector = (*Sender)(nil)
+)
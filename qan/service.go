@@ -0,0 +1,288 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package qan
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/rpc"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+
+	// collector running longer than that is considered healthy, and backoff is reset
+	resetBackoffAfter = time.Minute
+)
+
+// runningCollector is a collector with its goroutine.
+type runningCollector struct {
+	source *api.QANSource
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Service handles query analytics requests from PMM server and runs collectors.
+//
+// Collectors are not sub-agent processes managed by supervisor: they run in pmm-agent process as goroutines.
+// Collector that returns before it is stopped, or panics, is created again and restarted with exponential backoff.
+type Service struct {
+	ctx        context.Context
+	sender     *Sender
+	stateDir   string
+	redaction  *api.RedactionPolicy
+	factories  map[string]NewCollectorFunc
+	l          *logrus.Entry
+	m          sync.Mutex
+	collectors map[string]*runningCollector
+}
+
+// NewService creates a new service. Collectors run until ctx is canceled.
+// factories maps source types to collector constructors. Collectors state is stored in subdirectories of stateDir.
+// redaction is the default redaction policy for sources without own policy.
+func NewService(ctx context.Context, sender *Sender, stateDir string, redaction *api.RedactionPolicy, factories map[string]NewCollectorFunc) *Service {
+	return &Service{
+		ctx:        ctx,
+		sender:     sender,
+		stateDir:   stateDir,
+		redaction:  redaction,
+		factories:  factories,
+		l:          logrus.WithField("component", "qan"),
+		collectors: make(map[string]*runningCollector),
+	}
+}
+
+// SetQANConfig replaces query analytics sources: new collectors are started, removed ones are stopped,
+// and changed ones are restarted.
+func (svc *Service) SetQANConfig(ctx context.Context, req *api.SetQANConfigRequest) (*api.SetQANConfigResponse, error) {
+	byID := make(map[string]*api.QANSource, len(req.Sources))
+	for i := range req.Sources {
+		s := &req.Sources[i]
+		if s.ID == "" {
+			return nil, errors.New("source ID is empty")
+		}
+		if byID[s.ID] != nil {
+			return nil, errors.Errorf("duplicate source ID %q", s.ID)
+		}
+		if svc.factories[s.Type] == nil {
+			return nil, errors.Errorf("source %q: unexpected type %q", s.ID, s.Type)
+		}
+		if s.Redaction != nil {
+			if _, err := newRedactor(s.Redaction, s.Type); err != nil {
+				return nil, errors.Wrapf(err, "source %q", s.ID)
+			}
+		}
+		byID[s.ID] = s
+	}
+
+	svc.m.Lock()
+	defer svc.m.Unlock()
+
+	for id, c := range svc.collectors {
+		if s := byID[id]; s == nil || !reflect.DeepEqual(s, c.source) {
+			svc.l.Infof("Stopping %s collector %s.", c.source.Type, id)
+			c.cancel()
+			<-c.done
+			svc.sender.setRedactor(id, nil)
+			delete(svc.collectors, id)
+		}
+	}
+
+	var errs []string
+	for id, s := range byID {
+		if svc.collectors[id] != nil {
+			continue
+		}
+		if err := svc.start(s); err != nil {
+			svc.l.Errorf("Failed to start %s collector %s: %s.", s.Type, id, err)
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+	return new(api.SetQANConfigResponse), nil
+}
+
+// start creates and starts collector for a given source. Caller should hold svc.m.
+func (svc *Service) start(s *api.QANSource) error {
+	stateDir := filepath.Join(svc.stateDir, sanitizeName(s.ID))
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return errors.WithStack(err)
+	}
+	policy := s.Redaction
+	if policy == nil {
+		policy = svc.redaction
+	}
+	r, err := newRedactor(policy, s.Type)
+	if err != nil {
+		return errors.Wrapf(err, "source %q", s.ID)
+	}
+
+	collector, err := svc.factories[s.Type](&CollectorParams{
+		Source:   s,
+		StateDir: stateDir,
+		Sender:   svc.sender,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "source %q", s.ID)
+	}
+
+	svc.l.Infof("Starting %s collector %s with %s examples redaction.", s.Type, s.ID, policy.Mode)
+	svc.sender.setRedactor(s.ID, r)
+	ctx, cancel := context.WithCancel(svc.ctx)
+	c := &runningCollector{
+		source: s,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	svc.collectors[s.ID] = c
+	go func() {
+		defer close(c.done)
+		svc.run(ctx, s, collector, stateDir)
+	}()
+	return nil
+}
+
+// run runs collector for a given source, restarting it with exponential backoff until ctx is canceled.
+func (svc *Service) run(ctx context.Context, s *api.QANSource, collector Collector, stateDir string) {
+	l := svc.l.WithField("source", s.ID)
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		panicked := runCollector(ctx, l, collector)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(start) > resetBackoffAfter {
+			backoff = minBackoff
+		}
+		if panicked {
+			l.Warnf("Collector panicked. Restarting in %s.", backoff)
+		} else {
+			l.Warnf("Collector exited unexpectedly. Restarting in %s.", backoff)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		// use a new collector with state loaded from the state directory, not the one left in unknown state
+		c, err := svc.factories[s.Type](&CollectorParams{
+			Source:   s,
+			StateDir: stateDir,
+			Sender:   svc.sender,
+		})
+		if err != nil {
+			l.Errorf("Failed to create %s collector: %s.", s.Type, err)
+			continue
+		}
+		collector = c
+	}
+}
+
+// runCollector runs collector until it returns. It recovers and logs collector's panic, and returns true in that case.
+func runCollector(ctx context.Context, l *logrus.Entry, collector Collector) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			l.Errorf("Collector panic: %v\n%s", r, debug.Stack())
+			panicked = true
+		}
+	}()
+
+	collector.Run(ctx)
+	return false
+}
+
+// SourceDSN returns DSN of a running source with a given ID, for actions.
+func (svc *Service) SourceDSN(id string) (string, error) {
+	svc.m.Lock()
+	defer svc.m.Unlock()
+
+	c := svc.collectors[id]
+	if c == nil {
+		return "", errors.Errorf("unknown source %q", id)
+	}
+	if c.source.DSN == "" {
+		return "", errors.Errorf("source %q has no DSN", id)
+	}
+	return c.source.DSN, nil
+}
+
+// RedactPlan redacts execution plan for a query of a running source with a given ID, like EXPLAIN action output,
+// according to the source redaction policy. It returns error if policy does not allow plans to leave the host.
+func (svc *Service) RedactPlan(id string, plan []byte) ([]byte, error) {
+	svc.sender.rw.RLock()
+	r := svc.sender.redactors[id]
+	svc.sender.rw.RUnlock()
+	if r == nil {
+		return nil, errors.Errorf("unknown source %q", id)
+	}
+
+	redacted, _ := r.redactPlan(string(plan))
+	if redacted == "" && len(plan) != 0 {
+		return nil, errors.Errorf("source %q redaction policy (%s) does not allow sending plans", id, r.mode)
+	}
+	return []byte(redacted), nil
+}
+
+// Wait waits for all collectors to stop after context passed to NewService is canceled.
+func (svc *Service) Wait() {
+	svc.m.Lock()
+	defer svc.m.Unlock()
+
+	for _, c := range svc.collectors {
+		<-c.done
+	}
+}
+
+// sanitizeName replaces characters not safe for directory names, including dots, with underscores.
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// check interfaces
+var (
+	_ rpc.QANServer = (*Service)(nil)
+)
@@ -0,0 +1,80 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package qan
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+)
+
+type testCollector struct {
+	run func(ctx context.Context)
+}
+
+func (c *testCollector) Run(ctx context.Context) {
+	c.run(ctx)
+}
+
+func TestServiceRestartsCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmm-agent-qan-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the first collector panics, the second one runs until stopped
+	var created int32
+	running := make(chan struct{})
+	factory := func(params *CollectorParams) (Collector, error) {
+		switch atomic.AddInt32(&created, 1) {
+		case 1:
+			return &testCollector{run: func(context.Context) { panic("test") }}, nil
+		default:
+			return &testCollector{run: func(ctx context.Context) {
+				close(running)
+				<-ctx.Done()
+			}}, nil
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	svc := NewService(ctx, NewSender(nil, 1024*1024), dir, &api.RedactionPolicy{Mode: api.RedactionFingerprint},
+		map[string]NewCollectorFunc{api.TypeMySQLSlowLog: factory})
+	_, err = svc.SetQANConfig(ctx, &api.SetQANConfigRequest{
+		Sources: []api.QANSource{{ID: "mysql1", Type: api.TypeMySQLSlowLog}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-running:
+	case <-time.After(minBackoff + 5*time.Second):
+		t.Fatal("collector was not restarted")
+	}
+	cancel()
+	svc.Wait()
+	if n := atomic.LoadInt32(&created); n != 2 {
+		t.Errorf("expected 2 collectors, got %d", n)
+	}
+}
@@ -0,0 +1,248 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package slowlog
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Percona-Lab/pmm-agent/qan/tail"
+)
+
+// Event represents a single slow log entry.
+type Event struct {
+	Time     time.Time // query start time from SET timestamp, or the last "# Time:" header; may be zero
+	User     string
+	Host     string
+	ThreadID uint64
+	Schema   string
+	Query    string
+	Admin    bool // true for administrator commands, like Quit
+
+	// Numeric attributes by lowercased name, for example: query_time, rows_examined, innodb_io_r_ops.
+	// Yes/No attributes (Percona Server), like Full_scan, are stored as 1/0.
+	Metrics map[string]float64
+
+	pos tail.Position // position of the first line
+}
+
+var (
+	userHostRE = regexp.MustCompile(`^# User@Host: ([^\[]*)\[([^\]]*)\] @ ([^\[]*)\[([^\]]*)\](?:\s+Id:\s+(\d+))?`)
+	pairRE     = regexp.MustCompile(`(\w+): (\S*)`)
+	useRE      = regexp.MustCompile("^(?i)use `?([^`;]+)`?;$")
+	setTimeRE  = regexp.MustCompile(`^SET timestamp=(\d+);$`)
+)
+
+// non-metric attributes
+var skipAttributes = map[string]bool{
+	"id":                  true,
+	"thread_id":           true,
+	"schema":              true,
+	"errno":               true,
+	"last_errno":          true,
+	"killed":              true,
+	"innodb_trx_id":       true,
+	"log_slow_rate_type":  true,
+	"log_slow_rate_limit": true,
+}
+
+// isEventStart returns true if line starts a new event header.
+func isEventStart(line string) bool {
+	for _, prefix := range []string{"# Time: ", "# User@Host: ", "# Thread_id: ", "# Query_time: "} {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isServerHeader returns true for lines written by server on start and log flush.
+func isServerHeader(line string) bool {
+	return strings.Contains(line, ", Version: ") && strings.Contains(line, "started with:") ||
+		strings.HasPrefix(line, "Tcp port: ") ||
+		strings.HasPrefix(line, "Time                 Id Command    Argument")
+}
+
+// parser parses slow log line by line.
+type parser struct {
+	e          *Event // event in progress
+	inQuery    bool   // true if query text of e started
+	lastTime   time.Time
+	lastSchema string // server writes "use" only when database differs from the previous logged one
+}
+
+// line parses a single line without newline. pos is line position in the file.
+// It returns event completed by that line, if any.
+func (p *parser) line(line string, pos tail.Position) *Event {
+	line = strings.TrimSuffix(line, "\r")
+
+	if isServerHeader(line) || isEventStart(line) {
+		var res *Event
+		if p.e != nil && p.inQuery {
+			res = p.finish()
+		}
+		if isServerHeader(line) {
+			return res
+		}
+		if p.e == nil {
+			p.e = &Event{
+				Time:    p.lastTime,
+				Schema:  p.lastSchema,
+				Metrics: make(map[string]float64),
+				pos:     pos,
+			}
+		}
+		p.header(line)
+		return res
+	}
+
+	if p.e == nil {
+		// skip lines of event which started before the current offset
+		return nil
+	}
+
+	if !p.inQuery {
+		switch {
+		case strings.HasPrefix(line, "# administrator command: "):
+			p.e.Admin = true
+			p.e.Query = strings.TrimPrefix(line, "# ")
+			p.inQuery = true
+			return nil
+		case strings.HasPrefix(line, "#"):
+			p.header(line)
+			return nil
+		}
+
+		if m := useRE.FindStringSubmatch(line); m != nil {
+			p.e.Schema = m[1]
+			p.lastSchema = m[1]
+			return nil
+		}
+		if m := setTimeRE.FindStringSubmatch(line); m != nil {
+			if ts, err := strconv.ParseInt(m[1], 10, 64); err == nil {
+				p.e.Time = time.Unix(ts, 0)
+			}
+			return nil
+		}
+
+		p.e.Query = line
+		p.inQuery = true
+		return nil
+	}
+
+	p.e.Query += "\n" + line
+	return nil
+}
+
+// flush returns event in progress if its query text looks complete (ends with semicolon).
+// It is called when there is no more data in the file.
+func (p *parser) flush() *Event {
+	if p.e == nil || !p.inQuery || !strings.HasSuffix(strings.TrimSpace(p.e.Query), ";") {
+		return nil
+	}
+	return p.finish()
+}
+
+// pending returns position of event in progress, if any.
+func (p *parser) pending() (tail.Position, bool) {
+	if p.e == nil {
+		return tail.Position{}, false
+	}
+	return p.e.pos, true
+}
+
+// reset drops event in progress and remembered state; it is called when file is switched.
+func (p *parser) reset() {
+	p.e = nil
+	p.inQuery = false
+	p.lastTime = time.Time{}
+	p.lastSchema = ""
+}
+
+// finish returns event in progress.
+func (p *parser) finish() *Event {
+	e := p.e
+	e.Query = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(e.Query), ";"))
+	p.e = nil
+	p.inQuery = false
+	return e
+}
+
+// header parses header line.
+func (p *parser) header(line string) {
+	if strings.HasPrefix(line, "# Time: ") {
+		if t, ok := parseTime(strings.TrimSpace(strings.TrimPrefix(line, "# Time: "))); ok {
+			p.lastTime = t
+			p.e.Time = t
+		}
+		return
+	}
+
+	if m := userHostRE.FindStringSubmatch(line); m != nil {
+		p.e.User = strings.TrimSpace(m[1])
+		if p.e.User == "" {
+			p.e.User = m[2]
+		}
+		p.e.Host = strings.TrimSpace(m[3])
+		if p.e.Host == "" {
+			p.e.Host = m[4]
+		}
+		if m[5] != "" {
+			p.e.ThreadID, _ = strconv.ParseUint(m[5], 10, 64)
+		}
+		line = line[len(m[0]):]
+	}
+
+	for _, m := range pairRE.FindAllStringSubmatch(line, -1) {
+		name, value := strings.ToLower(m[1]), m[2]
+		switch name {
+		case "schema":
+			p.e.Schema = value
+			continue
+		case "id", "thread_id":
+			p.e.ThreadID, _ = strconv.ParseUint(value, 10, 64)
+			continue
+		}
+		if skipAttributes[name] {
+			continue
+		}
+
+		switch value {
+		case "Yes":
+			p.e.Metrics[name] = 1
+		case "No":
+			p.e.Metrics[name] = 0
+		default:
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				p.e.Metrics[name] = f
+			}
+		}
+	}
+}
+
+// parseTime parses "# Time:" header value in MySQL 5.7+ (RFC 3339) or older (YYMMDD H:MM:SS, local time) format.
+func parseTime(s string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, true
+	}
+	if t, err := time.ParseInLocation("060102 15:04:05", strings.Join(strings.Fields(s), " "), time.Local); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
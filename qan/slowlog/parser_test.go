@@ -0,0 +1,172 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package slowlog
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Percona-Lab/pmm-agent/qan/tail"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+// parseFile returns all events of a given file.
+func parseFile(t *testing.T, path string) []*Event {
+	t.Helper()
+	tailer := tail.New(path)
+	if err := tailer.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer tailer.Close()
+
+	p := new(parser)
+	var res []*Event
+	for {
+		line, pos, err := tailer.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e := p.line(line, pos); e != nil {
+			res = append(res, e)
+		}
+	}
+	if e := p.flush(); e != nil {
+		res = append(res, e)
+	}
+	return res
+}
+
+func TestParserGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no samples")
+	}
+	for _, file := range files {
+		file := file
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			events := parseFile(t, file)
+			for _, e := range events {
+				e.Time = e.Time.UTC()
+			}
+			actual, err := json.MarshalIndent(events, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual = append(actual, '\n')
+
+			golden := strings.TrimSuffix(file, ".log") + ".json"
+			if *updateGolden {
+				if err = ioutil.WriteFile(golden, actual, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(actual) != string(expected) {
+				t.Errorf("events do not match %s (run with -update to see the difference with git diff):\n%s", golden, actual)
+			}
+		})
+	}
+}
+
+func TestParserDetails(t *testing.T) {
+	t.Run("MultiLineAndSchema", func(t *testing.T) {
+		events := parseFile(t, filepath.Join("testdata", "mysql-5.6.log"))
+		if len(events) != 5 {
+			t.Fatalf("expected 5 events, got %d", len(events))
+		}
+		e := events[1]
+		expected := "SELECT c.id, c.name\nFROM customers c\nWHERE c.email LIKE '%@example.com'\nORDER BY c.name"
+		if e.Query != expected || e.Schema != "shop" || e.ThreadID != 7 || e.Host != "10.0.0.5" {
+			t.Errorf("unexpected event %+v", e)
+		}
+		if e.Time.Unix() != 1537535530 {
+			t.Errorf("SET timestamp is not used: %s", e.Time)
+		}
+
+		// schema is remembered when server does not repeat "use"
+		if e = events[3]; e.Schema != "shop" || !strings.HasPrefix(e.Query, "UPDATE orders") {
+			t.Errorf("unexpected event %+v", e)
+		}
+	})
+
+	t.Run("AdministratorCommand", func(t *testing.T) {
+		events := parseFile(t, filepath.Join("testdata", "percona-5.7.log"))
+		if len(events) != 3 {
+			t.Fatalf("expected 3 events, got %d", len(events))
+		}
+		e := events[2]
+		if !e.Admin || e.Query != "administrator command: Ping" || e.ThreadID != 12 {
+			t.Errorf("unexpected event %+v", e)
+		}
+	})
+
+	t.Run("PerconaExtended", func(t *testing.T) {
+		e := parseFile(t, filepath.Join("testdata", "percona-5.7.log"))[1]
+		for name, expected := range map[string]float64{
+			"query_time":            0.012778,
+			"rows_affected":         1,
+			"full_scan":             0,
+			"innodb_rec_lock_wait":  0.010541,
+			"innodb_pages_distinct": 3,
+		} {
+			if actual, ok := e.Metrics[name]; !ok || actual != expected {
+				t.Errorf("%s: expected %v, got %v (%v)", name, expected, actual, ok)
+			}
+		}
+		if _, ok := e.Metrics["innodb_trx_id"]; ok {
+			t.Error("innodb_trx_id should not be a metric")
+		}
+		if e.Schema != "sbtest" || e.Query != "UPDATE sbtest1\n   SET k = k + 1\n WHERE id = 5012" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	})
+
+	t.Run("MySQL80SlowExtra", func(t *testing.T) {
+		events := parseFile(t, filepath.Join("testdata", "mysql-8.0.log"))
+		if len(events) != 3 {
+			t.Fatalf("expected 3 events, got %d", len(events))
+		}
+		e := events[0]
+		if e.Schema != "inventory" || e.ThreadID != 41 || e.Metrics["read_rnd_next"] != 48212 {
+			t.Errorf("unexpected event %+v", e)
+		}
+		if _, ok := e.Metrics["start"]; ok {
+			t.Error("start should not be a metric")
+		}
+
+		// semicolon inside string literal does not end multi-line query
+		e = events[1]
+		if !strings.HasSuffix(e.Query, "('b-2', 'nut; hex', 20)") || e.Schema != "inventory" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	})
+}
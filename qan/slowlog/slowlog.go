@@ -0,0 +1,240 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package slowlog collects query analytics data from MySQL slow query log, including
+// Percona Server extended format.
+package slowlog
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/fingerprint"
+	"github.com/Percona-Lab/pmm-agent/qan"
+	"github.com/Percona-Lab/pmm-agent/qan/tail"
+)
+
+const (
+	// interval of checking for new data, rotation and truncation after the end of file is reached
+	pollInterval = time.Second
+
+	// interval of writing complete buckets and saving position
+	flushInterval = 10 * time.Second
+
+	// buckets are complete this time after their period end, so late events are not split into several buckets
+	flushDelay = 10 * time.Second
+
+	stateFile = "slowlog.json"
+)
+
+// SlowLog is a slow log collector.
+type SlowLog struct {
+	params *qan.CollectorParams
+	l      *logrus.Entry
+
+	t       *tail.Tailer
+	p       *parser
+	agg     *qan.Aggregator
+	pending map[int64]tail.Position // period start (Unix time) -> position of the first event of that period
+	saved   tail.Position
+}
+
+// New creates a new slow log collector.
+func New(params *qan.CollectorParams) (qan.Collector, error) {
+	if !filepath.IsAbs(params.Source.Path) {
+		return nil, errors.Errorf("slow log path should be absolute, got %q", params.Source.Path)
+	}
+	return &SlowLog{
+		params:  params,
+		l:       logrus.WithField("component", "qan").WithField("source", params.Source.ID),
+		t:       tail.New(params.Source.Path),
+		p:       new(parser),
+		agg:     qan.NewAggregator(params.Source.ID, fingerprint.MySQL),
+		pending: make(map[int64]tail.Position),
+	}, nil
+}
+
+// Run implements qan.Collector.
+func (s *SlowLog) Run(ctx context.Context) {
+	s.open()
+	defer s.t.Close()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	lastFlush := time.Now()
+	var lastErr string
+	for {
+		if time.Since(lastFlush) >= flushInterval {
+			s.flush(time.Now().Add(-flushDelay))
+			lastFlush = time.Now()
+		}
+
+		line, pos, err := s.t.ReadLine()
+		if err == nil {
+			if e := s.p.line(line, pos); e != nil {
+				s.add(e)
+			}
+
+			select {
+			case <-ctx.Done():
+				s.flush(time.Time{})
+				return
+			default:
+				continue
+			}
+		}
+
+		if err != io.EOF {
+			s.l.Errorf("Failed to read %s: %s.", s.t.Path(), err)
+			s.t.Close()
+		}
+		if e := s.p.flush(); e != nil {
+			s.add(e)
+		}
+
+		select {
+		case <-ctx.Done():
+			s.flush(time.Time{})
+			return
+		case <-ticker.C:
+		}
+
+		switched, err := s.t.Check()
+		if err != nil {
+			// log only new errors, like missing permissions, to avoid flooding
+			if err.Error() != lastErr {
+				s.l.Errorf("Failed to open %s: %s.", s.t.Path(), err)
+				lastErr = err.Error()
+			}
+			continue
+		}
+		lastErr = ""
+		if switched {
+			s.l.Infof("%s was rotated or truncated, reading from the start.", s.t.Path())
+			s.p.reset()
+		}
+	}
+}
+
+// open opens slow log at the saved position. If there is no saved position, it starts from the end of file.
+// If file was rotated since position was saved, it starts from the start of the new file.
+func (s *SlowLog) open() {
+	var saved *tail.Position
+	if b, err := ioutil.ReadFile(filepath.Join(s.params.StateDir, stateFile)); err == nil {
+		saved = new(tail.Position)
+		if err = json.Unmarshal(b, saved); err != nil {
+			s.l.Warnf("Failed to parse saved position: %s.", err)
+			saved = nil
+		}
+	}
+
+	fi, err := os.Stat(s.t.Path())
+	if err != nil {
+		// tailer will open file when it is created
+		s.l.Warnf("Failed to open %s: %s.", s.t.Path(), err)
+		return
+	}
+
+	var offset int64
+	switch {
+	case saved == nil:
+		offset = fi.Size()
+	case saved.Inode == tail.Inode(fi):
+		offset = saved.Offset
+	}
+	if err = s.t.Open(offset); err != nil {
+		s.l.Errorf("Failed to open %s: %s.", s.t.Path(), err)
+		return
+	}
+	s.l.Infof("Reading %s from offset %d.", s.t.Path(), s.t.Offset())
+}
+
+// add adds event to its bucket.
+func (s *SlowLog) add(e *Event) {
+	t := e.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	period := t.Truncate(qan.BucketPeriod).Unix()
+	if p, ok := s.pending[period]; !ok || e.pos.Before(p) {
+		s.pending[period] = e.pos
+	}
+
+	s.agg.Add(&qan.Event{
+		Time:    t,
+		Query:   e.Query,
+		Schema:  e.Schema,
+		Metrics: e.Metrics,
+	})
+}
+
+// flush writes buckets with periods ended before a given time (all buckets for zero time) to spool,
+// and saves position of the first event which is not written yet.
+func (s *SlowLog) flush(before time.Time) {
+	if err := s.params.Sender.Write(s.agg.Flush(before)); err != nil {
+		s.l.Error(err)
+	}
+
+	pos := s.t.Pos()
+	if p, ok := s.p.pending(); ok && p.Before(pos) {
+		pos = p
+	}
+	for period, p := range s.pending {
+		if before.IsZero() || !time.Unix(period, 0).Add(qan.BucketPeriod).After(before) {
+			delete(s.pending, period)
+			continue
+		}
+		if p.Before(pos) {
+			pos = p
+		}
+	}
+
+	if pos == s.saved || s.t.Inode() == 0 {
+		return
+	}
+	if err := s.savePosition(pos); err != nil {
+		s.l.Errorf("Failed to save position: %s.", err)
+		return
+	}
+	s.saved = pos
+}
+
+// savePosition writes position to state file atomically.
+func (s *SlowLog) savePosition(pos tail.Position) error {
+	b, err := json.Marshal(pos)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	path := filepath.Join(s.params.StateDir, stateFile)
+	if err = ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(path+".tmp", path))
+}
+
+// check interfaces
+var (
+	_ qan.Collector = (*SlowLog)(nil)
+)
@@ -0,0 +1,163 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package slowlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/qan"
+	"github.com/Percona-Lab/pmm-agent/qan/tail"
+	"github.com/Percona-Lab/pmm-agent/spool"
+)
+
+// event returns slow log event text for a given query.
+func event(query string) string {
+	return fmt.Sprintf("# Time: %s\n# User@Host: root[root] @ localhost []  Id:     1\n"+
+		"# Query_time: 0.100000  Lock_time: 0.000000 Rows_sent: 1  Rows_examined: 1\n"+
+		"SET timestamp=%d;\n%s;\n", time.Now().UTC().Format(time.RFC3339Nano), time.Now().Unix(), query)
+}
+
+func appendFile(t *testing.T, path, s string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSlowLogRotationAndTruncation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmm-agent-slowlog-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stateDir := filepath.Join(dir, "state")
+	if err = os.Mkdir(stateDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	s, err := spool.Open(&spool.Params{
+		Dir:         filepath.Join(dir, "spool"),
+		Name:        "qan",
+		MaxSize:     1024 * 1024,
+		SegmentSize: 64 * 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// existing content is skipped on the first start
+	path := filepath.Join(dir, "slow.log")
+	appendFile(t, path, event("SELECT * FROM existing"))
+
+	collector, err := New(&qan.CollectorParams{
+		Source:   &api.QANSource{ID: "slowlog", Type: api.TypeMySQLSlowLog, Path: path},
+		StateDir: stateDir,
+		Sender:   qan.NewSender(s, 1024*1024),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		collector.Run(ctx)
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	appendFile(t, path, event("SELECT * FROM before_rotation"))
+	time.Sleep(2 * pollInterval)
+
+	// rotation: file is renamed and a new one is created
+	if err = os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path+".1", event("SELECT * FROM late_write_to_rotated"))
+	appendFile(t, path, event("SELECT * FROM after_rotation")+event("SELECT * FROM padding"))
+	time.Sleep(3 * pollInterval)
+
+	// truncation: the same file is truncated and written again
+	if err = os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, event("SELECT * FROM after_truncation"))
+	time.Sleep(3 * pollInterval)
+
+	cancel()
+	<-done
+
+	records, _, err := s.Peek(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same query may be in two buckets if test crosses minute boundary
+	unique := make(map[string]bool)
+	for _, r := range records {
+		var b api.QueryBucket
+		if err = json.Unmarshal(r, &b); err != nil {
+			t.Fatal(err)
+		}
+		unique[b.Fingerprint] = true
+	}
+	var fingerprints []string
+	for f := range unique {
+		fingerprints = append(fingerprints, f)
+	}
+	sort.Strings(fingerprints)
+	expected := []string{
+		"select * from after_rotation",
+		"select * from after_truncation",
+		"select * from before_rotation",
+		"select * from late_write_to_rotated",
+		"select * from padding",
+	}
+	if fmt.Sprint(fingerprints) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, fingerprints)
+	}
+
+	// position at the end of the current file is saved
+	b, err := ioutil.ReadFile(filepath.Join(stateDir, stateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pos tail.Position
+	if err = json.Unmarshal(b, &pos); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos.Inode != tail.Inode(fi) || pos.Offset != fi.Size() {
+		t.Errorf("unexpected saved position %s, file size %d", b, fi.Size())
+	}
+}
@@ -0,0 +1,181 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package tail reads lines appended to log files, following rotation and truncation.
+package tail
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Position is a position in a log file.
+type Position struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+
+	seq int // tailer file sequence number, for comparing positions in different files
+}
+
+// Before returns true if p is before other.
+func (p Position) Before(other Position) bool {
+	if p.seq != other.seq {
+		return p.seq < other.seq
+	}
+	return p.Offset < other.Offset
+}
+
+// Tailer reads lines from a file which may be rotated (renamed and replaced by a new file)
+// or truncated while it is being read.
+type Tailer struct {
+	path    string
+	f       *os.File
+	r       *bufio.Reader
+	inode   uint64
+	seq     int
+	offset  int64  // offset of the next byte to read
+	partial string // incomplete last line
+}
+
+// New creates a new tailer for a given file path. File is not opened until Open or Check is called.
+func New(path string) *Tailer {
+	return &Tailer{
+		path: path,
+	}
+}
+
+// Inode returns file inode number.
+func Inode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
+
+// Path returns file path.
+func (t *Tailer) Path() string {
+	return t.path
+}
+
+// Inode returns inode number of the current file, or 0 if it is not open.
+func (t *Tailer) Inode() uint64 {
+	return t.inode
+}
+
+// Offset returns offset of the next byte to read in the current file.
+func (t *Tailer) Offset() int64 {
+	return t.offset
+}
+
+// Open opens file and seeks to a given offset. If file was truncated below that offset, it is read from the start.
+func (t *Tailer) Open(offset int64) error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	if offset > fi.Size() {
+		offset = 0
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+
+	t.Close()
+	t.f = f
+	t.r = bufio.NewReader(f)
+	t.inode = Inode(fi)
+	t.seq++
+	t.offset = offset
+	return nil
+}
+
+// Close closes the current file, if any.
+func (t *Tailer) Close() {
+	if t.f != nil {
+		t.f.Close()
+		t.f = nil
+	}
+	t.partial = ""
+}
+
+// Pos returns position of the next line.
+func (t *Tailer) Pos() Position {
+	return Position{
+		Inode:  t.inode,
+		Offset: t.offset - int64(len(t.partial)),
+		seq:    t.seq,
+	}
+}
+
+// ReadLine returns the next complete line without newline, and its position.
+// It returns io.EOF if there is no complete line yet.
+func (t *Tailer) ReadLine() (string, Position, error) {
+	if t.f == nil {
+		return "", Position{}, io.EOF
+	}
+
+	pos := t.Pos()
+	s, err := t.r.ReadString('\n')
+	t.offset += int64(len(s))
+	if err != nil {
+		t.partial += s
+		if err != io.EOF {
+			err = errors.WithStack(err)
+		}
+		return "", Position{}, err
+	}
+
+	line := t.partial + s
+	t.partial = ""
+	return line[:len(line)-1], pos, nil
+}
+
+// Check checks for rotation and truncation after the end of the current file is reached.
+// It returns true if a different file was opened, or the current one was truncated.
+func (t *Tailer) Check() (bool, error) {
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// rotated, but a new file is not created yet
+			return false, nil
+		}
+		return false, errors.WithStack(err)
+	}
+
+	if t.f == nil || Inode(fi) != t.inode {
+		// read lines written to the rotated file after the end was reached, but before it was renamed
+		if t.f != nil {
+			if cur, err := t.f.Stat(); err == nil && cur.Size() > t.offset {
+				return false, nil
+			}
+		}
+		return true, t.Open(0)
+	}
+	if fi.Size() < t.offset {
+		return true, t.Open(0)
+	}
+	return false, nil
+}
@@ -0,0 +1,163 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"bytes"
+	"time"
+)
+
+// Chunking keeps a single large message from occupying the WebSocket connection for a long time,
+// so heartbeats and other calls are interleaved with its chunks. It is not streaming:
+// the sender keeps the whole body, and the receiver assembles the whole body in memory
+// before passing it to the handler or the caller. Memory used by a single message is bounded by
+// the maximum message size, not by the chunk size; producers of large data (like spool batches)
+// should split it into several calls.
+
+const (
+	// DefaultMaxMessageSize is a default maximum size of request or response body in bytes.
+	DefaultMaxMessageSize = 64 * 1024 * 1024
+
+	// DefaultChunkSize is a default maximum size of frame body in a single wsrpc message.
+	DefaultChunkSize = 64 * 1024
+
+	// incomplete messages without new chunks for that time are dropped
+	assemblyIdleTimeout = time.Minute
+
+	// how often incomplete messages are checked for expiration
+	assemblyExpirationInterval = 10 * time.Second
+)
+
+// assemblyKey identifies message being assembled. Requests and responses are kept separately
+// as stream IDs are allocated by both sides independently.
+type assemblyKey struct {
+	streamID uint64
+	request  bool
+}
+
+// assembly is a message being assembled from chunks.
+type assembly struct {
+	header   header
+	received time.Time // when the first chunk was received
+	updated  time.Time // when the last chunk was received
+	deadline time.Time // zero for responses and requests without deadline
+	buf      bytes.Buffer
+	tooLarge bool // remaining chunks are discarded
+}
+
+// assemble adds chunk to the message being assembled, and returns a complete frame,
+// or nil if more chunks are expected or chunk should be dropped.
+func (c *Conn) assemble(streamID uint64, f *frame) *frame {
+	if f.Kind == kindCancel {
+		return f
+	}
+
+	key := assemblyKey{streamID: streamID, request: f.Kind == kindRequest}
+	more := f.Flags&flagMore != 0
+	continued := f.Flags&flagContinued != 0
+
+	// fast path for single-chunk messages
+	if !more && !continued {
+		if len(f.body) > c.maxMessageSize {
+			return &frame{header: f.header, tooLarge: true}
+		}
+		return f
+	}
+
+	c.rw.Lock()
+	defer c.rw.Unlock()
+
+	a := c.assemblies[key]
+	switch {
+	case !continued:
+		c.expireAssemblies()
+		a = &assembly{header: f.header, received: f.received}
+		a.header.Flags &^= flagMore
+		if d, ok := f.deadline(); ok {
+			a.deadline = d
+		}
+		c.assemblies[key] = a
+
+	case a == nil:
+		// call or request was canceled, or assembly expired
+		c.l.Debugf("Dropping %s chunk for stream %d.", f.Kind, streamID)
+		return nil
+	}
+
+	a.updated = f.received
+	if !a.tooLarge {
+		if a.buf.Len()+len(f.body) > c.maxMessageSize {
+			a.tooLarge = true
+			a.buf = bytes.Buffer{}
+		} else {
+			a.buf.Write(f.body)
+		}
+	}
+
+	if more {
+		return nil
+	}
+
+	delete(c.assemblies, key)
+	a.header.Flags &^= flagContinued
+	return &frame{
+		header:   a.header,
+		body:     a.buf.Bytes(),
+		received: a.received,
+		tooLarge: a.tooLarge,
+	}
+}
+
+// expireAssemblies removes incomplete requests with exceeded deadlines, and incomplete messages
+// without new chunks for assemblyIdleTimeout. Caller should hold c.rw.
+func (c *Conn) expireAssemblies() {
+	now := time.Now()
+	for key, a := range c.assemblies {
+		switch {
+		case !a.deadline.IsZero() && a.deadline.Before(now):
+			c.l.Debugf("Dropping expired incomplete request for stream %d.", key.streamID)
+			delete(c.assemblies, key)
+		case now.Sub(a.updated) > assemblyIdleTimeout:
+			c.l.Debugf("Dropping idle incomplete %s for stream %d.", a.header.Kind, key.streamID)
+			delete(c.assemblies, key)
+		}
+	}
+}
+
+// runAssembliesExpiration periodically removes expired incomplete messages until connection is closed,
+// so they don't hold memory when no new messages are received.
+func (c *Conn) runAssembliesExpiration() {
+	t := time.NewTicker(assemblyExpirationInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+			c.rw.Lock()
+			c.expireAssemblies()
+			c.rw.Unlock()
+		}
+	}
+}
+
+// dropAssembly removes incomplete message for a given stream, if any.
+func (c *Conn) dropAssembly(streamID uint64, request bool) {
+	c.rw.Lock()
+	delete(c.assemblies, assemblyKey{streamID: streamID, request: request})
+	c.rw.Unlock()
+}
@@ -0,0 +1,265 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAssemble(t *testing.T) {
+	c := NewConn(nil, &Params{MaxMessageSize: 10})
+	now := time.Now()
+	chunk := func(k kind, flags uint8, body string) *frame {
+		return &frame{
+			header:   header{Kind: k, Flags: flags, Timeout: int64(time.Minute)},
+			body:     []byte(body),
+			received: now,
+		}
+	}
+
+	t.Run("Single", func(t *testing.T) {
+		f := chunk(kindRequest, 0, "0123456789")
+		if actual := c.assemble(1, f); actual != f {
+			t.Errorf("Expected frame as is, got %+v.", actual)
+		}
+	})
+
+	t.Run("SingleTooLarge", func(t *testing.T) {
+		f := c.assemble(1, chunk(kindRequest, 0, "0123456789a"))
+		if !f.tooLarge || f.body != nil {
+			t.Errorf("Expected too large frame, got %+v.", f)
+		}
+	})
+
+	t.Run("Chunks", func(t *testing.T) {
+		// request and response for the same stream are assembled independently
+		for _, f := range []*frame{
+			chunk(kindRequest, flagMore, "abc"),
+			chunk(kindResponse, flagMore, "012"),
+			chunk(kindRequest, flagMore|flagContinued, "def"),
+			chunk(kindResponse, flagMore|flagContinued, "345"),
+		} {
+			if actual := c.assemble(1, f); actual != nil {
+				t.Fatalf("Expected nil, got %+v.", actual)
+			}
+		}
+		if len(c.assemblies) != 2 {
+			t.Fatalf("Expected 2 assemblies, got %d.", len(c.assemblies))
+		}
+
+		last := chunk(kindRequest, flagContinued, "g")
+		last.received = now.Add(time.Second)
+		f := c.assemble(1, last)
+		if f == nil || f.Kind != kindRequest || f.Flags != 0 || string(f.body) != "abcdefg" || f.tooLarge {
+			t.Fatalf("Unexpected frame %+v.", f)
+		}
+		if !f.received.Equal(now) {
+			t.Errorf("Expected receive time of the first chunk, got %s.", f.received)
+		}
+		if d, _ := f.deadline(); !d.Equal(now.Add(time.Minute)) {
+			t.Errorf("Expected deadline from the first chunk, got %s.", d)
+		}
+
+		f = c.assemble(1, chunk(kindResponse, flagContinued, "6"))
+		if f == nil || f.Kind != kindResponse || string(f.body) != "0123456" {
+			t.Fatalf("Unexpected frame %+v.", f)
+		}
+		if len(c.assemblies) != 0 {
+			t.Errorf("Expected no assemblies, got %d.", len(c.assemblies))
+		}
+	})
+
+	t.Run("ChunksTooLarge", func(t *testing.T) {
+		for _, f := range []*frame{
+			chunk(kindRequest, flagMore, "01234"),
+			chunk(kindRequest, flagMore|flagContinued, "56789"),
+			chunk(kindRequest, flagMore|flagContinued, "a"),
+		} {
+			if actual := c.assemble(3, f); actual != nil {
+				t.Fatalf("Expected nil, got %+v.", actual)
+			}
+		}
+		if a := c.assemblies[assemblyKey{streamID: 3, request: true}]; !a.tooLarge || a.buf.Len() != 0 {
+			t.Errorf("Expected discarded assembly, got tooLarge=%t, %d bytes.", a.tooLarge, a.buf.Len())
+		}
+
+		f := c.assemble(3, chunk(kindRequest, flagContinued, "b"))
+		if f == nil || !f.tooLarge || len(f.body) != 0 {
+			t.Errorf("Expected too large frame, got %+v.", f)
+		}
+	})
+
+	t.Run("ContinuedWithoutFirst", func(t *testing.T) {
+		if f := c.assemble(5, chunk(kindRequest, flagContinued, "abc")); f != nil {
+			t.Errorf("Expected chunk to be dropped, got %+v.", f)
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		if f := c.assemble(7, chunk(kindRequest, flagMore, "abc")); f != nil {
+			t.Fatalf("Expected nil, got %+v.", f)
+		}
+		cancel := chunk(kindCancel, 0, "")
+		if f := c.assemble(7, cancel); f != cancel {
+			t.Fatalf("Expected cancel frame as is, got %+v.", f)
+		}
+		c.dropAssembly(7, true)
+		if f := c.assemble(7, chunk(kindRequest, flagContinued, "def")); f != nil {
+			t.Errorf("Expected chunk to be dropped, got %+v.", f)
+		}
+	})
+}
+
+func TestExpireAssemblies(t *testing.T) {
+	c := NewConn(nil, new(Params))
+	now := time.Now()
+	for streamID, f := range map[uint64]*frame{
+		// idle response
+		1: {header: header{Kind: kindResponse, Flags: flagMore}, received: now.Add(-2 * assemblyIdleTimeout)},
+
+		// idle request without deadline
+		3: {header: header{Kind: kindRequest, Flags: flagMore}, received: now.Add(-2 * assemblyIdleTimeout)},
+
+		// request with exceeded deadline
+		5: {header: header{Kind: kindRequest, Flags: flagMore, Timeout: int64(time.Second)}, received: now.Add(-2 * time.Second)},
+
+		// fresh request and response
+		7: {header: header{Kind: kindRequest, Flags: flagMore, Timeout: int64(time.Minute)}, received: now},
+		9: {header: header{Kind: kindResponse, Flags: flagMore}, received: now},
+	} {
+		if actual := c.assemble(streamID, f); actual != nil {
+			t.Fatalf("Expected nil, got %+v.", actual)
+		}
+	}
+
+	c.rw.Lock()
+	c.expireAssemblies()
+	c.rw.Unlock()
+
+	expected := map[assemblyKey]bool{
+		{streamID: 7, request: true}:  true,
+		{streamID: 9, request: false}: true,
+	}
+	if len(c.assemblies) != len(expected) {
+		t.Errorf("Expected %d assemblies, got %d.", len(expected), len(c.assemblies))
+	}
+	for key := range c.assemblies {
+		if !expected[key] {
+			t.Errorf("Unexpected assembly %+v.", key)
+		}
+	}
+
+	// the rest of expired message is dropped
+	f := &frame{header: header{Kind: kindRequest, Flags: flagContinued}, body: []byte("abc"), received: now}
+	if actual := c.assemble(5, f); actual != nil {
+		t.Errorf("Expected chunk to be dropped, got %+v.", actual)
+	}
+}
+
+func TestConnChunks(t *testing.T) {
+	const (
+		chunkSize = 100
+		small     = 1000
+		large     = 1000000
+	)
+	body := make([]byte, 10*small)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	handlers := map[string]Handler{
+		"/echo": echo,
+		"/large": func(ctx context.Context, arg []byte) ([]byte, error) {
+			return body, nil
+		},
+	}
+
+	t.Run("Echo", func(t *testing.T) {
+		params := &Params{ChunkSize: chunkSize, MaxMessageSize: large}
+		p := newTestPair(t, params, params, handlers)
+		defer p.close()
+
+		res, err := p.client.Invoke(context.Background(), "/echo", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(res, body) {
+			t.Errorf("Unexpected response: %d bytes.", len(res))
+		}
+	})
+
+	t.Run("RequestTooLargeToSend", func(t *testing.T) {
+		params := &Params{ChunkSize: chunkSize, MaxMessageSize: small}
+		p := newTestPair(t, params, params, handlers)
+		defer p.close()
+
+		_, err := p.client.Invoke(context.Background(), "/echo", body)
+		if IsRejected(err) {
+			t.Fatalf("Expected local error, got %v.", err)
+		}
+		if expected := "/echo: request is larger than 1000 bytes"; err == nil || err.Error() != expected {
+			t.Errorf("Expected %q, got %v.", expected, err)
+		}
+	})
+
+	t.Run("RequestTooLargeToReceive", func(t *testing.T) {
+		p := newTestPair(t, &Params{ChunkSize: chunkSize, MaxMessageSize: large}, &Params{ChunkSize: chunkSize, MaxMessageSize: small}, handlers)
+		defer p.close()
+
+		_, err := p.client.Invoke(context.Background(), "/echo", body)
+		if !IsRejected(err) {
+			t.Fatalf("Expected *Error, got %v.", err)
+		}
+		if expected := "/echo: request is larger than 1000 bytes"; err.Error() != expected {
+			t.Errorf("Expected %q, got %q.", expected, err)
+		}
+
+		// connection is still usable
+		if _, err = p.client.Invoke(context.Background(), "/echo", body[:small]); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("ResponseTooLargeToReceive", func(t *testing.T) {
+		p := newTestPair(t, &Params{ChunkSize: chunkSize, MaxMessageSize: small}, &Params{ChunkSize: chunkSize, MaxMessageSize: large}, handlers)
+		defer p.close()
+
+		_, err := p.client.Invoke(context.Background(), "/large", nil)
+		if IsRejected(err) {
+			t.Fatalf("Expected local error, got %v.", err)
+		}
+		if expected := "/large: response is larger than 1000 bytes"; err == nil || err.Error() != expected {
+			t.Errorf("Expected %q, got %v.", expected, err)
+		}
+	})
+
+	t.Run("ResponseTooLargeToSend", func(t *testing.T) {
+		p := newTestPair(t, &Params{ChunkSize: chunkSize, MaxMessageSize: large}, &Params{ChunkSize: chunkSize, MaxMessageSize: small}, handlers)
+		defer p.close()
+
+		// callee reports its own failure to send response as error
+		_, err := p.client.Invoke(context.Background(), "/large", nil)
+		if !IsRejected(err) {
+			t.Fatalf("Expected *Error, got %v.", err)
+		}
+		if expected := "/large: response is larger than 1000 bytes"; err.Error() != expected {
+			t.Errorf("Expected %q, got %q.", expected, err)
+		}
+	})
+}
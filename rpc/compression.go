@@ -0,0 +1,211 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Compression is a frame body compression algorithm.
+type Compression string
+
+const (
+	// CompressionNone disables compression.
+	CompressionNone Compression = ""
+
+	// CompressionDeflate compresses frame bodies with DEFLATE (RFC 1951).
+	CompressionDeflate Compression = "deflate"
+)
+
+// DefaultCompressionThreshold is a frame body size in bytes below which bodies are sent uncompressed.
+const DefaultCompressionThreshold = 1024
+
+const (
+	// AcceptCompressionHeader is an HTTP header with comma-separated list of compression algorithms
+	// supported by the client.
+	AcceptCompressionHeader = "Pmm-Accept-Compression"
+
+	// CompressionHeader is an HTTP header with compression algorithm chosen by the server.
+	CompressionHeader = "Pmm-Compression"
+)
+
+// AcceptCompression adds compression algorithms supported by this package to connection request headers.
+func AcceptCompression(h http.Header) {
+	h.Set(AcceptCompressionHeader, string(CompressionDeflate))
+}
+
+// NegotiatedCompression returns compression algorithm chosen by the server from connection response headers.
+// Unknown algorithms are ignored.
+func NegotiatedCompression(h http.Header) Compression {
+	switch c := Compression(strings.TrimSpace(h.Get(CompressionHeader))); c {
+	case CompressionDeflate:
+		return c
+	default:
+		return CompressionNone
+	}
+}
+
+// CompressionStats contains compression statistics for the connection.
+type CompressionStats struct {
+	Compression Compression
+
+	SentCompressed          uint64        // number of sent compressed frames
+	SentUncompressed        uint64        // number of sent frames below threshold or incompressible
+	SentBytes               uint64        // sum of compressed frame body sizes before compression
+	SentCompressedBytes     uint64        // sum of compressed frame body sizes after compression
+	CompressionDuration     time.Duration // total time spent compressing
+	ReceivedCompressed      uint64        // number of received compressed frames
+	ReceivedBytes           uint64        // sum of received compressed frame body sizes after decompression
+	ReceivedCompressedBytes uint64        // sum of received compressed frame body sizes before decompression
+	DecompressionDuration   time.Duration // total time spent decompressing
+}
+
+// Ratio returns compression ratio for sent frames, or 0 if nothing was compressed yet.
+func (s *CompressionStats) Ratio() float64 {
+	if s.SentCompressedBytes == 0 {
+		return 0
+	}
+	return float64(s.SentBytes) / float64(s.SentCompressedBytes)
+}
+
+// compressor compresses and decompresses frame bodies, and collects statistics.
+type compressor struct {
+	compression Compression
+	threshold   int
+	metrics     *Metrics
+	writers     sync.Pool
+
+	m     sync.Mutex
+	stats CompressionStats
+}
+
+func newCompressor(compression Compression, threshold int, metrics *Metrics) *compressor {
+	if threshold == 0 {
+		threshold = DefaultCompressionThreshold
+	}
+	return &compressor{
+		compression: compression,
+		threshold:   threshold,
+		metrics:     metrics,
+		stats: CompressionStats{
+			Compression: compression,
+		},
+	}
+}
+
+// compress compresses frame body in place, if compression is enabled, and it makes sense.
+func (c *compressor) compress(f *frame) error {
+	if c.compression == CompressionNone || f.Kind == kindCancel {
+		return nil
+	}
+	if len(f.body) < c.threshold {
+		c.m.Lock()
+		c.stats.SentUncompressed++
+		c.m.Unlock()
+		return nil
+	}
+
+	start := time.Now()
+	var buf bytes.Buffer
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(&buf, flate.DefaultCompression); err != nil {
+			return errors.WithStack(err)
+		}
+	} else {
+		w.Reset(&buf)
+	}
+	if _, err := w.Write(f.body); err != nil {
+		return errors.Wrap(err, "failed to compress frame body")
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "failed to compress frame body")
+	}
+	c.writers.Put(w)
+	d := time.Since(start)
+	c.metrics.observeCompression("sent", len(f.body), buf.Len(), d)
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.stats.CompressionDuration += d
+	if buf.Len() >= len(f.body) {
+		c.stats.SentUncompressed++
+		return nil
+	}
+	c.stats.SentCompressed++
+	c.stats.SentBytes += uint64(len(f.body))
+	c.stats.SentCompressedBytes += uint64(buf.Len())
+
+	f.Flags |= flagDeflate
+	f.body = buf.Bytes()
+	return nil
+}
+
+// decompress decompresses frame body in place, if it is compressed.
+// It does it even if compression is not enabled for this side of connection.
+// If decompressed body exceeds limit, it is discarded, and frame is marked as too large.
+func (c *compressor) decompress(f *frame, limit int) error {
+	if f.Flags&flagDeflate == 0 || f.tooLarge {
+		return nil
+	}
+
+	start := time.Now()
+	r := flate.NewReader(bytes.NewReader(f.body))
+	b, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return errors.Wrap(err, "failed to decompress frame body")
+	}
+	if len(b) > limit {
+		r.Close()
+		f.body = nil
+		f.tooLarge = true
+		return nil
+	}
+	if err = r.Close(); err != nil {
+		return errors.Wrap(err, "failed to decompress frame body")
+	}
+	d := time.Since(start)
+	c.metrics.observeCompression("received", len(f.body), len(b), d)
+
+	c.m.Lock()
+	c.stats.DecompressionDuration += d
+	c.stats.ReceivedCompressed++
+	c.stats.ReceivedBytes += uint64(len(b))
+	c.stats.ReceivedCompressedBytes += uint64(len(f.body))
+	c.m.Unlock()
+
+	f.Flags &^= flagDeflate
+	f.body = b
+	return nil
+}
+
+// getStats returns a copy of collected statistics.
+func (c *compressor) getStats() CompressionStats {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.stats
+}
@@ -0,0 +1,166 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"testing"
+)
+
+func TestNegotiatedCompression(t *testing.T) {
+	h := make(http.Header)
+	AcceptCompression(h)
+	if v := h.Get(AcceptCompressionHeader); v != "deflate" {
+		t.Errorf("Unexpected %s header value %q.", AcceptCompressionHeader, v)
+	}
+
+	for value, expected := range map[string]Compression{
+		"":          CompressionNone,
+		"deflate":   CompressionDeflate,
+		" deflate ": CompressionDeflate,
+		"gzip":      CompressionNone,
+		"DEFLATE":   CompressionNone,
+	} {
+		h := make(http.Header)
+		if value != "" {
+			h.Set(CompressionHeader, value)
+		}
+		if actual := NegotiatedCompression(h); actual != expected {
+			t.Errorf("%q: expected %q, got %q.", value, expected, actual)
+		}
+	}
+}
+
+func TestCompressor(t *testing.T) {
+	compressible := bytes.Repeat([]byte("SELECT * FROM t WHERE id = ?; "), 100)
+	incompressible := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(incompressible)
+
+	for _, tc := range []struct {
+		name        string
+		compression Compression
+		body        []byte
+		compressed  bool
+	}{
+		{"disabled", CompressionNone, compressible, false},
+		{"below threshold", CompressionDeflate, compressible[:DefaultCompressionThreshold-1], false},
+		{"incompressible", CompressionDeflate, incompressible, false},
+		{"compressible", CompressionDeflate, compressible, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCompressor(tc.compression, 0, NewMetrics())
+			f := &frame{header: header{Kind: kindRequest}, body: append([]byte(nil), tc.body...)}
+			if err := c.compress(f); err != nil {
+				t.Fatal(err)
+			}
+			if compressed := f.Flags&flagDeflate != 0; compressed != tc.compressed {
+				t.Fatalf("Expected compressed=%t, got %t.", tc.compressed, compressed)
+			}
+			if tc.compressed && len(f.body) >= len(tc.body) {
+				t.Errorf("Body is not compressed: %d bytes.", len(f.body))
+			}
+
+			// receiving side decompresses regardless of its own settings
+			d := newCompressor(CompressionNone, 0, NewMetrics())
+			if err := d.decompress(f, len(tc.body)); err != nil {
+				t.Fatal(err)
+			}
+			if f.tooLarge || !bytes.Equal(f.body, tc.body) {
+				t.Errorf("Body does not round-trip: tooLarge=%t, %d bytes.", f.tooLarge, len(f.body))
+			}
+			if f.Flags&flagDeflate != 0 {
+				t.Error("Deflate flag is not cleared.")
+			}
+
+			stats := c.getStats()
+			var expected uint64
+			if tc.compressed {
+				expected = 1
+			}
+			if stats.SentCompressed != expected || d.getStats().ReceivedCompressed != expected {
+				t.Errorf("Unexpected stats: sent %+v, received %+v.", stats, d.getStats())
+			}
+		})
+	}
+}
+
+func TestCompressorLimit(t *testing.T) {
+	body := bytes.Repeat([]byte{'a'}, 100*1024)
+	c := newCompressor(CompressionDeflate, 0, NewMetrics())
+	f := &frame{header: header{Kind: kindResponse}, body: body}
+	if err := c.compress(f); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.body) > 1024 {
+		t.Fatalf("Expected highly compressible body, got %d bytes.", len(f.body))
+	}
+
+	// decompression bomb is stopped at the limit
+	if err := c.decompress(f, len(body)-1); err != nil {
+		t.Fatal(err)
+	}
+	if !f.tooLarge || f.body != nil {
+		t.Errorf("Expected too large frame, got tooLarge=%t, %d bytes.", f.tooLarge, len(f.body))
+	}
+}
+
+func TestConnCompression(t *testing.T) {
+	body := bytes.Repeat([]byte("SELECT * FROM t WHERE id = ?; "), 1000)
+	for name, compression := range map[string]Compression{
+		"none":    CompressionNone,
+		"deflate": CompressionDeflate,
+	} {
+		t.Run(name, func(t *testing.T) {
+			params := &Params{Compression: compression}
+			p := newTestPair(t, params, params, map[string]Handler{"/echo": echo})
+			defer p.close()
+
+			res, err := p.client.Invoke(context.Background(), "/echo", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(res, body) {
+				t.Fatalf("Unexpected response: %d bytes.", len(res))
+			}
+
+			// small bodies are never compressed
+			if _, err = p.client.Invoke(context.Background(), "/echo", []byte("small")); err != nil {
+				t.Fatal(err)
+			}
+
+			client, server := p.client.CompressionStats(), p.server.CompressionStats()
+			if client.Compression != compression || server.Compression != compression {
+				t.Errorf("Unexpected compression: client %q, server %q.", client.Compression, server.Compression)
+			}
+			var expected uint64
+			if compression == CompressionDeflate {
+				expected = 1
+				if client.Ratio() <= 1 {
+					t.Errorf("Unexpected ratio %f.", client.Ratio())
+				}
+			}
+			for _, s := range []CompressionStats{client, server} {
+				if s.SentCompressed != expected || s.SentUncompressed != expected || s.ReceivedCompressed != expected {
+					t.Errorf("Unexpected stats: %+v.", s)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,397 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package rpc implements context-aware RPC layer on top of wsrpc connection.
+//
+// Every call has a deadline which is passed to the callee, so it can stop working on a request
+// nobody waits for anymore. A caller can also cancel a call explicitly.
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Percona-Lab/wsrpc"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTimeout is used for calls without a deadline.
+const DefaultTimeout = 30 * time.Second
+
+var errConnClosed = errors.New("rpc: connection closed")
+
+// Handler handles a single incoming request. Context is canceled when the caller's deadline is exceeded,
+// when the caller cancels the call, or when the connection is closed.
+type Handler func(ctx context.Context, arg []byte) ([]byte, error)
+
+// Error is returned by Invoke when the callee returned an error.
+type Error struct {
+	Path    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// IsRejected returns true if err is returned by Invoke when the callee returned an error,
+// as opposed to connection problems and timeouts.
+func IsRejected(err error) bool {
+	_, ok := errors.Cause(err).(*Error)
+	return ok
+}
+
+// Params represent RPC connection parameters.
+type Params struct {
+	// Calls without a deadline get this timeout. If zero, DefaultTimeout is used.
+	Timeout time.Duration
+
+	// Compression algorithm negotiated with the other side, see NegotiatedCompression.
+	Compression Compression
+
+	// Frame bodies smaller than this value are sent uncompressed. If zero, DefaultCompressionThreshold is used.
+	CompressionThreshold int
+
+	// Maximum size of request or response body. Larger outgoing messages are rejected before sending,
+	// larger incoming messages are discarded and reported to the other side as errors.
+	// Whole messages are kept in memory, so it also limits memory used by a single call.
+	// If zero, DefaultMaxMessageSize is used.
+	MaxMessageSize int
+
+	// Maximum size of frame body in a single wsrpc message. If zero, DefaultChunkSize is used.
+	ChunkSize int
+
+	// Metrics shared by all connections. If nil, metrics are not exposed.
+	Metrics *Metrics
+}
+
+// Conn is a context-aware RPC connection.
+//
+// All exported Conn methods except Handle are safe for concurrent usage.
+type Conn struct {
+	conn           *wsrpc.Conn
+	l              *logrus.Entry
+	timeout        time.Duration
+	compressor     *compressor
+	metrics        *Metrics
+	maxMessageSize int
+	chunkSize      int
+
+	handlers map[string]Handler
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	rw           sync.Mutex
+	nextStreamID uint64                        // odd for client-created streams, as in wsrpc
+	calls        map[uint64]chan *frame        // outgoing calls awaiting responses
+	requests     map[uint64]context.CancelFunc // incoming requests being handled
+	assemblies   map[assemblyKey]*assembly     // incoming messages being assembled from chunks
+}
+
+// NewConn creates a new RPC connection on top of established wsrpc connection.
+// Caller is responsible for closing wsrpc connection.
+func NewConn(conn *wsrpc.Conn, params *Params) *Conn {
+	timeout := params.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	maxMessageSize := params.MaxMessageSize
+	if maxMessageSize == 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+	chunkSize := params.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	metrics := params.Metrics
+	if metrics == nil {
+		metrics = NewMetrics()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Conn{
+		conn:           conn,
+		l:              logrus.WithField("component", "rpc"),
+		timeout:        timeout,
+		compressor:     newCompressor(params.Compression, params.CompressionThreshold, metrics),
+		metrics:        metrics,
+		maxMessageSize: maxMessageSize,
+		chunkSize:      chunkSize,
+		handlers:       make(map[string]Handler),
+		ctx:            ctx,
+		cancel:         cancel,
+		nextStreamID:   1,
+		calls:          make(map[uint64]chan *frame),
+		requests:       make(map[uint64]context.CancelFunc),
+		assemblies:     make(map[assemblyKey]*assembly),
+	}
+}
+
+// Handle registers handler for a given path. It must be called before Run.
+func (c *Conn) Handle(path string, handler Handler) {
+	if c.handlers[path] != nil {
+		panic(fmt.Sprintf("handler for %s is already registered", path))
+	}
+	c.handlers[path] = handler
+}
+
+// Invoke calls method on the other side of connection and returns response.
+// If ctx has no deadline, connection's timeout is used. When ctx is done before the response
+// is received, the callee is notified, and ctx's error is returned.
+func (c *Conn) Invoke(ctx context.Context, path string, arg []byte) (_ []byte, err error) {
+	start := time.Now()
+	defer func() {
+		c.metrics.observeCall("outgoing", path, start, err)
+	}()
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		timeout = 1 // already expired; zero would mean no deadline
+	}
+
+	// buffered, so reader never blocks on it even if we are not waiting anymore
+	ch := make(chan *frame, 1)
+
+	c.rw.Lock()
+	streamID := c.nextStreamID
+	c.nextStreamID += 2
+	c.calls[streamID] = ch
+	c.rw.Unlock()
+
+	defer func() {
+		c.rw.Lock()
+		delete(c.calls, streamID)
+		delete(c.assemblies, assemblyKey{streamID: streamID})
+		c.rw.Unlock()
+	}()
+
+	req := &frame{
+		header: header{
+			Kind:    kindRequest,
+			Timeout: int64(timeout),
+		},
+		body: arg,
+	}
+	if err := c.write(ctx, streamID, path, req); err != nil {
+		if ctx.Err() != nil {
+			c.cancelCall(streamID, path)
+		}
+		return nil, errors.WithMessage(err, path)
+	}
+
+	select {
+	case res := <-ch:
+		switch {
+		case res.tooLarge:
+			return nil, errors.Errorf("%s: response is larger than %d bytes", path, c.maxMessageSize)
+		case res.Kind == kindError:
+			return nil, &Error{Path: path, Message: string(res.body)}
+		default:
+			return res.body, nil
+		}
+
+	case <-ctx.Done():
+		c.cancelCall(streamID, path)
+		return nil, errors.Wrap(ctx.Err(), path)
+
+	case <-c.ctx.Done():
+		return nil, errors.Wrap(errConnClosed, path)
+	}
+}
+
+// cancelCall notifies the callee that the caller is no longer interested in the response.
+func (c *Conn) cancelCall(streamID uint64, path string) {
+	f := &frame{header: header{Kind: kindCancel}}
+	if err := c.write(context.Background(), streamID, path, f); err != nil {
+		c.l.Warnf("Failed to cancel %s (stream %d): %s.", path, streamID, err)
+	}
+}
+
+// Run reads messages from the connection, sends responses to awaiting Invoke()-ers,
+// and handles requests with registered handlers.
+// It returns when connection is closed or on protocol error, after all handlers are finished.
+func (c *Conn) Run() error {
+	defer func() {
+		c.cancel()
+		c.wg.Wait()
+	}()
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.runAssembliesExpiration()
+	}()
+
+	for {
+		m, err := c.conn.Read()
+		if err != nil {
+			return errors.Wrap(err, "failed to read message")
+		}
+		f, err := decodeFrame(m.Arg)
+		if err != nil {
+			return errors.Wrapf(err, "failed to decode frame for %s (stream %d)", m.Path, m.StreamID)
+		}
+		if f = c.assemble(m.StreamID, f); f == nil {
+			continue
+		}
+		if err = c.compressor.decompress(f, c.maxMessageSize); err != nil {
+			return errors.Wrapf(err, "failed to decode frame for %s (stream %d)", m.Path, m.StreamID)
+		}
+
+		switch f.Kind {
+		case kindRequest:
+			c.rw.Lock()
+			ctx, cancel := c.requestContext(f)
+			c.requests[m.StreamID] = cancel
+			c.rw.Unlock()
+
+			c.wg.Add(1)
+			go func(streamID uint64, path string) {
+				defer c.wg.Done()
+				c.serve(ctx, streamID, path, f)
+
+				c.rw.Lock()
+				delete(c.requests, streamID)
+				c.rw.Unlock()
+				cancel()
+			}(m.StreamID, m.Path)
+
+		case kindResponse, kindError:
+			c.rw.Lock()
+			ch := c.calls[m.StreamID]
+			c.rw.Unlock()
+			if ch == nil {
+				// call timed out or was canceled
+				c.l.Debugf("Dropping late %s for %s (stream %d).", f.Kind, m.Path, m.StreamID)
+				continue
+			}
+			ch <- f
+
+		case kindCancel:
+			c.dropAssembly(m.StreamID, true)
+			c.rw.Lock()
+			cancel := c.requests[m.StreamID]
+			c.rw.Unlock()
+			if cancel != nil {
+				c.l.Debugf("%s (stream %d) canceled by the caller.", m.Path, m.StreamID)
+				cancel()
+			}
+		}
+	}
+}
+
+// requestContext returns context for handling incoming request with caller's deadline.
+func (c *Conn) requestContext(f *frame) (context.Context, context.CancelFunc) {
+	if d, ok := f.deadline(); ok {
+		return context.WithDeadline(c.ctx, d)
+	}
+	return context.WithCancel(c.ctx)
+}
+
+// serve handles a single request and writes response, if the caller still waits for it.
+func (c *Conn) serve(ctx context.Context, streamID uint64, path string, req *frame) {
+	start := time.Now()
+	res := &frame{header: header{Kind: kindResponse}}
+	handler := c.handlers[path]
+	var handlerErr error
+	switch {
+	case handler == nil:
+		handlerErr = errors.Errorf("unexpected path %q", path)
+	case req.tooLarge:
+		handlerErr = errors.Errorf("request is larger than %d bytes", c.maxMessageSize)
+	default:
+		res.body, handlerErr = handler(ctx, req.body)
+	}
+	if handlerErr != nil {
+		res.Kind = kindError
+		res.body = []byte(handlerErr.Error())
+	}
+	if handlerErr == nil {
+		handlerErr = ctx.Err()
+	}
+	c.metrics.observeCall("incoming", path, start, handlerErr)
+
+	if err := ctx.Err(); err != nil {
+		c.l.Debugf("Not sending %s for %s (stream %d): %s.", res.Kind, path, streamID, err)
+		return
+	}
+	err := c.write(ctx, streamID, path, res)
+	if err != nil && res.Kind == kindResponse && ctx.Err() == nil {
+		// response was not sent at all, report error to the caller instead
+		res = &frame{header: header{Kind: kindError}, body: []byte(err.Error())}
+		err = c.write(ctx, streamID, path, res)
+	}
+	if err != nil {
+		c.l.Errorf("Failed to send %s for %s (stream %d): %s.", res.Kind, path, streamID, err)
+	}
+}
+
+// CompressionStats returns compression statistics.
+func (c *Conn) CompressionStats() CompressionStats {
+	return c.compressor.getStats()
+}
+
+// write compresses, encodes and writes a frame, splitting it into chunks if needed.
+// If ctx is done before all chunks are written, the rest is not written, and ctx's error is returned.
+func (c *Conn) write(ctx context.Context, streamID uint64, path string, f *frame) error {
+	if len(f.body) > c.maxMessageSize {
+		return errors.Errorf("%s is larger than %d bytes", f.Kind, c.maxMessageSize)
+	}
+	if err := c.compressor.compress(f); err != nil {
+		return err
+	}
+
+	body := f.body
+	for {
+		chunk := &frame{header: f.header}
+		n := len(body)
+		if n > c.chunkSize {
+			n = c.chunkSize
+			chunk.Flags |= flagMore
+		}
+		if len(body) != len(f.body) {
+			chunk.Flags |= flagContinued
+		}
+		chunk.body, body = body[:n], body[n:]
+
+		b, err := encodeFrame(chunk)
+		if err != nil {
+			return err
+		}
+		err = c.conn.Write(&wsrpc.Message{
+			StreamID: streamID,
+			Path:     path,
+			Arg:      b,
+		})
+		if err != nil || len(body) == 0 {
+			return err
+		}
+
+		if err = ctx.Err(); err != nil {
+			return errors.Wrap(err, "failed to write all chunks")
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/wsrpc"
+	"github.com/pkg/errors"
+)
+
+// testPair is a pair of RPC connections over a real WebSocket connection.
+type testPair struct {
+	srv    *httptest.Server
+	client *Conn
+	server *Conn
+
+	clientWS *wsrpc.Conn
+	serverWS *wsrpc.Conn
+	wg       sync.WaitGroup
+}
+
+// newTestPair connects client and server with given parameters. Handlers are registered on the server side.
+// If client's compression is set, client asks for it, and server agrees.
+func newTestPair(t *testing.T, clientParams, serverParams *Params, handlers map[string]Handler) *testPair {
+	t.Helper()
+
+	p := new(testPair)
+	serverWS := make(chan *wsrpc.Conn, 1)
+	p.srv = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		respHeaders := make(http.Header)
+		if req.Header.Get(AcceptCompressionHeader) != "" {
+			respHeaders.Set(CompressionHeader, string(CompressionDeflate))
+		}
+		conn, err := wsrpc.Upgrade(rw, req, respHeaders)
+		if err != nil {
+			t.Error(err)
+			close(serverWS)
+			return
+		}
+		serverWS <- conn
+	}))
+
+	headers := make(http.Header)
+	if clientParams.Compression != CompressionNone {
+		AcceptCompression(headers)
+	}
+	var respHeaders http.Header
+	var err error
+	p.clientWS, respHeaders, err = wsrpc.Dial("ws"+strings.TrimPrefix(p.srv.URL, "http"), headers)
+	if err != nil {
+		p.srv.Close()
+		t.Fatal(err)
+	}
+	if c := NegotiatedCompression(respHeaders); c != clientParams.Compression {
+		t.Fatalf("Expected %q compression to be negotiated, got %q.", clientParams.Compression, c)
+	}
+	p.serverWS = <-serverWS
+	if p.serverWS == nil {
+		p.clientWS.Close()
+		p.srv.Close()
+		t.FailNow()
+	}
+
+	p.client = NewConn(p.clientWS, clientParams)
+	p.server = NewConn(p.serverWS, serverParams)
+	for path, handler := range handlers {
+		p.server.Handle(path, handler)
+	}
+	for _, c := range []*Conn{p.client, p.server} {
+		p.wg.Add(1)
+		go func(c *Conn) {
+			defer p.wg.Done()
+			c.Run()
+		}(c)
+	}
+	return p
+}
+
+// close closes both connections and waits for Run to return.
+func (p *testPair) close() {
+	p.clientWS.Close()
+	p.serverWS.Close()
+	p.wg.Wait()
+	p.srv.Close()
+}
+
+func echo(ctx context.Context, arg []byte) ([]byte, error) {
+	return arg, nil
+}
+
+func TestConnInvoke(t *testing.T) {
+	p := newTestPair(t, new(Params), new(Params), map[string]Handler{
+		"/echo": echo,
+		"/fail": func(ctx context.Context, arg []byte) ([]byte, error) {
+			return nil, errors.New("failed: " + string(arg))
+		},
+	})
+	defer p.close()
+
+	res, err := p.client.Invoke(context.Background(), "/echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != "hello" {
+		t.Errorf("Unexpected response %q.", res)
+	}
+
+	_, err = p.client.Invoke(context.Background(), "/fail", []byte("hello"))
+	if !IsRejected(err) {
+		t.Fatalf("Expected *Error, got %#v.", err)
+	}
+	if expected := "/fail: failed: hello"; err.Error() != expected {
+		t.Errorf("Expected %q, got %q.", expected, err)
+	}
+
+	_, err = p.client.Invoke(context.Background(), "/unknown", nil)
+	if !IsRejected(err) {
+		t.Fatalf("Expected *Error, got %#v.", err)
+	}
+	if expected := `/unknown: unexpected path "/unknown"`; err.Error() != expected {
+		t.Errorf("Expected %q, got %q.", expected, err)
+	}
+}
+
+// deadlineHandler sends remaining time of the request context, and waits for it to be done.
+func deadlineHandler(remaining chan<- time.Duration, done chan<- error) Handler {
+	return func(ctx context.Context, arg []byte) ([]byte, error) {
+		d, ok := ctx.Deadline()
+		if !ok {
+			remaining <- 0
+		} else {
+			remaining <- time.Until(d)
+		}
+		<-ctx.Done()
+		done <- ctx.Err()
+		return nil, ctx.Err()
+	}
+}
+
+func TestConnTimeout(t *testing.T) {
+	remaining := make(chan time.Duration, 1)
+	done := make(chan error, 1)
+	p := newTestPair(t, &Params{Timeout: 2 * time.Second}, new(Params), map[string]Handler{
+		"/wait": deadlineHandler(remaining, done),
+	})
+	defer p.close()
+
+	for _, timeout := range []time.Duration{
+		0, // connection's timeout
+		500 * time.Millisecond,
+	} {
+		ctx := context.Background()
+		expected := 2 * time.Second
+		if timeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+			expected = timeout
+		}
+
+		_, err := p.client.Invoke(ctx, "/wait", nil)
+		if errors.Cause(err) != context.DeadlineExceeded {
+			t.Errorf("Expected deadline exceeded, got %v.", err)
+		}
+
+		// callee's deadline is computed with its own clock from the relative timeout, so it is never later
+		if d := <-remaining; d <= expected-time.Second/4 || d > expected {
+			t.Errorf("Expected callee's remaining time close to %s, got %s.", expected, d)
+		}
+		select {
+		case err = <-done:
+			if err != context.DeadlineExceeded {
+				t.Errorf("Expected callee's context deadline to be exceeded, got %v.", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Callee's context is not done.")
+		}
+	}
+}
+
+func TestConnCancel(t *testing.T) {
+	remaining := make(chan time.Duration, 1)
+	done := make(chan error, 1)
+	p := newTestPair(t, new(Params), new(Params), map[string]Handler{
+		"/wait": deadlineHandler(remaining, done),
+	})
+	defer p.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := p.client.Invoke(ctx, "/wait", nil)
+		errCh <- err
+	}()
+
+	<-remaining
+	cancel()
+	if err := <-errCh; errors.Cause(err) != context.Canceled {
+		t.Errorf("Expected cancellation, got %v.", err)
+	}
+
+	// cancel frame should cancel callee's context long before its deadline
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Expected callee's context to be canceled, got %v.", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Callee's context is not canceled.")
+	}
+}
+
+func TestConnClosed(t *testing.T) {
+	remaining := make(chan time.Duration, 1)
+	done := make(chan error, 1)
+	p := newTestPair(t, new(Params), new(Params), map[string]Handler{
+		"/wait": deadlineHandler(remaining, done),
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := p.client.Invoke(context.Background(), "/wait", nil)
+		errCh <- err
+	}()
+
+	<-remaining
+	p.close()
+	if err := <-errCh; errors.Cause(err) != errConnClosed {
+		t.Errorf("Expected closed connection, got %v.", err)
+	}
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected callee's context to be canceled, got %v.", err)
+	}
+}
@@ -0,0 +1,131 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// kind is a frame kind.
+type kind uint8
+
+const (
+	kindRequest  kind = 1 // request from the caller
+	kindResponse kind = 2 // successful response from the callee
+	kindError    kind = 3 // error response from the callee; body contains error message
+	kindCancel   kind = 4 // caller is no longer interested in the response; body is empty
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindRequest:
+		return "request"
+	case kindResponse:
+		return "response"
+	case kindError:
+		return "error"
+	case kindCancel:
+		return "cancel"
+	default:
+		return fmt.Sprintf("kind(%d)", uint8(k))
+	}
+}
+
+// Frame flags.
+const (
+	flagDeflate   uint8 = 1 << 0 // body is compressed with DEFLATE
+	flagMore      uint8 = 1 << 1 // body is continued in the next frame of the same stream and kind
+	flagContinued uint8 = 1 << 2 // body continues the previous frame of the same stream and kind
+)
+
+// header is a fixed-size frame header.
+//
+// Each frame is carried in the argument of a single wsrpc message;
+// the wsrpc stream ID and path are used as is. Large bodies are split into several frames (chunks)
+// with the same header except flagMore and flagContinued, so a single message never occupies
+// the WebSocket connection for a long time.
+//
+//   - uint8 : kind
+//   - uint8 : flags - see flagXXX constants
+//   - int64 : remaining request timeout in nanoseconds, 0 if there is no deadline or for other kinds
+//   - bytes : frame body (until the end of the wsrpc message argument)
+//
+// The timeout is relative, so the callee computes the deadline with its own clock,
+// and clocks of both sides don't have to be synchronized.
+type header struct {
+	Kind    kind
+	Flags   uint8
+	Timeout int64
+}
+
+// frame represents decoded wsrpc message argument.
+type frame struct {
+	header
+	body     []byte
+	received time.Time // when the frame (or the first chunk) was received
+	tooLarge bool      // body exceeded maximum message size and was discarded
+}
+
+// deadline returns request deadline in the local clock, if it is set.
+func (f *frame) deadline() (time.Time, bool) {
+	if f.Timeout <= 0 {
+		return time.Time{}, false
+	}
+	return f.received.Add(time.Duration(f.Timeout)), true
+}
+
+// encodeFrame returns frame bytes, or wrapped error.
+func encodeFrame(f *frame) ([]byte, error) {
+	var w bytes.Buffer
+	w.Grow(binary.Size(&f.header) + len(f.body))
+	if err := binary.Write(&w, binary.BigEndian, &f.header); err != nil {
+		return nil, errors.Wrap(err, "failed to write frame header")
+	}
+	w.Write(f.body)
+	return w.Bytes(), nil
+}
+
+// decodeFrame decodes frame from b, or returns wrapped error. Frame body shares memory with b.
+// Frame receive time is set to the current time.
+func decodeFrame(b []byte) (*frame, error) {
+	f := new(frame)
+	size := binary.Size(&f.header)
+	if len(b) < size {
+		return nil, errors.Errorf("frame is too short: expected at least %d bytes, got %d", size, len(b))
+	}
+	if err := binary.Read(bytes.NewReader(b[:size]), binary.BigEndian, &f.header); err != nil {
+		return nil, errors.Wrap(err, "failed to read frame header")
+	}
+	switch f.Kind {
+	case kindRequest, kindResponse, kindError, kindCancel:
+	default:
+		return nil, errors.Errorf("unexpected frame %s", f.Kind)
+	}
+	f.body = b[size:]
+	f.received = time.Now()
+	return f, nil
+}
+
+// check interfaces
+var (
+	_ fmt.Stringer = kind(0)
+)
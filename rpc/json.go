@@ -0,0 +1,65 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// JSON-encoded methods use messages from api package. They use separate service namespaces,
+// so they are never confused with protobuf-encoded methods of pmm-api services.
+const (
+	agentJSONService   = "/agent.JSONService/"
+	gatewayJSONService = "/gateway.JSONService/"
+)
+
+// invokeJSON marshals request, calls method on the other side of connection, and unmarshals response.
+func (c *Conn) invokeJSON(ctx context.Context, path string, req, res interface{}) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal JSON message %T", req)
+	}
+	if b, err = c.Invoke(ctx, path, b); err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, res); err != nil {
+		return errors.Wrapf(err, "failed to unmarshal JSON message to %T", res)
+	}
+	return nil
+}
+
+// jsonHandler returns Handler which unmarshals request into a value returned by newReq, calls f, and marshals its response.
+func jsonHandler(newReq func() interface{}, f func(context.Context, interface{}) (interface{}, error)) Handler {
+	return func(ctx context.Context, arg []byte) ([]byte, error) {
+		r := newReq()
+		if err := json.Unmarshal(arg, r); err != nil {
+			return nil, errors.Wrapf(err, "failed to unmarshal JSON message to %T", r)
+		}
+		res, err := f(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(res)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to marshal JSON message %T", res)
+		}
+		return b, nil
+	}
+}
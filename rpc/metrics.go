@@ -0,0 +1,129 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	prometheusNamespace = "pmm_agent"
+	prometheusSubsystem = "rpc"
+)
+
+// Metrics contains RPC metrics. They outlive connections, so a single instance should be shared
+// by all connections created by the agent.
+type Metrics struct {
+	calls     *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+
+	compressionInput    *prometheus.CounterVec
+	compressionOutput   *prometheus.CounterVec
+	compressionDuration *prometheus.CounterVec
+}
+
+// NewMetrics creates a new Metrics instance.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "calls_total",
+			Help:      "A total number of finished RPC calls by direction (incoming, outgoing), path and result.",
+		}, []string{"direction", "path", "result"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "call_duration_seconds",
+			Help:      "RPC call durations by direction (incoming, outgoing) and path.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"direction", "path"}),
+
+		compressionInput: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "compression_input_bytes_total",
+			Help:      "A total number of bytes passed to compressor (sent) or decompressor (received).",
+		}, []string{"direction"}),
+		compressionOutput: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "compression_output_bytes_total",
+			Help:      "A total number of bytes produced by compressor (sent) or decompressor (received).",
+		}, []string{"direction"}),
+		compressionDuration: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "compression_seconds_total",
+			Help:      "A total time spent by compressor (sent) or decompressor (received).",
+		}, []string{"direction"}),
+	}
+}
+
+// observeCall records finished call.
+func (m *Metrics) observeCall(direction, path string, start time.Time, err error) {
+	m.calls.WithLabelValues(direction, path, callResult(err)).Inc()
+	m.durations.WithLabelValues(direction, path).Observe(time.Since(start).Seconds())
+}
+
+// observeCompression records compression (direction "sent") or decompression (direction "received").
+func (m *Metrics) observeCompression(direction string, input, output int, d time.Duration) {
+	m.compressionInput.WithLabelValues(direction).Add(float64(input))
+	m.compressionOutput.WithLabelValues(direction).Add(float64(output))
+	m.compressionDuration.WithLabelValues(direction).Add(d.Seconds())
+}
+
+// callResult returns result label value for a given call error.
+func callResult(err error) string {
+	switch errors.Cause(err) {
+	case nil:
+		return "ok"
+	case context.Canceled:
+		return "canceled"
+	case context.DeadlineExceeded:
+		return "deadline_exceeded"
+	default:
+		return "error"
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.calls.Describe(ch)
+	m.durations.Describe(ch)
+	m.compressionInput.Describe(ch)
+	m.compressionOutput.Describe(ch)
+	m.compressionDuration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.calls.Collect(ch)
+	m.durations.Collect(ch)
+	m.compressionInput.Collect(ch)
+	m.compressionOutput.Collect(ch)
+	m.compressionDuration.Collect(ch)
+}
+
+// check interfaces
+var (
+	_ prometheus.Collector = (*Metrics)(nil)
+)
@@ -0,0 +1,60 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// invokeProto marshals request, calls method on the other side of connection, and unmarshals response.
+func (c *Conn) invokeProto(ctx context.Context, path string, req, res proto.Message) error {
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal protobuf message %T", req)
+	}
+	if b, err = c.Invoke(ctx, path, b); err != nil {
+		return err
+	}
+	if err = proto.Unmarshal(b, res); err != nil {
+		return errors.Wrapf(err, "failed to unmarshal protobuf message to %T", res)
+	}
+	return nil
+}
+
+// protoHandler returns Handler which unmarshals request into req, calls f, and marshals its response.
+// req is used only as a prototype; it is cloned for every request.
+func protoHandler(req proto.Message, f func(context.Context, proto.Message) (proto.Message, error)) Handler {
+	return func(ctx context.Context, arg []byte) ([]byte, error) {
+		r := proto.Clone(req)
+		r.Reset()
+		if err := proto.Unmarshal(arg, r); err != nil {
+			return nil, errors.Wrapf(err, "failed to unmarshal protobuf message to %T", r)
+		}
+		res, err := f(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		b, err := proto.Marshal(res)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to marshal protobuf message %T", res)
+		}
+		return b, nil
+	}
+}
@@ -0,0 +1,247 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-api/agent"
+	"github.com/Percona-Lab/pmm-api/gateway"
+)
+
+// AgentServer is a context-aware variant of agent.ServiceServer.
+type AgentServer interface {
+	CreateTunnel(context.Context, *agent.CreateTunnelRequest) (*agent.CreateTunnelResponse, error)
+	WriteToTunnel(context.Context, *agent.WriteToTunnelRequest) (*agent.WriteToTunnelResponse, error)
+}
+
+// RegisterAgentServer registers handlers for agent.Service methods.
+func RegisterAgentServer(c *Conn, server AgentServer) {
+	c.Handle("/agent.Service/CreateTunnel", protoHandler(new(agent.CreateTunnelRequest), func(ctx context.Context, req proto.Message) (proto.Message, error) {
+		return server.CreateTunnel(ctx, req.(*agent.CreateTunnelRequest))
+	}))
+	c.Handle("/agent.Service/WriteToTunnel", protoHandler(new(agent.WriteToTunnelRequest), func(ctx context.Context, req proto.Message) (proto.Message, error) {
+		return server.WriteToTunnel(ctx, req.(*agent.WriteToTunnelRequest))
+	}))
+}
+
+// LogServer handles JSON-encoded agent methods for logging control.
+type LogServer interface {
+	SetLogLevel(context.Context, *api.SetLogLevelRequest) (*api.SetLogLevelResponse, error)
+	GetLogs(context.Context, *api.GetLogsRequest) (*api.GetLogsResponse, error)
+}
+
+// RegisterLogServer registers handlers for LogServer methods.
+func RegisterLogServer(c *Conn, server LogServer) {
+	c.Handle(agentJSONService+"SetLogLevel", jsonHandler(func() interface{} { return new(api.SetLogLevelRequest) }, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return server.SetLogLevel(ctx, req.(*api.SetLogLevelRequest))
+	}))
+	c.Handle(agentJSONService+"GetLogs", jsonHandler(func() interface{} { return new(api.GetLogsRequest) }, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return server.GetLogs(ctx, req.(*api.GetLogsRequest))
+	}))
+}
+
+// SupervisorServer handles JSON-encoded agent methods for managed processes.
+type SupervisorServer interface {
+	SetState(context.Context, *api.SetStateRequest) (*api.SetStateResponse, error)
+}
+
+// RegisterSupervisorServer registers handlers for SupervisorServer methods.
+func RegisterSupervisorServer(c *Conn, server SupervisorServer) {
+	c.Handle(agentJSONService+"SetState", jsonHandler(func() interface{} { return new(api.SetStateRequest) }, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return server.SetState(ctx, req.(*api.SetStateRequest))
+	}))
+}
+
+// PushServer handles JSON-encoded agent methods for push-mode metrics.
+type PushServer interface {
+	SetScrapeConfig(context.Context, *api.SetScrapeConfigRequest) (*api.SetScrapeConfigResponse, error)
+}
+
+// RegisterPushServer registers handlers for PushServer methods.
+func RegisterPushServer(c *Conn, server PushServer) {
+	c.Handle(agentJSONService+"SetScrapeConfig", jsonHandler(func() interface{} { return new(api.SetScrapeConfigRequest) }, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return server.SetScrapeConfig(ctx, req.(*api.SetScrapeConfigRequest))
+	}))
+}
+
+// QANServer handles JSON-encoded agent methods for query analytics.
+type QANServer interface {
+	SetQANConfig(context.Context, *api.SetQANConfigRequest) (*api.SetQANConfigResponse, error)
+}
+
+// RegisterQANServer registers handlers for QANServer methods.
+func RegisterQANServer(c *Conn, server QANServer) {
+	c.Handle(agentJSONService+"SetQANConfig", jsonHandler(func() interface{} { return new(api.SetQANConfigRequest) }, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return server.SetQANConfig(ctx, req.(*api.SetQANConfigRequest))
+	}))
+}
+
+// ActionsServer handles JSON-encoded agent methods for actions.
+type ActionsServer interface {
+	StartAction(context.Context, *api.StartActionRequest) (*api.StartActionResponse, error)
+	StopAction(context.Context, *api.StopActionRequest) (*api.StopActionResponse, error)
+}
+
+// RegisterActionsServer registers handlers for ActionsServer methods.
+func RegisterActionsServer(c *Conn, server ActionsServer) {
+	c.Handle(agentJSONService+"StartAction", jsonHandler(func() interface{} { return new(api.StartActionRequest) }, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return server.StartAction(ctx, req.(*api.StartActionRequest))
+	}))
+	c.Handle(agentJSONService+"StopAction", jsonHandler(func() interface{} { return new(api.StopActionRequest) }, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return server.StopAction(ctx, req.(*api.StopActionRequest))
+	}))
+}
+
+// GatewayClient is a context-aware variant of gateway.ServiceClient.
+type GatewayClient interface {
+	CreateTunnel(context.Context, *gateway.CreateTunnelRequest) (*gateway.CreateTunnelResponse, error)
+	WriteToTunnel(context.Context, *gateway.WriteToTunnelRequest) (*gateway.WriteToTunnelResponse, error)
+}
+
+type gatewayClient struct {
+	c *Conn
+}
+
+// NewGatewayClient returns client for gateway.Service methods.
+func NewGatewayClient(c *Conn) GatewayClient {
+	return &gatewayClient{c}
+}
+
+func (g *gatewayClient) CreateTunnel(ctx context.Context, req *gateway.CreateTunnelRequest) (*gateway.CreateTunnelResponse, error) {
+	res := new(gateway.CreateTunnelResponse)
+	if err := g.c.invokeProto(ctx, "/gateway.Service/CreateTunnel", req, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (g *gatewayClient) WriteToTunnel(ctx context.Context, req *gateway.WriteToTunnelRequest) (*gateway.WriteToTunnelResponse, error) {
+	res := new(gateway.WriteToTunnelResponse)
+	if err := g.c.invokeProto(ctx, "/gateway.Service/WriteToTunnel", req, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// SupervisorGatewayClient reports managed processes state to PMM server.
+type SupervisorGatewayClient interface {
+	ReportProcesses(context.Context, *api.ReportProcessesRequest) (*api.ReportProcessesResponse, error)
+}
+
+// NewSupervisorGatewayClient returns client for SupervisorGatewayClient methods.
+func NewSupervisorGatewayClient(c *Conn) SupervisorGatewayClient {
+	return &jsonGatewayClient{c}
+}
+
+// PushGatewayClient sends scraped metrics to PMM server.
+type PushGatewayClient interface {
+	PushMetrics(context.Context, *api.PushMetricsRequest) (*api.PushMetricsResponse, error)
+}
+
+// NewPushGatewayClient returns client for PushGatewayClient methods.
+func NewPushGatewayClient(c *Conn) PushGatewayClient {
+	return &jsonGatewayClient{c}
+}
+
+// QANGatewayClient sends query analytics data to PMM server.
+type QANGatewayClient interface {
+	PushQAN(context.Context, *api.PushQANRequest) (*api.PushQANResponse, error)
+}
+
+// NewQANGatewayClient returns client for QANGatewayClient methods.
+func NewQANGatewayClient(c *Conn) QANGatewayClient {
+	return &jsonGatewayClient{c}
+}
+
+// ActionsGatewayClient sends actions results to PMM server.
+type ActionsGatewayClient interface {
+	ActionResult(context.Context, *api.ActionResultRequest) (*api.ActionResultResponse, error)
+}
+
+// NewActionsGatewayClient returns client for ActionsGatewayClient methods.
+func NewActionsGatewayClient(c *Conn) ActionsGatewayClient {
+	return &jsonGatewayClient{c}
+}
+
+// AuditGatewayClient sends audit events to PMM server.
+type AuditGatewayClient interface {
+	PushAudit(context.Context, *api.PushAuditRequest) (*api.PushAuditResponse, error)
+}
+
+// NewAuditGatewayClient returns client for AuditGatewayClient methods.
+func NewAuditGatewayClient(c *Conn) AuditGatewayClient {
+	return &jsonGatewayClient{c}
+}
+
+// jsonGatewayClient implements all JSON-encoded gateway clients.
+type jsonGatewayClient struct {
+	c *Conn
+}
+
+func (g *jsonGatewayClient) ReportProcesses(ctx context.Context, req *api.ReportProcessesRequest) (*api.ReportProcessesResponse, error) {
+	res := new(api.ReportProcessesResponse)
+	if err := g.c.invokeJSON(ctx, gatewayJSONService+"ReportProcesses", req, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (g *jsonGatewayClient) PushMetrics(ctx context.Context, req *api.PushMetricsRequest) (*api.PushMetricsResponse, error) {
+	res := new(api.PushMetricsResponse)
+	if err := g.c.invokeJSON(ctx, gatewayJSONService+"PushMetrics", req, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (g *jsonGatewayClient) PushQAN(ctx context.Context, req *api.PushQANRequest) (*api.PushQANResponse, error) {
+	res := new(api.PushQANResponse)
+	if err := g.c.invokeJSON(ctx, gatewayJSONService+"PushQAN", req, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (g *jsonGatewayClient) ActionResult(ctx context.Context, req *api.ActionResultRequest) (*api.ActionResultResponse, error) {
+	res := new(api.ActionResultResponse)
+	if err := g.c.invokeJSON(ctx, gatewayJSONService+"ActionResult", req, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (g *jsonGatewayClient) PushAudit(ctx context.Context, req *api.PushAuditRequest) (*api.PushAuditResponse, error) {
+	res := new(api.PushAuditResponse)
+	if err := g.c.invokeJSON(ctx, gatewayJSONService+"PushAudit", req, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// check interfaces
+var (
+	_ GatewayClient           = (*gatewayClient)(nil)
+	_ SupervisorGatewayClient = (*jsonGatewayClient)(nil)
+	_ PushGatewayClient       = (*jsonGatewayClient)(nil)
+	_ QANGatewayClient        = (*jsonGatewayClient)(nil)
+	_ ActionsGatewayClient    = (*jsonGatewayClient)(nil)
+	_ AuditGatewayClient      = (*jsonGatewayClient)(nil)
+)
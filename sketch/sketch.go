@@ -0,0 +1,188 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package sketch implements DDSketch, a mergeable quantile sketch with relative accuracy guarantee.
+//
+// See "DDSketch: A Fast and Fully-Mergeable Quantile Sketch with Relative-Error Guarantees",
+// http://www.vldb.org/pvldb/vol12/p2195-masson.pdf.
+package sketch
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+)
+
+const (
+	// DefaultRelativeAccuracy is a relative accuracy of sketches created by New.
+	DefaultRelativeAccuracy = 0.01
+
+	// maxBins limits sketch size; the lowest bins are collapsed when it is reached.
+	// With the default accuracy, it covers values from 1 microsecond to more than a day without collapsing.
+	maxBins = 2048
+
+	// values smaller than that are counted as zeroes
+	minIndexable = 1e-9
+)
+
+// Sketch is DDSketch for non-negative values.
+type Sketch struct {
+	alpha      float64
+	gamma      float64
+	multiplier float64 // 1 / ln(gamma)
+
+	count  uint64
+	zero   uint64
+	offset int      // index of counts[0]
+	counts []uint64 // counts of consecutive bins
+}
+
+// New creates a new empty sketch with the default relative accuracy.
+func New() *Sketch {
+	return newSketch(DefaultRelativeAccuracy)
+}
+
+func newSketch(alpha float64) *Sketch {
+	gamma := (1 + alpha) / (1 - alpha)
+	return &Sketch{
+		alpha:      alpha,
+		gamma:      gamma,
+		multiplier: 1 / math.Log(gamma),
+	}
+}
+
+// Decode creates a new sketch from a serialized one.
+func Decode(s *api.Sketch) (*Sketch, error) {
+	if !(s.RelativeAccuracy > 0 && s.RelativeAccuracy < 1) {
+		return nil, errors.Errorf("invalid relative accuracy %v", s.RelativeAccuracy)
+	}
+	res := newSketch(s.RelativeAccuracy)
+	res.zero = s.ZeroCount
+	res.count = s.ZeroCount
+	res.offset = int(s.Offset)
+	res.counts = make([]uint64, len(s.Counts))
+	copy(res.counts, s.Counts)
+	for _, c := range res.counts {
+		res.count += c
+	}
+	res.collapse()
+	return res, nil
+}
+
+// Encode returns serialized sketch.
+func (s *Sketch) Encode() *api.Sketch {
+	counts := make([]uint64, len(s.counts))
+	copy(counts, s.counts)
+	return &api.Sketch{
+		RelativeAccuracy: s.alpha,
+		ZeroCount:        s.zero,
+		Offset:           int32(s.offset),
+		Counts:           counts,
+	}
+}
+
+// Count returns a total number of added values.
+func (s *Sketch) Count() uint64 {
+	return s.count
+}
+
+// Add adds value to sketch count times. Negative values are counted as zeroes.
+func (s *Sketch) Add(v float64, count uint64) {
+	if count == 0 || math.IsNaN(v) {
+		return
+	}
+	s.count += count
+	if v < minIndexable {
+		s.zero += count
+		return
+	}
+	s.add(int(math.Ceil(math.Log(v)*s.multiplier)), count)
+}
+
+// add adds count to bin with a given index, growing and collapsing bins as needed.
+func (s *Sketch) add(index int, count uint64) {
+	switch {
+	case len(s.counts) == 0:
+		s.offset = index
+		s.counts = []uint64{0}
+	case index < s.offset:
+		grown := make([]uint64, s.offset-index+len(s.counts))
+		copy(grown[s.offset-index:], s.counts)
+		s.offset = index
+		s.counts = grown
+	case index >= s.offset+len(s.counts):
+		s.counts = append(s.counts, make([]uint64, index-s.offset-len(s.counts)+1)...)
+	}
+	s.counts[index-s.offset] += count
+	s.collapse()
+}
+
+// collapse merges the lowest bins if there are too many of them.
+func (s *Sketch) collapse() {
+	extra := len(s.counts) - maxBins
+	if extra <= 0 {
+		return
+	}
+	for _, c := range s.counts[:extra] {
+		s.counts[extra] += c
+	}
+	s.counts = s.counts[extra:]
+	s.offset += extra
+}
+
+// Merge adds all values of other sketch with the same relative accuracy to this one.
+func (s *Sketch) Merge(other *Sketch) error {
+	if s.alpha != other.alpha {
+		return errors.Errorf("can't merge sketches with different relative accuracy: %v and %v", s.alpha, other.alpha)
+	}
+	s.count += other.zero
+	s.zero += other.zero
+	for i, c := range other.counts {
+		if c != 0 {
+			s.count += c
+			s.add(other.offset+i, c)
+		}
+	}
+	return nil
+}
+
+// Quantile returns an estimation of q-quantile (0 <= q <= 1) of added values,
+// or 0 if sketch is empty.
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.count == 0 || q < 0 || q > 1 {
+		return 0
+	}
+
+	rank := q * float64(s.count-1)
+	cum := s.zero
+	if float64(cum) > rank {
+		return 0
+	}
+	for i, c := range s.counts {
+		cum += c
+		if float64(cum) > rank {
+			return s.value(s.offset + i)
+		}
+	}
+	return s.value(s.offset + len(s.counts) - 1)
+}
+
+// value returns a value with the smallest relative error for all values in bin with a given index.
+func (s *Sketch) value(index int) float64 {
+	return 2 * math.Pow(s.gamma, float64(index)) / (s.gamma + 1)
+}
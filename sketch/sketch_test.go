@@ -0,0 +1,221 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package sketch
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+)
+
+// randomValues returns n log-uniformly distributed values in range [min, max).
+func randomValues(r *rand.Rand, n int, min, max float64) []float64 {
+	res := make([]float64, n)
+	for i := range res {
+		res[i] = min * math.Pow(max/min, r.Float64())
+	}
+	return res
+}
+
+// checkQuantiles checks that sketch quantiles are within relative accuracy of exact ones.
+func checkQuantiles(t *testing.T, s *Sketch, values []float64) {
+	t.Helper()
+
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	for _, q := range []float64{0, 0.01, 0.25, 0.5, 0.75, 0.95, 0.99, 0.999, 1} {
+		expected := sorted[int(q*float64(len(sorted)-1))]
+		actual := s.Quantile(q)
+		if math.Abs(actual-expected) > s.alpha*expected*(1+1e-9) {
+			t.Errorf("q=%v: expected %v ± %v%%, got %v", q, expected, s.alpha*100, actual)
+		}
+	}
+}
+
+func TestSketchQuantiles(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, tc := range []struct {
+		name     string
+		alpha    float64
+		min, max float64
+	}{
+		{"Default", DefaultRelativeAccuracy, 1e-6, 1e3},
+		{"Narrow", DefaultRelativeAccuracy, 0.1, 0.2},
+		{"Coarse", 0.05, 1e-6, 1e5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newSketch(tc.alpha)
+			values := randomValues(r, 10000, tc.min, tc.max)
+			for _, v := range values {
+				s.Add(v, 1)
+			}
+			if s.Count() != uint64(len(values)) {
+				t.Errorf("expected count %d, got %d", len(values), s.Count())
+			}
+			checkQuantiles(t, s, values)
+		})
+	}
+
+	t.Run("Zeroes", func(t *testing.T) {
+		s := New()
+		s.Add(0, 3)
+		s.Add(-1, 1)
+		s.Add(1e-12, 1)
+		s.Add(math.NaN(), 1)
+		s.Add(2, 5)
+		s.Add(2, 0)
+		if s.Count() != 10 {
+			t.Errorf("expected count 10, got %d", s.Count())
+		}
+		checkQuantiles(t, s, []float64{0, 0, 0, 0, 0, 2, 2, 2, 2, 2})
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		s := New()
+		for _, q := range []float64{0, 0.5, 1} {
+			if v := s.Quantile(q); v != 0 {
+				t.Errorf("q=%v: expected 0, got %v", q, v)
+			}
+		}
+	})
+}
+
+func TestSketchMerge(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	values1 := randomValues(r, 5000, 1e-3, 1)
+	values2 := randomValues(r, 5000, 0.5, 100)
+
+	s1, s2, all := New(), New(), New()
+	for _, v := range values1 {
+		s1.Add(v, 1)
+		all.Add(v, 1)
+	}
+	s1.Add(0, 2)
+	all.Add(0, 2)
+	for _, v := range values2 {
+		s2.Add(v, 1)
+		all.Add(v, 1)
+	}
+	if err := s1.Merge(s2); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(s1.Encode(), all.Encode()) {
+		t.Errorf("expected %+v, got %+v", all.Encode(), s1.Encode())
+	}
+	if s1.Count() != all.Count() {
+		t.Errorf("expected count %d, got %d", all.Count(), s1.Count())
+	}
+	checkQuantiles(t, s1, append(append([]float64{0, 0}, values1...), values2...))
+
+	if err := s1.Merge(newSketch(0.05)); err == nil {
+		t.Error("expected error for different relative accuracy")
+	}
+}
+
+func TestSketchEncode(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	s := New()
+	for _, v := range randomValues(r, 1000, 1e-6, 10) {
+		s.Add(v, 1)
+	}
+	s.Add(0, 5)
+
+	encoded := s.Encode()
+	decoded, err := Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, s) {
+		t.Errorf("expected %+v, got %+v", s, decoded)
+	}
+	if !reflect.DeepEqual(decoded.Encode(), encoded) {
+		t.Errorf("expected %+v, got %+v", encoded, decoded.Encode())
+	}
+
+	// encoded sketch does not share counts
+	encoded.Counts[0]++
+	if reflect.DeepEqual(decoded.Encode(), encoded) {
+		t.Error("expected encoded counts to be copied")
+	}
+
+	for _, alpha := range []float64{0, -0.1, 1, math.NaN()} {
+		if _, err = Decode(&api.Sketch{RelativeAccuracy: alpha}); err == nil {
+			t.Errorf("expected error for relative accuracy %v", alpha)
+		}
+	}
+}
+
+func TestSketchCollapse(t *testing.T) {
+	const extra = 10
+
+	t.Run("Add", func(t *testing.T) {
+		s := New()
+		for i := 0; i < maxBins+extra; i++ {
+			s.add(i, 1)
+			s.count++
+		}
+		if len(s.counts) != maxBins {
+			t.Fatalf("expected %d bins, got %d", maxBins, len(s.counts))
+		}
+		if s.offset != extra {
+			t.Errorf("expected offset %d, got %d", extra, s.offset)
+		}
+		if s.counts[0] != extra+1 {
+			t.Errorf("expected %d values in the lowest bin, got %d", extra+1, s.counts[0])
+		}
+		if s.Count() != maxBins+extra {
+			t.Errorf("expected count %d, got %d", maxBins+extra, s.Count())
+		}
+
+		// the lowest values are overestimated, the highest ones are still accurate
+		if v := s.Quantile(0); v != s.value(extra) {
+			t.Errorf("expected %v, got %v", s.value(extra), v)
+		}
+		if v := s.Quantile(1); v != s.value(maxBins+extra-1) {
+			t.Errorf("expected %v, got %v", s.value(maxBins+extra-1), v)
+		}
+
+		// values below collapsed bins are added to the lowest bin
+		s.add(0, 1)
+		if len(s.counts) != maxBins || s.offset != extra || s.counts[0] != extra+2 {
+			t.Errorf("unexpected bins after adding low value: offset %d, %d bins, lowest %d", s.offset, len(s.counts), s.counts[0])
+		}
+	})
+
+	t.Run("Decode", func(t *testing.T) {
+		counts := make([]uint64, maxBins+extra)
+		for i := range counts {
+			counts[i] = 1
+		}
+		s, err := Decode(&api.Sketch{RelativeAccuracy: DefaultRelativeAccuracy, Offset: -5, Counts: counts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s.counts) != maxBins || s.offset != extra-5 || s.counts[0] != extra+1 {
+			t.Errorf("unexpected bins: offset %d, %d bins, lowest %d", s.offset, len(s.counts), s.counts[0])
+		}
+		if s.Count() != maxBins+extra {
+			t.Errorf("expected count %d, got %d", maxBins+extra, s.Count())
+		}
+	})
+}
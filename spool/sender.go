@@ -0,0 +1,170 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package spool
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// delays between send retries
+	minRetryDelay = time.Second
+	maxRetryDelay = 30 * time.Second
+
+	// number of rejections in a row after which request size is halved, or a single record is dropped
+	maxRejections = 3
+)
+
+// SendFunc sends records to PMM server in a single request. It returns a number of actually sent records,
+// which may be less than len(records) if some of them were skipped as undecodable.
+type SendFunc func(records [][]byte) (int, error)
+
+// SenderParams represent sender parameters.
+type SenderParams struct {
+	Spool      *Spool
+	L          *logrus.Entry
+	Name       string // records name used in logs, for example: metrics batches
+	MaxRecords int    // maximum number of records in a single request
+	MaxSize    int    // maximum total size of records in a single request
+
+	// Send sends records; Rejected returns true for errors returned by PMM server for sent requests,
+	// as opposed to connection problems.
+	Send     SendFunc
+	Rejected func(err error) bool
+
+	// Producer's metrics: sent records, retried requests, and dropped records by reason.
+	Sent    prometheus.Counter
+	Retries prometheus.Counter
+	Dropped *prometheus.CounterVec
+}
+
+// Sender sends records from spool to PMM server in order.
+//
+// Failed requests are retried with increasing delay; records are removed from spool only after
+// they were sent, so they are sent again after reconnection or restart. Requests are limited
+// by the number of records and their total size. Records which can't be sent are dropped,
+// so they don't block the whole queue: records larger than the size limit (reason too_large), and records
+// rejected by PMM server several times in a row even when sent alone (reason rejected).
+type Sender struct {
+	p        *SenderParams
+	minDelay time.Duration
+	maxDelay time.Duration
+}
+
+// NewSender creates a new sender.
+func NewSender(params *SenderParams) *Sender {
+	return &Sender{
+		p:        params,
+		minDelay: minRetryDelay,
+		maxDelay: maxRetryDelay,
+	}
+}
+
+// Run sends records until done is closed.
+func (s *Sender) Run(done <-chan struct{}) {
+	delay := s.minDelay
+	maxRecords := s.p.MaxRecords
+	var rejections int
+	for {
+		records, first, err := s.p.Spool.Peek(maxRecords)
+		if err != nil {
+			s.p.L.Errorf("Failed to read %s from spool: %s.", s.p.Name, err)
+		}
+		if len(records) == 0 {
+			wait := s.p.Spool.Notify()
+			if err != nil {
+				wait = nil
+			}
+			select {
+			case <-done:
+				return
+			case <-wait:
+			case <-time.After(s.maxDelay):
+			}
+			continue
+		}
+
+		// the first record is always taken to be sent or dropped
+		n, size := 1, len(records[0])
+		for n < len(records) && size+len(records[n]) <= s.p.MaxSize {
+			size += len(records[n])
+			n++
+		}
+		if size > s.p.MaxSize {
+			s.p.L.Errorf("Dropping one of %s: size %d is larger than %d bytes.", s.p.Name, size, s.p.MaxSize)
+			s.drop(first, "too_large")
+			continue
+		}
+
+		sent, err := s.p.Send(records[:n])
+		if err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if s.p.Rejected(err) {
+				rejections++
+				if rejections >= maxRejections {
+					rejections = 0
+					if n == 1 {
+						s.p.L.Errorf("Dropping one of %s: rejected %d times: %s.", s.p.Name, maxRejections, err)
+						s.drop(first, "rejected")
+						continue
+					}
+					// isolate rejected records
+					maxRecords = (n + 1) / 2
+				}
+			}
+
+			s.p.Retries.Inc()
+			s.p.L.Warnf("Failed to send %d %s, retrying in %s: %s.", n, s.p.Name, delay, err)
+			select {
+			case <-done:
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if delay > s.maxDelay {
+				delay = s.maxDelay
+			}
+			continue
+		}
+
+		s.p.Sent.Add(float64(sent))
+		delay = s.minDelay
+		rejections = 0
+		if maxRecords *= 2; maxRecords > s.p.MaxRecords {
+			maxRecords = s.p.MaxRecords
+		}
+		if err = s.p.Spool.Pop(first, n); err != nil {
+			s.p.L.Errorf("Failed to remove sent %s from spool: %s.", s.p.Name, err)
+		}
+	}
+}
+
+// drop removes the first record from spool without sending it.
+func (s *Sender) drop(first uint64, reason string) {
+	s.p.Dropped.WithLabelValues(reason).Inc()
+	if err := s.p.Spool.Pop(first, 1); err != nil {
+		s.p.L.Errorf("Failed to remove dropped %s from spool: %s.", s.p.Name, err)
+	}
+}
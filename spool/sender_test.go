@@ -0,0 +1,150 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package spool
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+func counterValue(t *testing.T, m prometheus.Metric) float64 {
+	t.Helper()
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	return pb.GetCounter().GetValue()
+}
+
+var errRejected = errors.New("rejected")
+
+// fakeServer records sent requests, rejects requests containing "bad" record, and fails the first request.
+type fakeServer struct {
+	m        sync.Mutex
+	requests [][]string
+	sent     []string
+	failed   bool
+}
+
+func (f *fakeServer) send(records [][]byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	req := make([]string, len(records))
+	for i, r := range records {
+		req[i] = string(r)
+	}
+	f.requests = append(f.requests, req)
+	if !f.failed {
+		f.failed = true
+		return 0, errors.New("connection closed")
+	}
+	for _, r := range req {
+		if r == "bad" {
+			return 0, errRejected
+		}
+	}
+	f.sent = append(f.sent, req...)
+	return len(req), nil
+}
+
+func (f *fakeServer) getSent() []string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return append([]string(nil), f.sent...)
+}
+
+func TestSender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmm-agent-spool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(&Params{
+		Dir:         dir,
+		Name:        "test",
+		MaxSize:     1024 * 1024,
+		SegmentSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	records := []string{"a", "b", "c", strings.Repeat("x", 20), "d", "e", "bad", "f", "g"}
+	for _, r := range records {
+		if err = s.Write([]byte(r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := new(fakeServer)
+	dropped := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "dropped"}, []string{"reason"})
+	sender := NewSender(&SenderParams{
+		Spool:      s,
+		L:          logrus.WithField("component", "spool-test"),
+		Name:       "test records",
+		MaxRecords: 4,
+		MaxSize:    10,
+		Send:       server.send,
+		Rejected:   func(err error) bool { return err == errRejected },
+		Sent:       prometheus.NewCounter(prometheus.CounterOpts{Name: "sent"}),
+		Retries:    prometheus.NewCounter(prometheus.CounterOpts{Name: "retries"}),
+		Dropped:    dropped,
+	})
+	sender.minDelay = time.Millisecond
+	sender.maxDelay = 10 * time.Millisecond
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		sender.Run(done)
+		close(stopped)
+	}()
+
+	expected := []string{"a", "b", "c", "d", "e", "f", "g"}
+	for i := 0; i < 500 && len(server.getSent()) < len(expected); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	<-stopped
+
+	if sent := server.getSent(); !reflect.DeepEqual(expected, sent) {
+		t.Errorf("expected %v, got %v; requests: %v", expected, sent, server.requests)
+	}
+	for reason, expected := range map[string]int{"too_large": 1, "rejected": 1} {
+		ch := make(chan prometheus.Metric, 1)
+		dropped.WithLabelValues(reason).Collect(ch)
+		if actual := counterValue(t, <-ch); actual != float64(expected) {
+			t.Errorf("expected %d records dropped as %s, got %v", expected, reason, actual)
+		}
+	}
+	if records, _, err := s.Peek(10); err != nil || len(records) != 0 {
+		t.Errorf("expected empty spool, got %q, %v", records, err)
+	}
+}
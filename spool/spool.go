@@ -0,0 +1,516 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package spool implements bounded on-disk FIFO queue (write-ahead log) for data which should survive
+// disconnections and agent restarts.
+//
+// Queue is stored in a directory as a sequence of segment files. Each record is stored as a 4-byte
+// big-endian length, 4-byte CRC-32 of data, and data itself. Incomplete and corrupted records at
+// the end of a segment (after a crash) are discarded on open. When the total size exceeds the limit,
+// the oldest segments are removed with all their records.
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	prometheusNamespace = "pmm_agent"
+	prometheusSubsystem = "spool"
+
+	headerSize    = 8
+	segmentSuffix = ".wal"
+	positionFile  = "position.json"
+
+	// maximum record size; larger length in header means corruption
+	maxRecordSize = 256 * 1024 * 1024
+)
+
+// Params represent spool parameters.
+type Params struct {
+	Dir         string // directory for segment files, created if needed
+	Name        string // name used in logs and metrics, for example: metrics
+	MaxSize     int64  // maximum total size of segments
+	SegmentSize int64  // segment is closed and a new one is created when that size is reached
+}
+
+type segment struct {
+	seq     uint64
+	size    int64
+	records int
+}
+
+// position is a read position stored in position file.
+type position struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// Spool is on-disk FIFO queue.
+type Spool struct {
+	params *Params
+	l      *logrus.Entry
+	notify chan struct{}
+
+	written *prometheus.Desc
+	read    *prometheus.Desc
+	dropped *prometheus.Desc
+	size    *prometheus.Desc
+	pending *prometheus.Desc
+
+	m            sync.Mutex
+	segments     []*segment // from the oldest to the newest; the last one is open for writing
+	f            *os.File   // the last segment
+	readOffset   int64      // read offset in the first segment
+	readRecords  int        // number of read records in the first segment
+	head         uint64     // sequence number of the first unread record since Open
+	writtenTotal uint64
+	readTotal    uint64
+	droppedTotal map[string]uint64 // by reason
+}
+
+// Open opens or creates spool in a given directory.
+func Open(params *Params) (*Spool, error) {
+	if params.SegmentSize <= 0 || params.MaxSize < 2*params.SegmentSize {
+		return nil, errors.Errorf("invalid sizes: segment %d, max %d; max size should be at least two segments",
+			params.SegmentSize, params.MaxSize)
+	}
+	if err := os.MkdirAll(params.Dir, 0700); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	labels := prometheus.Labels{"spool": params.Name}
+	s := &Spool{
+		params: params,
+		l:      logrus.WithField("component", "spool").WithField("spool", params.Name),
+		notify: make(chan struct{}, 1),
+
+		written: prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, prometheusSubsystem, "records_written_total"),
+			"A total number of records written to spool.", nil, labels),
+		read: prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, prometheusSubsystem, "records_read_total"),
+			"A total number of records read from spool and acknowledged.", nil, labels),
+		dropped: prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, prometheusSubsystem, "records_dropped_total"),
+			"A total number of records dropped from spool by reason: evicted when size limit is reached, corrupted after crash.", []string{"reason"}, labels),
+		size: prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, prometheusSubsystem, "size_bytes"),
+			"Total size of spool segments.", nil, labels),
+		pending: prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, prometheusSubsystem, "pending_records"),
+			"A number of records waiting to be read.", nil, labels),
+
+		droppedTotal: map[string]uint64{"evicted": 0, "corrupted": 0},
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if len(s.segments) == 0 {
+		s.segments = []*segment{{seq: 1}}
+	}
+	if err := s.openLast(); err != nil {
+		return nil, err
+	}
+	if s.pendingRecords() > 0 {
+		s.l.Infof("%d records pending.", s.pendingRecords())
+		s.notify <- struct{}{}
+	}
+	return s, nil
+}
+
+// load scans existing segments, truncates corrupted ones, and restores read position.
+func (s *Spool) load() error {
+	files, err := ioutil.ReadDir(s.params.Dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &segment{seq: seq})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	var pos position
+	if b, err := ioutil.ReadFile(filepath.Join(s.params.Dir, positionFile)); err == nil {
+		if err = json.Unmarshal(b, &pos); err != nil {
+			s.l.Warnf("Failed to parse read position, reading from the start: %s.", err)
+		}
+	}
+
+	for _, seg := range s.segments {
+		var readOffset int64 = -1
+		if seg.seq == pos.Segment {
+			readOffset = pos.Offset
+		}
+		readRecords, err := s.scan(seg, readOffset)
+		if err != nil {
+			return err
+		}
+		if seg.seq == pos.Segment {
+			s.readRecords = readRecords
+		}
+	}
+
+	// remove segments read completely before restart
+	for len(s.segments) > 1 && s.segments[0].seq < pos.Segment {
+		if err := os.Remove(s.path(s.segments[0].seq)); err != nil {
+			return errors.WithStack(err)
+		}
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) > 0 && s.segments[0].seq == pos.Segment && pos.Offset <= s.segments[0].size {
+		s.readOffset = pos.Offset
+	} else {
+		s.readRecords = 0
+	}
+	return nil
+}
+
+// scan counts valid records of segment and truncates it after the last valid record.
+// It returns a number of records before readOffset.
+func (s *Spool) scan(seg *segment, readOffset int64) (int, error) {
+	path := s.path(seg.seq)
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	var readRecords int
+	r := bufio.NewReader(f)
+	for {
+		if seg.size == readOffset {
+			readRecords = seg.records
+		}
+		n, err := readRecord(r, nil)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fi, _ := f.Stat()
+			s.l.Warnf("Segment %s: %s at offset %d; discarding %d bytes.", path, err, seg.size, fi.Size()-seg.size)
+			s.droppedTotal["corrupted"]++
+			if err = os.Truncate(path, seg.size); err != nil {
+				return 0, errors.WithStack(err)
+			}
+			break
+		}
+		seg.size += n
+		seg.records++
+	}
+	if seg.size == readOffset {
+		readRecords = seg.records
+	}
+	return readRecords, nil
+}
+
+// readRecord reads a single record and returns its total size. If data is not nil, record data is appended to it.
+func readRecord(r io.Reader, data *[]byte) (int64, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		return 0, errors.New("incomplete record header")
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	sum := binary.BigEndian.Uint32(header[4:])
+	if size > maxRecordSize {
+		return 0, errors.Errorf("invalid record size %d", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, errors.New("incomplete record")
+	}
+	if crc32.ChecksumIEEE(b) != sum {
+		return 0, errors.New("checksum mismatch")
+	}
+	if data != nil {
+		*data = b
+	}
+	return headerSize + int64(size), nil
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.params.Dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// openLast opens the last segment for writing. Caller should hold s.m or have exclusive access.
+func (s *Spool) openLast() error {
+	seg := s.segments[len(s.segments)-1]
+	f, err := os.OpenFile(s.path(seg.seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.f = f
+	return nil
+}
+
+// removeFirst removes the first segment, counting its unread records as dropped. Caller should hold s.m.
+func (s *Spool) removeFirst(reason string) error {
+	seg := s.segments[0]
+	if n := seg.records - s.readRecords; n > 0 {
+		s.droppedTotal[reason] += uint64(n)
+		s.head += uint64(n)
+		s.l.Warnf("Dropped %d unread records (%s).", n, reason)
+	}
+	if err := os.Remove(s.path(seg.seq)); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	s.segments = s.segments[1:]
+	s.readOffset = 0
+	s.readRecords = 0
+	return nil
+}
+
+// Notify returns channel which receives a value after records are written.
+// Several writes may be coalesced into one value.
+func (s *Spool) Notify() <-chan struct{} {
+	return s.notify
+}
+
+// Write appends record to the queue and syncs it to disk, evicting the oldest segments if needed.
+func (s *Spool) Write(data []byte) error {
+	if len(data) > maxRecordSize {
+		return errors.Errorf("record is too large: %d bytes", len(data))
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	seg := s.segments[len(s.segments)-1]
+	if seg.size >= s.params.SegmentSize {
+		if err := s.f.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+		seg = &segment{seq: seg.seq + 1}
+		s.segments = append(s.segments, seg)
+		if err := s.openLast(); err != nil {
+			return err
+		}
+	}
+
+	b := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(b[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(b[4:headerSize], crc32.ChecksumIEEE(data))
+	copy(b[headerSize:], data)
+	if _, err := s.f.Write(b); err != nil {
+		// partially written record will be discarded on the next open
+		return errors.WithStack(err)
+	}
+	if err := s.f.Sync(); err != nil {
+		return errors.WithStack(err)
+	}
+	seg.size += int64(len(b))
+	seg.records++
+	s.writtenTotal++
+
+	for len(s.segments) > 1 && s.totalSize() > s.params.MaxSize {
+		if err := s.removeFirst("evicted"); err != nil {
+			return err
+		}
+		if err := s.savePosition(); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Peek returns up to max the oldest unread records without removing them,
+// and a sequence number of the first one which should be passed to Pop.
+func (s *Spool) Peek(max int) ([][]byte, uint64, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var res [][]byte
+	offset := s.readOffset
+	for _, seg := range s.segments {
+		if len(res) >= max {
+			break
+		}
+		if offset >= seg.size {
+			offset = 0
+			continue
+		}
+
+		f, err := os.Open(s.path(seg.seq))
+		if err != nil {
+			return nil, 0, errors.WithStack(err)
+		}
+		if _, err = f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, 0, errors.WithStack(err)
+		}
+		r := bufio.NewReader(io.LimitReader(f, seg.size-offset))
+		for len(res) < max {
+			var data []byte
+			if _, err = readRecord(r, &data); err != nil {
+				break
+			}
+			res = append(res, data)
+		}
+		f.Close()
+		if err != nil && err != io.EOF {
+			return nil, 0, errors.Wrapf(err, "segment %d", seg.seq)
+		}
+		offset = 0
+	}
+	return res, s.head, nil
+}
+
+// Pop removes n records starting from a given sequence number returned by Peek, after they were processed.
+// Records evicted since Peek are skipped.
+func (s *Spool) Pop(first uint64, n int) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.head > first {
+		n -= int(s.head - first)
+	}
+	for ; n > 0; n-- {
+		seg := s.segments[0]
+		if s.readRecords == seg.records {
+			if len(s.segments) == 1 {
+				return errors.New("no records to pop")
+			}
+			if err := s.removeFirst("evicted"); err != nil {
+				return err
+			}
+			seg = s.segments[0]
+		}
+
+		f, err := os.Open(s.path(seg.seq))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err = f.Seek(s.readOffset, io.SeekStart); err != nil {
+			f.Close()
+			return errors.WithStack(err)
+		}
+		var header [headerSize]byte
+		_, err = io.ReadFull(f, header[:])
+		f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "segment %d", seg.seq)
+		}
+		s.readOffset += headerSize + int64(binary.BigEndian.Uint32(header[:4]))
+		s.readRecords++
+		s.readTotal++
+		s.head++
+	}
+
+	// remove the first segment if it is read completely, and it is not the one open for writing
+	if len(s.segments) > 1 && s.readRecords == s.segments[0].records {
+		if err := s.removeFirst("evicted"); err != nil {
+			return err
+		}
+	}
+	return s.savePosition()
+}
+
+// savePosition writes read position file atomically. Caller should hold s.m.
+func (s *Spool) savePosition() error {
+	b, err := json.Marshal(&position{
+		Segment: s.segments[0].seq,
+		Offset:  s.readOffset,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	path := filepath.Join(s.params.Dir, positionFile)
+	if err = ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(path+".tmp", path))
+}
+
+// totalSize returns total size of all segments. Caller should hold s.m.
+func (s *Spool) totalSize() int64 {
+	var res int64
+	for _, seg := range s.segments {
+		res += seg.size
+	}
+	return res
+}
+
+// pendingRecords returns a number of unread records. Caller should hold s.m.
+func (s *Spool) pendingRecords() int {
+	res := -s.readRecords
+	for _, seg := range s.segments {
+		res += seg.records
+	}
+	return res
+}
+
+// Close closes spool. Unread records are kept for the next Open.
+func (s *Spool) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return errors.WithStack(s.f.Close())
+}
+
+// Describe implements prometheus.Collector.
+func (s *Spool) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.written
+	ch <- s.read
+	ch <- s.dropped
+	ch <- s.size
+	ch <- s.pending
+}
+
+// Collect implements prometheus.Collector.
+func (s *Spool) Collect(ch chan<- prometheus.Metric) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(s.written, prometheus.CounterValue, float64(s.writtenTotal))
+	ch <- prometheus.MustNewConstMetric(s.read, prometheus.CounterValue, float64(s.readTotal))
+	for reason, v := range s.droppedTotal {
+		ch <- prometheus.MustNewConstMetric(s.dropped, prometheus.CounterValue, float64(v), reason)
+	}
+	ch <- prometheus.MustNewConstMetric(s.size, prometheus.GaugeValue, float64(s.totalSize()))
+	ch <- prometheus.MustNewConstMetric(s.pending, prometheus.GaugeValue, float64(s.pendingRecords()))
+}
+
+// check interfaces
+var (
+	_ prometheus.Collector = (*Spool)(nil)
+)
@@ -0,0 +1,365 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package spool
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// record returns 10-byte record data; it takes 18 bytes on disk with the header.
+func record(i int) []byte {
+	return []byte(fmt.Sprintf("record-%03d", i))
+}
+
+func records(from, to int) []string {
+	var res []string
+	for i := from; i <= to; i++ {
+		res = append(res, string(record(i)))
+	}
+	return res
+}
+
+func openSpool(t *testing.T, dir string, maxSize, segmentSize int64) *Spool {
+	t.Helper()
+	s, err := Open(&Params{
+		Dir:         dir,
+		Name:        "test",
+		MaxSize:     maxSize,
+		SegmentSize: segmentSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func write(t *testing.T, s *Spool, from, to int) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		if err := s.Write(record(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkPeek checks that Peek returns expected records and sequence number.
+func checkPeek(t *testing.T, s *Spool, max int, expected []string, expectedFirst uint64) {
+	t.Helper()
+	res, first, err := s.Peek(max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual []string
+	for _, r := range res {
+		actual = append(actual, string(r))
+	}
+	if !reflect.DeepEqual(actual, expected) || first != expectedFirst {
+		t.Errorf("Expected %q (first %d), got %q (first %d).", expected, expectedFirst, actual, first)
+	}
+}
+
+// segmentFiles returns segment file sizes by name.
+func segmentFiles(t *testing.T, dir string) map[string]int64 {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make(map[string]int64)
+	for _, fi := range files {
+		if filepath.Ext(fi.Name()) == segmentSuffix {
+			res[fi.Name()] = fi.Size()
+		}
+	}
+	return res
+}
+
+func readPosition(t *testing.T, dir string) position {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(dir, positionFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pos position
+	if err = json.Unmarshal(b, &pos); err != nil {
+		t.Fatal(err)
+	}
+	return pos
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "pmm-agent-spool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestSpoolInvalidSizes(t *testing.T) {
+	for _, sizes := range [][2]int64{{100, 0}, {99, 50}} {
+		_, err := Open(&Params{Dir: "/nonexistent", MaxSize: sizes[0], SegmentSize: sizes[1]})
+		expected := fmt.Sprintf("invalid sizes: segment %d, max %d; max size should be at least two segments", sizes[1], sizes[0])
+		if err == nil || err.Error() != expected {
+			t.Errorf("Expected %q, got %v.", expected, err)
+		}
+	}
+}
+
+func TestSpoolSegments(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// a new segment is started when the current one reaches 50 bytes, i.e. after 3 records
+	s := openSpool(t, dir, 1000, 50)
+	defer s.Close()
+	write(t, s, 1, 10)
+	expectedFiles := map[string]int64{
+		"00000000000000000001.wal": 54,
+		"00000000000000000002.wal": 54,
+		"00000000000000000003.wal": 54,
+		"00000000000000000004.wal": 18,
+	}
+	if actual := segmentFiles(t, dir); !reflect.DeepEqual(actual, expectedFiles) {
+		t.Errorf("Expected %v, got %v.", expectedFiles, actual)
+	}
+	checkPeek(t, s, 100, records(1, 10), 0)
+	checkPeek(t, s, 4, records(1, 4), 0)
+
+	// completely read segment is removed
+	if err := s.Pop(0, 4); err != nil {
+		t.Fatal(err)
+	}
+	delete(expectedFiles, "00000000000000000001.wal")
+	if actual := segmentFiles(t, dir); !reflect.DeepEqual(actual, expectedFiles) {
+		t.Errorf("Expected %v, got %v.", expectedFiles, actual)
+	}
+	if pos := readPosition(t, dir); pos != (position{Segment: 2, Offset: 18}) {
+		t.Errorf("Unexpected position %+v.", pos)
+	}
+	checkPeek(t, s, 2, records(5, 6), 4)
+
+	// the last segment open for writing is not removed even if it is read completely
+	if err := s.Pop(4, 6); err != nil {
+		t.Fatal(err)
+	}
+	expectedFiles = map[string]int64{"00000000000000000004.wal": 18}
+	if actual := segmentFiles(t, dir); !reflect.DeepEqual(actual, expectedFiles) {
+		t.Errorf("Expected %v, got %v.", expectedFiles, actual)
+	}
+	checkPeek(t, s, 100, nil, 10)
+	if err := s.Pop(10, 1); err == nil || err.Error() != "no records to pop" {
+		t.Errorf("Unexpected error %v.", err)
+	}
+
+	write(t, s, 11, 11)
+	checkPeek(t, s, 100, records(11, 11), 10)
+	if s.readTotal != 10 || s.writtenTotal != 11 || s.pendingRecords() != 1 {
+		t.Errorf("Unexpected counters: read %d, written %d, pending %d.", s.readTotal, s.writtenTotal, s.pendingRecords())
+	}
+}
+
+func TestSpoolEviction(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// at most 100 bytes: two full segments are not kept
+	s := openSpool(t, dir, 100, 50)
+	defer s.Close()
+
+	write(t, s, 1, 3)
+	checkPeek(t, s, 100, records(1, 3), 0)
+
+	// the first segment is evicted while its records are being processed
+	write(t, s, 4, 6)
+	if s.droppedTotal["evicted"] != 3 {
+		t.Errorf("Expected 3 evicted records, got %d.", s.droppedTotal["evicted"])
+	}
+	if size := s.totalSize(); size != 54 {
+		t.Errorf("Expected size 54, got %d.", size)
+	}
+	if pos := readPosition(t, dir); pos != (position{Segment: 2, Offset: 0}) {
+		t.Errorf("Unexpected position %+v.", pos)
+	}
+
+	// evicted records are skipped by Pop, the rest is not popped
+	if err := s.Pop(0, 3); err != nil {
+		t.Fatal(err)
+	}
+	checkPeek(t, s, 2, records(4, 5), 3)
+
+	// Pop with partially evicted records removes only remaining ones
+	if err := s.Pop(3, 1); err != nil {
+		t.Fatal(err)
+	}
+	checkPeek(t, s, 100, records(5, 6), 4)
+	write(t, s, 7, 9) // evicts record 5 and 6
+	if s.droppedTotal["evicted"] != 5 {
+		t.Errorf("Expected 5 evicted records, got %d.", s.droppedTotal["evicted"])
+	}
+	if err := s.Pop(4, 3); err != nil {
+		t.Fatal(err)
+	}
+	checkPeek(t, s, 100, records(8, 9), 7)
+	if s.readTotal != 2 || s.pendingRecords() != 2 {
+		t.Errorf("Unexpected counters: read %d, pending %d.", s.readTotal, s.pendingRecords())
+	}
+
+	// read records are not counted as dropped
+	write(t, s, 10, 12)
+	if s.droppedTotal["evicted"] != 7 {
+		t.Errorf("Expected 7 evicted records, got %d.", s.droppedTotal["evicted"])
+	}
+	checkPeek(t, s, 100, records(10, 12), 9)
+	expectedFiles := map[string]int64{
+		"00000000000000000004.wal": 54,
+	}
+	if actual := segmentFiles(t, dir); !reflect.DeepEqual(actual, expectedFiles) {
+		t.Errorf("Expected %v, got %v.", expectedFiles, actual)
+	}
+}
+
+func TestSpoolPosition(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openSpool(t, dir, 1000, 50)
+	write(t, s, 1, 7)
+	if err := s.Pop(0, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// segment read completely before a crash, but not removed, is removed on open
+	old := filepath.Join(dir, "00000000000000000001.wal")
+	if err := ioutil.WriteFile(old, []byte{0, 0, 0, 0, 0, 0, 0, 0}, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// sequence numbers start from 0 after open
+	s = openSpool(t, dir, 1000, 50)
+	checkPeek(t, s, 100, records(6, 7), 0)
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed, got %v.", old, err)
+	}
+	select {
+	case <-s.Notify():
+	default:
+		t.Error("Expected notification about pending records.")
+	}
+
+	write(t, s, 8, 8)
+	if err := s.Pop(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openSpool(t, dir, 1000, 50)
+	checkPeek(t, s, 100, records(7, 8), 0)
+	if err := s.Pop(0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is pending
+	s = openSpool(t, dir, 1000, 50)
+	checkPeek(t, s, 100, nil, 0)
+	select {
+	case <-s.Notify():
+		t.Error("Unexpected notification.")
+	default:
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// invalid position file is ignored, and remaining records are read again
+	if err := ioutil.WriteFile(filepath.Join(dir, positionFile), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s = openSpool(t, dir, 1000, 50)
+	defer s.Close()
+	checkPeek(t, s, 100, records(7, 8), 0)
+}
+
+func TestSpoolCorruptedTail(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		modify   func(b []byte) []byte
+		expected []string
+	}{
+		{"IncompleteHeader", func(b []byte) []byte { return append(b, 0, 0, 0) }, records(1, 3)},
+		{"IncompleteRecord", func(b []byte) []byte { return b[:len(b)-1] }, records(1, 2)},
+		{"ChecksumMismatch", func(b []byte) []byte {
+			b[len(b)-1] ^= 1
+			return b
+		}, records(1, 2)},
+		{"InvalidSize", func(b []byte) []byte { return append(b, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0) }, records(1, 3)},
+		{"CorruptedMiddle", func(b []byte) []byte {
+			b[18+8] ^= 1
+			return b
+		}, records(1, 1)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			s := openSpool(t, dir, 1000, 500)
+			write(t, s, 1, 3)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(dir, "00000000000000000001.wal")
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ioutil.WriteFile(path, tc.modify(b), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			// segment is truncated after the last valid record, so new records are readable
+			s = openSpool(t, dir, 1000, 500)
+			defer s.Close()
+			if s.droppedTotal["corrupted"] != 1 {
+				t.Errorf("Expected corruption to be counted, got %d.", s.droppedTotal["corrupted"])
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Size() != int64(18*len(tc.expected)) {
+				t.Errorf("Expected segment to be truncated to %d bytes, got %d.", 18*len(tc.expected), fi.Size())
+			}
+			write(t, s, 4, 4)
+			checkPeek(t, s, 100, append(tc.expected, records(4, 4)...), 0)
+		})
+	}
+}
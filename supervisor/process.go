@@ -0,0 +1,320 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package supervisor
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+
+	// process running longer than that is considered healthy, and backoff is reset
+	resetBackoffAfter = time.Minute
+
+	// time between SIGTERM and SIGKILL
+	killTimeout = 5 * time.Second
+
+	// maximum length of output line; longer lines are split
+	maxLineLength = 64 * 1024
+)
+
+// ProcessParams represent managed process parameters.
+type ProcessParams struct {
+	Name string   // unique name, for example: node_exporter
+	Path string   // executable path
+	Args []string // arguments without executable path
+	Env  []string // environment variables in KEY=value form; agent environment is not inherited
+
+	ListenPort uint16 // port allocated for process, if any; reported to PMM server
+
+	// Private directory for text files; it is created before every start and removed after the final stop.
+	TextFilesDir string
+	TextFiles    map[string]string // file name -> content
+}
+
+// process runs a single child process, restarting it with exponential backoff until ctx is canceled.
+type process struct {
+	params   *ProcessParams
+	l        *logrus.Entry
+	onChange func()
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	rw     sync.RWMutex
+	status api.ProcessStatus
+}
+
+// startProcess starts process in the background. onChange is called after every state change.
+func startProcess(ctx context.Context, params *ProcessParams, onChange func()) *process {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &process{
+		params:   params,
+		l:        logrus.WithField("component", "supervisor").WithField("process", params.Name),
+		onChange: onChange,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		status: api.ProcessStatus{
+			Name:       params.Name,
+			State:      api.ProcessStateStarting,
+			Since:      time.Now(),
+			ListenPort: params.ListenPort,
+		},
+	}
+	go p.run(ctx)
+	return p
+}
+
+// stop stops process and waits for it to exit.
+func (p *process) stop() {
+	p.cancel()
+	<-p.done
+}
+
+// Status returns current process status.
+func (p *process) Status() api.ProcessStatus {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	return p.status
+}
+
+// setState changes process state. If err is not nil, it is stored as the last error.
+func (p *process) setState(state string, pid int, err error) {
+	p.rw.Lock()
+	p.status.State = state
+	p.status.PID = pid
+	p.status.Since = time.Now()
+	if err != nil {
+		p.status.LastError = err.Error()
+	}
+	p.rw.Unlock()
+
+	p.onChange()
+}
+
+func (p *process) run(ctx context.Context) {
+	defer close(p.done)
+	defer p.removeTextFiles()
+
+	backoff := minBackoff
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			p.rw.Lock()
+			p.status.Restarts++
+			p.rw.Unlock()
+		}
+
+		p.setState(api.ProcessStateStarting, 0, nil)
+		start := time.Now()
+		err := p.runOnce(ctx)
+		if ctx.Err() != nil {
+			p.l.Infof("Process stopped.")
+			p.setState(api.ProcessStateStopped, 0, nil)
+			return
+		}
+
+		if time.Since(start) > resetBackoffAfter {
+			backoff = minBackoff
+		}
+		p.l.Warnf("Process exited: %s. Restarting in %s.", err, backoff)
+		p.setState(api.ProcessStateWaiting, 0, err)
+
+		select {
+		case <-ctx.Done():
+			p.l.Infof("Process stopped.")
+			p.setState(api.ProcessStateStopped, 0, nil)
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// runOnce starts process and waits for it to exit, or for ctx to be canceled.
+// In the latter case, process group is terminated. It returns process exit reason.
+func (p *process) runOnce(ctx context.Context) error {
+	if err := p.writeTextFiles(); err != nil {
+		return err
+	}
+
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdoutR.Close()
+		stdoutW.Close()
+		return errors.WithStack(err)
+	}
+
+	cmd := exec.Command(p.params.Path, p.params.Args...)
+	cmd.Env = p.params.Env
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		// own process group, so the whole group can be killed
+		Setpgid: true,
+	}
+
+	err = cmd.Start()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		stdoutR.Close()
+		stderrR.Close()
+		return errors.WithStack(err)
+	}
+
+	pid := cmd.Process.Pid
+	p.l.Infof("Process started with PID %d.", pid)
+	p.setState(api.ProcessStateRunning, pid, nil)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.logOutput(stdoutR, "stdout")
+	}()
+	go func() {
+		defer wg.Done()
+		p.logOutput(stderrR, "stderr")
+	}()
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- waitExited(cmd)
+	}()
+
+	// process group is signaled only while process is not reaped, so its ID can't be reused
+	select {
+	case err = <-exited:
+	case <-ctx.Done():
+		p.l.Debugf("Sending SIGTERM to process group %d.", pid)
+		killGroup(pid, syscall.SIGTERM)
+		select {
+		case err = <-exited:
+		case <-time.After(killTimeout):
+			p.l.Warnf("Process did not exit in %s, sending SIGKILL to process group %d.", killTimeout, pid)
+			killGroup(pid, syscall.SIGKILL)
+			err = <-exited
+		}
+	}
+
+	if waitKeepsZombie {
+		// kill children left after process exit; they keep output pipes open
+		killGroup(pid, syscall.SIGKILL)
+		err = cmd.Wait()
+	}
+	if err == nil {
+		err = errors.New("exit status 0")
+	}
+
+	wg.Wait()
+	stdoutR.Close()
+	stderrR.Close()
+	return err
+}
+
+// writeTextFiles writes text files into private directory, readable only by agent user.
+// Directory is created anew on every start; existing paths are never reused or followed.
+func (p *process) writeTextFiles() error {
+	if p.params.TextFilesDir == "" {
+		return nil
+	}
+
+	// remove leftovers of the previous start
+	if err := os.RemoveAll(p.params.TextFilesDir); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Mkdir(p.params.TextFilesDir, 0700); err != nil {
+		return errors.WithStack(err)
+	}
+	for name, content := range p.params.TextFiles {
+		path := filepath.Join(p.params.TextFilesDir, name)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = f.WriteString(content)
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// removeTextFiles removes private directory with text files.
+func (p *process) removeTextFiles() {
+	if p.params.TextFilesDir == "" {
+		return
+	}
+	if err := os.RemoveAll(p.params.TextFilesDir); err != nil {
+		p.l.Errorf("Failed to remove text files: %s.", err)
+	}
+}
+
+// logOutput logs process output lines until r is closed.
+func (p *process) logOutput(r io.Reader, stream string) {
+	l := p.l.WithField("stream", stream)
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 4096), maxLineLength)
+	s.Split(scanLines)
+	for s.Scan() {
+		l.Info(s.Text())
+	}
+	if err := s.Err(); err != nil {
+		l.Errorf("Failed to read output: %s.", err)
+	}
+}
+
+// scanLines is bufio.ScanLines which returns too long lines in parts instead of failing.
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := bufio.ScanLines(data, atEOF)
+	if advance == 0 && token == nil && err == nil && len(data) >= maxLineLength {
+		return len(data), data, nil
+	}
+	return advance, token, err
+}
+
+// killGroup sends signal to process group, ignoring errors for already exited group.
+func killGroup(pgid int, sig syscall.Signal) {
+	if err := syscall.Kill(-pgid, sig); err != nil && err != syscall.ESRCH {
+		logrus.WithField("component", "supervisor").Errorf("Failed to send %s to process group %d: %s.", sig, pgid, err)
+	}
+}
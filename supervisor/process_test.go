@@ -0,0 +1,300 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+)
+
+// script writes executable shell script with a given body to dir and returns its path.
+func script(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// stateRecorder records process state changes.
+type stateRecorder struct {
+	p *process
+
+	m      sync.Mutex
+	states []api.ProcessStatus
+}
+
+func (r *stateRecorder) onChange() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.p != nil {
+		r.states = append(r.states, r.p.Status())
+	}
+}
+
+// waitState waits for process to reach a given state at least n times.
+func (r *stateRecorder) waitState(t *testing.T, state string, n int, timeout time.Duration) []api.ProcessStatus {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		r.m.Lock()
+		var found []api.ProcessStatus
+		for _, s := range r.states {
+			if s.State == state {
+				found = append(found, s)
+			}
+		}
+		r.m.Unlock()
+		if len(found) >= n {
+			return found
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("process did not reach state %q %d times in %s", state, n, timeout)
+	return nil
+}
+
+func start(t *testing.T, params *ProcessParams) (*process, *stateRecorder) {
+	t.Helper()
+	r := new(stateRecorder)
+	r.m.Lock()
+	r.p = startProcess(context.Background(), params, r.onChange)
+	r.m.Unlock()
+	return r.p, r
+}
+
+// readPID waits for a file with PID to be written and returns PID.
+func readPID(t *testing.T, path string) int {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		b, err := ioutil.ReadFile(path)
+		if err == nil && strings.HasSuffix(string(b), "\n") {
+			pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return pid
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s was not written", path)
+	return 0
+}
+
+// alive returns true if process exists and is not a zombie; zombies may be left unreaped in containers.
+func alive(pid int) bool {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// state follows command name in parenthesis
+	s := string(b)
+	i := strings.LastIndex(s, ")")
+	return i < 0 || !strings.HasPrefix(s[i+1:], " Z")
+}
+
+func waitDead(t *testing.T, pid int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !alive(pid) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("process %d is still alive after %s", pid, timeout)
+}
+
+func TestProcessRestartBackoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmm-agent-supervisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, r := start(t, &ProcessParams{
+		Name: "fail",
+		Path: script(t, dir, "fail.sh", "exit 1"),
+	})
+	defer p.stop()
+
+	// delays are minBackoff, then 2*minBackoff
+	running := r.waitState(t, api.ProcessStateRunning, 3, 3*minBackoff+5*time.Second)
+	first := running[1].Since.Sub(running[0].Since)
+	second := running[2].Since.Sub(running[1].Since)
+	t.Logf("Delays between starts: %s, %s.", first, second)
+	if first < minBackoff {
+		t.Errorf("first restart delay %s is less than %s", first, minBackoff)
+	}
+	if second < 2*minBackoff {
+		t.Errorf("second restart delay %s is less than %s", second, 2*minBackoff)
+	}
+
+	waiting := r.waitState(t, api.ProcessStateWaiting, 1, time.Second)
+	if waiting[0].LastError != "exit status 1" {
+		t.Errorf("unexpected last error %q", waiting[0].LastError)
+	}
+	if s := p.Status(); s.Restarts < 2 {
+		t.Errorf("expected at least 2 restarts, got %d", s.Restarts)
+	}
+}
+
+func TestProcessStopKillsGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmm-agent-supervisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// child ignores SIGTERM, so it is killed by SIGKILL to the whole group after parent's exit
+	pidFile := filepath.Join(dir, "child.pid")
+	p, r := start(t, &ProcessParams{
+		Name: "parent",
+		Path: script(t, dir, "parent.sh", `sh -c 'trap "" TERM; sleep 1000' &
+echo $! > `+pidFile+`
+wait`),
+	})
+	r.waitState(t, api.ProcessStateRunning, 1, 5*time.Second)
+	child := readPID(t, pidFile)
+	if !alive(child) {
+		t.Fatalf("child %d is not running", child)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		p.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(killTimeout + 5*time.Second):
+		t.Fatal("stop did not return")
+	}
+
+	waitDead(t, child, 5*time.Second)
+	if s := p.Status(); s.State != api.ProcessStateStopped {
+		t.Errorf("expected state %q, got %q", api.ProcessStateStopped, s.State)
+	}
+}
+
+func TestProcessExitKillsChildren(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmm-agent-supervisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// child inherits output pipes and would keep them open after parent's exit
+	pidFile := filepath.Join(dir, "child.pid")
+	p, r := start(t, &ProcessParams{
+		Name: "parent",
+		Path: script(t, dir, "parent.sh", `sleep 1000 &
+echo $! > `+pidFile+`
+exit 0`),
+	})
+	defer p.stop()
+
+	r.waitState(t, api.ProcessStateRunning, 1, 5*time.Second)
+	child := readPID(t, pidFile)
+	waiting := r.waitState(t, api.ProcessStateWaiting, 1, 5*time.Second)
+	if waiting[0].LastError != "exit status 0" {
+		t.Errorf("unexpected last error %q", waiting[0].LastError)
+	}
+	waitDead(t, child, 5*time.Second)
+}
+
+func TestProcessStopDuringBackoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmm-agent-supervisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, r := start(t, &ProcessParams{
+		Name: "fail",
+		Path: script(t, dir, "fail.sh", "exit 1"),
+	})
+	r.waitState(t, api.ProcessStateWaiting, 1, 5*time.Second)
+
+	start := time.Now()
+	p.stop()
+	if d := time.Since(start); d > minBackoff/2 {
+		t.Errorf("stop took %s; it should not wait for backoff", d)
+	}
+	if s := p.Status(); s.State != api.ProcessStateStopped {
+		t.Errorf("expected state %q, got %q", api.ProcessStateStopped, s.State)
+	}
+	if s := p.Status(); s.Restarts != 0 {
+		t.Errorf("expected no restarts, got %d", s.Restarts)
+	}
+}
+
+func TestProcessTextFilesPlantedSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmm-agent-supervisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// other user's directory planted at the text files path
+	planted := filepath.Join(dir, "planted")
+	if err = os.Mkdir(planted, 0777); err != nil {
+		t.Fatal(err)
+	}
+	textDir := filepath.Join(dir, "text")
+	if err = os.Symlink(planted, textDir); err != nil {
+		t.Fatal(err)
+	}
+
+	p, r := start(t, &ProcessParams{
+		Name:         "text",
+		Path:         script(t, dir, "text.sh", "exec sleep 60"),
+		TextFilesDir: textDir,
+		TextFiles:    map[string]string{"my.cnf": "[client]\npassword=secret\n"},
+	})
+	defer p.stop()
+	r.waitState(t, api.ProcessStateRunning, 1, 5*time.Second)
+
+	if files, _ := ioutil.ReadDir(planted); len(files) != 0 {
+		t.Errorf("text files were written to planted directory: %v", files)
+	}
+	fi, err := os.Lstat(textDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.IsDir() || fi.Mode().Perm() != 0700 {
+		t.Errorf("unexpected text files directory mode %s", fi.Mode())
+	}
+	fi, err = os.Lstat(filepath.Join(textDir, "my.cnf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0600 {
+		t.Errorf("unexpected text file mode %s", fi.Mode())
+	}
+}
@@ -0,0 +1,174 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package supervisor
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/ports"
+	"github.com/Percona-Lab/pmm-agent/rpc"
+)
+
+// maxTextFilesDirPrefix limits the length of sanitized process ID in text files directory name.
+const maxTextFilesDirPrefix = 64
+
+// Service handles managed processes requests from PMM server.
+type Service struct {
+	s       *Supervisor
+	paths   map[string]string
+	ports   *ports.Allocator
+	tempDir string
+}
+
+// NewService creates a new service. paths maps agent process types to executable paths.
+// Ports for processes are allocated by a given allocator. Text files are written
+// to process-specific subdirectories of tempDir, which should be private to the agent user
+// (see ioutil.TempDir).
+func NewService(s *Supervisor, paths map[string]string, allocator *ports.Allocator, tempDir string) *Service {
+	return &Service{
+		s:       s,
+		paths:   paths,
+		ports:   allocator,
+		tempDir: tempDir,
+	}
+}
+
+// SetState reconciles processes with desired state and returns their statuses.
+func (svc *Service) SetState(ctx context.Context, req *api.SetStateRequest) (*api.SetStateResponse, error) {
+	// ports allocated for this request are released if it is rejected before any change
+	assigned := svc.ports.Assigned()
+
+	var problems []string
+	desired := make([]*ProcessParams, 0, len(req.AgentProcesses))
+	names := make([]string, 0, len(req.AgentProcesses))
+	for i := range req.AgentProcesses {
+		p := &req.AgentProcesses[i]
+		names = append(names, p.ID)
+		params, err := svc.processParams(p)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("process %q: %s", p.ID, err))
+			continue
+		}
+		desired = append(desired, params)
+	}
+	if len(problems) != 0 {
+		if err := svc.releasePorts(assigned); err != nil {
+			problems = append(problems, err.Error())
+		}
+		return nil, errors.New(strings.Join(problems, "\n"))
+	}
+
+	if err := svc.s.SetState(desired); err != nil {
+		// some processes may be already started, so keep their ports, and release only ports of failed ones
+		if e := svc.ports.Retain(svc.s.Managed()); e != nil {
+			return nil, errors.Wrap(err, e.Error())
+		}
+		return nil, err
+	}
+	if err := svc.ports.Retain(names); err != nil {
+		return nil, err
+	}
+	return &api.SetStateResponse{
+		Processes: svc.s.Processes(),
+	}, nil
+}
+
+// releasePorts releases ports allocated after a given assignments snapshot was taken.
+func (svc *Service) releasePorts(assigned map[string]uint16) error {
+	names := make([]string, 0, len(assigned))
+	for name := range assigned {
+		names = append(names, name)
+	}
+	return svc.ports.Retain(names)
+}
+
+// processParams allocates port, renders text files and arguments, and returns process parameters.
+//
+// Templates data contains "listen_port" with allocated port, and "text_files" map with paths of rendered files,
+// so arguments can reference them like {{ .text_files.my_cnf }}.
+func (svc *Service) processParams(p *api.AgentProcess) (*ProcessParams, error) {
+	path := svc.paths[p.Type]
+	if path == "" {
+		return nil, errors.Errorf("unexpected type %q", p.Type)
+	}
+
+	port, err := svc.ports.Allocate(p.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := svc.textFilesDir(p.ID)
+	paths := make(map[string]string, len(p.TextFiles))
+	for name := range p.TextFiles {
+		if sanitizeName(name) != name || name == "." || name == ".." {
+			return nil, errors.Errorf("invalid text file name %q", name)
+		}
+		paths[name] = filepath.Join(dir, name)
+	}
+	data := map[string]interface{}{
+		"listen_port": port,
+		"text_files":  paths,
+	}
+
+	textFiles := make(map[string]string, len(p.TextFiles))
+	for name, text := range p.TextFiles {
+		if textFiles[name], err = renderTemplate(name, text, data); err != nil {
+			return nil, err
+		}
+	}
+	args, err := renderArgs(p.Args, data)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &ProcessParams{
+		Name:       p.ID,
+		Path:       path,
+		Args:       args,
+		Env:        p.Env,
+		ListenPort: port,
+	}
+	if len(textFiles) != 0 {
+		params.TextFilesDir = dir
+		params.TextFiles = textFiles
+	}
+	return params, nil
+}
+
+// textFilesDir returns a directory for text files of a process with a given ID.
+// ID comes from PMM server and may be any string, like ".." or "a/b", so directory name consists of
+// (shortened) sanitized ID for readability and ID hash for uniqueness. It is always a direct child of tempDir.
+func (svc *Service) textFilesDir(id string) string {
+	name := sanitizeName(id)
+	if len(name) > maxTextFilesDirPrefix {
+		name = name[:maxTextFilesDirPrefix]
+	}
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(svc.tempDir, fmt.Sprintf("%s-%x", name, sum[:8]))
+}
+
+// check interfaces
+var (
+	_ rpc.SupervisorServer = (*Service)(nil)
+)
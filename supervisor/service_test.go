@@ -0,0 +1,205 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package supervisor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+	"github.com/Percona-Lab/pmm-agent/ports"
+)
+
+func TestServiceSetStateReleasesPorts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "pmm-agent-supervisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	allocator, err := ports.NewAllocator(42000, 42099, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sup := New(ctx)
+	defer func() {
+		cancel()
+		sup.Wait()
+	}()
+	svc := NewService(sup, map[string]string{api.TypeMySQLdExporter: "/bin/sleep"}, allocator, dir)
+	args := []string{"{{ .listen_port }}"}
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := svc.SetState(ctx, &api.SetStateRequest{
+			AgentProcesses: []api.AgentProcess{
+				{ID: "good", Type: api.TypeMySQLdExporter, Args: args},
+				{ID: "bad", Type: api.TypeMySQLdExporter, Args: []string{"{{ .unclosed"}},
+			},
+		})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if assigned := allocator.Assigned(); len(assigned) != 0 {
+			t.Errorf("ports are not released: %v", assigned)
+		}
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		if err := sup.SetLocalState([]*ProcessParams{{Name: "local", Path: "/bin/sleep", Args: []string{"1000"}}}); err != nil {
+			t.Fatal(err)
+		}
+
+		// non-conflicting process is started, so its port is kept
+		_, err := svc.SetState(ctx, &api.SetStateRequest{
+			AgentProcesses: []api.AgentProcess{
+				{ID: "good", Type: api.TypeMySQLdExporter, Args: args},
+				{ID: "local", Type: api.TypeMySQLdExporter, Args: args},
+			},
+		})
+		if expected := `process "local" is not managed by PMM server`; err == nil || err.Error() != expected {
+			t.Fatalf("expected %q, got %v", expected, err)
+		}
+		assigned := allocator.Assigned()
+		if len(assigned) != 1 || assigned["good"] == 0 {
+			t.Fatalf("unexpected ports: %v", assigned)
+		}
+		if managed := sup.Managed(); !reflect.DeepEqual(managed, []string{"good"}) {
+			t.Errorf("unexpected managed processes: %v", managed)
+		}
+
+		// port is not reallocated, so process is not restarted
+		port := assigned["good"]
+		sup.rw.RLock()
+		good := sup.processes["good"]
+		sup.rw.RUnlock()
+		_, err = svc.SetState(ctx, &api.SetStateRequest{
+			AgentProcesses: []api.AgentProcess{
+				{ID: "good", Type: api.TypeMySQLdExporter, Args: args},
+				{ID: "other", Type: api.TypeMySQLdExporter, Args: args},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assigned = allocator.Assigned()
+		if len(assigned) != 2 || assigned["good"] != port || assigned["other"] == port {
+			t.Errorf("unexpected ports: %v, expected %d for good", assigned, port)
+		}
+		sup.rw.RLock()
+		restarted := sup.processes["good"] != good
+		sup.rw.RUnlock()
+		if restarted {
+			t.Error("process is restarted")
+		}
+	})
+}
+
+func TestServiceTextFilesDir(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "pmm-agent-supervisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// files outside and inside of private directory which should not be removed
+	tempDir := filepath.Join(dir, "private")
+	if err = os.Mkdir(tempDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(dir, "sentinel"), filepath.Join(tempDir, "sentinel")} {
+		if err = ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	allocator, err := ports.NewAllocator(42000, 42099, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sup := New(ctx)
+	defer func() {
+		cancel()
+		sup.Wait()
+	}()
+	svc := NewService(sup, map[string]string{api.TypeMySQLdExporter: "/bin/sleep"}, allocator, tempDir)
+
+	ids := []string{"..", ".", "../escape", "a/b", "a_b", "sentinel", strings.Repeat("x", 300)}
+	req := new(api.SetStateRequest)
+	for _, id := range ids {
+		req.AgentProcesses = append(req.AgentProcesses, api.AgentProcess{
+			ID:        id,
+			Type:      api.TypeMySQLdExporter,
+			Args:      []string{"1000"},
+			TextFiles: map[string]string{"my.cnf": "port={{ .listen_port }}"},
+		})
+	}
+	if _, err = svc.SetState(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	// every process gets own direct subdirectory of private directory
+	dirs := make(map[string]string)
+	for _, id := range ids {
+		d := svc.textFilesDir(id)
+		if filepath.Dir(d) != tempDir {
+			t.Errorf("%q: directory %s is not in %s", id, d, tempDir)
+		}
+		if other, ok := dirs[d]; ok {
+			t.Errorf("%q and %q: the same directory %s", id, other, d)
+		}
+		dirs[d] = id
+
+		path := filepath.Join(d, "my.cnf")
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if _, err = os.Stat(path); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%q: %s", id, err)
+			}
+		}
+	}
+
+	// processes are stopped, and their directories are removed
+	if _, err = svc.SetState(ctx, new(api.SetStateRequest)); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(dir, "sentinel"), filepath.Join(tempDir, "sentinel")} {
+		if _, err = os.Stat(path); err != nil {
+			t.Error(err)
+		}
+	}
+	files, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("unexpected files in %s: %v", tempDir, files)
+	}
+}
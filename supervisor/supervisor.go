@@ -0,0 +1,257 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package supervisor runs and restarts managed processes: exporters and helpers.
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-agent/api"
+)
+
+// Supervisor manages child processes. All processes are stopped when its context is canceled.
+type Supervisor struct {
+	ctx     context.Context
+	l       *logrus.Entry
+	changes chan struct{}
+	stateM  sync.Mutex // serializes SetState calls
+
+	rw        sync.RWMutex
+	processes map[string]*process
+	desired   map[string]bool // names of processes managed by SetState
+	local     map[string]bool // names of processes managed by SetLocalState
+}
+
+// New creates a new supervisor.
+func New(ctx context.Context) *Supervisor {
+	return &Supervisor{
+		ctx:       ctx,
+		l:         logrus.WithField("component", "supervisor"),
+		changes:   make(chan struct{}, 1),
+		processes: make(map[string]*process),
+		desired:   make(map[string]bool),
+		local:     make(map[string]bool),
+	}
+}
+
+// Changes returns channel which receives a value after processes state changes.
+// Several changes may be coalesced into one value; use Processes to get the current state.
+func (s *Supervisor) Changes() <-chan struct{} {
+	return s.changes
+}
+
+func (s *Supervisor) notify() {
+	select {
+	case s.changes <- struct{}{}:
+	default:
+	}
+}
+
+// Start starts a new process. Process with the same name should not exist or should be stopped,
+// and should not be managed by SetState or SetLocalState.
+func (s *Supervisor) Start(params *ProcessParams) error {
+	if params.Name == "" {
+		return errors.New("process name is empty")
+	}
+
+	s.rw.Lock()
+	defer s.rw.Unlock()
+
+	managed := s.desired[params.Name] || s.local[params.Name]
+	if p := s.processes[params.Name]; managed || (p != nil && p.Status().State != api.ProcessStateStopped) {
+		return errors.Errorf("process %q already exists", params.Name)
+	}
+	if s.ctx.Err() != nil {
+		return errors.WithStack(s.ctx.Err())
+	}
+
+	s.l.Infof("Starting process %q: %s %v.", params.Name, params.Path, params.Args)
+	s.processes[params.Name] = startProcess(s.ctx, params, s.notify)
+	return nil
+}
+
+// Stop stops process and waits for it to exit. Stopped process is still reported until removed or replaced.
+func (s *Supervisor) Stop(name string) error {
+	s.rw.RLock()
+	p := s.processes[name]
+	s.rw.RUnlock()
+	if p == nil {
+		return errors.Errorf("no such process: %q", name)
+	}
+
+	s.l.Infof("Stopping process %q.", name)
+	p.stop()
+	return nil
+}
+
+// Restart stops process and starts it again with the same parameters.
+func (s *Supervisor) Restart(name string) error {
+	s.rw.RLock()
+	p := s.processes[name]
+	s.rw.RUnlock()
+	if p == nil {
+		return errors.Errorf("no such process: %q", name)
+	}
+
+	s.l.Infof("Restarting process %q.", name)
+	p.stop()
+
+	s.rw.Lock()
+	defer s.rw.Unlock()
+
+	if s.processes[name] != p {
+		return errors.Errorf("process %q was changed during restart", name)
+	}
+	if s.ctx.Err() != nil {
+		return errors.WithStack(s.ctx.Err())
+	}
+	s.processes[name] = startProcess(s.ctx, p.params, s.notify)
+	return nil
+}
+
+// SetState reconciles processes previously started by SetState with a given desired list:
+// new processes are started, removed ones are stopped, and changed ones are restarted.
+// Processes started by Start or SetLocalState are not affected, and can't be replaced.
+// It returns error describing all processes which failed to start; other changes are still applied.
+func (s *Supervisor) SetState(desired []*ProcessParams) error {
+	return s.reconcile(s.desired, "PMM server", desired)
+}
+
+// SetLocalState is the same as SetState, but for processes from the configuration file.
+// Sets of processes managed by SetState and SetLocalState are independent.
+func (s *Supervisor) SetLocalState(desired []*ProcessParams) error {
+	return s.reconcile(s.local, "configuration file", desired)
+}
+
+// reconcile implements SetState and SetLocalState. managed contains names of processes
+// previously started by this function with the same map; owner describes them in errors.
+func (s *Supervisor) reconcile(managed map[string]bool, owner string, desired []*ProcessParams) error {
+	s.stateM.Lock()
+	defer s.stateM.Unlock()
+
+	byName := make(map[string]*ProcessParams, len(desired))
+	for _, params := range desired {
+		if params.Name == "" {
+			return errors.New("process name is empty")
+		}
+		if byName[params.Name] != nil {
+			return errors.Errorf("duplicate process name %q", params.Name)
+		}
+		byName[params.Name] = params
+	}
+
+	type change struct {
+		name    string
+		current *process
+		desired *ProcessParams
+	}
+	var changes []change
+	var problems []string
+	s.rw.RLock()
+	for name := range managed {
+		if byName[name] == nil {
+			changes = append(changes, change{name: name, current: s.processes[name]})
+		}
+	}
+	for _, params := range desired {
+		current := s.processes[params.Name]
+		switch {
+		case current != nil && !managed[params.Name]:
+			problems = append(problems, fmt.Sprintf("process %q is not managed by %s", params.Name, owner))
+		case current == nil || !reflect.DeepEqual(current.params, params):
+			changes = append(changes, change{name: params.Name, current: current, desired: params})
+		}
+	}
+	s.rw.RUnlock()
+
+	for _, c := range changes {
+		if c.current != nil {
+			s.l.Infof("Stopping process %q.", c.name)
+			c.current.stop()
+		}
+
+		s.rw.Lock()
+		delete(s.processes, c.name)
+		delete(managed, c.name)
+		if c.desired != nil {
+			if s.ctx.Err() != nil {
+				problems = append(problems, fmt.Sprintf("process %q: %s", c.name, s.ctx.Err()))
+			} else {
+				s.l.Infof("Starting process %q: %s %v.", c.name, c.desired.Path, c.desired.Args)
+				s.processes[c.name] = startProcess(s.ctx, c.desired, s.notify)
+				managed[c.name] = true
+			}
+		}
+		s.rw.Unlock()
+	}
+	s.notify()
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "\n"))
+}
+
+// Processes returns statuses of all processes sorted by name.
+func (s *Supervisor) Processes() []api.ProcessStatus {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+
+	res := make([]api.ProcessStatus, 0, len(s.processes))
+	for _, p := range s.processes {
+		res = append(res, p.Status())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// Managed returns names of processes managed by SetState, sorted.
+func (s *Supervisor) Managed() []string {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+
+	res := make([]string, 0, len(s.desired))
+	for name := range s.desired {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Wait waits for all processes to be stopped after context is canceled.
+func (s *Supervisor) Wait() {
+	<-s.ctx.Done()
+
+	s.rw.RLock()
+	processes := make([]*process, 0, len(s.processes))
+	for _, p := range s.processes {
+		processes = append(processes, p)
+	}
+	s.rw.RUnlock()
+
+	for _, p := range processes {
+		<-p.done
+	}
+}
@@ -0,0 +1,49 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package supervisor
+
+import (
+	"os/exec"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// waitKeepsZombie is true if waitExited does not reap the process.
+const waitKeepsZombie = true
+
+// P_PID from waitid(2)
+const pPID = 1
+
+// waitExited blocks until process exits, but does not reap it, so its PID and process group ID
+// can't be reused by other processes until cmd.Wait is called. Like os.Process.blockUntilWaitable.
+func waitExited(cmd *exec.Cmd) error {
+	var siginfo [16]uint64
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pPID, uintptr(cmd.Process.Pid),
+			uintptr(unsafe.Pointer(&siginfo[0])), syscall.WEXITED|syscall.WNOWAIT, 0, 0)
+		switch errno {
+		case 0:
+			return nil
+		case syscall.EINTR:
+			continue
+		default:
+			return errors.WithStack(errno)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !linux
+// +build !linux
+
+package supervisor
+
+import (
+	"os/exec"
+)
+
+// waitKeepsZombie is true if waitExited does not reap the process.
+// There is no portable way to wait without reaping, so children left after process exit are not killed,
+// and process output is logged until they exit.
+const waitKeepsZombie = false
+
+// waitExited waits for process to exit and reaps it.
+func waitExited(cmd *exec.Cmd) error {
+	return cmd.Wait()
+}
@@ -0,0 +1,77 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	prometheusNamespace = "pmm_agent"
+	prometheusSubsystem = "tunnel"
+)
+
+// Metrics contains tunnel metrics. They outlive connections, so a single instance should be shared
+// by all services created by the agent.
+type Metrics struct {
+	open   prometheus.Gauge
+	bytes  *prometheus.CounterVec
+	errors *prometheus.CounterVec
+}
+
+// NewMetrics creates a new Metrics instance.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		open: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "open",
+			Help:      "A number of open tunnels.",
+		}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "bytes_total",
+			Help:      "A total number of bytes read from tunnels and sent to the server (in), and received from the server and written to tunnels (out).",
+		}, []string{"direction"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Subsystem: prometheusSubsystem,
+			Name:      "errors_total",
+			Help:      "A total number of tunnel errors by operation (dial, read, write, send).",
+		}, []string{"op"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.open.Describe(ch)
+	m.bytes.Describe(ch)
+	m.errors.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.open.Collect(ch)
+	m.bytes.Collect(ch)
+	m.errors.Collect(ch)
+}
+
+// check interfaces
+var (
+	_ prometheus.Collector = (*Metrics)(nil)
+)
@@ -17,6 +17,7 @@
 package tunnel
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"sync"
@@ -24,27 +25,60 @@ import (
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/Percona-Lab/pmm-agent/rpc"
 	"github.com/Percona-Lab/pmm-api/agent"
 	"github.com/Percona-Lab/pmm-api/gateway"
 )
 
 type Service struct {
-	client gateway.ServiceClient
-
-	rw      sync.RWMutex
-	tunnels map[string]net.Conn
+	client  rpc.GatewayClient
+	metrics *Metrics
+	l       *logrus.Entry
+
+	rw         sync.RWMutex
+	tunnels    map[string]net.Conn
+	dialing    int // tunnels being dialed; counted towards the limit
+	maxTunnels int
 }
 
-func NewService(client gateway.ServiceClient) *Service {
+// NewService creates a new service. If maxTunnels is positive, it limits a number of open tunnels.
+func NewService(client rpc.GatewayClient, metrics *Metrics, maxTunnels int) *Service {
 	return &Service{
-		client:  client,
-		tunnels: make(map[string]net.Conn),
+		client:     client,
+		metrics:    metrics,
+		l:          logrus.WithField("component", "tunnel"),
+		tunnels:    make(map[string]net.Conn),
+		maxTunnels: maxTunnels,
 	}
 }
 
-func (s *Service) CreateTunnel(req *agent.CreateTunnelRequest) (*agent.CreateTunnelResponse, error) {
-	c, err := net.Dial("tcp", req.Dial)
+// SetMaxTunnels changes a limit of open tunnels. Already open tunnels are not closed.
+func (s *Service) SetMaxTunnels(maxTunnels int) {
+	s.rw.Lock()
+	s.maxTunnels = maxTunnels
+	s.rw.Unlock()
+}
+
+func (s *Service) CreateTunnel(ctx context.Context, req *agent.CreateTunnelRequest) (*agent.CreateTunnelResponse, error) {
+	// reserve a slot before dialing, so concurrent requests can't exceed the limit
+	s.rw.Lock()
+	open := len(s.tunnels) + s.dialing
+	if s.maxTunnels > 0 && open >= s.maxTunnels {
+		s.rw.Unlock()
+		return &agent.CreateTunnelResponse{
+			Error: fmt.Sprintf("too many open tunnels: %d", open),
+		}, nil
+	}
+	s.dialing++
+	s.rw.Unlock()
+
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", req.Dial)
 	if err != nil {
+		s.rw.Lock()
+		s.dialing--
+		s.rw.Unlock()
+		s.metrics.errors.WithLabelValues("dial").Inc()
 		return &agent.CreateTunnelResponse{
 			Error: err.Error(),
 		}, nil
@@ -52,11 +86,19 @@ func (s *Service) CreateTunnel(req *agent.CreateTunnelRequest) (*agent.CreateTun
 
 	tunnelID := fmt.Sprintf("%s-%s-%d", c.LocalAddr().String(), c.RemoteAddr().String(), time.Now().UnixNano())
 	s.rw.Lock()
+	s.dialing--
 	s.tunnels[tunnelID] = c
 	s.rw.Unlock()
+	s.metrics.open.Inc()
 
 	go func() {
-		defer c.Close()
+		defer func() {
+			s.rw.Lock()
+			delete(s.tunnels, tunnelID)
+			s.rw.Unlock()
+			c.Close()
+			s.metrics.open.Dec()
+		}()
 
 		time.Sleep(time.Second) // FIXME HACK
 
@@ -64,32 +106,37 @@ func (s *Service) CreateTunnel(req *agent.CreateTunnelRequest) (*agent.CreateTun
 			b := make([]byte, 4096)
 			n, err := c.Read(b)
 			if err != nil {
-				logrus.Error(err)
+				s.metrics.errors.WithLabelValues("read").Inc()
+				s.l.Error(err)
 				return
 			}
 			if n == 0 {
 				continue
 			}
 
-			res, err := s.client.WriteToTunnel(&gateway.WriteToTunnelRequest{
+			// tunnel outlives CreateTunnel request, so its context is not used there
+			res, err := s.client.WriteToTunnel(context.Background(), &gateway.WriteToTunnelRequest{
 				TunnelId: tunnelID,
 				Data:     b[:n],
 			})
 			if err != nil {
-				logrus.Error(err)
+				s.metrics.errors.WithLabelValues("send").Inc()
+				s.l.Error(err)
 				return
 			}
 			if res.Error != "" {
-				logrus.Error(res.Error)
+				s.metrics.errors.WithLabelValues("send").Inc()
+				s.l.Error(res.Error)
 				return
 			}
+			s.metrics.bytes.WithLabelValues("in").Add(float64(n))
 		}
 	}()
 
 	return &agent.CreateTunnelResponse{TunnelId: tunnelID}, nil
 }
 
-func (s *Service) WriteToTunnel(req *agent.WriteToTunnelRequest) (*agent.WriteToTunnelResponse, error) {
+func (s *Service) WriteToTunnel(ctx context.Context, req *agent.WriteToTunnelRequest) (*agent.WriteToTunnelResponse, error) {
 	s.rw.RLock()
 	c := s.tunnels[req.TunnelId]
 	s.rw.RUnlock()
@@ -99,7 +146,10 @@ func (s *Service) WriteToTunnel(req *agent.WriteToTunnelRequest) (*agent.WriteTo
 		}, nil
 	}
 
-	if _, err := c.Write(req.Data); err != nil {
+	n, err := c.Write(req.Data)
+	s.metrics.bytes.WithLabelValues("out").Add(float64(n))
+	if err != nil {
+		s.metrics.errors.WithLabelValues("write").Inc()
 		return &agent.WriteToTunnelResponse{
 			Error: err.Error(),
 		}, nil
@@ -107,5 +157,12 @@ func (s *Service) WriteToTunnel(req *agent.WriteToTunnelRequest) (*agent.WriteTo
 	return &agent.WriteToTunnelResponse{}, nil
 }
 
+// Count returns a number of open tunnels.
+func (s *Service) Count() int {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	return len(s.tunnels)
+}
+
 // check interfaces
-var _ agent.ServiceServer = (*Service)(nil)
+var _ rpc.AgentServer = (*Service)(nil)
@@ -0,0 +1,111 @@
+// pmm-agent
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/pmm-api/agent"
+)
+
+// acceptAll accepts connections until listener is closed, and returns them.
+func acceptAll(l net.Listener) <-chan []net.Conn {
+	res := make(chan []net.Conn, 1)
+	go func() {
+		var conns []net.Conn
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				res <- conns
+				return
+			}
+			conns = append(conns, c)
+		}
+	}()
+	return res
+}
+
+func TestCreateTunnelLimit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := acceptAll(l)
+
+	const max = 3
+	s := NewService(nil, NewMetrics(), max)
+
+	// failed dial does not hold a slot
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	for i := 0; i < max+1; i++ {
+		res, _ := s.CreateTunnel(context.Background(), &agent.CreateTunnelRequest{Dial: closed.Addr().String()})
+		if res.Error == "" || res.Error == "too many open tunnels: 3" {
+			t.Fatalf("Expected dial error, got %+v.", res)
+		}
+	}
+
+	// concurrent requests do not exceed the limit
+	var wg sync.WaitGroup
+	responses := make(chan *agent.CreateTunnelResponse, 10*max)
+	for i := 0; i < cap(responses); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, _ := s.CreateTunnel(context.Background(), &agent.CreateTunnelRequest{Dial: l.Addr().String()})
+			responses <- res
+		}()
+	}
+	wg.Wait()
+	close(responses)
+
+	var created int
+	for res := range responses {
+		switch res.Error {
+		case "":
+			created++
+		case "too many open tunnels: 3":
+		default:
+			t.Errorf("Unexpected error %q.", res.Error)
+		}
+	}
+	if created != max {
+		t.Errorf("Expected %d tunnels to be created, got %d.", max, created)
+	}
+	if c := s.Count(); c != max {
+		t.Errorf("Expected %d open tunnels, got %d.", max, c)
+	}
+
+	// tunnels are closed and slots are released when the other side closes connections
+	l.Close()
+	for _, c := range <-accepted {
+		c.Close()
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.Count() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected no open tunnels, got %d.", s.Count())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}